@@ -0,0 +1,308 @@
+package receiptapi
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Source whose receipts are in the API's own JSON, used when no other is given
+const sourceNative = "native"
+
+// Returned when no adapter is registered for a source
+var ErrUnknownSource = errors.New("unknown receipt source")
+
+// Reads receipts sent in a retailer's or scanning partner's own format. Parse only maps
+// the format to a receipt; the receipt is validated and scored as any other.
+type ReceiptAdapter interface {
+	Parse(raw []byte) (Receipt, error)
+}
+
+// Adapters keyed by the source whose format they read
+var receiptAdapters = map[string]ReceiptAdapter{
+	sourceNative: NativeAdapter{},
+	"schema-org": SchemaOrgOrderAdapter{},
+	"poslog":     POSLogAdapter{},
+}
+
+// Registers the adapter for a source's format, replacing any registered before
+func RegisterAdapter(source string, adapter ReceiptAdapter) {
+	receiptAdapters[source] = adapter
+}
+
+// Returns the sources there are adapters for, sorted
+func ReceiptSources() []string {
+	return slices.Sorted(maps.Keys(receiptAdapters))
+}
+
+// Returns the source a submission is in: the X-Receipt-Source header, or the partner's
+// own source, or the API's own JSON
+func ReceiptSource(r *http.Request, partner Partner) string {
+	if source := r.Header.Get("X-Receipt-Source"); source != "" {
+		return source
+	}
+	if partner.Source != "" {
+		return partner.Source
+	}
+	return sourceNative
+}
+
+// Reads a receipt with the adapter for its source
+func ParseReceipt(source string, raw []byte) (Receipt, error) {
+	adapter, ok := receiptAdapters[source]
+	if !ok {
+		return Receipt{}, ErrUnknownSource
+	}
+	return adapter.Parse(raw)
+}
+
+// Returns the rejection for a receipt its source's adapter couldn't read. Malformed
+// receipts in the API's own JSON are only turned away here in Fetch compatibility
+// mode; otherwise validation says what is missing.
+func UnreadableReceipt(source string, err error) *Rejection {
+	switch {
+	case errors.Is(err, ErrUnknownSource):
+		message := "Unknown receipt source " + source + "; sources are " + strings.Join(ReceiptSources(), ", ") + "."
+		return &Rejection{http.StatusBadRequest, codeUnknownReceiptSource, message}
+	case err == nil:
+		return nil
+	case source != sourceNative:
+		return &Rejection{http.StatusBadRequest, codeInvalidReceipt, "The receipt could not be read as " + source + ": " + err.Error() + "."}
+	case config.FetchCompat:
+		// The Fetch spec treats a malformed body as an invalid receipt
+		return InvalidReceipt()
+	}
+	return nil
+}
+
+// Returns an amount such as "6.5" as dollars and cents, "6.50"
+func normalizeAmount(amount string) (string, error) {
+	cents, ok := exactCents(strings.TrimSpace(amount))
+	if !ok {
+		return "", fmt.Errorf("%q is not an amount of money", amount)
+	}
+	return formatCents(cents), nil
+}
+
+// Returns cents as dollars and cents, e.g. "6.50" for 650
+func formatCents(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// Splits a timestamp such as "2022-01-01T13:01:00-05:00" into the date and time of day
+// as written, in the zone the purchase was made in. A date alone has no time.
+func splitTimestamp(timestamp string) (string, string, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", dateLayout} {
+		parsed, err := time.Parse(layout, strings.TrimSpace(timestamp))
+		if err == nil && layout == dateLayout {
+			return parsed.Format(dateLayout), "", nil
+		}
+		if err == nil {
+			return parsed.Format(dateLayout), parsed.Format("15:04"), nil
+		}
+	}
+	return "", "", fmt.Errorf("%q is not a date and time", timestamp)
+}
+
+/*
+	Below is the adapter for the API's own JSON
+*/
+
+// Reads receipts in the API's own JSON, as documented for /receipts/process
+type NativeAdapter struct{}
+
+// Decodes a receipt, first renaming any configured field aliases; anything after the
+// receipt is ignored
+func (NativeAdapter) Parse(raw []byte) (Receipt, error) {
+	var receipt Receipt
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if len(config.FieldAliases) == 0 {
+		err := decoder.Decode(&receipt)
+		return receipt, err
+	}
+	var value json.RawMessage
+	err := decoder.Decode(&value)
+	if err != nil {
+		return receipt, err
+	}
+	err = json.Unmarshal(ApplyFieldAliases(value), &receipt)
+	return receipt, err
+}
+
+/*
+	Below is the adapter for schema.org orders, as embedded in emailed receipts
+*/
+
+// Reads schema.org Order objects in JSON-LD, the markup retailers put in order
+// confirmation emails. Each accepted offer is an item, priced for its quantity, and the
+// order number is kept as the partner's own ID.
+type SchemaOrgOrderAdapter struct{}
+
+// Order in schema.org JSON-LD; prices may be numbers or strings
+type schemaOrgOrder struct {
+	Type        string `json:"@type"`
+	OrderNumber string `json:"orderNumber"`
+	OrderDate   string `json:"orderDate"`
+	Merchant    struct {
+		Name string `json:"name"`
+	} `json:"merchant"`
+	Seller struct {
+		Name string `json:"name"`
+	} `json:"seller"`
+	AcceptedOffer []struct {
+		ItemOffered struct {
+			Name string `json:"name"`
+		} `json:"itemOffered"`
+		Price            json.Number `json:"price"`
+		EligibleQuantity struct {
+			Value json.Number `json:"value"`
+		} `json:"eligibleQuantity"`
+	} `json:"acceptedOffer"`
+	Price           json.Number `json:"price"`
+	TotalPaymentDue struct {
+		Price json.Number `json:"price"`
+		Value json.Number `json:"value"`
+	} `json:"totalPaymentDue"`
+}
+
+// Maps an order to a receipt. The total is the order's totalPaymentDue, or its price.
+func (SchemaOrgOrderAdapter) Parse(raw []byte) (Receipt, error) {
+	var order schemaOrgOrder
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	err := decoder.Decode(&order)
+	if err != nil {
+		return Receipt{}, err
+	}
+	if order.Type != "Order" {
+		return Receipt{}, fmt.Errorf("the @type is %q rather than Order", order.Type)
+	}
+
+	receipt := Receipt{Retailer: order.Merchant.Name, ExternalID: order.OrderNumber, Items: []Item{}}
+	if receipt.Retailer == "" {
+		receipt.Retailer = order.Seller.Name
+	}
+	if order.OrderDate != "" {
+		receipt.PurchaseDate, receipt.PurchaseTime, err = splitTimestamp(order.OrderDate)
+		if err != nil {
+			return Receipt{}, fmt.Errorf("orderDate %w", err)
+		}
+	}
+	for _, offer := range order.AcceptedOffer {
+		cents, ok := exactCents(offer.Price.String())
+		if !ok {
+			return Receipt{}, fmt.Errorf("the price of %s is not an amount of money", offer.ItemOffered.Name)
+		}
+		quantity := int64(1)
+		if offer.EligibleQuantity.Value != "" {
+			quantity, err = strconv.ParseInt(offer.EligibleQuantity.Value.String(), 10, 64)
+			if err != nil || quantity <= 0 {
+				return Receipt{}, fmt.Errorf("the quantity of %s is not a whole number", offer.ItemOffered.Name)
+			}
+		}
+		receipt.Items = append(receipt.Items, Item{ShortDescription: offer.ItemOffered.Name, Price: formatCents(cents * quantity)})
+	}
+
+	total := cmp.Or(order.TotalPaymentDue.Price, order.TotalPaymentDue.Value, order.Price)
+	if total != "" {
+		receipt.Total, err = normalizeAmount(total.String())
+		if err != nil {
+			return Receipt{}, fmt.Errorf("the total %w", err)
+		}
+	}
+	return receipt, nil
+}
+
+/*
+	Below is the adapter for ARTS POSLog, the XML point of sale systems export
+*/
+
+// Reads a sale from an ARTS POSLog document, the NRF standard XML many point of sale
+// systems log transactions in. Voided lines and lines other than sales, such as tenders
+// and returns, are left out.
+type POSLogAdapter struct{}
+
+// Parts of a POSLog document a receipt is made from, in any namespace
+type posLog struct {
+	Transactions []struct {
+		BusinessUnit struct {
+			UnitID struct {
+				Name string `xml:"Name,attr"`
+			} `xml:"UnitID"`
+		} `xml:"BusinessUnit"`
+		RetailStoreID     string `xml:"RetailStoreID"`
+		WorkstationID     string `xml:"WorkstationID"`
+		SequenceNumber    string `xml:"SequenceNumber"`
+		BeginDateTime     string `xml:"BeginDateTime"`
+		EndDateTime       string `xml:"EndDateTime"`
+		RetailTransaction struct {
+			LineItems []struct {
+				VoidFlag bool `xml:"VoidFlag,attr"`
+				Sale     *struct {
+					Description    string `xml:"Description"`
+					ExtendedAmount string `xml:"ExtendedAmount"`
+				} `xml:"Sale"`
+			} `xml:"LineItem"`
+			Totals []struct {
+				Type   string `xml:"TotalType,attr"`
+				Amount string `xml:",chardata"`
+			} `xml:"Total"`
+		} `xml:"RetailTransaction"`
+	} `xml:"Transaction"`
+}
+
+// Maps the one transaction in a POSLog document to a receipt. The retailer is the
+// business unit's name, the total is the transaction's grand amount, and the store,
+// workstation and sequence number together are kept as the partner's own ID.
+func (POSLogAdapter) Parse(raw []byte) (Receipt, error) {
+	var log posLog
+	err := xml.Unmarshal(raw, &log)
+	if err != nil {
+		return Receipt{}, err
+	}
+	if len(log.Transactions) != 1 {
+		return Receipt{}, fmt.Errorf("the document has %d transactions rather than one", len(log.Transactions))
+	}
+	transaction := log.Transactions[0]
+
+	receipt := Receipt{Retailer: transaction.BusinessUnit.UnitID.Name, Items: []Item{}}
+	if transaction.SequenceNumber != "" {
+		receipt.ExternalID = transaction.RetailStoreID + "-" + transaction.WorkstationID + "-" + transaction.SequenceNumber
+	}
+	when := cmp.Or(transaction.EndDateTime, transaction.BeginDateTime)
+	if when != "" {
+		receipt.PurchaseDate, receipt.PurchaseTime, err = splitTimestamp(when)
+		if err != nil {
+			return Receipt{}, fmt.Errorf("the transaction time %w", err)
+		}
+	}
+	for _, line := range transaction.RetailTransaction.LineItems {
+		if line.VoidFlag || line.Sale == nil {
+			continue
+		}
+		price, err := normalizeAmount(line.Sale.ExtendedAmount)
+		if err != nil {
+			return Receipt{}, fmt.Errorf("the amount of %s %w", line.Sale.Description, err)
+		}
+		receipt.Items = append(receipt.Items, Item{ShortDescription: line.Sale.Description, Price: price})
+	}
+	for _, total := range transaction.RetailTransaction.Totals {
+		if total.Type != "TransactionGrandAmount" {
+			continue
+		}
+		receipt.Total, err = normalizeAmount(total.Amount)
+		if err != nil {
+			return Receipt{}, fmt.Errorf("the total %w", err)
+		}
+	}
+	return receipt, nil
+}
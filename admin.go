@@ -0,0 +1,52 @@
+package receiptapi
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Returns the token admin endpoints must be authorized with, from the secrets provider
+// if it has one, so it can be rotated without a restart
+func adminToken() string {
+	if token, ok := Secret("ADMIN_TOKEN"); ok {
+		return token
+	}
+	return config.AdminToken
+}
+
+// Answers 401 instead of calling next unless the request has the admin token as a bearer
+// token, and 403 if no admin token is configured
+func RequireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rejection := checkAdminToken(r)
+		if rejection != nil {
+			w.Header().Set("Content-Type", "application/json")
+			if rejection.Status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			WriteRejection(w, rejection)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Requires the admin token for every route of a router, as RequireAdminToken does for one
+func AdminOnly(next http.Handler) http.Handler {
+	return RequireAdminToken(next.ServeHTTP)
+}
+
+// Returns the rejection for a request without the admin token as a bearer token, 401, or
+// 403 if no admin token is configured; nil if it has it
+func checkAdminToken(r *http.Request) *Rejection {
+	token := adminToken()
+	if token == "" {
+		return &Rejection{http.StatusForbidden, codeUnauthorized, "Admin endpoints need ADMIN_TOKEN to be set."}
+	}
+	given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return &Rejection{http.StatusUnauthorized, codeUnauthorized, "The Authorization header must hold the admin token as a bearer token."}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package receiptapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		status        int
+	}{
+		{"admin token", "admin", "Bearer admin", http.StatusOK},
+		{"no admin token set", "", "Bearer ", http.StatusForbidden},
+		{"no admin token set, none sent", "", "", http.StatusForbidden},
+		{"wrong token", "admin", "Bearer admins", http.StatusUnauthorized},
+		{"no token", "admin", "", http.StatusUnauthorized},
+		{"not a bearer token", "admin", "admin", http.StatusUnauthorized},
+		{"basic auth", "admin", "Basic YWRtaW4=", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withConfig(t, func(config *Config) { config.AdminToken = test.adminToken })
+			called := false
+			handler := RequireAdminToken(func(w http.ResponseWriter, r *http.Request) { called = true })
+			r := httptest.NewRequest("GET", "/admin/jobs/1", nil)
+			r.Header.Set("Authorization", test.authorization)
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.status || called != (test.status == http.StatusOK) {
+				t.Errorf("status = %d, handler called %v, want %d", w.Code, called, test.status)
+			}
+			if test.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want %q", w.Header().Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	withConfig(t, func(config *Config) { config.AdminToken = "admin" })
+	s := New()
+	s.Store.Add(Receipt{ID: "stored", Retailer: "Target", Items: []Item{{ShortDescription: "Pizza", Price: "1.00"}}})
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		status        int
+		contentType   string
+	}{
+		{"export without the admin token", "/admin/receipts/export", "", http.StatusUnauthorized, "application/json"},
+		{"export", "/admin/receipts/export", "Bearer admin", http.StatusOK, "text/csv"},
+		{"receipt lookup", "/admin/receipts/stored", "Bearer admin", http.StatusOK, "application/json"},
+		{"old export path", "/receipts/export", "Bearer admin", http.StatusNotFound, ""},
+		{"counters without the admin token", "/admin/debug/vars", "", http.StatusUnauthorized, "application/json"},
+		{"counters", "/admin/debug/vars", "Bearer admin", http.StatusOK, "application/json; charset=utf-8"},
+		{"old counters path", "/debug/vars", "Bearer admin", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.path, nil)
+			r.Header.Set("Authorization", test.authorization)
+			w := httptest.NewRecorder()
+			NewRouter(s).ServeHTTP(w, r)
+			if w.Code != test.status || (test.contentType != "" && w.Header().Get("Content-Type") != test.contentType) {
+				t.Errorf("status = %d, content type %q, want %d, %q: %s", w.Code, w.Header().Get("Content-Type"), test.status, test.contentType, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Prefix of the aliases of item fields, such as "items.amount"
+const itemAliasPrefix = "items."
+
+// JSON names of item fields, and of the receipt and item fields that hold strings
+var (
+	itemFieldNames          = jsonFieldNames(reflect.TypeFor[Item]())
+	receiptStringFieldNames = stringFieldNames(reflect.TypeFor[Receipt]())
+	itemStringFieldNames    = stringFieldNames(reflect.TypeFor[Item]())
+)
+
+// Returns the JSON names of a struct's string fields
+func stringFieldNames(structType reflect.Type) []string {
+	names := []string{}
+	for i := range structType.NumField() {
+		name, _, _ := strings.Cut(structType.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" && structType.Field(i).Type.Kind() == reflect.String {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Checks that every alias names a receipt field, or an item field for an alias of one,
+// and isn't the name of a field itself
+func CheckFieldAliases(aliases map[string]string) error {
+	for alias, field := range aliases {
+		fields, name := receiptFieldNames, field
+		if strings.HasPrefix(alias, itemAliasPrefix) {
+			fields = itemFieldNames
+			var ok bool
+			name, ok = strings.CutPrefix(field, itemAliasPrefix)
+			if !ok {
+				return fmt.Errorf("FIELD_ALIASES: %s is an item field alias, so it must name an item field like items.price, not %s", alias, field)
+			}
+		}
+		if !slices.Contains(fields, name) {
+			return fmt.Errorf("FIELD_ALIASES: %s names an unknown field %s", alias, field)
+		}
+		if slices.Contains(fields, strings.TrimPrefix(alias, itemAliasPrefix)) {
+			return fmt.Errorf("FIELD_ALIASES: %s is a field itself, so it can't be an alias", alias)
+		}
+	}
+	return nil
+}
+
+// Renames the aliased fields of a JSON object to the fields they stand for. A field that
+// is also given under its own name keeps that value. A number given for a string field,
+// such as "amount": 12.50, becomes that string as written.
+func renameAliases(object map[string]json.RawMessage, aliases map[string]string, stringFields []string) {
+	for alias, field := range aliases {
+		value, ok := object[alias]
+		if !ok {
+			continue
+		}
+		delete(object, alias)
+		if _, given := object[field]; given {
+			continue
+		}
+		trimmed := strings.TrimSpace(string(value))
+		if slices.Contains(stringFields, field) && trimmed != "" && (trimmed[0] == '-' || (trimmed[0] >= '0' && trimmed[0] <= '9')) {
+			value, _ = json.Marshal(trimmed)
+		}
+		object[field] = value
+	}
+}
+
+// Returns a receipt in the API's own JSON with the configured aliases renamed to the
+// fields they stand for. Anything that isn't a JSON object is returned as is, for
+// decoding to report.
+func ApplyFieldAliases(raw json.RawMessage) json.RawMessage {
+	receiptAliases, itemAliases := map[string]string{}, map[string]string{}
+	for alias, field := range config.FieldAliases {
+		if itemAlias, ok := strings.CutPrefix(alias, itemAliasPrefix); ok {
+			itemAliases[itemAlias] = strings.TrimPrefix(field, itemAliasPrefix)
+		} else {
+			receiptAliases[alias] = field
+		}
+	}
+
+	var object map[string]json.RawMessage
+	if json.Unmarshal(raw, &object) != nil || object == nil {
+		return raw
+	}
+	renameAliases(object, receiptAliases, receiptStringFieldNames)
+
+	var items []map[string]json.RawMessage
+	if len(itemAliases) > 0 && json.Unmarshal(object["items"], &items) == nil {
+		for _, item := range items {
+			if item != nil {
+				renameAliases(item, itemAliases, itemStringFieldNames)
+			}
+		}
+		object["items"], _ = json.Marshal(items)
+	}
+
+	renamed, err := json.Marshal(object)
+	if err != nil {
+		return raw
+	}
+	return renamed
+}
@@ -0,0 +1,80 @@
+package receiptapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckFieldAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases map[string]string
+		wantErr string
+	}{
+		{"receipt and item fields", map[string]string{"purchase_date": "purchaseDate", "items.amount": "items.price"}, ""},
+		{"unknown field", map[string]string{"store": "shop"}, "names an unknown field shop"},
+		{"unknown item field", map[string]string{"items.amount": "items.cost"}, "names an unknown field items.cost"},
+		{"item alias for a receipt field", map[string]string{"items.amount": "total"}, "must name an item field"},
+		{"alias that is a field", map[string]string{"total": "retailer"}, "is a field itself"},
+		{"item alias that is an item field", map[string]string{"items.price": "items.shortDescription"}, "is a field itself"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckFieldAliases(test.aliases)
+			if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("CheckFieldAliases() = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNativeAdapterAliases(t *testing.T) {
+	withConfig(t, func(config *Config) {
+		config.FieldAliases = map[string]string{
+			"store":         "retailer",
+			"purchase_date": "purchaseDate",
+			"amount":        "total",
+			"items.name":    "items.shortDescription",
+			"items.amount":  "items.price",
+		}
+	})
+	tests := []struct {
+		name string
+		raw  string
+		want Receipt
+	}{
+		{
+			name: "aliases renamed",
+			raw:  `{"store": "Target", "purchase_date": "2022-01-01", "items": [{"name": "Pizza", "amount": "12.25"}], "amount": "12.25"}`,
+			want: Receipt{Retailer: "Target", PurchaseDate: "2022-01-01", Items: []Item{{ShortDescription: "Pizza", Price: "12.25"}}, Total: "12.25"},
+		},
+		{
+			name: "numbers for string fields kept as written",
+			raw:  `{"amount": 12.50, "items": [{"amount": 12.50}]}`,
+			want: Receipt{Items: []Item{{Price: "12.50"}}, Total: "12.50"},
+		},
+		{
+			name: "field given under its own name wins",
+			raw:  `{"retailer": "Walmart", "store": "Target"}`,
+			want: Receipt{Retailer: "Walmart"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NativeAdapter{}.Parse([]byte(test.raw))
+			if err != nil {
+				t.Fatalf("Parse() = %v", err)
+			}
+			if got.Retailer != test.want.Retailer || got.PurchaseDate != test.want.PurchaseDate || got.Total != test.want.Total ||
+				len(got.Items) != len(test.want.Items) || len(got.Items) > 0 && got.Items[0] != test.want.Items[0] {
+				t.Errorf("Parse() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	// Anything that isn't an object is left for decoding to report
+	_, err := NativeAdapter{}.Parse([]byte(`["store"]`))
+	if err == nil {
+		t.Error("Parse() of an array succeeded, want an error")
+	}
+}
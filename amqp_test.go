@@ -0,0 +1,358 @@
+package receiptapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAMQPArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args *amqpArgs
+		want []byte
+	}{
+		{"octet", new(amqpArgs).octet(2), []byte{2}},
+		{"short", new(amqpArgs).short(0x0102), []byte{1, 2}},
+		{"long", new(amqpArgs).long(0x01020304), []byte{1, 2, 3, 4}},
+		{"short string", new(amqpArgs).shortString("abc"), []byte{3, 'a', 'b', 'c'}},
+		{"empty short string", new(amqpArgs).shortString(""), []byte{0}},
+		{"long string", new(amqpArgs).longString("abc"), []byte{0, 0, 0, 3, 'a', 'b', 'c'}},
+		{"chained", new(amqpArgs).short(10).shortString("x").octet(1), []byte{0, 10, 1, 'x', 1}},
+	}
+	for _, test := range tests {
+		if !bytes.Equal(*test.args, test.want) {
+			t.Errorf("%s = %v, want %v", test.name, *test.args, test.want)
+		}
+	}
+}
+
+// Returns a publisher and a peer speaking frames to each other over an in-memory connection
+func amqpPipe(t *testing.T) (*AMQPPublisher, *AMQPPublisher) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &AMQPPublisher{conn: client, reader: bufio.NewReader(client)}, &AMQPPublisher{conn: server, reader: bufio.NewReader(server)}
+}
+
+func TestAMQPWriteMethod(t *testing.T) {
+	publisher, peer := amqpPipe(t)
+	go publisher.writeMethod(1, amqpConfirmSelect, amqpArgs{0})
+	frame := make([]byte, 13)
+	_, err := io.ReadFull(peer.reader, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{amqpFrameMethod, 0, 1, 0, 0, 0, 5, 0, 85, 0, 10, 0, amqpFrameEnd}
+	if !bytes.Equal(frame, want) {
+		t.Errorf("Confirm.Select frame = %v, want %v", frame, want)
+	}
+}
+
+func TestAMQPReadFrame(t *testing.T) {
+	tests := []struct {
+		name        string
+		frame       []byte
+		wantType    byte
+		wantPayload []byte
+		wantErr     string
+	}{
+		{"heartbeat", []byte{amqpFrameHeartbeat, 0, 0, 0, 0, 0, 0, amqpFrameEnd}, amqpFrameHeartbeat, []byte{}, ""},
+		{"body", []byte{amqpFrameBody, 0, 1, 0, 0, 0, 2, 'h', 'i', amqpFrameEnd}, amqpFrameBody, []byte("hi"), ""},
+		{"wrong end", []byte{amqpFrameBody, 0, 1, 0, 0, 0, 2, 'h', 'i', 0}, 0, nil, "malformed"},
+		{"too large", []byte{amqpFrameBody, 0, 1, 0, 0x10, 0, 1}, 0, nil, "too large"},
+		{"cut short", []byte{amqpFrameBody, 0, 1, 0, 0, 0, 2, 'h'}, 0, nil, "EOF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			publisher := &AMQPPublisher{reader: bufio.NewReader(bytes.NewReader(test.frame))}
+			frameType, payload, err := publisher.readFrame()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("readFrame() error = %v, want one saying %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || frameType != test.wantType || !bytes.Equal(payload, test.wantPayload) {
+				t.Errorf("readFrame() = %d, %q, %v; want %d, %q", frameType, payload, err, test.wantType, test.wantPayload)
+			}
+		})
+	}
+}
+
+func TestAMQPReadMethod(t *testing.T) {
+	publisher, peer := amqpPipe(t)
+	go func() {
+		peer.writeFrame(amqpFrameHeartbeat, 0, nil)
+		peer.writeMethod(0, amqpConnectionOpenOk, amqpArgs{0})
+		args := amqpArgs{}
+		args.short(403).shortString("ACCESS_REFUSED").short(10).short(40)
+		peer.writeMethod(0, amqpConnectionClose, args)
+	}()
+
+	method, args, err := publisher.readMethod()
+	if err != nil || method != amqpConnectionOpenOk || !bytes.Equal(args, []byte{0}) {
+		t.Errorf("readMethod() = %v, %v, %v; want Connection.Open-Ok after skipping the heartbeat", method, args, err)
+	}
+	_, _, err = publisher.readMethod()
+	if err == nil || !strings.Contains(err.Error(), "403 ACCESS_REFUSED") {
+		t.Errorf("readMethod() of Connection.Close = %v, want its reply code and text", err)
+	}
+}
+
+// Message a fake broker received
+type amqpMessage struct {
+	exchange    string
+	routingKey  string
+	contentType string
+	persistent  bool
+	headers     map[string]string
+	body        []byte
+	bodyFrames  int
+}
+
+// Broker that speaks the side of AMQP 0-9-1 a publisher needs, one connection at a time
+type fakeBroker struct {
+	t        *testing.T
+	listener net.Listener
+
+	// Frame size connections are tuned to, and whether messages are turned away
+	frameMax uint32
+	nack     bool
+
+	// Login response and virtual host of the last connection, and the messages received
+	login    string
+	vhost    string
+	messages chan amqpMessage
+}
+
+// Starts a broker with the given settings listening on a local port
+func newFakeBroker(t *testing.T, broker *fakeBroker) *fakeBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.t, broker.listener, broker.messages = t, listener, make(chan amqpMessage, 10)
+	t.Cleanup(func() { listener.Close() })
+	go broker.serve()
+	return broker
+}
+
+// Returns the URL of the broker with credentials and a virtual host
+func (b *fakeBroker) URL() string {
+	return "amqp://user:pass@" + b.listener.Addr().String() + "/events"
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.handle(&AMQPPublisher{conn: conn, reader: bufio.NewReader(conn)})
+		conn.Close()
+	}
+}
+
+// Goes through the handshake, then receives messages and confirms each one
+func (b *fakeBroker) handle(peer *AMQPPublisher) {
+	protocol := make([]byte, 8)
+	_, err := io.ReadFull(peer.reader, protocol)
+	if err != nil || string(protocol) != "AMQP\x00\x00\x09\x01" {
+		b.t.Errorf("protocol header = %q, %v", protocol, err)
+		return
+	}
+	start := amqpArgs{}
+	start.octet(0).octet(9).long(0).longString("PLAIN").longString("en_US")
+	peer.writeMethod(0, amqpConnectionStart, start)
+	startOk, err := peer.expectMethod(amqpConnectionStartOk)
+	if err != nil {
+		b.t.Errorf("Connection.Start-Ok: %v", err)
+		return
+	}
+	_, rest := readShortString(startOk[4:])
+	b.login, _ = readLongString(rest)
+
+	tune := amqpArgs{}
+	tune.short(2047).long(b.frameMax).short(60)
+	peer.writeMethod(0, amqpConnectionTune, tune)
+
+	// A broker without a frame size limit leaves it to the client
+	frameMax := b.frameMax
+	if frameMax == 0 {
+		frameMax = 131072
+	}
+	tuneOk, err := peer.expectMethod(amqpConnectionTuneOk)
+	if err != nil || binary.BigEndian.Uint32(tuneOk[2:]) != frameMax || binary.BigEndian.Uint16(tuneOk[6:]) != 0 {
+		b.t.Errorf("Connection.Tune-Ok = %v, %v; want frame size %d and no heartbeats", tuneOk, err, frameMax)
+		return
+	}
+	open, err := peer.expectMethod(amqpConnectionOpen)
+	if err != nil {
+		b.t.Errorf("Connection.Open: %v", err)
+		return
+	}
+	b.vhost, _ = readShortString(open)
+	peer.writeMethod(0, amqpConnectionOpenOk, amqpArgs{0})
+	_, err = peer.expectMethod(amqpChannelOpen)
+	if err != nil {
+		b.t.Errorf("Channel.Open: %v", err)
+		return
+	}
+	peer.writeMethod(1, amqpChannelOpenOk, amqpArgs{0, 0, 0, 0})
+	_, err = peer.expectMethod(amqpConfirmSelect)
+	if err != nil {
+		b.t.Errorf("Confirm.Select: %v", err)
+		return
+	}
+	peer.writeMethod(1, amqpConfirmSelectOk, nil)
+
+	for tag := uint64(1); ; tag++ {
+		method, args, err := peer.readMethod()
+		if method == amqpConnectionClose {
+			peer.writeMethod(0, amqpConnectionCloseOk, nil)
+		}
+		if err != nil {
+			return
+		}
+		if method != amqpBasicPublish {
+			b.t.Errorf("method = %v, want Basic.Publish", method)
+			return
+		}
+		var message amqpMessage
+		message.exchange, args = readShortString(args[2:])
+		message.routingKey, _ = readShortString(args)
+
+		_, header, err := peer.readFrame()
+		if err != nil {
+			b.t.Errorf("content header: %v", err)
+			return
+		}
+		size := binary.BigEndian.Uint64(header[4:])
+		flags := binary.BigEndian.Uint16(header[12:])
+		properties := header[14:]
+		message.contentType, properties = readShortString(properties)
+		if flags&0x2000 != 0 {
+			var table string
+			table, properties = readLongString(properties)
+			message.headers = readStringTable([]byte(table))
+		}
+		message.persistent = properties[0] == 2
+
+		for uint64(len(message.body)) < size {
+			_, chunk, err := peer.readFrame()
+			if err != nil {
+				b.t.Errorf("content body: %v", err)
+				return
+			}
+			message.body = append(message.body, chunk...)
+			message.bodyFrames += 1
+		}
+		b.messages <- message
+
+		// A heartbeat and a confirm for an earlier message come first, to be skipped
+		peer.writeFrame(amqpFrameHeartbeat, 0, nil)
+		confirm := amqpArgs(binary.BigEndian.AppendUint64(nil, tag-1))
+		confirm.octet(0)
+		peer.writeMethod(1, amqpBasicAck, confirm)
+		confirm = binary.BigEndian.AppendUint64(nil, tag)
+		confirm.octet(0)
+		if b.nack {
+			peer.writeMethod(1, amqpBasicNack, confirm)
+		} else {
+			peer.writeMethod(1, amqpBasicAck, confirm)
+		}
+	}
+}
+
+// Reads a short string from the start of data, returning it and the rest
+func readShortString(data []byte) (string, []byte) {
+	size := int(data[0])
+	return string(data[1 : 1+size]), data[1+size:]
+}
+
+// Reads a long string from the start of data, returning it and the rest
+func readLongString(data []byte) (string, []byte) {
+	size := int(binary.BigEndian.Uint32(data))
+	return string(data[4 : 4+size]), data[4+size:]
+}
+
+// Reads a field table holding only long string values
+func readStringTable(data []byte) map[string]string {
+	table := map[string]string{}
+	for len(data) > 0 {
+		var name, value string
+		name, data = readShortString(data)
+		value, data = readLongString(data[1:])
+		table[name] = value
+	}
+	return table
+}
+
+func TestAMQPPublish(t *testing.T) {
+	broker := newFakeBroker(t, &fakeBroker{frameMax: 4096})
+	publisher := &AMQPPublisher{URL: broker.URL(), Exchange: "receipts"}
+	err := publisher.Publish(context.Background(), "receipt.processed", []byte(`{"id":"1"}`))
+	if err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+	message := <-broker.messages
+	if broker.login != "\x00user\x00pass" || broker.vhost != "events" {
+		t.Errorf("logged in with %q to %q, want user and pass to events", broker.login, broker.vhost)
+	}
+	if message.exchange != "receipts" || message.routingKey != "receipt.processed" || message.contentType != "application/json" ||
+		!message.persistent || message.headers != nil || string(message.body) != `{"id":"1"}` || message.bodyFrames != 1 {
+		t.Errorf("broker received %+v", message)
+	}
+
+	// Larger bodies are split to fit the frame size, and traces go in the headers
+	trace := NewTrace()
+	payload := bytes.Repeat([]byte("x"), 10000)
+	err = publisher.Publish(WithTrace(context.Background(), trace), "receipt.flagged", payload)
+	if err != nil {
+		t.Fatalf("second Publish() = %v", err)
+	}
+	message = <-broker.messages
+	if !bytes.Equal(message.body, payload) || message.bodyFrames != 3 {
+		t.Errorf("broker received %d bytes in %d frames, want %d bytes in 3", len(message.body), message.bodyFrames, len(payload))
+	}
+	if message.headers["traceparent"] != trace.Traceparent() || message.headers["b3"] != trace.B3() {
+		t.Errorf("broker received headers %v, want the trace", message.headers)
+	}
+
+	err = publisher.Close()
+	if err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+}
+
+func TestAMQPPublishNacked(t *testing.T) {
+	broker := newFakeBroker(t, &fakeBroker{nack: true})
+	publisher := &AMQPPublisher{URL: broker.URL(), Exchange: "receipts"}
+	defer publisher.Close()
+
+	err := publisher.Publish(context.Background(), "receipt.processed", []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "did not accept") {
+		t.Errorf("Publish() = %v, want the message turned away", err)
+	}
+	if publisher.frameMax != 131072 {
+		t.Errorf("frame size = %d, want 131072 when the broker sets no limit", publisher.frameMax)
+	}
+}
+
+func TestAMQPURL(t *testing.T) {
+	publisher := &AMQPPublisher{URL: "amqps://localhost/"}
+	err := publisher.Publish(context.Background(), "receipt.processed", []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "unsupported AMQP URL scheme") {
+		t.Errorf("Publish() = %v, want the scheme turned away", err)
+	}
+}
@@ -0,0 +1,68 @@
+package receiptapi
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Number of recent prices remembered per product
+const priceHistorySize = 100
+
+// Recent prices in cents of accepted items, keyed by SKU
+var priceHistory = map[string][]int64{}
+
+// Guards priceHistory
+var priceHistoryMu sync.Mutex
+
+// Checks matched items against their products' price history, returning a warning for each
+// price that is more than the configured factor away from the median. Normal prices are
+// added to the history; anomalous ones are left out so they don't skew it.
+func CheckPriceAnomalies(receipt Receipt) []string {
+	var warnings []string
+	priceHistoryMu.Lock()
+	defer priceHistoryMu.Unlock()
+
+	for _, item := range receipt.Items {
+		if item.SKU == "" {
+			continue
+		}
+		cents, err := ParseCents(item.Price)
+		if err != nil {
+			continue
+		}
+
+		history := priceHistory[item.SKU]
+		if len(history) >= config.PriceAnomalyMinSamples {
+			median := MedianCents(history)
+			factor := config.PriceAnomalyFactor
+			if float64(cents) > float64(median)*factor || float64(cents)*factor < float64(median) {
+				warnings = append(warnings, fmt.Sprintf("Price %s for %q is far from the usual %.2f.",
+					item.Price, item.ShortDescription, float64(median)/100))
+				continue
+			}
+		}
+
+		// Test prices from the sandbox mustn't skew what is usual in production
+		if receipt.Sandbox {
+			continue
+		}
+		history = append(history, cents)
+		if len(history) > priceHistorySize {
+			history = history[1:]
+		}
+		priceHistory[item.SKU] = history
+	}
+	return warnings
+}
+
+// Returns the median of a list of prices in cents
+func MedianCents(prices []int64) int64 {
+	sorted := slices.Clone(prices)
+	slices.Sort(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
@@ -0,0 +1,40 @@
+package receiptapi
+
+import "time"
+
+// When a receipt was anonymized, and the points it had earned from each rule by then,
+// since the rules can no longer be worked out from what's left
+type Anonymization struct {
+	At           time.Time    `json:"at"`
+	PointsByRule []RulePoints `json:"pointsByRule"`
+}
+
+// Scrubs the retailer and item descriptions from a receipt, along with the SKUs matched
+// from the descriptions. The total, prices, merchant category and points are kept, so
+// the receipt still counts in analytics.
+func Anonymize(receipt *Receipt, rules Rules, now time.Time) {
+	receipt.Anonymized = &Anonymization{At: now, PointsByRule: rules.PointsByRule(*receipt)}
+	receipt.Retailer = ""
+
+	// Replace the items rather than changing them, since copies of the receipt share them
+	items := make([]Item, len(receipt.Items))
+	for i, item := range receipt.Items {
+		items[i] = Item{Price: item.Price}
+	}
+	receipt.Items = items
+
+	// Who submitted it goes too, though not how it came in
+	if receipt.Provenance != nil {
+		provenance := *receipt.Provenance
+		provenance.ClientIP = ""
+		provenance.UserAgent = ""
+		receipt.Provenance = &provenance
+	}
+
+	// The SKUs of the products that earned bonuses would give the items away too
+	if receipt.Scoring != nil {
+		scoring := *receipt.Scoring
+		scoring.ProductBonuses = nil
+		receipt.Scoring = &scoring
+	}
+}
@@ -0,0 +1,135 @@
+package receiptapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Layout of the timestamps requests are signed with
+const amzDateLayout = "20060102T150405Z"
+
+// Signs requests to an AWS service with Signature Version 4
+type awsSigner struct {
+	Region          string
+	Service         string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// Adds Signature Version 4 headers to a request. An X-Amz-Target header, if set, is
+// signed too.
+func (a awsSigner) sign(request *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	request.Header.Set("X-Amz-Date", now.Format(amzDateLayout))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 request.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format(amzDateLayout),
+	}
+	if target := request.Header.Get("X-Amz-Target"); target != "" {
+		headers["x-amz-target"] = target
+	}
+	signedHeaders, canonicalHeaders := canonicalHeaders(headers)
+	canonical := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := a.scope(now)
+	signature := a.signature(now, scope, canonical)
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// Returns the credential scope for requests signed at the given time
+func (a awsSigner) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + a.Region + "/" + a.Service + "/aws4_request"
+}
+
+// Returns the signature of a canonical request
+func (a awsSigner) signature(now time.Time, scope string, canonical string) string {
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(amzDateLayout),
+		scope,
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+a.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, a.Region)
+	key = hmacSHA256(key, a.Service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+/*
+	Below are helpers for building Signature Version 4 canonical requests
+*/
+
+// Returns the signed header names and the canonical header block for a set of headers
+// with lower case names
+func canonicalHeaders(headers map[string]string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var block strings.Builder
+	for _, name := range names {
+		block.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	return strings.Join(names, ";"), block.String()
+}
+
+// Returns query parameters escaped and sorted the way AWS expects
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(name, false)+"="+awsEscape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// Percent encodes everything but unreserved characters, and slashes if keepSlash is set
+func awsEscape(value string, keepSlash bool) string {
+	var escaped strings.Builder
+	for _, c := range []byte(value) {
+		unreserved := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~'
+		if unreserved || (keepSlash && c == '/') {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// Returns the hex SHA-256 digest of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the HMAC-SHA256 of a message
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
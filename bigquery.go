@@ -0,0 +1,218 @@
+package receiptapi
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope of the access tokens rows are inserted with
+const bigQueryScope = "https://www.googleapis.com/auth/bigquery.insertdata"
+
+// Google Cloud service account key, as downloaded from the console
+type ServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+// Reads a service account key file and its private key
+func ReadServiceAccount(path string) (*ServiceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	account := &ServiceAccount{}
+	err = json.Unmarshal(data, account)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("the private key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the private key must be an RSA key")
+	}
+	account.key = key
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return account, nil
+}
+
+// Copies receipts to a BigQuery table with streaming inserts. Tokens are obtained for the
+// service account with a signed JWT, as Google's client libraries do.
+type BigQueryWarehouse struct {
+	// Base URL of the API, "https://bigquery.googleapis.com" if empty
+	Endpoint string
+
+	Project     string
+	Dataset     string
+	Table       string
+	Credentials *ServiceAccount
+
+	// Access token requests are made with until shortly before it expires
+	mu           sync.Mutex
+	token        string
+	tokenExpires time.Time
+}
+
+// Response to a streaming insert; rows listed in insertErrors weren't inserted
+type bigQueryInsertResponse struct {
+	InsertErrors []struct {
+		Index  int `json:"index"`
+		Errors []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"insertErrors"`
+}
+
+// Appends rows to the table. BigQuery drops rows sent again with the same insert ID for
+// a short while, so a batch retried soon after isn't duplicated.
+func (b *BigQueryWarehouse) Insert(ctx context.Context, rows []WarehouseRow) error {
+	type insertRow struct {
+		InsertID string         `json:"insertId"`
+		JSON     map[string]any `json:"json"`
+	}
+	request := struct {
+		Rows []insertRow `json:"rows"`
+	}{}
+	for _, row := range rows {
+		request.Rows = append(request.Rows, insertRow{InsertID: row.InsertID, JSON: row.Columns})
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	token, err := b.accessToken(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get a BigQuery access token: %w", err)
+	}
+	endpoint := b.Endpoint
+	if endpoint == "" {
+		endpoint = "https://bigquery.googleapis.com"
+	}
+	target := strings.TrimSuffix(endpoint, "/") + "/bigquery/v2/projects/" + url.PathEscape(b.Project) +
+		"/datasets/" + url.PathEscape(b.Dataset) + "/tables/" + url.PathEscape(b.Table) + "/insertAll"
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Authorization", "Bearer "+token)
+
+	response, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("insert into %s.%s: %s: %s", b.Dataset, b.Table, response.Status, detail)
+	}
+	var inserted bigQueryInsertResponse
+	err = json.NewDecoder(response.Body).Decode(&inserted)
+	if err != nil {
+		return err
+	}
+	if len(inserted.InsertErrors) > 0 {
+		first := inserted.InsertErrors[0]
+		message := "unknown error"
+		if len(first.Errors) > 0 {
+			message = first.Errors[0].Reason + ": " + first.Errors[0].Message
+		}
+		return fmt.Errorf("insert into %s.%s: %d of %d rows failed, the first at row %d with %s",
+			b.Dataset, b.Table, len(inserted.InsertErrors), len(rows), first.Index, message)
+	}
+	return nil
+}
+
+// Returns an access token for the service account, exchanging a newly signed JWT for
+// one when the last is about to expire
+func (b *BigQueryWarehouse) accessToken(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.token != "" && now.Add(time.Minute).Before(b.tokenExpires) {
+		return b.token, nil
+	}
+
+	assertion, err := b.Credentials.signJWT(now)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, b.Credentials.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return "", fmt.Errorf("%s: %s", response.Status, detail)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	b.token = token.AccessToken
+	b.tokenExpires = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return b.token, nil
+}
+
+// Returns a JWT asserting the service account's identity for an hour, signed with RS256
+func (a *ServiceAccount) signJWT(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": a.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   a.ClientEmail,
+		"scope": bigQueryScope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(nil, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
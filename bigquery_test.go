@@ -0,0 +1,255 @@
+package receiptapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a service account key file with a private key and token URI, returning its path
+func writeServiceAccount(t *testing.T, key crypto.PrivateKey, tokenURI string) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "sync@project.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokenURI,
+	})
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Returns a new RSA key for a service account
+func newServiceAccountKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Checks a JWT's RS256 signature and returns its header and claims
+func verifyJWT(token string, key *rsa.PublicKey) (map[string]any, map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, fmt.Errorf("JWT %q doesn't have three parts", token)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("JWT signature doesn't verify: %w", err)
+	}
+	var header, claims map[string]any
+	decoded, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	json.Unmarshal(decoded, &header)
+	decoded, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(decoded, &claims)
+	return header, claims, nil
+}
+
+func TestReadServiceAccount(t *testing.T) {
+	key := newServiceAccountKey(t)
+	account, err := ReadServiceAccount(writeServiceAccount(t, key, ""))
+	if err != nil {
+		t.Fatalf("ReadServiceAccount() = %v", err)
+	}
+	if account.ClientEmail != "sync@project.iam.gserviceaccount.com" || account.TokenURI != "https://oauth2.googleapis.com/token" || !account.key.Equal(key) {
+		t.Errorf("ReadServiceAccount() = %+v, want the account with Google's token URI", account)
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, err = ReadServiceAccount(writeServiceAccount(t, ecKey, ""))
+	if err == nil || !strings.Contains(err.Error(), "RSA") {
+		t.Errorf("ReadServiceAccount() with an EC key = %v, want an error", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	os.WriteFile(path, []byte(`{"private_key":"not a key"}`), 0o600)
+	_, err = ReadServiceAccount(path)
+	if err == nil || !strings.Contains(err.Error(), "PEM") {
+		t.Errorf("ReadServiceAccount() without a PEM key = %v, want an error", err)
+	}
+}
+
+func TestServiceAccountSignJWT(t *testing.T) {
+	key := newServiceAccountKey(t)
+	account := &ServiceAccount{ClientEmail: "sync@project.iam.gserviceaccount.com", PrivateKeyID: "key-1", TokenURI: "https://oauth2.googleapis.com/token", key: key}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	token, err := account.signJWT(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, claims, err := verifyJWT(token, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header["alg"] != "RS256" || header["kid"] != "key-1" {
+		t.Errorf("JWT header = %v, want RS256 with the key ID", header)
+	}
+	want := map[string]any{
+		"iss":   "sync@project.iam.gserviceaccount.com",
+		"scope": bigQueryScope,
+		"aud":   "https://oauth2.googleapis.com/token",
+		"iat":   float64(now.Unix()),
+		"exp":   float64(now.Add(time.Hour).Unix()),
+	}
+	for name, value := range want {
+		if claims[name] != value {
+			t.Errorf("JWT claim %s = %v, want %v", name, claims[name], value)
+		}
+	}
+}
+
+// Fake Google token endpoint and BigQuery API, recording the tokens issued and the rows
+// inserted
+type fakeBigQuery struct {
+	// Key the service account's JWTs are checked with
+	key *rsa.PublicKey
+
+	// Response to each insert, if not success
+	insertStatus   int
+	insertResponse string
+
+	tokensIssued int
+	inserts      []map[string]any
+}
+
+func (f *fakeBigQuery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/token":
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+		_, _, err := verifyJWT(r.PostForm.Get("assertion"), f.key)
+		if err != nil {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		f.tokensIssued += 1
+		json.NewEncoder(w).Encode(map[string]any{"access_token": fmt.Sprintf("token-%d", f.tokensIssued), "expires_in": 3600})
+	case "/bigquery/v2/projects/project/datasets/analytics/tables/receipts/insertAll":
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer token-") {
+			http.Error(w, `{"error":{"message":"unauthenticated"}}`, http.StatusUnauthorized)
+			return
+		}
+		var insert map[string]any
+		json.NewDecoder(r.Body).Decode(&insert)
+		f.inserts = append(f.inserts, insert)
+		if f.insertStatus != 0 {
+			w.WriteHeader(f.insertStatus)
+		}
+		io.WriteString(w, f.insertResponse)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Returns a warehouse sending to a fake BigQuery, and the fake
+func newFakeBigQuery(t *testing.T) (*BigQueryWarehouse, *fakeBigQuery) {
+	t.Helper()
+	key := newServiceAccountKey(t)
+	fake := &fakeBigQuery{key: &key.PublicKey, insertResponse: "{}"}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	account, err := ReadServiceAccount(writeServiceAccount(t, key, server.URL+"/token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warehouse := &BigQueryWarehouse{Endpoint: server.URL + "/", Project: "project", Dataset: "analytics", Table: "receipts", Credentials: account}
+	return warehouse, fake
+}
+
+func TestBigQueryInsert(t *testing.T) {
+	warehouse, fake := newFakeBigQuery(t)
+	rows := []WarehouseRow{
+		{InsertID: "r1-2024-05-01T12:00:00Z", Columns: map[string]any{"id": "r1", "points": 28}},
+		{InsertID: "r2-2024-05-01T12:00:00Z", Columns: map[string]any{"id": "r2", "points": nil}},
+	}
+	for range 2 {
+		err := warehouse.Insert(context.Background(), rows)
+		if err != nil {
+			t.Fatalf("Insert() = %v", err)
+		}
+	}
+
+	// The access token is kept until shortly before it expires
+	if fake.tokensIssued != 1 || len(fake.inserts) != 2 {
+		t.Errorf("made %d inserts with %d tokens, want 2 with 1", len(fake.inserts), fake.tokensIssued)
+	}
+	sent, _ := json.Marshal(fake.inserts[0])
+	want := `{"rows":[{"insertId":"r1-2024-05-01T12:00:00Z","json":{"id":"r1","points":28}},` +
+		`{"insertId":"r2-2024-05-01T12:00:00Z","json":{"id":"r2","points":null}}]}`
+	if string(sent) != want {
+		t.Errorf("insert sent %s, want %s", sent, want)
+	}
+}
+
+func TestBigQueryInsertErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response string
+		wantErr  string
+	}{
+		{
+			name:     "rows turned away",
+			response: `{"insertErrors":[{"index":1,"errors":[{"reason":"invalid","message":"no such field: mcc"}]}]}`,
+			wantErr:  "1 of 2 rows failed, the first at row 1 with invalid: no such field: mcc",
+		},
+		{
+			name:     "request refused",
+			status:   http.StatusForbidden,
+			response: `{"error":{"message":"Access Denied"}}`,
+			wantErr:  "403 Forbidden",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			warehouse, fake := newFakeBigQuery(t)
+			fake.insertStatus, fake.insertResponse = test.status, test.response
+			err := warehouse.Insert(context.Background(), []WarehouseRow{{InsertID: "r1"}, {InsertID: "r2"}})
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Insert() = %v, want an error saying %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBigQueryTokenRefused(t *testing.T) {
+	warehouse, _ := newFakeBigQuery(t)
+	warehouse.Credentials.TokenURI = strings.Replace(warehouse.Credentials.TokenURI, "/token", "/missing", 1)
+	err := warehouse.Insert(context.Background(), []WarehouseRow{{InsertID: "r1"}})
+	if err == nil || !strings.Contains(err.Error(), "access token") {
+		t.Errorf("Insert() = %v, want the token error", err)
+	}
+}
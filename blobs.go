@@ -0,0 +1,212 @@
+package receiptapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Returned when there is no blob with the requested key
+var ErrBlobNotFound = errors.New("blob not found")
+
+// Stores files such as exports and backups under slash separated keys
+type BlobStore interface {
+	Put(ctx context.Context, key string, data io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+
+	// Returns a URL anyone can download the blob from until it expires
+	SignedURL(key string, expires time.Duration) (string, error)
+}
+
+// Returns the blob store selected by the configuration, or nil if none is, telling the
+// time signed URLs expire from with a clock
+func NewBlobStore(config Config, clock Clock) (BlobStore, error) {
+	switch config.BlobStore {
+	case "":
+		return nil, nil
+	case "disk":
+		return &DiskBlobStore{
+			Dir:        config.BlobDir,
+			URLBase:    config.BlobURLBase,
+			SigningKey: []byte(config.BlobSigningKey),
+			Clock:      clock,
+		}, nil
+	case "s3":
+		return &S3BlobStore{
+			Endpoint:        config.S3Endpoint,
+			Region:          config.S3Region,
+			Bucket:          config.S3Bucket,
+			AccessKeyID:     config.S3AccessKeyID,
+			SecretAccessKey: config.S3SecretAccessKey,
+			PathStyle:       config.S3PathStyle,
+			Clock:           clock,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown BLOB_STORE %q", config.BlobStore)
+}
+
+// Checks a key is a clean relative path, so it can't reach outside the store
+func CheckBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
+
+/*
+	Below is the blob store that keeps blobs as files in a local directory
+*/
+
+// Keeps blobs as files under a directory. Signed URLs point at this API, which checks
+// the signature before serving the file.
+type DiskBlobStore struct {
+	Dir string
+
+	// Where the API serving signed URLs is reached, e.g. "http://localhost:8000"
+	URLBase string
+
+	// Secret signed URLs are signed with
+	SigningKey []byte
+
+	// Tells the time signed URLs expire from; the system clock when nil
+	Clock Clock
+}
+
+// Returns the path of the file a blob is kept in
+func (d *DiskBlobStore) path(key string) (string, error) {
+	err := CheckBlobKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d.Dir, filepath.FromSlash(key)), nil
+}
+
+// Writes a blob, replacing any blob with the same key
+func (d *DiskBlobStore) Put(ctx context.Context, key string, data io.Reader) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(name), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// Write alongside and rename, so readers never see a partial blob
+	temp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = io.Copy(temp, data)
+	closeErr := temp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(temp.Name(), name)
+}
+
+// Opens a blob for reading
+func (d *DiskBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+// Deletes a blob; deleting one that doesn't exist is not an error
+func (d *DiskBlobStore) Delete(ctx context.Context, key string) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Returns a URL on this API that serves the blob until it expires
+func (d *DiskBlobStore) SignedURL(key string, expires time.Duration) (string, error) {
+	err := CheckBlobKey(key)
+	if err != nil {
+		return "", err
+	}
+	if len(d.SigningKey) == 0 {
+		return "", errors.New("BLOB_SIGNING_KEY must be set to sign URLs")
+	}
+	expiry := strconv.FormatInt(clockOrSystem(d.Clock).Now().Add(expires).Unix(), 10)
+	query := url.Values{"expires": {expiry}, "signature": {d.sign(key, expiry)}}
+	return strings.TrimSuffix(d.URLBase, "/") + "/blobs/" + key + "?" + query.Encode(), nil
+}
+
+// Returns the signature of a key and expiry time
+func (d *DiskBlobStore) sign(key string, expiry string) string {
+	mac := hmac.New(sha256.New, d.SigningKey)
+	mac.Write([]byte(key + "\n" + expiry))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks a signed URL's signature is valid and it hasn't expired
+func (d *DiskBlobStore) CheckSignature(key string, expiry string, signature string, now time.Time) bool {
+	if len(d.SigningKey) == 0 {
+		return false
+	}
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.Unix() > seconds {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(d.sign(key, expiry)))
+}
+
+// Method to download a blob from the disk store through a signed URL
+func (s *Server) ServeBlob(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	query := r.URL.Query()
+	disk, ok := s.Blobs.(*DiskBlobStore)
+	if !ok || !disk.CheckSignature(key, query.Get("expires"), query.Get("signature"), s.Clock.Now()) {
+		WriteError(w, http.StatusForbidden, codeInvalidSignature, "The link is invalid or has expired.")
+		return
+	}
+
+	blob, err := disk.Get(r.Context(), key)
+	if errors.Is(err, ErrBlobNotFound) {
+		WriteError(w, http.StatusNotFound, codeBlobNotFound, "No file found for that link.")
+		return
+	}
+	if err != nil {
+		logStorage.Error("Could not read blob", "error", err)
+		WriteError(w, http.StatusInternalServerError, codeInternal, "The file could not be read.")
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+path.Base(key)+`"`)
+	io.Copy(w, blob)
+}
@@ -0,0 +1,213 @@
+package receiptapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Whether points are issued as usual, receipts fall back to the configured behaviour as
+// the day's budget is nearly spent, or the budget is spent
+const (
+	budgetOpen  = "open"
+	budgetLow   = "low"
+	budgetSpent = "spent"
+)
+
+// What receipts fall back to once the day's points budget is nearly spent: being held for
+// review, or earning a reduced percentage of their points
+const (
+	budgetFallbackReview = "review"
+	budgetFallbackReduce = "reduce"
+)
+
+// Type of the events alerting the notification service that the points budget is low or
+// spent
+const budgetAlertEventType = "budget.alert"
+
+// Points issued on a day against the daily budget, and the point at which receipts fall
+// back
+type PointsBudget struct {
+	Day       string `json:"day"`
+	Budget    int64  `json:"budget"`
+	Threshold int64  `json:"threshold"`
+	Issued    int64  `json:"issued"`
+	Remaining int64  `json:"remaining"`
+	Status    string `json:"status"`
+	Fallback  string `json:"fallback"`
+}
+
+// Event published to the event broker when the points budget first becomes low or spent
+// on a day
+type BudgetAlertEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	PointsBudget
+}
+
+// Points issued on the day the running total is kept for, counted from the stored
+// receipts the first time the day is asked about and kept as receipts are processed and
+// approved after that; and the day the budget alerts were sent for, and the statuses they
+// were sent for
+var (
+	budgetDay      string
+	budgetIssued   int64
+	budgetAlertDay string
+	budgetAlerted  = map[string]bool{}
+	budgetMu       sync.Mutex
+)
+
+// Returns the points issued on the day, in UTC, of a time against the daily budget:
+// those awarded to receipts processed that day, counting flagged ones once approved.
+// Sandbox receipts are left out.
+func (s *Server) PointsBudget(now time.Time) PointsBudget {
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	return s.pointsBudget(now)
+}
+
+// Returns the points budget of the day of a time from the running total, starting it
+// again if the day has changed. budgetMu must be held.
+func (s *Server) pointsBudget(now time.Time) PointsBudget {
+	day := now.UTC().Format(dateLayout)
+	if budgetDay != day {
+		budgetDay, budgetIssued = day, 0
+		for _, receipt := range s.Store.All() {
+			if !receipt.Sandbox && receipt.ProcessedAt != nil && receipt.ProcessedAt.UTC().Format(dateLayout) == day {
+				budgetIssued += AwardedPoints(receipt)
+			}
+		}
+	}
+
+	budget := PointsBudget{
+		Day:       day,
+		Budget:    config.DailyPointsBudget,
+		Threshold: config.DailyPointsBudget * int64(config.PointsBudgetAlertPercent) / 100,
+		Issued:    budgetIssued,
+		Status:    budgetOpen,
+		Fallback:  config.PointsBudgetFallback,
+	}
+	budget.Remaining = max(budget.Budget-budget.Issued, 0)
+	switch {
+	case budget.Issued >= budget.Budget:
+		budget.Status = budgetSpent
+	case budget.Issued >= budget.Threshold:
+		budget.Status = budgetLow
+	}
+	return budget
+}
+
+// Keeps a scored receipt within the daily points budget, if there is one. Once issuing
+// its points would pass the threshold, it falls back to being held for review or earning
+// a reduced percentage of its points; if its points would still pass the budget, it is
+// held for review either way. The points of a receipt that isn't held are reserved
+// against the budget straight away, so submissions made at once can't pass it together.
+// Returns the warning to keep with it, if any, and the points reserved, which are given
+// back with AdjustPointsBudget if it isn't stored after all.
+func (s *Server) ApplyPointsBudget(ctx context.Context, receipt *Receipt, now time.Time) (string, int64) {
+	if config.DailyPointsBudget == 0 || receipt.Sandbox || receipt.Points == 0 {
+		return "", 0
+	}
+	budgetMu.Lock()
+	budget := s.pointsBudget(now)
+	warning := ""
+	alert := budget
+	if budget.Issued+receipt.Points > budget.Threshold {
+		warning = "Today's points budget is nearly spent, so the receipt is held for review."
+		if config.PointsBudgetFallback == budgetFallbackReduce {
+			ReducePoints(receipt, config.PointsBudgetReducedPercent)
+			warning = fmt.Sprintf("Today's points budget is nearly spent, so the receipt earned %d%% of its points.", config.PointsBudgetReducedPercent)
+		}
+		alert.Status = budgetLow
+		if budget.Issued+receipt.Points > budget.Budget {
+			alert.Status = budgetSpent
+			warning = "Today's points budget is spent, so the receipt is held for review."
+		}
+		if config.PointsBudgetFallback == budgetFallbackReview || alert.Status == budgetSpent {
+			receipt.Flagged = true
+		}
+	}
+	reserved := int64(0)
+	if !receipt.Flagged {
+		reserved = receipt.Points
+		budgetIssued += reserved
+	}
+	budgetMu.Unlock()
+
+	if warning != "" {
+		s.alertPointsBudget(ctx, alert, now)
+	}
+	return warning, reserved
+}
+
+// Adds points to the running total of the day they count against, when it is kept for
+// that day: those of a flagged receipt when it is approved, the change in a recalculated
+// receipt's points, or reserved points given back when negative
+func AdjustPointsBudget(day time.Time, points int64) {
+	if config.DailyPointsBudget == 0 || points == 0 {
+		return
+	}
+	budgetMu.Lock()
+	if budgetDay == day.UTC().Format(dateLayout) {
+		budgetIssued += points
+	}
+	budgetMu.Unlock()
+}
+
+// Cuts a receipt's points to a percentage of them, as a nearly spent budget does, and
+// records it with its rule snapshot
+func ReducePoints(receipt *Receipt, percent int) {
+	receipt.Points = receipt.Points * int64(percent) / 100
+	if receipt.Scoring != nil {
+		receipt.Scoring.BudgetPercent = percent
+	}
+}
+
+// Logs and publishes an alert the first time each day the budget becomes low or spent
+func (s *Server) alertPointsBudget(ctx context.Context, budget PointsBudget, now time.Time) {
+	budgetMu.Lock()
+	if budgetAlertDay != budget.Day {
+		budgetAlertDay, budgetAlerted = budget.Day, map[string]bool{}
+	}
+	alerted := budgetAlerted[budget.Status]
+	budgetAlerted[budget.Status] = true
+	budgetMu.Unlock()
+	if alerted {
+		return
+	}
+
+	logApp.Warn("Daily points budget is "+budget.Status, "day", budget.Day, "budget", budget.Budget, "issued", budget.Issued, "fallback", budget.Fallback)
+	if s.Events == nil {
+		return
+	}
+	event := BudgetAlertEvent{ID: GenerateID(), Type: budgetAlertEventType, CreatedAt: now, PointsBudget: budget}
+	body, _ := json.Marshal(event)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		ctx, span := StartSpan(ctx, "events.publish")
+		err := s.Events.Publish(ctx, budgetAlertEventType, body)
+		span.End(logApp, "type", budgetAlertEventType)
+		if err != nil {
+			logApp.ErrorContext(ctx, "Could not publish budget alert", "error", err)
+		}
+	}()
+}
+
+/*
+	Below is the handler for admins to follow the points budget
+*/
+
+// Method to get the points issued today against the daily budget
+func (s *Server) GetPointsBudget(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if config.DailyPointsBudget == 0 {
+		WriteError(w, http.StatusNotFound, codeBudgetNotConfigured, "There is no daily points budget without DAILY_POINTS_BUDGET set.")
+		return
+	}
+	json.NewEncoder(w).Encode(s.PointsBudget(s.Clock.Now()))
+}
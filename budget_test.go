@@ -0,0 +1,152 @@
+package receiptapi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Forgets the running total of points issued and the alerts sent, before and after a test
+func withoutBudgetTotal(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		budgetMu.Lock()
+		budgetDay, budgetIssued, budgetAlertDay, budgetAlerted = "", 0, "", map[string]bool{}
+		budgetMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestPointsBudget(t *testing.T) {
+	withoutBudgetTotal(t)
+	withConfig(t, func(config *Config) {
+		config.DailyPointsBudget = 100
+		config.PointsBudgetAlertPercent = 80
+	})
+	s := New()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	yesterday := now.AddDate(0, 0, -1)
+	stored := []struct {
+		id          string
+		points      int64
+		status      string
+		sandbox     bool
+		processedAt time.Time
+	}{
+		{"today", 50, statusProcessed, false, now},
+		{"approved", 20, statusProcessed, false, now},
+		{"flagged", 30, statusSubmitted, false, now},
+		{"sandbox", 30, statusProcessed, true, now},
+		{"yesterday", 30, statusProcessed, false, yesterday},
+	}
+	for _, r := range stored {
+		receipt := targetReceipt
+		receipt.ID, receipt.Points, receipt.Status, receipt.Sandbox = r.id, r.points, r.status, r.sandbox
+		receipt.ProcessedAt = &r.processedAt
+		s.Store.Add(receipt)
+	}
+
+	budget := s.PointsBudget(now)
+	if budget.Issued != 70 || budget.Remaining != 30 || budget.Threshold != 80 || budget.Status != budgetOpen {
+		t.Errorf("PointsBudget() = %+v, want 70 issued of a threshold of 80, open", budget)
+	}
+	AdjustPointsBudget(now, 15)
+	AdjustPointsBudget(yesterday, 100)
+	budget = s.PointsBudget(now)
+	if budget.Issued != 85 || budget.Status != budgetLow {
+		t.Errorf("PointsBudget() after adjusting = %+v, want 85 issued, low", budget)
+	}
+}
+
+func TestApplyPointsBudget(t *testing.T) {
+	tests := []struct {
+		name         string
+		fallback     string
+		issued       int64
+		points       int64
+		sandbox      bool
+		wantPoints   int64
+		wantFlagged  bool
+		wantReserved int64
+		wantWarning  bool
+	}{
+		{name: "under the threshold", fallback: budgetFallbackReview, issued: 20, points: 50, wantPoints: 50, wantReserved: 50},
+		{name: "up to the threshold", fallback: budgetFallbackReview, issued: 30, points: 50, wantPoints: 50, wantReserved: 50},
+		{name: "held for review", fallback: budgetFallbackReview, issued: 50, points: 40, wantPoints: 40, wantFlagged: true, wantWarning: true},
+		{name: "reduced", fallback: budgetFallbackReduce, issued: 50, points: 40, wantPoints: 20, wantReserved: 20, wantWarning: true},
+		{name: "past the budget", fallback: budgetFallbackReduce, issued: 50, points: 120, wantPoints: 60, wantFlagged: true, wantWarning: true},
+		{name: "sandbox", fallback: budgetFallbackReview, issued: 100, points: 40, sandbox: true, wantPoints: 40},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withoutBudgetTotal(t)
+			withConfig(t, func(config *Config) {
+				config.DailyPointsBudget = 100
+				config.PointsBudgetAlertPercent = 80
+				config.PointsBudgetFallback = test.fallback
+				config.PointsBudgetReducedPercent = 50
+			})
+			s := New()
+			now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			s.PointsBudget(now)
+			AdjustPointsBudget(now, test.issued)
+
+			receipt := targetReceipt
+			receipt.Points, receipt.Sandbox = test.points, test.sandbox
+			warning, reserved := s.ApplyPointsBudget(context.Background(), &receipt, now)
+			if receipt.Points != test.wantPoints || receipt.Flagged != test.wantFlagged || reserved != test.wantReserved || (warning != "") != test.wantWarning {
+				t.Errorf("ApplyPointsBudget() = points %d, flagged %v, reserved %d, warning %q, want %d, %v, %d, warning %v",
+					receipt.Points, receipt.Flagged, reserved, warning, test.wantPoints, test.wantFlagged, test.wantReserved, test.wantWarning)
+			}
+			if budget := s.PointsBudget(now); budget.Issued != test.issued+test.wantReserved {
+				t.Errorf("issued after = %d, want %d", budget.Issued, test.issued+test.wantReserved)
+			}
+		})
+	}
+}
+
+func TestRecalculateReceiptBudgetAndBalance(t *testing.T) {
+	withoutBudgetTotal(t)
+	withConfig(t, func(config *Config) { config.DailyPointsBudget = 1000 })
+	s := newLedgerServer(t)
+	now := s.Clock.Now()
+	for _, user := range []string{"spender", "saver"} {
+		receipt := targetReceipt
+		receipt.ID, receipt.UserID, receipt.Status, receipt.Points, receipt.ProcessedAt = user, user, statusProcessed, 100, &now
+		s.Store.Add(receipt)
+	}
+	redemptions["spent"] = &Redemption{ID: "spent", UserID: "spender", Points: 90, Status: redemptionCaptured}
+	if issued := s.PointsBudget(now).Issued; issued != 200 {
+		t.Fatalf("PointsBudget() issued %d before recalculating, want 200", issued)
+	}
+
+	for _, id := range []string{"spender", "saver"} {
+		err := s.RecalculateReceipt(id)
+		if err != nil {
+			t.Fatalf("RecalculateReceipt(%q) = %v", id, err)
+		}
+	}
+	tests := []struct {
+		id     string
+		points int64
+	}{
+		{"spender", 90},
+		{"saver", 28},
+	}
+	for _, test := range tests {
+		receipt, _ := s.Store.Find(test.id)
+		if receipt.Points != test.points {
+			t.Errorf("%s: points = %d after recalculating, want %d", test.id, receipt.Points, test.points)
+		}
+	}
+	pointsMu.Lock()
+	balance := s.pointsBalance("spender")
+	pointsMu.Unlock()
+	if balance.Available != 0 {
+		t.Errorf("spender's available balance = %d, want 0", balance.Available)
+	}
+	if issued := s.PointsBudget(now).Issued; issued != 118 {
+		t.Errorf("PointsBudget() issued %d after recalculating, want 118", issued)
+	}
+}
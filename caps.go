@@ -0,0 +1,74 @@
+package receiptapi
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Name used for the receipt's total in the list of caps it hit
+const capTotal = "total"
+
+// Returns the points each rule awards a receipt, cut to the rule's configured cap
+func CapRulePoints(points []RulePoints, rules ProgramRules) []RulePoints {
+	for i, rule := range points {
+		limit, capped := rules.RulePointCaps[rule.Rule]
+		if capped && rule.Points > limit {
+			points[i].Points = limit
+		}
+	}
+	return points
+}
+
+// Cuts a receipt's points to the configured maximum, if there is one
+func CapReceiptPoints(points int64, rules ProgramRules) int64 {
+	if rules.MaxReceiptPoints > 0 && points > rules.MaxReceiptPoints {
+		return rules.MaxReceiptPoints
+	}
+	return points
+}
+
+// Returns the rules whose points for a receipt were cut to their cap, followed by
+// "total" if its points were cut to the maximum per receipt
+func ExceededPointCaps(receipt Receipt) []string {
+	return CurrentProgram().Rules.ExceededPointCaps(receipt)
+}
+
+// Returns the rules whose points for a receipt were cut to their cap with these rule
+// values, followed by "total" if its points were cut to the maximum per receipt
+func (rules ProgramRules) ExceededPointCaps(receipt Receipt) []string {
+	var exceeded []string
+	var points int64
+	for _, rule := range rules.UncappedPointsByRule(receipt) {
+		limit, capped := rules.RulePointCaps[rule.Rule]
+		if capped && rule.Points > limit {
+			exceeded = append(exceeded, rule.Rule)
+			rule.Points = limit
+		}
+		points += rule.Points
+	}
+	if rules.MaxReceiptPoints > 0 && points > rules.MaxReceiptPoints {
+		exceeded = append(exceeded, capTotal)
+	}
+	return exceeded
+}
+
+// Returns the warning for a receipt whose points were cut to the configured caps
+func PointCapWarning(exceeded []string) string {
+	return "Points were cut to the configured caps for " + strings.Join(exceeded, ", ") + "."
+}
+
+// Checks every rule with a point cap exists and no cap is negative
+func validatePointCaps(caps map[string]int64) error {
+	rules := GetUncappedPointsByRule(Receipt{})
+	for rule, limit := range caps {
+		known := slices.ContainsFunc(rules, func(r RulePoints) bool { return r.Rule == rule })
+		if !known {
+			return fmt.Errorf("unknown rule %q in RULE_POINT_CAPS", rule)
+		}
+		if limit < 0 {
+			return fmt.Errorf("the cap for %s in RULE_POINT_CAPS must not be negative", rule)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Product in the catalog that receipt items can be matched to
+type Product struct {
+	SKU      string `json:"sku"`
+	Name     string `json:"name"`
+	Brand    string `json:"brand"`
+	Category string `json:"category"`
+
+	// Words that must all appear in an item description to match; defaults to the name
+	Keywords []string `json:"keywords"`
+
+	// Sponsored points awarded for every matching item
+	BonusPoints int64 `json:"bonusPoints"`
+}
+
+// Holds all products in the catalog, loaded at startup
+var catalog []Product
+
+// Loads the product catalog from a JSON array of products
+func LoadCatalog(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var products []Product
+	err = json.Unmarshal(data, &products)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for i, product := range products {
+		if product.SKU == "" {
+			return fmt.Errorf("product %d has no sku", i)
+		}
+		if seen[product.SKU] {
+			return fmt.Errorf("duplicate sku %q", product.SKU)
+		}
+		seen[product.SKU] = true
+
+		if len(product.Keywords) == 0 {
+			product.Keywords = strings.Fields(product.Name)
+		}
+		for j, keyword := range product.Keywords {
+			product.Keywords[j] = strings.ToLower(keyword)
+		}
+		products[i] = product
+	}
+	catalog = products
+	return nil
+}
+
+// Returns the catalog product an item description refers to, or nil if none match.
+// When several products match, the one with the most keywords wins as the most specific.
+func MatchProduct(description string) *Product {
+	words := map[string]bool{}
+	for _, word := range strings.Fields(strings.ToLower(NormalizeDescription(description))) {
+		words[word] = true
+	}
+
+	var best *Product
+	for i := range catalog {
+		product := &catalog[i]
+		if len(product.Keywords) == 0 {
+			continue
+		}
+		matched := true
+		for _, keyword := range product.Keywords {
+			// Normalized as the description is, since the program can change meanwhile
+			if !words[NormalizeDescription(keyword)] {
+				matched = false
+				break
+			}
+		}
+		if matched && (best == nil || len(product.Keywords) > len(best.Keywords)) {
+			best = product
+		}
+	}
+	return best
+}
+
+// Returns the product with the given SKU, or nil if it isn't in the catalog
+func GetProduct(sku string) *Product {
+	for i := range catalog {
+		if catalog[i].SKU == sku {
+			return &catalog[i]
+		}
+	}
+	return nil
+}
+
+// Sets the SKU of every item that matches a catalog product
+func MatchItems(receipt *Receipt) {
+	for i := range receipt.Items {
+		receipt.Items[i].SKU = ""
+		product := MatchProduct(receipt.Items[i].ShortDescription)
+		if product != nil {
+			receipt.Items[i].SKU = product.SKU
+		}
+	}
+}
+
+// Returns sponsored bonus points for items matched to catalog products
+func GetProductPoints(receipt Receipt) int64 {
+	var points int64
+	for _, item := range receipt.Items {
+		if item.SKU == "" {
+			continue
+		}
+		product := GetProduct(item.SKU)
+		if product != nil {
+			points += product.BonusPoints
+		}
+	}
+	return points
+}
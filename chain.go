@@ -0,0 +1,326 @@
+package receiptapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Changes to accepted receipts that are chained as links of their own
+const (
+	chainCorrected  = "corrected"
+	chainAnonymized = "anonymized"
+	chainCompacted  = "compacted"
+	chainRehydrated = "rehydrated"
+)
+
+// Receipt's place in the hash chain over accepted production receipts. Each link's hash
+// covers the receipt as accepted and the hash of the link before it, so changing or
+// removing a receipt breaks the chain from there on. Corrections, anonymization,
+// compaction and rehydration are chained as links of their own.
+type ChainLink struct {
+	Sequence     int64  `json:"sequence"`
+	PreviousHash string `json:"previousHash"`
+	Hash         string `json:"hash"`
+
+	// For the link of a change, which change it was and the hash of the receipt's link
+	// it replaced
+	Change   string `json:"change,omitempty"`
+	Replaces string `json:"replaces,omitempty"`
+}
+
+// Parts of a receipt a chain link's hash covers: what was submitted and accepted, not
+// what reviews, recalculation, enrichment and corrections change later
+type chainContent struct {
+	ID           string      `json:"id"`
+	Partner      string      `json:"partner"`
+	ExternalID   string      `json:"externalId"`
+	Tenant       string      `json:"tenant"`
+	Retailer     string      `json:"retailer"`
+	PurchaseDate string      `json:"purchaseDate"`
+	PurchaseTime string      `json:"purchaseTime"`
+	Total        string      `json:"total"`
+	Items        []chainItem `json:"items"`
+	ProcessedAt  *time.Time  `json:"processedAt"`
+}
+
+// Parts of an item a chain link's hash covers
+type chainItem struct {
+	ShortDescription string `json:"shortDescription"`
+	Price            string `json:"price"`
+}
+
+// What the hash of a change's link covers: the change, the link it replaced, the receipt
+// as it is after the change and the records of how it was changed, so neither what was
+// replaced nor the markers saying why can be altered or added later
+type chainChangeContent struct {
+	Change      string            `json:"change"`
+	Replaces    string            `json:"replaces"`
+	Receipt     chainContent      `json:"receipt"`
+	Corrections []chainCorrection `json:"corrections"`
+	Anonymized  *Anonymization    `json:"anonymized"`
+	Compacted   *Compaction       `json:"compacted"`
+}
+
+// Parts of a correction a change link's hash covers; the points it scored are only
+// known after it is chained
+type chainCorrection struct {
+	DisputeID   string          `json:"disputeId"`
+	Corrector   string          `json:"corrector"`
+	Before      CorrectedFields `json:"before"`
+	CorrectedAt time.Time       `json:"correctedAt"`
+}
+
+// Result of checking part of the hash chain
+type ChainVerification struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+
+	// Whether every link in the range was found and matched, and how many were checked
+	Valid   bool `json:"valid"`
+	Checked int  `json:"checked"`
+
+	// Receipts checked that are anonymized or compacted, through the links that chained
+	// those changes
+	Anonymized int `json:"anonymized"`
+	Compacted  int `json:"compacted"`
+
+	// Latest link, for auditors to keep and compare later; removing the newest receipts
+	// can only be noticed against a head kept from before
+	Head *ChainLink `json:"head"`
+
+	Problems []ChainProblem `json:"problems"`
+}
+
+// Link that didn't verify, and why
+type ChainProblem struct {
+	Sequence  int64  `json:"sequence"`
+	ReceiptID string `json:"receiptId,omitempty"`
+	Problem   string `json:"problem"`
+}
+
+// Returns the hash of a receipt's link, given the hash of the link before it
+func chainHash(previousHash string, receipt Receipt) string {
+	encoded, _ := json.Marshal(chainContentOf(receipt))
+	sum := sha256.Sum256(append([]byte(previousHash+"\n"), encoded...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the hash of the link of a change to a receipt, given the hash of the link
+// before it in the chain
+func chainChangeHash(previousHash string, link ChainLink, receipt Receipt) string {
+	content := chainChangeContent{
+		Change:      link.Change,
+		Replaces:    link.Replaces,
+		Receipt:     chainContentOf(receipt),
+		Corrections: []chainCorrection{},
+		Anonymized:  receipt.Anonymized,
+		Compacted:   receipt.Compacted,
+	}
+	for _, correction := range receipt.Corrections {
+		content.Corrections = append(content.Corrections, chainCorrection{
+			DisputeID:   correction.DisputeID,
+			Corrector:   correction.Corrector,
+			Before:      correction.Before,
+			CorrectedAt: correction.CorrectedAt,
+		})
+	}
+	encoded, _ := json.Marshal(content)
+	sum := sha256.Sum256(append([]byte(previousHash+"\n"), encoded...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the parts of a receipt chain links cover
+func chainContentOf(receipt Receipt) chainContent {
+	content := chainContent{
+		ID:           receipt.ID,
+		Partner:      receipt.Partner,
+		ExternalID:   receipt.ExternalID,
+		Tenant:       receipt.Tenant,
+		Retailer:     receipt.Retailer,
+		PurchaseDate: receipt.PurchaseDate,
+		PurchaseTime: receipt.PurchaseTime,
+		Total:        receipt.Total,
+		Items:        []chainItem{},
+		ProcessedAt:  receipt.ProcessedAt,
+	}
+	for _, item := range receipt.Items {
+		content.Items = append(content.Items, chainItem{ShortDescription: item.ShortDescription, Price: item.Price})
+	}
+	return content
+}
+
+// Returns a receipt's latest link: that of the last change chained, or the one it was
+// accepted with
+func latestLink(receipt Receipt) ChainLink {
+	if len(receipt.ChainChanges) > 0 {
+		return receipt.ChainChanges[len(receipt.ChainChanges)-1]
+	}
+	return *receipt.Chain
+}
+
+// Chains a change just made to an accepted receipt as a link after the head, replacing
+// the receipt's latest link, and returns the new head. Receipts outside the chain are
+// left as they are.
+func chainChange(head ChainLink, receipt *Receipt, change string) ChainLink {
+	if receipt.Chain == nil {
+		return head
+	}
+	link := ChainLink{
+		Sequence:     head.Sequence + 1,
+		PreviousHash: head.Hash,
+		Change:       change,
+		Replaces:     latestLink(*receipt).Hash,
+	}
+	link.Hash = chainChangeHash(link.PreviousHash, link, *receipt)
+	receipt.ChainChanges = append(slices.Clone(receipt.ChainChanges), link)
+	return link
+}
+
+// Returns the latest link of the chain over the receipts, whether it was a receipt being
+// accepted or a change
+func chainHeadOf(receipts []Receipt) ChainLink {
+	var head ChainLink
+	for _, receipt := range receipts {
+		if receipt.Chain != nil && latestLink(receipt).Sequence > head.Sequence {
+			head = latestLink(receipt)
+		}
+		for _, link := range receipt.ChainChanges {
+			if link.Sequence > head.Sequence {
+				head = link
+			}
+		}
+	}
+	return head
+}
+
+// Returns what is wrong with one of a receipt's links, -1 for the one it was accepted
+// with and otherwise the change at that index, or an empty string. Only the latest can be
+// checked against what the receipt holds now; each earlier one is vouched for by the
+// change that replaced it.
+func linkProblem(receipt Receipt, index int) string {
+	last := len(receipt.ChainChanges) - 1
+	if index < 0 {
+		switch {
+		case last >= 0:
+			return ""
+		case chainHash(receipt.Chain.PreviousHash, receipt) != receipt.Chain.Hash:
+			return "The receipt doesn't match its hash; it was changed after it was accepted."
+		case receipt.Anonymized != nil || receipt.Compacted != nil || len(receipt.Corrections) > 0:
+			return "The receipt is marked as changed, but no change was chained."
+		}
+		return ""
+	}
+	link := receipt.ChainChanges[index]
+	replaced := *receipt.Chain
+	if index > 0 {
+		replaced = receipt.ChainChanges[index-1]
+	}
+	if link.Replaces != replaced.Hash {
+		return "The change doesn't replace the receipt's link before it."
+	}
+	if index == last && chainChangeHash(link.PreviousHash, link, receipt) != link.Hash {
+		return "The receipt doesn't match the hash of its last change; it was changed after that."
+	}
+	return ""
+}
+
+// Checks the links from one sequence number to another against the stored receipts. The
+// range is kept from the first link to the head, since there are no links past it.
+func (s *Server) VerifyChain(from int64, to int64) ChainVerification {
+	head, hasHead := s.Store.ChainHead()
+	from, to = max(from, 1), min(to, head.Sequence)
+
+	// Receipts keyed by the sequence of each of their links, with the link's index as
+	// linkProblem takes it
+	type chained struct {
+		receipt Receipt
+		index   int
+	}
+	links := map[int64][]chained{}
+	for _, receipt := range s.Store.All() {
+		if receipt.Chain == nil {
+			continue
+		}
+		links[receipt.Chain.Sequence] = append(links[receipt.Chain.Sequence], chained{receipt, -1})
+		for i, link := range receipt.ChainChanges {
+			links[link.Sequence] = append(links[link.Sequence], chained{receipt, i})
+		}
+	}
+	linkOf := func(entry chained) ChainLink {
+		if entry.index < 0 {
+			return *entry.receipt.Chain
+		}
+		return entry.receipt.ChainChanges[entry.index]
+	}
+
+	verification := ChainVerification{From: from, To: to, Problems: []ChainProblem{}}
+	if hasHead {
+		verification.Head = &head
+	}
+	for sequence := from; sequence <= to; sequence++ {
+		found := links[sequence]
+		if len(found) == 0 {
+			verification.Problems = append(verification.Problems, ChainProblem{sequence, "", "No receipt has this link; it may have been deleted."})
+			continue
+		}
+		if len(found) > 1 {
+			verification.Problems = append(verification.Problems, ChainProblem{sequence, found[1].receipt.ID, "More than one receipt has this link."})
+		}
+		receipt, link := found[0].receipt, linkOf(found[0])
+		verification.Checked += 1
+
+		// Receipts are counted once, at the link they were accepted with
+		if found[0].index < 0 && receipt.Anonymized != nil {
+			verification.Anonymized += 1
+		}
+		if found[0].index < 0 && receipt.Compacted != nil {
+			verification.Compacted += 1
+		}
+		problem := linkProblem(receipt, found[0].index)
+		if problem != "" {
+			verification.Problems = append(verification.Problems, ChainProblem{sequence, receipt.ID, problem})
+		}
+
+		// The first link follows nothing; others must follow the link before, when it
+		// is still there to compare
+		previous := links[sequence-1]
+		switch {
+		case sequence == 1 && link.PreviousHash != "":
+			verification.Problems = append(verification.Problems, ChainProblem{sequence, receipt.ID, "The first link has a previous hash."})
+		case len(previous) > 0 && linkOf(previous[0]).Hash != link.PreviousHash:
+			verification.Problems = append(verification.Problems, ChainProblem{sequence, receipt.ID, "The previous hash doesn't match receipt " + previous[0].receipt.ID + "."})
+		}
+	}
+	verification.Valid = len(verification.Problems) == 0
+	return verification
+}
+
+// Method to verify the hash chain over accepted receipts, from link ?from= (the first by
+// default) to ?to= (the latest by default)
+func (s *Server) GetChainVerification(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	head, _ := s.Store.ChainHead()
+	from, to := int64(1), head.Sequence
+	for name, value := range map[string]*int64{"from": &from, "to": &to} {
+		if query.Get(name) == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(query.Get(name), 10, 64)
+		if err != nil || parsed < 1 {
+			WriteError(w, http.StatusBadRequest, codeInvalidQuery, "The "+name+" parameter must be a positive whole number.")
+			return
+		}
+		*value = parsed
+	}
+	if to < from && query.Get("to") != "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidQuery, "The to parameter must not be before from.")
+		return
+	}
+	json.NewEncoder(w).Encode(s.VerifyChain(from, to))
+}
@@ -0,0 +1,294 @@
+package receiptapi
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a server with three chained receipts, and a sandbox receipt left out of the chain
+func newChainedServer(t *testing.T) *Server {
+	t.Helper()
+	s := New()
+	for _, id := range []string{"first", "second", "third"} {
+		receipt := targetReceipt
+		receipt.ID = id
+		s.Store.Add(receipt)
+	}
+	s.Store.Add(Receipt{ID: "sandbox", Retailer: "Test", Sandbox: true})
+	return s
+}
+
+// Anonymizes a stored receipt, chaining the change
+func anonymizeChained(s *Server, id string) {
+	s.Store.ModifyChained(id, chainAnonymized, func(receipt *Receipt) bool {
+		Anonymize(receipt, StandardRules{}, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+		return true
+	})
+}
+
+// Corrects a stored receipt's total, chaining the change
+func correctChained(s *Server, id string, total string) {
+	s.Store.ModifyChained(id, chainCorrected, func(receipt *Receipt) bool {
+		before := CorrectedFields{receipt.Retailer, receipt.PurchaseDate, receipt.PurchaseTime, receipt.Total, receipt.Items}
+		receipt.Total = total
+		receipt.Corrections = append(receipt.Corrections, Correction{DisputeID: "dispute", Corrector: "ana", Before: before})
+		return true
+	})
+}
+
+func TestChainLinks(t *testing.T) {
+	s := newChainedServer(t)
+	previous := ""
+	for i, id := range []string{"first", "second", "third"} {
+		receipt, _ := s.Store.Find(id)
+		link := receipt.Chain
+		if link == nil || link.Sequence != int64(i+1) || link.PreviousHash != previous || link.Hash != chainHash(previous, receipt) {
+			t.Fatalf("receipt %s has link %+v, want sequence %d following %q", id, link, i+1, previous)
+		}
+		previous = link.Hash
+	}
+	sandbox, _ := s.Store.Find("sandbox")
+	if sandbox.Chain != nil {
+		t.Errorf("sandbox receipt has link %+v, want none", sandbox.Chain)
+	}
+	head, ok := s.Store.ChainHead()
+	if !ok || head.Sequence != 3 || head.Hash != previous {
+		t.Errorf("ChainHead() = %+v, %v; want the third link", head, ok)
+	}
+}
+
+func TestChainHashCoversAcceptedFields(t *testing.T) {
+	receipt := targetReceipt
+	hash := chainHash("", receipt)
+	changes := map[string]func(receipt *Receipt){
+		"retailer": func(receipt *Receipt) { receipt.Retailer = "Walmart" },
+		"total":    func(receipt *Receipt) { receipt.Total = "35.36" },
+		"item":     func(receipt *Receipt) { receipt.Items = receipt.Items[1:] },
+		"partner":  func(receipt *Receipt) { receipt.Partner = "acme" },
+	}
+	for name, change := range changes {
+		changed := receipt
+		changed.Items = append([]Item{}, receipt.Items...)
+		change(&changed)
+		if chainHash("", changed) == hash {
+			t.Errorf("changing the %s left the hash unchanged", name)
+		}
+	}
+	if chainHash("previous", receipt) == hash {
+		t.Error("changing the previous hash left the hash unchanged")
+	}
+
+	// Points are given after acceptance and may be recalculated, so aren't covered
+	scored := receipt
+	scored.Points = 28
+	if chainHash("", scored) != hash {
+		t.Error("changing the points changed the hash")
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	tests := []struct {
+		name         string
+		change       func(s *Server)
+		from, to     int64
+		wantFrom     int64
+		wantTo       int64
+		wantChecked  int
+		wantProblems []string
+	}{
+		{name: "intact", from: 1, to: 3, wantFrom: 1, wantTo: 3, wantChecked: 3},
+		{name: "range kept to the head", from: 0, to: math.MaxInt64, wantFrom: 1, wantTo: 3, wantChecked: 3},
+		{name: "part of the chain", from: 2, to: 2, wantFrom: 2, wantTo: 2, wantChecked: 1},
+		{
+			name: "receipt changed",
+			change: func(s *Server) {
+				s.Store.Modify("second", func(receipt *Receipt) bool {
+					receipt.Total = "1.00"
+					return true
+				})
+			},
+			from: 1, to: 3, wantFrom: 1, wantTo: 3, wantChecked: 3,
+			wantProblems: []string{"doesn't match its hash"},
+		},
+		{
+			name:   "receipt deleted",
+			change: func(s *Server) { s.Store.Delete(map[string]bool{"second": true}) },
+			from:   1, to: 3, wantFrom: 1, wantTo: 3, wantChecked: 2,
+			wantProblems: []string{"No receipt has this link"},
+		},
+		{
+			name: "link forged",
+			change: func(s *Server) {
+				s.Store.Modify("third", func(receipt *Receipt) bool {
+					link := ChainLink{Sequence: 3, PreviousHash: "forged"}
+					link.Hash = chainHash(link.PreviousHash, *receipt)
+					receipt.Chain = &link
+					return true
+				})
+			},
+			from: 1, to: 3, wantFrom: 1, wantTo: 3, wantChecked: 3,
+			wantProblems: []string{"previous hash doesn't match"},
+		},
+		{
+			name:   "anonymized receipt",
+			change: func(s *Server) { anonymizeChained(s, "first") },
+			from:   1, to: 4, wantFrom: 1, wantTo: 4, wantChecked: 4,
+		},
+		{
+			name: "corrected, then anonymized",
+			change: func(s *Server) {
+				correctChained(s, "second", "1.00")
+				anonymizeChained(s, "second")
+			},
+			from: 1, to: 5, wantFrom: 1, wantTo: 5, wantChecked: 5,
+		},
+		{
+			name: "anonymized without chaining it",
+			change: func(s *Server) {
+				s.Store.Modify("first", func(receipt *Receipt) bool {
+					Anonymize(receipt, StandardRules{}, time.Now())
+					return true
+				})
+			},
+			from: 1, to: 3, wantFrom: 1, wantTo: 3, wantChecked: 3,
+			wantProblems: []string{"doesn't match its hash"},
+		},
+		{
+			name: "marked as corrected without chaining it",
+			change: func(s *Server) {
+				s.Store.Modify("first", func(receipt *Receipt) bool {
+					receipt.Corrections = []Correction{{DisputeID: "forged"}}
+					return true
+				})
+			},
+			from: 1, to: 3, wantFrom: 1, wantTo: 3, wantChecked: 3,
+			wantProblems: []string{"no change was chained"},
+		},
+		{
+			name: "anonymization marker removed",
+			change: func(s *Server) {
+				anonymizeChained(s, "first")
+				s.Store.Modify("first", func(receipt *Receipt) bool {
+					receipt.Anonymized = nil
+					return true
+				})
+			},
+			from: 1, to: 4, wantFrom: 1, wantTo: 4, wantChecked: 4,
+			wantProblems: []string{"hash of its last change"},
+		},
+		{
+			name: "replaced content rewritten",
+			change: func(s *Server) {
+				correctChained(s, "third", "1.00")
+				s.Store.Modify("third", func(receipt *Receipt) bool {
+					receipt.Corrections[0].Before.Total = "2.00"
+					return true
+				})
+			},
+			from: 1, to: 4, wantFrom: 1, wantTo: 4, wantChecked: 4,
+			wantProblems: []string{"hash of its last change"},
+		},
+		{
+			name: "change link forged",
+			change: func(s *Server) {
+				anonymizeChained(s, "first")
+				s.Store.Modify("first", func(receipt *Receipt) bool {
+					link := receipt.ChainChanges[0]
+					link.Replaces = "forged"
+					link.Hash = chainChangeHash(link.PreviousHash, link, *receipt)
+					receipt.ChainChanges = []ChainLink{link}
+					return true
+				})
+			},
+			from: 1, to: 4, wantFrom: 1, wantTo: 4, wantChecked: 4,
+			wantProblems: []string{"doesn't replace the receipt's link"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newChainedServer(t)
+			if test.change != nil {
+				test.change(s)
+			}
+			verification := s.VerifyChain(test.from, test.to)
+			if verification.From != test.wantFrom || verification.To != test.wantTo || verification.Checked != test.wantChecked {
+				t.Errorf("VerifyChain(%d, %d) checked %d from %d to %d, want %d from %d to %d", test.from, test.to,
+					verification.Checked, verification.From, verification.To, test.wantChecked, test.wantFrom, test.wantTo)
+			}
+			if verification.Valid != (len(test.wantProblems) == 0) || len(verification.Problems) != len(test.wantProblems) {
+				t.Fatalf("VerifyChain() problems = %+v, want %v", verification.Problems, test.wantProblems)
+			}
+			for i, want := range test.wantProblems {
+				if !strings.Contains(verification.Problems[i].Problem, want) {
+					t.Errorf("VerifyChain() problem = %q, want one saying %q", verification.Problems[i].Problem, want)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyEmptyChain(t *testing.T) {
+	verification := New().VerifyChain(1, math.MaxInt64)
+	if !verification.Valid || verification.Checked != 0 || verification.Head != nil {
+		t.Errorf("VerifyChain() on an empty store = %+v, want it valid with nothing checked", verification)
+	}
+}
+
+func TestChainChanges(t *testing.T) {
+	s := newChainedServer(t)
+	accepted, _ := s.Store.Find("second")
+	correctChained(s, "second", "1.00")
+	anonymizeChained(s, "second")
+	anonymizeChained(s, "sandbox")
+
+	receipt, _ := s.Store.Find("second")
+	if len(receipt.ChainChanges) != 2 || *receipt.Chain != *accepted.Chain {
+		t.Fatalf("changed receipt has links %+v and %+v, want its accepted link and two changes", receipt.Chain, receipt.ChainChanges)
+	}
+	corrected, anonymized := receipt.ChainChanges[0], receipt.ChainChanges[1]
+	if corrected.Sequence != 4 || corrected.Change != chainCorrected || corrected.Replaces != accepted.Chain.Hash {
+		t.Errorf("correction link = %+v, want sequence 4 replacing the accepted link", corrected)
+	}
+	if anonymized.Sequence != 5 || anonymized.Change != chainAnonymized || anonymized.Replaces != corrected.Hash || anonymized.PreviousHash != corrected.Hash {
+		t.Errorf("anonymization link = %+v, want sequence 5 replacing and following the correction", anonymized)
+	}
+	head, _ := s.Store.ChainHead()
+	if head != anonymized {
+		t.Errorf("ChainHead() = %+v, want the anonymization link", head)
+	}
+
+	sandbox, _ := s.Store.Find("sandbox")
+	if sandbox.Chain != nil || len(sandbox.ChainChanges) != 0 {
+		t.Errorf("sandbox receipt has links %+v and %+v, want none", sandbox.Chain, sandbox.ChainChanges)
+	}
+}
+
+func TestChainCompaction(t *testing.T) {
+	withConfig(t, func(config *Config) { config.DetailRetentionDays = 30 })
+	s := New()
+	s.Blobs = &DiskBlobStore{Dir: t.TempDir()}
+	receipt := targetReceipt
+	receipt.ID, receipt.Status = "old", statusProcessed
+	s.Store.Add(receipt)
+
+	err := s.CompactReceipt("old")
+	if err != nil {
+		t.Fatalf("CompactReceipt() error = %v", err)
+	}
+	verification := s.VerifyChain(1, math.MaxInt64)
+	if !verification.Valid || verification.Checked != 2 || verification.Compacted != 1 {
+		t.Fatalf("VerifyChain() after compaction = %+v, want both links valid", verification)
+	}
+
+	rehydrated, rejection := s.RehydrateReceipt(context.Background(), "old")
+	if rejection != nil || rehydrated.Compacted != nil || len(rehydrated.ChainChanges) != 2 {
+		t.Fatalf("RehydrateReceipt() = %+v, %v; want it whole with both changes chained", rehydrated, rejection)
+	}
+	verification = s.VerifyChain(1, math.MaxInt64)
+	if !verification.Valid || verification.Checked != 3 || verification.Compacted != 0 {
+		t.Errorf("VerifyChain() after rehydration = %+v, want all three links valid", verification)
+	}
+}
@@ -0,0 +1,125 @@
+package receiptapi
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// One thing the check command verifies, and how
+type selfCheck struct {
+	Name  string
+	Check func() error
+}
+
+// Checks that the server could start and do its work with the current configuration,
+// without serving anything: the settings, the files it loads, the data file and the
+// blob store. Prints the outcome of every check and fails if any of them did.
+func RunCheck(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	checks := []selfCheck{
+		{"secrets", SetupSecrets},
+		{"configuration", func() error { return ValidateConfig(config) }},
+		{"logging", func() error { return SetupLogging(config) }},
+		{"response signing key", func() error { return SetupResponseSigning(config.ResponseSigningKey) }},
+		{"merchant registry", func() error { return LoadMerchantRegistry(config.MerchantsFile) }},
+		{"product catalog", func() error { return LoadCatalog(config.CatalogFile) }},
+		{"OCR corrections", func() error { return LoadOCRCorrections(config.OCRCorrectionsFile) }},
+		{"partners", func() error { return LoadPartners(config.PartnersFile) }},
+		{"data file", func() error { return checkWritableFile(config.DataFile, true) }},
+		{"webhook log", func() error { return checkWritableFile(config.WebhookLogFile, false) }},
+		{"blob store", checkBlobStore},
+		{"warehouse state file", func() error { return checkWritableFile(config.WarehouseStateFile, false) }},
+		{"warehouse credentials", func() error { _, err := NewWarehouse(config); return err }},
+	}
+	failed := 0
+	for _, check := range checks {
+		err = check.Check()
+		if err != nil {
+			failed += 1
+			fmt.Printf("FAIL  %s: %v\n", check.Name, err)
+			continue
+		}
+		fmt.Printf("ok    %s\n", check.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// Checks that a file can be appended to and that files can be created next to it, for
+// locks and rewrites, without changing it. With receipts set it must also hold valid
+// receipts. A missing file is fine if its directory is writable, since it is created
+// on first use.
+func checkWritableFile(path string, receipts bool) error {
+	if path == "" {
+		return nil
+	}
+	if receipts {
+		_, err := LoadReceipts(path)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", path, err)
+		}
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err == nil {
+		file.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s is not writable: %w", path, err)
+	}
+
+	probe, err := os.CreateTemp(filepath.Dir(path), ".check-*")
+	if err != nil {
+		return fmt.Errorf("can't create files next to %s: %w", path, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Stores, reads back and deletes a small blob, if a blob store is configured, so missing
+// permissions show up before an export or backup needs them
+func checkBlobStore() error {
+	blobs, err := NewBlobStore(config, SystemClock{})
+	if err != nil || blobs == nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	key := "checks/" + GenerateID() + ".txt"
+	content := "receipt-api check " + time.Now().UTC().Format(time.RFC3339)
+	err = blobs.Put(ctx, key, strings.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("could not store a blob: %w", err)
+	}
+	reader, err := blobs.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("could not read back a stored blob: %w", err)
+	}
+	read, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("could not read back a stored blob: %w", err)
+	}
+	if string(read) != content {
+		return errors.New("a stored blob read back differently")
+	}
+	err = blobs.Delete(ctx, key)
+	if err != nil {
+		return fmt.Errorf("could not delete a stored blob: %w", err)
+	}
+	_, err = blobs.SignedURL(key, time.Hour)
+	return err
+}
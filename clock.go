@@ -0,0 +1,60 @@
+package receiptapi
+
+import "time"
+
+// Layout of purchase dates on receipts
+const dateLayout = "2006-01-02"
+
+// Source of the current time, and of the time zone receipt dates are read in, so tests
+// and replays can control both
+type Clock interface {
+	Now() time.Time
+	Location() *time.Location
+}
+
+// Clock that reads the system time in the local time zone
+type SystemClock struct{}
+
+// Returns the current system time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Returns the local time zone
+func (SystemClock) Location() *time.Location {
+	return time.Local
+}
+
+// Returns the clock, or the system clock if it is nil
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock{}
+	}
+	return clock
+}
+
+// Clock stopped at a given time, reading dates in that time's zone
+type FixedClock struct {
+	Time time.Time
+}
+
+// Returns the time the clock is stopped at
+func (c FixedClock) Now() time.Time {
+	return c.Time
+}
+
+// Returns the time zone of the time the clock is stopped at
+func (c FixedClock) Location() *time.Location {
+	return c.Time.Location()
+}
+
+// Returns midnight at the start of the clock's current day
+func Today(clock Clock) time.Time {
+	now := clock.Now().In(clock.Location())
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, clock.Location())
+}
+
+// Parses a purchase date such as "2022-01-01" as midnight in the clock's time zone
+func ParseDate(clock Clock, date string) (time.Time, error) {
+	return time.ParseInLocation(dateLayout, date, clock.Location())
+}
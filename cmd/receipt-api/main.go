@@ -0,0 +1,12 @@
+// Command receipt-api serves the receipt processor API and runs its admin commands
+package main
+
+import (
+	"os"
+
+	receiptapi "github.com/heathercerise/receipt-api"
+)
+
+func main() {
+	os.Exit(receiptapi.Main(os.Args[1:]))
+}
@@ -0,0 +1,596 @@
+package receiptapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// Subcommand of the binary
+type Command struct {
+	Usage   string
+	Summary string
+	Run     func(args []string) error
+}
+
+// Subcommands by name; the server runs when none is given
+var commands = map[string]Command{
+	"serve": {
+		Usage:   "serve [-addr :8000]",
+		Summary: "Run the API server",
+		Run:     RunServe,
+	},
+	"anonymize": {
+		Usage:   "anonymize -older-than-days N [-dry-run]",
+		Summary: "Scrub retailers and item descriptions from receipts purchased more than N days ago",
+		Run:     RunAnonymize,
+	},
+	"compact": {
+		Usage:   "compact [-older-than-days N] [-dry-run]",
+		Summary: "Move the full payloads of receipts purchased more than N days ago to the blob store, keeping summaries",
+		Run:     RunCompact,
+	},
+	"check": {
+		Usage:   "check",
+		Summary: "Check the configuration, data file and blob store without serving, failing on problems",
+		Run:     RunCheck,
+	},
+	"consume": {
+		Usage:   "consume",
+		Summary: "Process receipt submissions from the SQS queue instead of serving HTTP",
+		Run:     RunConsume,
+	},
+	"migrate": {
+		Usage:   "migrate",
+		Summary: "Bring stored receipts up to the current format and compact the data file",
+		Run:     RunMigrate,
+	},
+	"recalculate": {
+		Usage:   "recalculate",
+		Summary: "Re-enrich and rescore every stored receipt with the current rules",
+		Run:     RunRecalculate,
+	},
+	"digest": {
+		Usage:   "digest [-dry-run]",
+		Summary: "Build the digest of the past week, storing and emailing it as the server does weekly",
+		Run:     RunDigest,
+	},
+	"warehouse-backfill": {
+		Usage:   "warehouse-backfill [-since YYYY-MM-DD]",
+		Summary: "Copy every stored receipt, or those changed since a date, to the data warehouse",
+		Run:     RunWarehouseBackfill,
+	},
+	"export": {
+		Usage:   "export [-blob KEY]",
+		Summary: "Write every stored receipt as CSV to standard output or the blob store",
+		Run:     RunExport,
+	},
+	"backup": {
+		Usage:   "backup",
+		Summary: "Copy the stored receipts to the blob store",
+		Run:     RunBackup,
+	},
+	"replay": {
+		Usage:   "replay [-partner NAME] [-original-time] [-merge-items] [-dry-run] FILE",
+		Summary: "Validate, score and store the receipts in an NDJSON or CSV archive",
+		Run:     RunReplay,
+	},
+	"loadtest": {
+		Usage:   "loadtest [-url URL] [-rate N] [-duration D] [-invalid-percent N] [-from FILE]",
+		Summary: "Send receipts to a running server at a steady rate and report latency and errors",
+		Run:     RunLoadTest,
+	},
+	"conformance": {
+		Usage:   "conformance [-url URL] [-api-key KEY] [-unicode-names] [-out FILE]",
+		Summary: "Run black-box API tests against a deployment and write a JSON report",
+		Run:     RunConformance,
+	},
+	"purge": {
+		Usage:   "purge -older-than-days N [-dry-run]",
+		Summary: "Delete receipts purchased more than N days ago",
+		Run:     RunPurge,
+	},
+}
+
+// Prints the available commands
+func PrintUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	fmt.Println("Commands:")
+	for _, name := range names {
+		fmt.Printf("  %-40s %s\n", commands[name].Usage, commands[name].Summary)
+	}
+}
+
+// Runs the API server until it is interrupted, then lets requests in flight finish
+func RunServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", ":8000", "address to listen on")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	err = Setup()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	s, closeServer, err := openServer(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeServer()
+
+	if config.DigestWeekday != "" {
+		go s.RunDigests(ctx)
+	}
+	warehouse, err := NewWarehouse(config)
+	if err != nil {
+		return err
+	}
+	if warehouse != nil {
+		go s.RunWarehouseSync(ctx, warehouse)
+	}
+
+	server := &http.Server{Addr: *addr, Handler: s.Handler()}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	logHTTP.Info("Listening", "addr", *addr)
+	err = server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	// Wait for requests in flight, so none is still writing to the data file when it closes
+	<-stopped
+	return nil
+}
+
+// Sets up a server that owns the data file, with its blob store, webhook log and event
+// publisher, and keeps secrets fresh and retries saving changes until the context ends.
+// The returned function closes everything that was opened.
+func openServer(ctx context.Context) (*Server, func(), error) {
+	var closers []func()
+	closeAll := func() {
+		for _, closer := range slices.Backward(closers) {
+			closer()
+		}
+	}
+
+	var err error
+	s := New()
+	s.Blobs, err = NewBlobStore(config, s.Clock)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.DataFile != "" {
+		err = LockDataFile(config.DataFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, func() { UnlockDataFile(config.DataFile) })
+		err = s.Store.Open(config.DataFile)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("could not open data file: %w", err)
+		}
+		closers = append(closers, func() { s.Store.Close() })
+		go s.Store.RetryUnsaved(ctx, time.Duration(config.ReadOnlyRetryAfterSeconds)*time.Second)
+		go s.Store.MonitorHealth(ctx, time.Duration(config.StorageHealthIntervalSeconds)*time.Second)
+	}
+	if config.FallbackStore != "" {
+		fallback, err := NewReceiptBackend("FALLBACK_STORE", config.FallbackStore)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		s.Store.SetFallback(fallback)
+		if file, ok := fallback.(*FileBackend); ok {
+			closers = append(closers, file.Close)
+		}
+		recovered, err := s.Store.RecoverFromFallback(ctx)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("could not read the fallback store: %w", err)
+		}
+		if recovered > 0 {
+			logStorage.Warn("Recovered receipts saved to the fallback while failed over", "count", recovered)
+		}
+	}
+	if config.MigrationTarget != "" {
+		target, err := NewReceiptBackend("MIGRATION_TARGET", config.MigrationTarget)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		s.StartMigration(ctx, target)
+		if file, ok := target.(*FileBackend); ok {
+			closers = append(closers, file.Close)
+		}
+	}
+	SetReadOnly(config.ReadOnly, "READ_ONLY is set", s.Clock.Now())
+	err = OpenWebhookLog(config.WebhookLogFile)
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("could not open webhook log: %w", err)
+	}
+	err = OpenRedemptionLog(config.RedemptionsFile)
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("could not open redemptions file: %w", err)
+	}
+	err = OpenTransferLog(config.TransfersFile)
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("could not open transfers file: %w", err)
+	}
+	err = OpenLoyaltyLog(config.LoyaltyFile)
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("could not open loyalty file: %w", err)
+	}
+	err = OpenDisputeLog(config.DisputesFile)
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("could not open disputes file: %w", err)
+	}
+	err = OpenProgramLog(config.ProgramFile)
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("could not open program file: %w", err)
+	}
+	err = OpenSubscriptionLog(config.SubscriptionsFile)
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("could not open subscriptions file: %w", err)
+	}
+	err = OpenAuditLog(config.AuditLogFile)
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+	err = OpenSpool(config.SpoolFile)
+	if err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("could not open spool file: %w", err)
+	}
+	if config.SpoolFile != "" {
+		closers = append(closers, CloseSpool)
+		go s.DrainSpool(ctx, time.Duration(config.ReadOnlyRetryAfterSeconds)*time.Second)
+	}
+	s.Events, err = NewEventPublisher(config)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	if s.Events != nil {
+		closers = append(closers, func() { s.Events.Close() })
+	}
+
+	provider, err := NewSecretsProvider(config)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	go RefreshSecrets(ctx, provider, time.Duration(config.SecretsRefreshSeconds)*time.Second)
+	return s, closeAll, nil
+}
+
+// Fills in fields older versions didn't store: a status, points and a short code of the
+// receipt's own. Rewrites the data file without superseded lines.
+func RunMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	stored, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer UnlockDataFile(config.DataFile)
+
+	codes := map[string]bool{}
+	for _, receipt := range stored {
+		codes[receipt.ShortCode] = true
+	}
+
+	migrated := 0
+	owned := map[string]bool{}
+	for i := range stored {
+		receipt := &stored[i]
+		changed := false
+
+		// Receipts stored before statuses existed were all processed and scored
+		if receipt.Status == "" {
+			receipt.Status = statusProcessed
+			receipt.Points = StandardRules{}.Points(*receipt)
+			receipt.LengthMode = DescriptionLengthMode()
+			receipt.Scoring = SnapshotRules(*receipt, time.Now().UTC())
+			changed = true
+		}
+
+		// The first receipt with a short code keeps it
+		if receipt.ShortCode == "" || owned[receipt.ShortCode] {
+			receipt.ShortCode = GenerateShortCode()
+			for codes[receipt.ShortCode] {
+				receipt.ShortCode = GenerateShortCode()
+			}
+			codes[receipt.ShortCode] = true
+			changed = true
+		}
+		owned[receipt.ShortCode] = true
+
+		if changed {
+			receipt.UpdatedAt = updatedNow()
+			migrated += 1
+		}
+	}
+
+	err = SaveReceipts(config.DataFile, stored)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Migrated", migrated, "of", len(stored), "receipts")
+	return nil
+}
+
+// Re-enriches and rescores every stored receipt, as the recalculate job does
+func RunRecalculate(args []string) error {
+	flags := flag.NewFlagSet("recalculate", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	err = Setup()
+	if err != nil {
+		return err
+	}
+	stored, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer UnlockDataFile(config.DataFile)
+
+	// Points users have spent are kept awarded, so their redemptions and transfers are needed
+	err = OpenRedemptionLog(config.RedemptionsFile)
+	if err != nil {
+		return fmt.Errorf("could not open redemptions file: %w", err)
+	}
+	err = OpenTransferLog(config.TransfersFile)
+	if err != nil {
+		return fmt.Errorf("could not open transfers file: %w", err)
+	}
+
+	s := New()
+	s.Store.Replace(stored)
+	for _, receipt := range stored {
+		err = s.RecalculateReceipt(receipt.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = SaveReceipts(config.DataFile, s.Store.All())
+	if err != nil {
+		return err
+	}
+	fmt.Println("Recalculated", len(stored), "receipts")
+	return nil
+}
+
+// Writes the stored receipts as CSV, in the same format as the export endpoint, to
+// standard output or under a key in the blob store. Only reads the data file, so it can
+// run alongside the server.
+func RunExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	key := flags.String("blob", "", "store the CSV in the blob store under this key")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if config.DataFile == "" {
+		return errors.New("DATA_FILE must be set")
+	}
+	stored, err := LoadReceipts(config.DataFile)
+	if err != nil {
+		return fmt.Errorf("could not read data file: %w", err)
+	}
+	if *key == "" {
+		return WriteReceiptsCSV(os.Stdout, stored, nil)
+	}
+
+	var csv bytes.Buffer
+	err = WriteReceiptsCSV(&csv, stored, nil)
+	if err != nil {
+		return err
+	}
+	return putBlob(*key, &csv)
+}
+
+// Copies the stored receipts, without superseded lines, to a timestamped key in the blob
+// store. Only reads the data file, so it can run alongside the server.
+func RunBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if config.DataFile == "" {
+		return errors.New("DATA_FILE must be set")
+	}
+	stored, err := LoadReceipts(config.DataFile)
+	if err != nil {
+		return fmt.Errorf("could not read data file: %w", err)
+	}
+
+	var backup bytes.Buffer
+	encoder := json.NewEncoder(&backup)
+	for _, receipt := range stored {
+		err = encoder.Encode(receipt)
+		if err != nil {
+			return err
+		}
+	}
+	key := "backups/receipts-" + time.Now().UTC().Format("20060102T150405Z") + ".ndjson"
+	return putBlob(key, &backup)
+}
+
+// Stores data in the configured blob store and prints a link to it that lasts a day
+func putBlob(key string, data io.Reader) error {
+	err := SetupSecrets()
+	if err != nil {
+		return err
+	}
+	err = ValidateConfig(config)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	blobs, err := NewBlobStore(config, SystemClock{})
+	if err != nil {
+		return err
+	}
+	if blobs == nil {
+		return errors.New("BLOB_STORE must be set")
+	}
+	err = blobs.Put(context.Background(), key, data)
+	if err != nil {
+		return fmt.Errorf("could not store %s: %w", key, err)
+	}
+	fmt.Println("Stored", key)
+
+	link, err := blobs.SignedURL(key, 24*time.Hour)
+	if err == nil {
+		fmt.Println(link)
+	}
+	return nil
+}
+
+// Deletes receipts purchased more than the given number of days ago
+func RunPurge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	days := flags.Int("older-than-days", 0, "delete receipts purchased more than this many days ago")
+	dryRun := flags.Bool("dry-run", false, "report what would be deleted without deleting it")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return errors.New("-older-than-days must be a positive number of days")
+	}
+	stored, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer UnlockDataFile(config.DataFile)
+
+	clock := SystemClock{}
+	cutoff := Today(clock).AddDate(0, 0, -*days)
+	kept := []Receipt{}
+	for _, receipt := range stored {
+		purchaseDate, err := ParseDate(clock, receipt.PurchaseDate)
+		if err == nil && purchaseDate.Before(cutoff) {
+			continue
+		}
+		kept = append(kept, receipt)
+	}
+
+	purged := len(stored) - len(kept)
+	if *dryRun {
+		fmt.Println("Would purge", purged, "of", len(stored), "receipts")
+		return nil
+	}
+	err = SaveReceipts(config.DataFile, kept)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Purged", purged, "of", len(stored), "receipts")
+	return nil
+}
+
+// Scrubs the retailer and item descriptions from receipts purchased more than the given
+// number of days ago, keeping their totals, prices and points
+func RunAnonymize(args []string) error {
+	flags := flag.NewFlagSet("anonymize", flag.ContinueOnError)
+	days := flags.Int("older-than-days", 0, "anonymize receipts purchased more than this many days ago")
+	dryRun := flags.Bool("dry-run", false, "report what would be anonymized without changing it")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return errors.New("-older-than-days must be a positive number of days")
+	}
+	stored, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer UnlockDataFile(config.DataFile)
+
+	clock := SystemClock{}
+	cutoff := Today(clock).AddDate(0, 0, -*days)
+	head := chainHeadOf(stored)
+	anonymized := 0
+	for i := range stored {
+		purchaseDate, err := ParseDate(clock, stored[i].PurchaseDate)
+		if err != nil || !purchaseDate.Before(cutoff) || stored[i].Anonymized != nil {
+			continue
+		}
+		Anonymize(&stored[i], StandardRules{}, clock.Now().UTC())
+		stored[i].UpdatedAt = updatedNow()
+		head = chainChange(head, &stored[i], chainAnonymized)
+		anonymized += 1
+	}
+
+	if *dryRun {
+		fmt.Println("Would anonymize", anonymized, "of", len(stored), "receipts")
+		return nil
+	}
+	err = SaveReceipts(config.DataFile, stored)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Anonymized", anonymized, "of", len(stored), "receipts")
+	return nil
+}
+
+// Locks the data file for a command that changes it and returns the receipts stored in
+// it; the caller must unlock it when done
+func openForCommand() ([]Receipt, error) {
+	if config.DataFile == "" {
+		return nil, errors.New("DATA_FILE must be set")
+	}
+	err := LockDataFile(config.DataFile)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := LoadReceipts(config.DataFile)
+	if err != nil {
+		UnlockDataFile(config.DataFile)
+		return nil, fmt.Errorf("could not read data file: %w", err)
+	}
+	return stored, nil
+}
@@ -0,0 +1,248 @@
+package receiptapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// When a receipt was compacted, where its full payload was moved to, and the points it
+// had earned from each rule by then, since the rules can no longer be worked out from
+// what's left
+type Compaction struct {
+	At           time.Time    `json:"at"`
+	BlobKey      string       `json:"blobKey"`
+	PointsByRule []RulePoints `json:"pointsByRule"`
+}
+
+// Returns the blob key a receipt's full payload is kept under once it is compacted
+func coldReceiptKey(id string) string {
+	return "cold/receipts/" + id + ".json"
+}
+
+// Returns whether a receipt is due to be compacted: it was purchased before the cutoff,
+// its review is settled, and it isn't compacted already
+func dueForCompaction(clock Clock, receipt Receipt, cutoff time.Time) bool {
+	if receipt.Compacted != nil || (receipt.Status != statusProcessed && receipt.Status != statusRejected) {
+		return false
+	}
+	purchaseDate, err := ParseDate(clock, receipt.PurchaseDate)
+	return err == nil && purchaseDate.Before(cutoff)
+}
+
+// Returns the day before which receipts are due to be compacted, given how many days
+// they keep their full detail
+func compactionCutoff(clock Clock, days int) time.Time {
+	return Today(clock).AddDate(0, 0, -days)
+}
+
+// Returns whether two optional times are both unset or the same
+func sameTime(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// Stores a receipt's full payload in the blob store, where it can be rehydrated from
+func storeColdReceipt(ctx context.Context, blobs BlobStore, receipt Receipt) error {
+	payload, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	return blobs.Put(ctx, coldReceiptKey(receipt.ID), bytes.NewReader(payload))
+}
+
+// Reduces a receipt whose full payload is stored to its summary: who and what it is for,
+// the retailer, purchase date, total and points. Items, warnings, scoring and the other
+// details are only kept in the blob store.
+func Compact(receipt *Receipt, rules Rules, now time.Time) {
+	compacted := Receipt{
+		ID:           receipt.ID,
+		Retailer:     receipt.Retailer,
+		PurchaseDate: receipt.PurchaseDate,
+		PurchaseTime: receipt.PurchaseTime,
+		Items:        []Item{},
+		Total:        receipt.Total,
+		Status:       receipt.Status,
+		ShortCode:    receipt.ShortCode,
+		Tenant:       receipt.Tenant,
+		Sandbox:      receipt.Sandbox,
+		Partner:      receipt.Partner,
+		ExternalID:   receipt.ExternalID,
+		UserID:       receipt.UserID,
+		MCC:          receipt.MCC,
+		Points:       receipt.Points,
+		ProcessedAt:  receipt.ProcessedAt,
+		Anonymized:   receipt.Anonymized,
+		UpdatedAt:    receipt.UpdatedAt,
+		Chain:        receipt.Chain,
+		ChainChanges: receipt.ChainChanges,
+		Compacted: &Compaction{
+			At:           now,
+			BlobKey:      coldReceiptKey(receipt.ID),
+			PointsByRule: PointsByRule(*receipt, rules),
+		},
+	}
+	*receipt = compacted
+}
+
+// Moves a receipt's full payload to the blob store and compacts it, if it was purchased
+// more than DETAIL_RETENTION_DAYS ago, as the compact job does
+func (s *Server) CompactReceipt(id string) error {
+	days := CurrentProgram().Retention.DetailRetentionDays
+	if days <= 0 || s.Blobs == nil {
+		return errors.New("compaction needs DETAIL_RETENTION_DAYS and BLOB_STORE to be set")
+	}
+	receipt, found := s.Store.Find(id)
+	if !found {
+		return fmt.Errorf("receipt %s no longer exists", id)
+	}
+	if !dueForCompaction(s.Clock, receipt, compactionCutoff(s.Clock, days)) {
+		return nil
+	}
+
+	// Stored outside the lock; if the receipt changes meanwhile, it is left for the next run
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := storeColdReceipt(ctx, s.Blobs, receipt)
+	if err != nil {
+		return fmt.Errorf("could not store receipt %s: %w", id, err)
+	}
+	s.Store.ModifyChained(id, chainCompacted, func(stored *Receipt) bool {
+		if stored.Compacted != nil || !sameTime(stored.UpdatedAt, receipt.UpdatedAt) {
+			return false
+		}
+		Compact(stored, s.Rules, s.Clock.Now().UTC())
+		return true
+	})
+	return nil
+}
+
+// Restores a compacted receipt's full payload from the blob store. The receipt stays
+// whole until it is compacted again.
+func (s *Server) RehydrateReceipt(ctx context.Context, id string) (Receipt, *Rejection) {
+	receipt, found := s.Store.Find(id)
+	if !found {
+		return Receipt{}, &Rejection{http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage}
+	}
+	if receipt.Compacted == nil {
+		return receipt, nil
+	}
+	if s.Blobs == nil {
+		return Receipt{}, &Rejection{http.StatusServiceUnavailable, codeInternal, "No blob store is configured to rehydrate the receipt from."}
+	}
+
+	blob, err := s.Blobs.Get(ctx, receipt.Compacted.BlobKey)
+	if err != nil {
+		logApp.Error("Could not read compacted receipt", "receiptId", id, "error", err)
+		return Receipt{}, &Rejection{http.StatusInternalServerError, codeInternal, "The receipt's full payload could not be read."}
+	}
+	defer blob.Close()
+	var full Receipt
+	err = json.NewDecoder(blob).Decode(&full)
+	if err != nil || full.ID != receipt.ID {
+		logApp.Error("Compacted receipt payload is unreadable", "receiptId", id, "error", err)
+		return Receipt{}, &Rejection{http.StatusInternalServerError, codeInternal, "The receipt's full payload could not be read."}
+	}
+
+	// The payload was stored before the compaction was chained, so the links since are kept
+	rehydrated, _ := s.Store.ModifyChained(id, chainRehydrated, func(stored *Receipt) bool {
+		if stored.Compacted == nil {
+			return false
+		}
+		changes := stored.ChainChanges
+		*stored = full
+		stored.ChainChanges = changes
+		return true
+	})
+	return rehydrated, nil
+}
+
+// Method to restore a compacted receipt's full payload from cold storage; responds with
+// the receipt as restored
+func (s *Server) RehydrateReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+	rejection := CheckAnyIDPrefix(id)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	receipt, rejection := s.RehydrateReceipt(r.Context(), s.Store.ResolveShortCode(id))
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// Moves the full payloads of receipts purchased more than the given number of days ago to
+// the blob store, keeping a summary of each
+func RunCompact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	days := flags.Int("older-than-days", CurrentProgram().Retention.DetailRetentionDays, "compact receipts purchased more than this many days ago")
+	dryRun := flags.Bool("dry-run", false, "report what would be compacted without changing it")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return errors.New("-older-than-days or DETAIL_RETENTION_DAYS must be a positive number of days")
+	}
+	err = Setup()
+	if err != nil {
+		return err
+	}
+	blobs, err := NewBlobStore(config, SystemClock{})
+	if err != nil {
+		return err
+	}
+	if blobs == nil {
+		return errors.New("BLOB_STORE must be set")
+	}
+	stored, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer UnlockDataFile(config.DataFile)
+
+	clock := SystemClock{}
+	cutoff := compactionCutoff(clock, *days)
+	head := chainHeadOf(stored)
+	compacted := 0
+	for i := range stored {
+		if !dueForCompaction(clock, stored[i], cutoff) {
+			continue
+		}
+		compacted += 1
+		if *dryRun {
+			continue
+		}
+		err = storeColdReceipt(context.Background(), blobs, stored[i])
+		if err != nil {
+			return fmt.Errorf("could not store receipt %s: %w", stored[i].ID, err)
+		}
+		Compact(&stored[i], StandardRules{}, clock.Now().UTC())
+		stored[i].UpdatedAt = updatedNow()
+		head = chainChange(head, &stored[i], chainCompacted)
+	}
+
+	if *dryRun {
+		fmt.Println("Would compact", compacted, "of", len(stored), "receipts")
+		return nil
+	}
+	err = SaveReceipts(config.DataFile, stored)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Compacted", compacted, "of", len(stored), "receipts")
+	return nil
+}
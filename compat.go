@@ -0,0 +1,21 @@
+package receiptapi
+
+// Error strings used by the Fetch receipt processor spec
+const (
+	invalidReceiptMessage  = "The receipt is invalid."
+	receiptNotFoundMessage = "No receipt found for that ID."
+)
+
+// Price and total patterns; the Fetch spec anchors both ends of the string
+const (
+	pricePattern      = "\\d+\\.\\d{2}$"
+	fetchPricePattern = "^\\d+\\.\\d{2}$"
+)
+
+// Returns the pattern prices and totals must match in the current mode
+func GetPricePattern() string {
+	if config.FetchCompat {
+		return fetchPricePattern
+	}
+	return pricePattern
+}
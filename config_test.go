@@ -0,0 +1,32 @@
+package receiptapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMalformedConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		variable string
+		value    string
+		err      string
+	}{
+		{"integer", "SHED_MAX_IN_FLIGHT", "abc", `SHED_MAX_IN_FLIGHT must be a whole number, not "abc"`},
+		{"boolean", "FETCH_COMPAT", "yes please", `FETCH_COMPAT must be true or false, not "yes please"`},
+		{"float", "PRICE_ANOMALY_FACTOR", "10x", `PRICE_ANOMALY_FACTOR must be a number, not "10x"`},
+		{"unset", "SHED_MAX_IN_FLIGHT", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(test.variable, test.value)
+			err := ValidateConfig(LoadConfig())
+			if test.err == "" && err != nil {
+				t.Errorf("ValidateConfig() = %v, want no error", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("ValidateConfig() = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
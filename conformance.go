@@ -0,0 +1,307 @@
+package receiptapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Behaviour of the API checked by the conformance command: a submission and the status
+// it should get, with the points it should earn if accepted, or a lookup of a receipt
+type conformanceCase struct {
+	Name     string
+	Category string
+	Body     string
+	Lookup   string
+	Status   int
+
+	// Points the receipt should earn with the default rules, or -1 not to check them
+	Points int64
+}
+
+// Outcome of a conformance case
+type ConformanceResult struct {
+	Name           string `json:"name"`
+	Category       string `json:"category"`
+	Passed         bool   `json:"passed"`
+	ExpectedStatus int    `json:"expectedStatus"`
+	Status         int    `json:"status,omitempty"`
+	ExpectedPoints *int64 `json:"expectedPoints,omitempty"`
+	Points         *int64 `json:"points,omitempty"`
+	ReceiptID      string `json:"receiptId,omitempty"`
+	DurationMS     int64  `json:"durationMs"`
+
+	// Why the case failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// Report of a conformance run, written as JSON for CI and other tools to read
+type ConformanceReport struct {
+	URL        string              `json:"url"`
+	StartedAt  time.Time           `json:"startedAt"`
+	DurationMS int64               `json:"durationMs"`
+	Passed     int                 `json:"passed"`
+	Failed     int                 `json:"failed"`
+	Results    []ConformanceResult `json:"results"`
+}
+
+// Items of the example receipts in the API spec
+var (
+	conformanceTargetItems = []Item{
+		{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+		{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+		{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+		{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+		{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+	}
+	conformanceGatorades = []Item{
+		{ShortDescription: "Gatorade", Price: "2.25"},
+		{ShortDescription: "Gatorade", Price: "2.25"},
+		{ShortDescription: "Gatorade", Price: "2.25"},
+		{ShortDescription: "Gatorade", Price: "2.25"},
+	}
+)
+
+// Returns a receipt as JSON to submit
+func conformanceReceipt(retailer string, date string, purchaseTime string, total string, items ...Item) string {
+	body, _ := json.Marshal(loadTestReceipt{retailer, date, purchaseTime, total, items})
+	return string(body)
+}
+
+// Returns the most recent day before now whose day of the month is odd, and the most
+// recent one whose day is even, so receipts pass any purchase date window
+func conformanceDates(now time.Time) (string, string) {
+	var odd, even string
+	for day := now.UTC().AddDate(0, 0, -1); odd == "" || even == ""; day = day.AddDate(0, 0, -1) {
+		switch {
+		case day.Day()%2 == 1 && odd == "":
+			odd = day.Format(dateLayout)
+		case day.Day()%2 == 0 && even == "":
+			even = day.Format(dateLayout)
+		}
+	}
+	return odd, even
+}
+
+// Returns the cases to run. Points are those the default rules award; accented and other
+// non-ASCII retailers are only accepted if the server allows Unicode names.
+func conformanceCases(now time.Time, unicodeNames bool) []conformanceCase {
+	odd, even := conformanceDates(now)
+
+	// Walgreens earns 9 points for its name and 25 for a total of 1.25, bought on an even
+	// day outside the afternoon, with a description whose length isn't a multiple of 3
+	pepsi := Item{ShortDescription: "Pepsi - 12-oz", Price: "1.25"}
+	walgreens := func(purchaseTime string) string {
+		return conformanceReceipt("Walgreens", even, purchaseTime, "1.25", pepsi)
+	}
+	total := func(total string) string {
+		return conformanceReceipt("Walgreens", even, "13:00", total, Item{ShortDescription: "Pepsi - 12-oz", Price: total})
+	}
+	unicodeStatus := http.StatusBadRequest
+	if unicodeNames {
+		unicodeStatus = http.StatusOK
+	}
+	unicodeRetailer := func(retailer string, points int64) conformanceCase {
+		if !unicodeNames {
+			points = -1
+		}
+		return conformanceCase{Name: "retailer " + retailer, Category: "unicode", Body: conformanceReceipt(retailer, even, "13:00", "1.25", pepsi), Status: unicodeStatus, Points: points}
+	}
+	invalid := func(name string, body string) conformanceCase {
+		return conformanceCase{Name: name, Category: "invalid", Body: body, Status: http.StatusBadRequest, Points: -1}
+	}
+
+	return []conformanceCase{
+		// Examples from the API spec, on recent days of the same parity
+		{Name: "spec example Target", Category: "valid", Body: conformanceReceipt("Target", odd, "13:01", "35.35", conformanceTargetItems...), Status: http.StatusOK, Points: 28},
+		{Name: "spec example M&M Corner Market", Category: "valid", Body: conformanceReceipt("M&M Corner Market", even, "14:33", "9.00", conformanceGatorades...), Status: http.StatusOK, Points: 109},
+		{Name: "description length multiple of 3", Category: "valid", Body: conformanceReceipt("Walgreens", even, "13:00", "12.25", conformanceTargetItems[1]), Status: http.StatusOK, Points: 37},
+
+		// Either side of the afternoon bonus, from 14:00 up to but not including 16:00
+		{Name: "time 00:00", Category: "times", Body: walgreens("00:00"), Status: http.StatusOK, Points: 34},
+		{Name: "time 13:59", Category: "times", Body: walgreens("13:59"), Status: http.StatusOK, Points: 34},
+		{Name: "time 14:00", Category: "times", Body: walgreens("14:00"), Status: http.StatusOK, Points: 44},
+		{Name: "time 15:59", Category: "times", Body: walgreens("15:59"), Status: http.StatusOK, Points: 44},
+		{Name: "time 16:00", Category: "times", Body: walgreens("16:00"), Status: http.StatusOK, Points: 34},
+		{Name: "time 23:59", Category: "times", Body: walgreens("23:59"), Status: http.StatusOK, Points: 34},
+		{Name: "time 2:30 PM", Category: "times", Body: walgreens("2:30 PM"), Status: http.StatusOK, Points: 44},
+		invalid("time 24:00", walgreens("24:00")),
+		invalid("time 14:60", walgreens("14:60")),
+
+		// Round dollar and multiple of 0.25 totals, with a zero total qualifying for both
+		{Name: "total 1.00", Category: "totals", Body: total("1.00"), Status: http.StatusOK, Points: 84},
+		{Name: "total 0.25", Category: "totals", Body: total("0.25"), Status: http.StatusOK, Points: 34},
+		{Name: "total 0.01", Category: "totals", Body: total("0.01"), Status: http.StatusOK, Points: 9},
+		{Name: "total 0.00", Category: "totals", Body: total("0.00"), Status: http.StatusOK, Points: 84},
+		invalid("total 1.5", total("1.5")),
+		invalid("total 1.005", total("1.005")),
+		invalid("total 1,00", total("1,00")),
+		invalid("total missing", total("")),
+
+		unicodeRetailer("Café Olé", 32),
+		unicodeRetailer("東京マート", 30),
+		invalid("retailer with emoji", conformanceReceipt("Pizza 🍕", even, "13:00", "1.25", pepsi)),
+
+		invalid("malformed JSON", `{"retailer": "Target",`),
+		invalid("empty object", `{}`),
+		invalid("total as a number", `{"retailer":"Target","purchaseDate":"`+even+`","purchaseTime":"13:00","total":1.25,"items":[{"shortDescription":"Pepsi - 12-oz","price":"1.25"}]}`),
+		invalid("retailer missing", conformanceReceipt("", even, "13:00", "1.25", pepsi)),
+		invalid("no items", conformanceReceipt("Walgreens", even, "13:00", "1.25")),
+		invalid("date 2022-13-45", conformanceReceipt("Walgreens", "2022-13-45", "13:00", "1.25", pepsi)),
+		invalid("item price free", conformanceReceipt("Walgreens", even, "13:00", "1.25", Item{ShortDescription: "Pepsi - 12-oz", Price: "free"})),
+		invalid("item price 1.2", conformanceReceipt("Walgreens", even, "13:00", "1.25", Item{ShortDescription: "Pepsi - 12-oz", Price: "1.2"})),
+
+		{Name: "points of an unknown receipt", Category: "lookup", Lookup: "conformance-" + GenerateID(), Status: http.StatusNotFound, Points: -1},
+	}
+}
+
+// Sends a request with the API key and submission token, if there are any, returning the
+// status and body
+func conformanceRequest(client *http.Client, method string, url string, apiKey string, token string, body string) (int, []byte, error) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		request.Header.Set("X-API-Key", apiKey)
+	}
+	if token != "" {
+		request.Header.Set("X-Submission-Token", token)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	return response.StatusCode, data, err
+}
+
+// Runs a case against the server: submits its receipt, or looks up its receipt, and
+// checks the status, then for accepted receipts looks up the points they earned
+func runConformanceCase(client *http.Client, url string, apiKey string, c conformanceCase) ConformanceResult {
+	result := ConformanceResult{Name: c.Name, Category: c.Category, ExpectedStatus: c.Status}
+	if c.Points >= 0 {
+		result.ExpectedPoints = &c.Points
+	}
+	started := time.Now()
+	defer func() { result.DurationMS = time.Since(started).Milliseconds() }()
+
+	var status int
+	var body []byte
+	var err error
+	if c.Lookup != "" {
+		status, body, err = conformanceRequest(client, http.MethodGet, url+"/receipts/"+c.Lookup+"/points", apiKey, "", "")
+	} else {
+		// Submissions without an API key need a submission token
+		token := ""
+		if apiKey == "" {
+			token, err = FetchSubmissionToken(context.Background(), client, url)
+		}
+		if err == nil {
+			status, body, err = conformanceRequest(client, http.MethodPost, url+"/receipts/process", apiKey, token, c.Body)
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Status = status
+	if status != c.Status {
+		result.Error = fmt.Sprintf("expected status %d, got %d: %s", c.Status, status, bytes.TrimSpace(body))
+		return result
+	}
+	if c.Lookup != "" || status != http.StatusOK {
+		result.Passed = true
+		return result
+	}
+
+	var created IDResponse
+	err = json.Unmarshal(body, &created)
+	if err != nil || created.ID == "" {
+		result.Error = fmt.Sprintf("response has no receipt ID: %s", bytes.TrimSpace(body))
+		return result
+	}
+	result.ReceiptID = created.ID
+	status, body, err = conformanceRequest(client, http.MethodGet, url+"/receipts/"+created.ID+"/points", apiKey, "", "")
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	var points PointsResponse
+	if status != http.StatusOK || json.Unmarshal(body, &points) != nil {
+		result.Error = fmt.Sprintf("could not get the points of receipt %s: status %d: %s", created.ID, status, bytes.TrimSpace(body))
+		return result
+	}
+	result.Points = &points.Points
+	if c.Points >= 0 && points.Points != c.Points {
+		result.Error = fmt.Sprintf("expected %d points, got %d", c.Points, points.Points)
+		return result
+	}
+	result.Passed = true
+	return result
+}
+
+// Runs black-box tests of the API against a deployment: valid and invalid receipts, edge
+// case totals, Unicode retailers and times either side of the afternoon bonus. Writes a
+// JSON report, and fails if any case did.
+func RunConformance(args []string) error {
+	flags := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	url := flags.String("url", "http://localhost:8000", "base URL of the deployment to test")
+	apiKey := flags.String("api-key", "", "API key to submit with")
+	unicodeNames := flags.Bool("unicode-names", false, "expect retailers with letters outside ASCII to be accepted, as with NAME_CHARACTERS=unicode")
+	out := flags.String("out", "", "file to write the report to instead of standard output")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("conformance takes no arguments")
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	base := strings.TrimSuffix(*url, "/")
+	report := ConformanceReport{URL: base, StartedAt: time.Now().UTC(), Results: []ConformanceResult{}}
+	for _, c := range conformanceCases(report.StartedAt, *unicodeNames) {
+		result := runConformanceCase(client, base, *apiKey, c)
+		if result.Passed {
+			report.Passed += 1
+		} else {
+			report.Failed += 1
+		}
+		report.Results = append(report.Results, result)
+	}
+	report.DurationMS = time.Since(report.StartedAt).Milliseconds()
+
+	output := os.Stdout
+	if *out != "" {
+		output, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+	}
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(report)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%d of %d conformance cases passed against %s\n", report.Passed, len(report.Results), base)
+	if report.Failed > 0 {
+		return fmt.Errorf("%d conformance cases failed", report.Failed)
+	}
+	return nil
+}
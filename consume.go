@@ -0,0 +1,276 @@
+package receiptapi
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Client SQS is called with; long polls take up to 20 seconds, so it allows longer
+var sqsClient = &http.Client{Timeout: 30 * time.Second}
+
+// Submission read from a message queue
+type QueueMessage struct {
+	ID string
+
+	// Receipt, as it would be posted to /receipts/process
+	Body []byte
+
+	// Format the receipt is in, from the message's "source" attribute; the partner's own
+	// source if not given
+	Source string
+
+	// Name of the partner and the tenant it is submitted for, taken from the message's
+	// "partner" and "tenant" attributes
+	Partner string
+	Tenant  string
+
+	// Span that sent the message, from its "traceparent" attribute, if any
+	TraceParent string
+
+	// What the source needs to delete the message once it's handled
+	Handle string
+}
+
+// Queue receipt submissions are read from. Receive waits a while for messages and may
+// return none; messages that aren't deleted are received again later.
+type MessageSource interface {
+	Receive(ctx context.Context) ([]QueueMessage, error)
+	Delete(ctx context.Context, message QueueMessage) error
+}
+
+// Returns the message source selected by the configuration
+func NewMessageSource(config Config) (MessageSource, error) {
+	if config.SQSQueueURL == "" {
+		return nil, errors.New("SQS_QUEUE_URL must be set")
+	}
+	return &SQSSource{
+		QueueURL:        config.SQSQueueURL,
+		Region:          config.SQSRegion,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}, nil
+}
+
+// Reads submissions from an Amazon SQS queue with long polling
+type SQSSource struct {
+	// URL of the queue, which is also the endpoint requests are sent to
+	QueueURL string
+
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// Waits up to 20 seconds for up to 10 messages
+func (q *SQSSource) Receive(ctx context.Context) ([]QueueMessage, error) {
+	var response struct {
+		Messages []struct {
+			MessageID         string `json:"MessageId"`
+			ReceiptHandle     string `json:"ReceiptHandle"`
+			Body              string `json:"Body"`
+			MessageAttributes map[string]struct {
+				StringValue string `json:"StringValue"`
+			} `json:"MessageAttributes"`
+		} `json:"Messages"`
+	}
+	err := q.call(ctx, "ReceiveMessage", map[string]any{
+		"QueueUrl":              q.QueueURL,
+		"MaxNumberOfMessages":   10,
+		"WaitTimeSeconds":       20,
+		"MessageAttributeNames": []string{"All"},
+	}, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]QueueMessage, 0, len(response.Messages))
+	for _, message := range response.Messages {
+		messages = append(messages, QueueMessage{
+			ID:      message.MessageID,
+			Body:    []byte(message.Body),
+			Partner: message.MessageAttributes["partner"].StringValue,
+			Tenant:  message.MessageAttributes["tenant"].StringValue,
+			Handle:  message.ReceiptHandle,
+
+			Source:      message.MessageAttributes["source"].StringValue,
+			TraceParent: message.MessageAttributes["traceparent"].StringValue,
+		})
+	}
+	return messages, nil
+}
+
+// Deletes a message from the queue
+func (q *SQSSource) Delete(ctx context.Context, message QueueMessage) error {
+	return q.call(ctx, "DeleteMessage", map[string]any{
+		"QueueUrl":      q.QueueURL,
+		"ReceiptHandle": message.Handle,
+	}, nil)
+}
+
+// Calls an action of the SQS JSON API and decodes its response into result, if given
+func (q *SQSSource) call(ctx context.Context, action string, params map[string]any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, q.QueueURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	request.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	signer := awsSigner{
+		Region:          q.Region,
+		Service:         "sqs",
+		AccessKeyID:     q.AccessKeyID,
+		SecretAccessKey: q.SecretAccessKey,
+	}
+	signer.sign(request, body, time.Now().UTC())
+
+	response, err := sqsClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("SQS %s returned %d: %s", action, response.StatusCode, bytes.TrimSpace(data))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// Runs the processing pipeline on submissions read from a queue instead of HTTP, until
+// it is interrupted. Owns the data file as the server does, so the two can't run on
+// the same one at once.
+func RunConsume(args []string) error {
+	flags := flag.NewFlagSet("consume", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	err = Setup()
+	if err != nil {
+		return err
+	}
+	source, err := NewMessageSource(config)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	s, closeServer, err := openServer(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeServer()
+
+	logApp.Info("Consuming", "queue", config.SQSQueueURL)
+	for ctx.Err() == nil {
+		// Messages wait in the queue while receipts can't be changed
+		if s.ReadOnlyStatus().ReadOnly {
+			sleepContext(ctx, time.Duration(config.ReadOnlyRetryAfterSeconds)*time.Second)
+			continue
+		}
+		messages, err := source.Receive(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logApp.Error("Could not receive messages", "error", err)
+				sleepContext(ctx, 5*time.Second)
+			}
+			continue
+		}
+		for _, message := range messages {
+			s.ConsumeMessage(context.WithoutCancel(ctx), message)
+
+			// Handled, even if rejected, since it would only be rejected again. Deleting
+			// outlives an interruption, so a message that was stored isn't redelivered.
+			err = source.Delete(context.WithoutCancel(ctx), message)
+			if err != nil {
+				logApp.Error("Could not delete message", "message", message.ID, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validates, scores and stores the receipt in a message, as a submission over HTTP
+// would be, and logs the outcome. The queue's access policy decides who may send, so
+// the partner is trusted as named and no API key or signature is checked. The message's
+// trace is continued, if it has one.
+func (s *Server) ConsumeMessage(ctx context.Context, message QueueMessage) {
+	trace, ok := ParseTraceparent(message.TraceParent)
+	if ok {
+		ctx = WithTrace(ctx, trace.Child())
+	} else {
+		ctx = WithTrace(ctx, NewTrace())
+	}
+
+	partner, ok := FindPartner(message.Partner)
+	if message.Partner != "" && !ok {
+		fmt.Printf("message %s: rejected: unknown partner %q\n", message.ID, message.Partner)
+		return
+	}
+	source := cmp.Or(message.Source, partner.Source, sourceNative)
+	receipt, err := ParseReceipt(source, message.Body)
+	if err != nil {
+		code := codeInvalidReceipt
+		if errors.Is(err, ErrUnknownSource) {
+			code = codeUnknownReceiptSource
+		}
+		RecordPartnerActivity(partner.Name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "receipt_rejected", Detail: code})
+		CountRejection(code, s.Clock.Now())
+		fmt.Printf("message %s: rejected: %s: %v\n", message.ID, source, err)
+		return
+	}
+
+	// IDs are always ours to assign
+	receipt.ID = ""
+	receipt.Tenant = message.Tenant
+	receipt.Provenance = &Provenance{Channel: channelQueue, Format: source, ParserVersion: parserVersion}
+
+	existing, exists := s.Store.FindExternal(partner.Name, receipt.ExternalID, IsSandbox(partner, receipt.Tenant))
+	if exists {
+		RecordPartnerActivity(partner.Name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "receipt_duplicate", ReceiptID: existing.ID})
+		fmt.Printf("message %s: duplicate of %s\n", message.ID, existing.ID)
+		return
+	}
+
+	receipt, _, rejection := s.ProcessReceipt(ctx, receipt, partner)
+	if rejection != nil {
+		RecordPartnerActivity(partner.Name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "receipt_rejected", Detail: rejection.Code})
+		CountRejection(rejection.Code, s.Clock.Now())
+		fmt.Printf("message %s: rejected: %s: %s\n", message.ID, rejection.Code, rejection.Message)
+		return
+	}
+	RecordPartnerActivity(partner.Name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "receipt_accepted", ReceiptID: receipt.ID})
+	s.Announce(ctx, "receipt."+receipt.Status, receipt)
+	fmt.Printf("message %s: accepted %s as %s, %d points\n", message.ID, receipt.ID, receipt.Status, receipt.Points)
+}
+
+// Waits for the given time, or until the context ends
+func sleepContext(ctx context.Context, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
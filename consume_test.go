@@ -0,0 +1,94 @@
+package receiptapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a fake SQS queue that checks each request's signature, records the actions
+// called with their parameters, and answers ReceiveMessage with the given response
+func newFakeSQS(t *testing.T, received string, calls *[]map[string]any) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signedAt, err := time.Parse(amzDateLayout, r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			http.Error(w, "no date", http.StatusBadRequest)
+			return
+		}
+		check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), bytes.NewReader(body))
+		check.Header.Set("X-Amz-Target", r.Header.Get("X-Amz-Target"))
+		awsSigner{Region: "us-east-1", Service: "sqs", AccessKeyID: "key", SecretAccessKey: "secret"}.sign(check, body, signedAt)
+		if check.Header.Get("Authorization") != r.Header.Get("Authorization") {
+			http.Error(w, `{"__type":"InvalidSignatureException"}`, http.StatusForbidden)
+			return
+		}
+
+		var params map[string]any
+		json.Unmarshal(body, &params)
+		params["action"] = strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSQS.")
+		*calls = append(*calls, params)
+		if params["action"] == "ReceiveMessage" {
+			io.WriteString(w, received)
+			return
+		}
+		io.WriteString(w, "{}")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSQSSource(t *testing.T) {
+	received := `{"Messages":[{"MessageId":"m1","ReceiptHandle":"h1","Body":"{\"retailer\":\"Target\"}",
+		"MessageAttributes":{"partner":{"StringValue":"acme"},"tenant":{"StringValue":"t1"},"source":{"StringValue":"csv"},
+		"traceparent":{"StringValue":"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}},
+		{"MessageId":"m2","ReceiptHandle":"h2","Body":"{}"}]}`
+	var calls []map[string]any
+	queue := newFakeSQS(t, received, &calls)
+	source := &SQSSource{QueueURL: queue.URL + "/123456789012/receipts", Region: "us-east-1", AccessKeyID: "key", SecretAccessKey: "secret"}
+
+	ctx := context.Background()
+	messages, err := source.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() = %v", err)
+	}
+	want := []QueueMessage{
+		{
+			ID: "m1", Body: []byte(`{"retailer":"Target"}`), Source: "csv", Partner: "acme", Tenant: "t1",
+			TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", Handle: "h1",
+		},
+		{ID: "m2", Body: []byte("{}"), Handle: "h2"},
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("Receive() = %+v, want %+v", messages, want)
+	}
+	for i := range want {
+		got := messages[i]
+		if got.ID != want[i].ID || !bytes.Equal(got.Body, want[i].Body) || got.Source != want[i].Source || got.Partner != want[i].Partner ||
+			got.Tenant != want[i].Tenant || got.TraceParent != want[i].TraceParent || got.Handle != want[i].Handle {
+			t.Errorf("Receive()[%d] = %+v, want %+v", i, got, want[i])
+		}
+	}
+
+	err = source.Delete(ctx, messages[0])
+	if err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	if len(calls) != 2 || calls[0]["action"] != "ReceiveMessage" || calls[0]["WaitTimeSeconds"] != float64(20) ||
+		calls[1]["action"] != "DeleteMessage" || calls[1]["ReceiptHandle"] != "h1" || calls[1]["QueueUrl"] != source.QueueURL {
+		t.Errorf("calls made = %v, want a long poll then a delete of h1", calls)
+	}
+
+	source.SecretAccessKey = "wrong"
+	_, err = source.Receive(ctx)
+	if err == nil || !strings.Contains(err.Error(), "InvalidSignatureException") {
+		t.Errorf("Receive() with the wrong secret = %v, want the signature error", err)
+	}
+}
@@ -0,0 +1,53 @@
+package receiptapi
+
+import (
+	"strings"
+	"time"
+)
+
+// Fills in the purchase date and time from purchaseDateTime, if given, as the wall clock
+// time at the offset it was written with. The combined value is stored in canonical
+// RFC 3339 form. Returns false if it can't be parsed or contradicts the separate fields.
+func ApplyPurchaseDateTime(receipt *Receipt) bool {
+	if receipt.PurchaseDateTime == "" {
+		return true
+	}
+	purchased, err := time.Parse(time.RFC3339, receipt.PurchaseDateTime)
+	if err != nil {
+		logScoring.Debug("Invalid purchase date time format")
+		return false
+	}
+
+	date := purchased.Format("2006-01-02")
+	clock := purchased.Format("15:04")
+	if (receipt.PurchaseDate != "" && receipt.PurchaseDate != date) ||
+		(receipt.PurchaseTime != "" && receipt.PurchaseTime != clock) {
+		logScoring.Debug("Purchase date time doesn't match purchase date and time")
+		return false
+	}
+
+	receipt.PurchaseDate = date
+	receipt.PurchaseTime = clock
+	receipt.PurchaseDateTime = purchased.Format(time.RFC3339)
+	return true
+}
+
+// Rewrites a purchase time in one of the configured additional layouts, such as
+// "2:05 PM", as 24 hour "14:05". Times already in 24 hour form, or in no known
+// layout, are returned unchanged for validation to check.
+func NormalizePurchaseTime(timeString string) string {
+	_, err := time.Parse("15:04", timeString)
+	if err == nil || config.FetchCompat {
+		return timeString
+	}
+
+	// Accept "pm" and "p.m." as well as "PM"
+	cleaned := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(timeString), ".", ""))
+	for _, layout := range config.TimeLayouts {
+		parsed, err := time.Parse(layout, cleaned)
+		if err == nil {
+			return parsed.Format("15:04")
+		}
+	}
+	return timeString
+}
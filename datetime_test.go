@@ -0,0 +1,71 @@
+package receiptapi
+
+import "testing"
+
+// Sets the configuration for a test, and puts it back along with the program taken from
+// it when the test ends
+func withConfig(t *testing.T, change func(config *Config)) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		resetProgram()
+	})
+	change(&config)
+	resetProgram()
+}
+
+// Makes the program be taken from the configuration again when next asked for
+func resetProgram() {
+	programMu.Lock()
+	programLoaded, programChanges = false, nil
+	programMu.Unlock()
+}
+
+func TestNormalizePurchaseTime(t *testing.T) {
+	withConfig(t, func(config *Config) {
+		config.TimeLayouts = []string{"3:04 PM", "3:04PM", "3:04:05 PM"}
+	})
+	tests := []struct {
+		time string
+		want string
+	}{
+		{"14:05", "14:05"},
+		{"2:05 PM", "14:05"},
+		{"2:05 pm", "14:05"},
+		{"2:05 p.m.", "14:05"},
+		{"2:05PM", "14:05"},
+		{" 2:05 PM ", "14:05"},
+		{"12:30 AM", "00:30"},
+		{"12:30 PM", "12:30"},
+		{"11:59:59 PM", "23:59"},
+
+		// Times in no known layout are left for validation to reject
+		{"2:05", "2:05"},
+		{"14:05 PM", "14:05 PM"},
+		{"13:05 PM", "13:05 PM"},
+		{"noon", "noon"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got := NormalizePurchaseTime(test.time)
+		if got != test.want {
+			t.Errorf("NormalizePurchaseTime(%q) = %q, want %q", test.time, got, test.want)
+		}
+	}
+}
+
+func TestNormalizePurchaseTimeLayouts(t *testing.T) {
+	withConfig(t, func(config *Config) { config.TimeLayouts = []string{"15H04"} })
+	if got := NormalizePurchaseTime("14h05"); got != "14:05" {
+		t.Errorf("NormalizePurchaseTime(%q) = %q, want %q", "14h05", got, "14:05")
+	}
+	if got := NormalizePurchaseTime("2:05 PM"); got != "2:05 PM" {
+		t.Errorf("NormalizePurchaseTime(%q) = %q with the 12 hour layouts removed, want it unchanged", "2:05 PM", got)
+	}
+
+	withConfig(t, func(config *Config) { config.FetchCompat = true })
+	if got := NormalizePurchaseTime("14h05"); got != "14h05" {
+		t.Errorf("NormalizePurchaseTime(%q) = %q in Fetch compatibility mode, want it unchanged", "14h05", got)
+	}
+}
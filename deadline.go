@@ -0,0 +1,66 @@
+package receiptapi
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Count of requests answered 504 because their deadline passed, published at
+// /admin/debug/vars
+var deadlinesExceeded = expvar.NewInt("deadlines_exceeded")
+
+// Reads the timeout a request asks for in its X-Request-Timeout header: a duration such as
+// "1500ms" or "2s", or a whole number of milliseconds. Returns zero when it doesn't ask.
+func requestTimeout(r *http.Request) (time.Duration, bool) {
+	value := strings.TrimSpace(r.Header.Get("X-Request-Timeout"))
+	if value == "" {
+		return 0, true
+	}
+	if ms, err := strconv.Atoi(value); err == nil {
+		return time.Duration(ms) * time.Millisecond, ms > 0
+	}
+	timeout, err := time.ParseDuration(value)
+	return timeout, err == nil && timeout > 0
+}
+
+// Gives each request a deadline: the X-Request-Timeout it asks for, up to the most
+// allowed, or else the server's default. Handlers check it between steps and answer 504
+// once it has passed, as deadlineRejection describes.
+func RequestDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, ok := requestTimeout(r)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			WriteError(w, http.StatusBadRequest, codeInvalidRequestTimeout, "X-Request-Timeout must be a positive duration such as 1500ms or 2s, or a number of milliseconds.")
+			return
+		}
+		if timeout == 0 {
+			timeout = time.Duration(config.RequestTimeoutMS) * time.Millisecond
+		}
+		timeout = min(timeout, time.Duration(config.MaxRequestTimeoutMS)*time.Millisecond)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Returns the rejection for a request whose deadline has passed, or nil while there is
+// time left. Work is only ever abandoned before it is saved, so a 504 means nothing
+// was changed.
+func deadlineRejection(ctx context.Context, step string) *Rejection {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil
+	}
+	deadlinesExceeded.Add(1)
+	logHTTP.WarnContext(ctx, "Request deadline passed", "step", step)
+	return &Rejection{http.StatusGatewayTimeout, codeDeadlineExceeded, "The request's deadline passed before " + step + "; nothing was saved, so it can be retried."}
+}
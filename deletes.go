@@ -0,0 +1,143 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How long a bulk delete preview can be confirmed for
+const deletePreviewTTL = 10 * time.Minute
+
+// Conditions a receipt must meet to be deleted in bulk; empty conditions match everything
+type DeleteFilter struct {
+	Tenant   string
+	Retailer string
+	Period   period
+}
+
+// Preview of a bulk delete, which must be confirmed to delete anything
+type DeletePreview struct {
+	ID        string    `json:"id"`
+	Count     int       `json:"count"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// Receipts that matched; only these are deleted, and only if they still match
+	ids    map[string]bool
+	filter DeleteFilter
+}
+
+// Response when a bulk delete is confirmed
+type DeleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// Previews keyed by ID, until they're confirmed or expire
+var deletePreviews = map[string]*DeletePreview{}
+
+// Guards deletePreviews
+var deletePreviewsMu sync.Mutex
+
+// Reads the bulk delete conditions from ?tenant=, ?retailer=, ?from= and ?to=. At least
+// one is required, so everything can't be deleted by mistake.
+func parseDeleteFilter(clock Clock, query url.Values) (DeleteFilter, *Rejection) {
+	dates, rejection := parsePeriod(clock, query)
+	if rejection != nil {
+		return DeleteFilter{}, rejection
+	}
+	filter := DeleteFilter{Tenant: query.Get("tenant"), Retailer: query.Get("retailer"), Period: dates}
+	if filter.Tenant == "" && filter.Retailer == "" && dates.From.IsZero() && dates.To.IsZero() {
+		return DeleteFilter{}, &Rejection{http.StatusBadRequest, codeInvalidQuery, "At least one of tenant, retailer, from or to is required."}
+	}
+	return filter, nil
+}
+
+// Checks whether a receipt meets every condition of the filter. Retailers are compared
+// ignoring case, and dates are purchase dates with both ends included.
+func (f DeleteFilter) Matches(clock Clock, receipt Receipt) bool {
+	if f.Tenant != "" && receipt.Tenant != f.Tenant {
+		return false
+	}
+	if f.Retailer != "" && !strings.EqualFold(strings.TrimSpace(receipt.Retailer), strings.TrimSpace(f.Retailer)) {
+		return false
+	}
+	if (!f.Period.From.IsZero() || !f.Period.To.IsZero()) && !f.Period.Contains(clock, receipt) {
+		return false
+	}
+	return true
+}
+
+// Method to preview deleting every receipt that matches the query, returning how many
+// would be deleted and a preview ID to confirm it with
+func (s *Server) PreviewDelete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	filter, rejection := parseDeleteFilter(s.Clock, r.URL.Query())
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+
+	ids := map[string]bool{}
+	for _, receipt := range s.Store.All() {
+		if filter.Matches(s.Clock, receipt) {
+			ids[receipt.ID] = true
+		}
+	}
+	now := s.Clock.Now().UTC()
+	preview := &DeletePreview{
+		ID:        GenerateID(),
+		Count:     len(ids),
+		ExpiresAt: now.Add(deletePreviewTTL),
+		ids:       ids,
+		filter:    filter,
+	}
+
+	deletePreviewsMu.Lock()
+	for id, old := range deletePreviews {
+		if !now.Before(old.ExpiresAt) {
+			delete(deletePreviews, id)
+		}
+	}
+	deletePreviews[preview.ID] = preview
+	deletePreviewsMu.Unlock()
+	json.NewEncoder(w).Encode(preview)
+}
+
+// Method to confirm a previewed bulk delete. Only receipts counted in the preview that
+// still match are deleted, so ones stored or changed since are left alone.
+func (s *Server) ConfirmDelete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	deletePreviewsMu.Lock()
+	preview, ok := deletePreviews[mux.Vars(r)["id"]]
+	if ok {
+		// A preview can only be confirmed once
+		delete(deletePreviews, preview.ID)
+	}
+	deletePreviewsMu.Unlock()
+	if !ok || !s.Clock.Now().Before(preview.ExpiresAt) {
+		WriteError(w, http.StatusNotFound, codeDeletePreviewNotFound, "No unexpired delete preview found for that ID; preview the delete again.")
+		return
+	}
+
+	ids := map[string]bool{}
+	for _, receipt := range s.Store.All() {
+		if preview.ids[receipt.ID] && preview.filter.Matches(s.Clock, receipt) {
+			ids[receipt.ID] = true
+		}
+	}
+	deleted, err := s.Store.Delete(ids)
+	if err != nil {
+		logStorage.Error("Could not delete receipts", "error", err)
+		if deleted == 0 {
+			WriteError(w, http.StatusInternalServerError, codeInternal, "The receipts could not be deleted.")
+			return
+		}
+	}
+	logStorage.Info("Deleted receipts", "count", deleted, "preview", preview.ID)
+	json.NewEncoder(w).Encode(DeleteResponse{Deleted: deleted})
+}
@@ -0,0 +1,138 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseDeleteFilter(t *testing.T) {
+	tests := []struct {
+		query  string
+		wantOK bool
+	}{
+		{"tenant=t1", true},
+		{"retailer=Target", true},
+		{"from=2022-01-01", true},
+		{"to=2022-01-01", true},
+		{"", false},
+		{"from=yesterday&tenant=t1", false},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		_, rejection := parseDeleteFilter(SystemClock{}, query)
+		if (rejection == nil) != test.wantOK {
+			t.Errorf("parseDeleteFilter(%q) = %+v, want accepted %v", test.query, rejection, test.wantOK)
+		}
+	}
+}
+
+func TestDeleteFilterMatches(t *testing.T) {
+	receipt := targetReceipt
+	receipt.Tenant = "t1"
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"tenant=t1", true},
+		{"tenant=t2", false},
+		{"retailer=target", true},
+		{"retailer=Walmart", false},
+		{"from=2022-01-01&to=2022-01-01", true},
+		{"from=2022-01-02", false},
+		{"to=2021-12-31", false},
+		{"tenant=t1&retailer=Walmart", false},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		filter, _ := parseDeleteFilter(SystemClock{}, query)
+		if got := filter.Matches(SystemClock{}, receipt); got != test.want {
+			t.Errorf("Matches() with %q = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+// Calls a bulk delete handler with the query, and the preview ID as the {id} route variable
+func callDelete(handler http.HandlerFunc, id string, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/admin/receipts/delete/preview?"+query, nil)
+	r = mux.SetURLVars(r, map[string]string{"id": id})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestBulkDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.json")
+	s := New()
+	s.Clock = FixedClock{time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	err := s.Store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Store.Close()
+	for _, id := range []string{"a", "b", "changed", "other"} {
+		receipt := targetReceipt
+		receipt.ID = id
+		if id == "other" {
+			receipt.Retailer = "Walmart"
+		}
+		s.Store.Add(receipt)
+	}
+
+	w := callDelete(s.PreviewDelete, "", "retailer=Target")
+	var preview DeletePreview
+	json.NewDecoder(w.Body).Decode(&preview)
+	if w.Code != http.StatusOK || preview.Count != 3 {
+		t.Fatalf("PreviewDelete() = %d, %s, want 3 receipts", w.Code, w.Body)
+	}
+
+	// Receipts stored or changed since the preview are left alone
+	late := targetReceipt
+	late.ID = "late"
+	s.Store.Add(late)
+	s.Store.Modify("changed", func(receipt *Receipt) bool {
+		receipt.Retailer = "Walmart"
+		return true
+	})
+
+	w = callDelete(s.ConfirmDelete, preview.ID, "")
+	var response DeleteResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || response.Deleted != 2 {
+		t.Fatalf("ConfirmDelete() = %d, %s, want 2 deleted", w.Code, w.Body)
+	}
+	if w := callDelete(s.ConfirmDelete, preview.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("second ConfirmDelete() status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// The data file no longer has them, and later changes are still saved to it
+	extra := targetReceipt
+	extra.ID = "extra"
+	s.Store.Add(extra)
+	loaded, err := LoadReceipts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]bool{}
+	for _, receipt := range loaded {
+		ids[receipt.ID] = true
+	}
+	if len(ids) != 4 || ids["a"] || ids["b"] || !ids["changed"] || !ids["other"] || !ids["late"] || !ids["extra"] {
+		t.Errorf("data file has %v, want changed, other, late and extra", ids)
+	}
+
+	// Previews expire
+	w = callDelete(s.PreviewDelete, "", "retailer=Target")
+	json.NewDecoder(w.Body).Decode(&preview)
+	s.Clock = FixedClock{s.Clock.Now().Add(deletePreviewTTL)}
+	w = callDelete(s.ConfirmDelete, preview.ID, "")
+	if w.Code != http.StatusNotFound || s.Store.Len() != 4 {
+		t.Errorf("ConfirmDelete() of an expired preview = %d with %d receipts left, want %d with 4", w.Code, s.Store.Len(), http.StatusNotFound)
+	}
+}
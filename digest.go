@@ -0,0 +1,324 @@
+package receiptapi
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/smtp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most retailers and reasons listed in a digest
+const digestListSize = 10
+
+// Weekly report on the program: how many receipts were processed, the points issued,
+// the busiest retailers and why receipts were turned away
+type Digest struct {
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	GeneratedAt time.Time `json:"generatedAt"`
+
+	// Production receipts stored in the period, those still waiting for review, and the
+	// points awarded to them
+	ReceiptsProcessed int   `json:"receiptsProcessed"`
+	PendingReview     int   `json:"pendingReview"`
+	PointsIssued      int64 `json:"pointsIssued"`
+
+	TopRetailers []DigestRetailer `json:"topRetailers"`
+
+	// Submissions turned away in the period by error code, counted by the server since it
+	// started, and receipts rejected in review by reason
+	RejectedSubmissions []DigestCount `json:"rejectedSubmissions"`
+	RejectedInReview    []DigestCount `json:"rejectedInReview"`
+}
+
+// Retailer in a digest with its receipts and their points
+type DigestRetailer struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+	Points   int64  `json:"points"`
+}
+
+// Reason in a digest and how often it came up
+type DigestCount struct {
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+// Days submissions turned away are counted for
+const rejectionTallyDays = 35
+
+// Submissions turned away, by day and error code
+var (
+	rejectionTally   = map[string]map[string]int{}
+	rejectionTallyMu sync.Mutex
+)
+
+// Counts a submission turned away with the given error code, for the digest
+func CountRejection(code string, now time.Time) {
+	day := now.UTC().Format(dateLayout)
+	rejectionTallyMu.Lock()
+	defer rejectionTallyMu.Unlock()
+	if rejectionTally[day] == nil {
+		rejectionTally[day] = map[string]int{}
+		oldest := now.UTC().AddDate(0, 0, -rejectionTallyDays).Format(dateLayout)
+		for kept := range rejectionTally {
+			if kept < oldest {
+				delete(rejectionTally, kept)
+			}
+		}
+	}
+	rejectionTally[day][code] += 1
+}
+
+// Returns when a receipt was stored: when it was processed, or for receipts stored before
+// that was kept, when it was last scored
+func storedAt(receipt Receipt) (time.Time, bool) {
+	switch {
+	case receipt.ProcessedAt != nil:
+		return *receipt.ProcessedAt, true
+	case receipt.Scoring != nil:
+		return receipt.Scoring.ScoredAt, true
+	}
+	return time.Time{}, false
+}
+
+// Builds the digest of the production receipts stored from one time until another
+func (s *Server) BuildDigest(from time.Time, to time.Time) Digest {
+	digest := Digest{From: from.UTC(), To: to.UTC(), GeneratedAt: s.Clock.Now().UTC()}
+	retailers := map[string]*DigestRetailer{}
+	reviewReasons := map[string]int{}
+	for _, receipt := range s.Store.All() {
+		at, ok := storedAt(receipt)
+		if receipt.Sandbox || !ok || at.Before(from) || !at.Before(to) {
+			continue
+		}
+		digest.ReceiptsProcessed += 1
+		digest.PointsIssued += AwardedPoints(receipt)
+		switch {
+		case receipt.Status == statusSubmitted:
+			digest.PendingReview += 1
+		case receipt.Status == statusRejected && receipt.Review != nil:
+			reviewReasons[receipt.Review.Reason] += 1
+		}
+
+		// Retailers are grouped ignoring case and spacing, named as first seen
+		key := strings.ToLower(strings.Join(strings.Fields(receipt.Retailer), " "))
+		if key == "" {
+			continue
+		}
+		if retailers[key] == nil {
+			retailers[key] = &DigestRetailer{Retailer: receipt.Retailer}
+		}
+		retailers[key].Receipts += 1
+		retailers[key].Points += AwardedPoints(receipt)
+	}
+
+	digest.TopRetailers = []DigestRetailer{}
+	for _, retailer := range retailers {
+		digest.TopRetailers = append(digest.TopRetailers, *retailer)
+	}
+	slices.SortFunc(digest.TopRetailers, func(a, b DigestRetailer) int {
+		return cmp.Or(b.Receipts-a.Receipts, cmp.Compare(b.Points, a.Points), cmp.Compare(a.Retailer, b.Retailer))
+	})
+	digest.TopRetailers = digest.TopRetailers[:min(len(digest.TopRetailers), digestListSize)]
+
+	codes := map[string]int{}
+	rejectionTallyMu.Lock()
+	for day, counts := range rejectionTally {
+		if day >= from.UTC().Format(dateLayout) && day < to.UTC().Format(dateLayout) {
+			for code, count := range counts {
+				codes[code] += count
+			}
+		}
+	}
+	rejectionTallyMu.Unlock()
+	digest.RejectedSubmissions = topCounts(codes)
+	digest.RejectedInReview = topCounts(reviewReasons)
+	return digest
+}
+
+// Returns the most frequent reasons, most frequent first
+func topCounts(counts map[string]int) []DigestCount {
+	sorted := []DigestCount{}
+	for reason, count := range counts {
+		sorted = append(sorted, DigestCount{Reason: reason, Count: count})
+	}
+	slices.SortFunc(sorted, func(a, b DigestCount) int {
+		return cmp.Or(b.Count-a.Count, cmp.Compare(a.Reason, b.Reason))
+	})
+	return sorted[:min(len(sorted), digestListSize)]
+}
+
+// Layout of the HTML digest
+var digestTemplate = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Receipt program digest</title></head>
+<body>
+<h1>Receipt program digest</h1>
+<p>{{.From.Format "Mon 2 Jan 2006"}} to {{.To.Format "Mon 2 Jan 2006"}}</p>
+<table>
+<tr><th align="left">Receipts processed</th><td>{{.ReceiptsProcessed}}</td></tr>
+<tr><th align="left">Waiting for review</th><td>{{.PendingReview}}</td></tr>
+<tr><th align="left">Points issued</th><td>{{.PointsIssued}}</td></tr>
+</table>
+<h2>Top retailers</h2>
+<table>
+<tr><th align="left">Retailer</th><th>Receipts</th><th>Points</th></tr>
+{{range .TopRetailers}}<tr><td>{{.Retailer}}</td><td>{{.Receipts}}</td><td>{{.Points}}</td></tr>
+{{else}}<tr><td colspan="3">None</td></tr>
+{{end}}</table>
+<h2>Rejected submissions</h2>
+<table>
+{{range .RejectedSubmissions}}<tr><td>{{.Reason}}</td><td>{{.Count}}</td></tr>
+{{else}}<tr><td>None</td></tr>
+{{end}}</table>
+<h2>Rejected in review</h2>
+<table>
+{{range .RejectedInReview}}<tr><td>{{.Reason}}</td><td>{{.Count}}</td></tr>
+{{else}}<tr><td>None</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Stores a digest as JSON and HTML in the blob store, if there is one, and emails the
+// HTML to the configured operators, if any
+func (s *Server) PublishDigest(ctx context.Context, digest Digest) error {
+	body, err := json.MarshalIndent(digest, "", "  ")
+	if err != nil {
+		return err
+	}
+	var page bytes.Buffer
+	err = digestTemplate.Execute(&page, digest)
+	if err != nil {
+		return err
+	}
+
+	name := "reports/digest-" + digest.To.Format(dateLayout)
+	if s.Blobs != nil {
+		err = s.Blobs.Put(ctx, name+".json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("could not store %s.json: %w", name, err)
+		}
+		err = s.Blobs.Put(ctx, name+".html", bytes.NewReader(page.Bytes()))
+		if err != nil {
+			return fmt.Errorf("could not store %s.html: %w", name, err)
+		}
+		logJobs.Info("Stored digest", "key", name)
+	}
+	if len(config.DigestEmailTo) > 0 {
+		subject := "Receipt program digest for the week to " + digest.To.Format("2 Jan 2006")
+		err = sendEmail(config.DigestEmailTo, subject, page.String())
+		if err != nil {
+			return fmt.Errorf("could not email digest: %w", err)
+		}
+		logJobs.Info("Emailed digest", "to", strings.Join(config.DigestEmailTo, ","))
+	}
+	return nil
+}
+
+// Sends an HTML email through the configured SMTP server
+func sendEmail(to []string, subject string, html string) error {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", config.SMTPFrom)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(html, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if config.SMTPUsername != "" {
+		host, _, _ := strings.Cut(config.SMTPAddr, ":")
+		auth = smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, host)
+	}
+	return smtp.SendMail(config.SMTPAddr, auth, config.SMTPFrom, to, message.Bytes())
+}
+
+// Returns the next time the weekly digest is due after now
+func nextDigestTime(now time.Time, weekday time.Weekday, hour int) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+	next = next.AddDate(0, 0, int(weekday-next.Weekday()+7)%7)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
+
+// Builds and publishes the digest of the week before each time it is due, until the
+// context is done
+func (s *Server) RunDigests(ctx context.Context) {
+	weekday, _ := parseWeekday(config.DigestWeekday)
+	for {
+		due := nextDigestTime(s.Clock.Now(), weekday, config.DigestHour)
+		sleepContext(ctx, time.Until(due))
+		if ctx.Err() != nil {
+			return
+		}
+		logJobs.Info("Started", "job", "digest")
+		digest := s.BuildDigest(due.AddDate(0, 0, -7), due)
+		err := s.PublishDigest(ctx, digest)
+		if err != nil {
+			logJobs.Error("Could not publish digest", "error", err)
+			continue
+		}
+		logJobs.Info("Finished", "job", "digest", "receipts", digest.ReceiptsProcessed)
+	}
+}
+
+// Reads a day of the week such as "monday"
+func parseWeekday(name string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(name, day.String()) {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// Builds the digest of the past week from the data file, then stores and emails it as
+// the server would, or with -dry-run only prints it. Submissions turned away aren't
+// stored, so only the server's own digests count them.
+func RunDigest(args []string) error {
+	flags := flag.NewFlagSet("digest", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the digest instead of storing and emailing it")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	err = Setup()
+	if err != nil {
+		return err
+	}
+	stored, err := LoadReceipts(config.DataFile)
+	if err != nil {
+		return fmt.Errorf("could not read data file: %w", err)
+	}
+
+	s := New()
+	s.Store.Replace(stored)
+	s.Blobs, err = NewBlobStore(config, s.Clock)
+	if err != nil {
+		return err
+	}
+	now := s.Clock.Now()
+	digest := s.BuildDigest(now.AddDate(0, 0, -7), now)
+	if *dryRun {
+		body, err := json.MarshalIndent(digest, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+		return nil
+	}
+	return s.PublishDigest(context.Background(), digest)
+}
@@ -0,0 +1,567 @@
+package receiptapi
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Statuses of a dispute: open until a reviewer takes it up, in review while they look
+// into it, and resolved once they are done. A resolved dispute can't be reopened; the
+// user opens another.
+const (
+	disputeOpen     = "open"
+	disputeInReview = "in_review"
+	disputeResolved = "resolved"
+)
+
+// Who wrote a message on a dispute
+const (
+	roleUser     = "user"
+	roleReviewer = "reviewer"
+)
+
+// User's challenge to how a processed receipt was read or scored, e.g. that the total
+// came out wrong, with the conversation about it
+type Dispute struct {
+	ID        string `json:"id"`
+	ReceiptID string `json:"receiptId"`
+
+	// User the receipt belongs to, if it is linked to one
+	UserID string `json:"userId,omitempty"`
+
+	Status   string           `json:"status"`
+	Messages []DisputeMessage `json:"messages"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// How the dispute was resolved, and the correction made to the receipt if any
+	ResolvedAt *time.Time  `json:"resolvedAt,omitempty"`
+	Resolution string      `json:"resolution,omitempty"`
+	Correction *Correction `json:"correction,omitempty"`
+}
+
+// Message in a dispute's thread
+type DisputeMessage struct {
+	Author string    `json:"author"`
+	Role   string    `json:"role"`
+	Body   string    `json:"body"`
+	At     time.Time `json:"at"`
+}
+
+// Change a reviewer made to a receipt to resolve a dispute. What the receipt said before
+// is kept, so the receipt can still be checked against its hash chain link.
+type Correction struct {
+	DisputeID string          `json:"disputeId"`
+	Corrector string          `json:"corrector"`
+	Before    CorrectedFields `json:"before"`
+
+	// Points before and after the receipt was scored again
+	PointsBefore int64 `json:"pointsBefore"`
+	PointsAfter  int64 `json:"pointsAfter"`
+
+	CorrectedAt time.Time `json:"correctedAt"`
+}
+
+// Parts of a receipt a reviewer can correct
+type CorrectedFields struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Total        string `json:"total"`
+	Items        []Item `json:"items"`
+}
+
+// Request to open a dispute or add a message to one
+type DisputeMessageRequest struct {
+	Message string `json:"message"`
+}
+
+// Request to move a dispute to another status; resolving it needs a resolution
+type DisputeStatusRequest struct {
+	Status     string `json:"status"`
+	Resolution string `json:"resolution"`
+}
+
+// Request to correct a disputed receipt. Fields left out keep their values; items, if
+// given, replace all of the receipt's items.
+type CorrectionRequest struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Total        string `json:"total"`
+	Items        []Item `json:"items"`
+	Resolution   string `json:"resolution"`
+}
+
+// Response listing disputes
+type DisputeList struct {
+	Disputes []Dispute `json:"disputes"`
+}
+
+// Disputes keyed by ID
+var disputes = map[string]*Dispute{}
+
+// Guards disputes and their log file
+var disputesMu sync.Mutex
+
+// Log file every change to a dispute is appended to, if one is open
+var disputeLog *os.File
+
+// Loads disputes from a log file, then keeps it open to append to. Each line holds a
+// dispute as JSON; a dispute appears again each time it changes, and its last line wins.
+func OpenDisputeLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	disputesMu.Lock()
+	defer disputesMu.Unlock()
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line += 1
+			var dispute Dispute
+			err = json.Unmarshal(scanner.Bytes(), &dispute)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			disputes[dispute.ID] = &dispute
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+	}
+
+	disputeLog, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	return err
+}
+
+// Appends a dispute as it is now to the log file, if one is open; the caller must hold
+// disputesMu
+func persistDispute(dispute *Dispute) error {
+	if disputeLog == nil {
+		return nil
+	}
+	line, err := json.Marshal(dispute)
+	if err != nil {
+		return err
+	}
+	_, err = disputeLog.Write(append(line, '\n'))
+	return err
+}
+
+// Opens a dispute on a processed receipt from production, or the sandbox, with the
+// user's first message. A receipt can only have one unresolved dispute at a time.
+func (s *Server) OpenDispute(receiptID string, sandbox bool, message string) (Dispute, *Rejection) {
+	receipt, found := s.Store.Find(receiptID)
+	if !found || receipt.Sandbox != sandbox {
+		return Dispute{}, &Rejection{http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage}
+	}
+	if receipt.Status != statusProcessed {
+		return Dispute{}, &Rejection{http.StatusConflict, codeInvalidDispute, "Only processed receipts can be disputed."}
+	}
+
+	now := s.Clock.Now().UTC()
+	disputesMu.Lock()
+	defer disputesMu.Unlock()
+	for _, dispute := range disputes {
+		if dispute.ReceiptID == receipt.ID && dispute.Status != disputeResolved {
+			return Dispute{}, &Rejection{http.StatusConflict, codeDisputeOpen, "The receipt already has an unresolved dispute, " + dispute.ID + "."}
+		}
+	}
+	dispute := &Dispute{
+		ID:        uuid.New().String(),
+		ReceiptID: receipt.ID,
+		UserID:    receipt.UserID,
+		Status:    disputeOpen,
+		Messages:  []DisputeMessage{{Author: cmp.Or(receipt.UserID, roleUser), Role: roleUser, Body: message, At: now}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err := persistDispute(dispute)
+	if err != nil {
+		logApp.Error("Could not write dispute log", "error", err)
+		return Dispute{}, &Rejection{http.StatusInternalServerError, codeInternal, "The dispute could not be saved."}
+	}
+	disputes[dispute.ID] = dispute
+	return *dispute, nil
+}
+
+// Changes an unresolved dispute while holding the lock and saves it. change returns a
+// rejection to leave the dispute as it was.
+func (s *Server) changeDispute(id string, change func(dispute *Dispute, now time.Time) *Rejection) (Dispute, *Rejection) {
+	now := s.Clock.Now().UTC()
+	disputesMu.Lock()
+	defer disputesMu.Unlock()
+	dispute, ok := disputes[id]
+	if !ok {
+		return Dispute{}, &Rejection{http.StatusNotFound, codeDisputeNotFound, "No dispute found for that ID."}
+	}
+	if dispute.Status == disputeResolved {
+		return Dispute{}, &Rejection{http.StatusConflict, codeDisputeResolved, "The dispute was already resolved."}
+	}
+
+	// Changed on a copy, with messages of its own, so a failed save leaves it untouched
+	changed := *dispute
+	changed.Messages = slices.Clone(dispute.Messages)
+	rejection := change(&changed, now)
+	if rejection != nil {
+		return Dispute{}, rejection
+	}
+	changed.UpdatedAt = now
+	err := persistDispute(&changed)
+	if err != nil {
+		logApp.Error("Could not write dispute log", "error", err)
+		return Dispute{}, &Rejection{http.StatusInternalServerError, codeInternal, "The dispute could not be saved."}
+	}
+	*dispute = changed
+	return changed, nil
+}
+
+// Adds a message to an unresolved dispute. A reviewer's reply takes an open dispute
+// into review.
+func (s *Server) AddDisputeMessage(id string, author string, role string, message string) (Dispute, *Rejection) {
+	return s.changeDispute(id, func(dispute *Dispute, now time.Time) *Rejection {
+		if role == roleUser {
+			author = cmp.Or(dispute.UserID, roleUser)
+		}
+		dispute.Messages = append(dispute.Messages, DisputeMessage{Author: author, Role: role, Body: message, At: now})
+		if role == roleReviewer && dispute.Status == disputeOpen {
+			dispute.Status = disputeInReview
+		}
+		return nil
+	})
+}
+
+// Moves an unresolved dispute to another status, resolving it without a correction if
+// the status is resolved
+func (s *Server) SetDisputeStatus(id string, request DisputeStatusRequest) (Dispute, *Rejection) {
+	switch {
+	case request.Status != disputeOpen && request.Status != disputeInReview && request.Status != disputeResolved:
+		return Dispute{}, &Rejection{http.StatusBadRequest, codeInvalidDispute, "The status must be open, in_review or resolved."}
+	case request.Status == disputeResolved && request.Resolution == "":
+		return Dispute{}, &Rejection{http.StatusBadRequest, codeInvalidDispute, "A resolution is required to resolve a dispute."}
+	}
+	return s.changeDispute(id, func(dispute *Dispute, now time.Time) *Rejection {
+		dispute.Status = request.Status
+		if request.Status == disputeResolved {
+			dispute.ResolvedAt = &now
+			dispute.Resolution = request.Resolution
+		}
+		return nil
+	})
+}
+
+// Returns what a receipt will say once a correction is applied, or why it can't be
+// applied. The purchase date window isn't checked again, since the receipt was already
+// accepted.
+func correctedReceipt(receipt Receipt, request CorrectionRequest) (Receipt, *Rejection) {
+	receipt.Retailer = cmp.Or(request.Retailer, receipt.Retailer)
+	receipt.PurchaseDate = cmp.Or(request.PurchaseDate, receipt.PurchaseDate)
+	receipt.PurchaseTime = NormalizePurchaseTime(cmp.Or(request.PurchaseTime, receipt.PurchaseTime))
+	receipt.Total = cmp.Or(request.Total, receipt.Total)
+	if request.Items != nil {
+		receipt.Items = request.Items
+	}
+
+	if message := CheckLimits(receipt); message != "" {
+		return Receipt{}, &Rejection{http.StatusBadRequest, codeLimitExceeded, message}
+	}
+	valid := CheckValidDescription(receipt.Retailer) &&
+		CheckValidTime(receipt.PurchaseDate, receipt.PurchaseTime) &&
+		CheckItemsValidity(receipt) &&
+		len(CheckItemDescriptions(receipt)) == 0 &&
+		CheckPriceValidity(receipt.Total)
+	if !valid {
+		return Receipt{}, &Rejection{http.StatusBadRequest, codeInvalidReceipt, "The corrected receipt is not valid."}
+	}
+	return receipt, nil
+}
+
+// Corrects a disputed receipt, scores it again with the current rules, and resolves the
+// dispute with the correction. The dispute stays locked throughout, so it can't be
+// corrected twice.
+func (s *Server) CorrectDisputedReceipt(id string, corrector string, request CorrectionRequest) (Dispute, Receipt, *Rejection) {
+	var corrected Receipt
+	dispute, rejection := s.changeDispute(id, func(dispute *Dispute, now time.Time) *Rejection {
+		receipt, found := s.Store.Find(dispute.ReceiptID)
+		if !found {
+			return &Rejection{http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage}
+		}
+		if receipt.Anonymized != nil {
+			return &Rejection{http.StatusConflict, codeInvalidDispute, "The receipt was anonymized and can't be corrected."}
+		}
+		if receipt.Compacted != nil {
+			return &Rejection{http.StatusConflict, codeInvalidDispute, "The receipt was compacted; rehydrate it before correcting it."}
+		}
+		fixed, rejection := correctedReceipt(receipt, request)
+		if rejection != nil {
+			return rejection
+		}
+
+		correction := Correction{
+			DisputeID: dispute.ID,
+			Corrector: corrector,
+			Before: CorrectedFields{
+				Retailer:     receipt.Retailer,
+				PurchaseDate: receipt.PurchaseDate,
+				PurchaseTime: receipt.PurchaseTime,
+				Total:        receipt.Total,
+				Items:        receipt.Items,
+			},
+			PointsBefore: AwardedPoints(receipt),
+			CorrectedAt:  now,
+		}
+		_, found = s.Store.ModifyChained(receipt.ID, chainCorrected, func(receipt *Receipt) bool {
+			receipt.Retailer = fixed.Retailer
+			receipt.PurchaseDate = fixed.PurchaseDate
+			receipt.PurchaseTime = fixed.PurchaseTime
+			receipt.Total = fixed.Total
+			receipt.Items = fixed.Items
+			receipt.Corrections = append(slices.Clone(receipt.Corrections), correction)
+			return true
+		})
+		if !found {
+			return &Rejection{http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage}
+		}
+		err := s.RecalculateReceipt(receipt.ID)
+		if err != nil {
+			return &Rejection{http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage}
+		}
+
+		// Record the points it scored on both the receipt's correction and the dispute
+		corrected, _ = s.Store.Modify(receipt.ID, func(receipt *Receipt) bool {
+			receipt.Corrections = slices.Clone(receipt.Corrections)
+			receipt.Corrections[len(receipt.Corrections)-1].PointsAfter = AwardedPoints(*receipt)
+			return true
+		})
+		correction.PointsAfter = AwardedPoints(corrected)
+
+		dispute.Status = disputeResolved
+		dispute.ResolvedAt = &now
+		dispute.Resolution = cmp.Or(request.Resolution, "The receipt was corrected.")
+		dispute.Correction = &correction
+		return nil
+	})
+	return dispute, corrected, rejection
+}
+
+// Returns a dispute by ID
+func findDispute(id string) (Dispute, bool) {
+	disputesMu.Lock()
+	defer disputesMu.Unlock()
+	dispute, ok := disputes[id]
+	if !ok {
+		return Dispute{}, false
+	}
+	return *dispute, true
+}
+
+// Returns the disputes for which keep is true, oldest first
+func listDisputes(keep func(dispute *Dispute) bool) []Dispute {
+	found := []Dispute{}
+	disputesMu.Lock()
+	for _, dispute := range disputes {
+		if keep(dispute) {
+			found = append(found, *dispute)
+		}
+	}
+	disputesMu.Unlock()
+	slices.SortFunc(found, func(a, b Dispute) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	return found
+}
+
+/*
+	Below are the handlers for disputes, for users and then for reviewers
+*/
+
+// Method for a user to dispute a processed receipt, e.g. because its total was read wrong
+func (s *Server) CreateDispute(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	message, ok := readDisputeMessage(w, r)
+	if !ok {
+		return
+	}
+	rejection := CheckIDPrefix(mux.Vars(r)["id"], IsSandboxRequest(r))
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	dispute, rejection := s.OpenDispute(s.Store.ResolveShortCode(mux.Vars(r)["id"]), IsSandboxRequest(r), message)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(dispute)
+}
+
+// Method to list a receipt's disputes, oldest first
+func (s *Server) ListReceiptDisputes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rejection := CheckIDPrefix(mux.Vars(r)["id"], IsSandboxRequest(r))
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	receipt, found := s.Store.Find(s.Store.ResolveShortCode(mux.Vars(r)["id"]))
+	if !found || receipt.Sandbox != IsSandboxRequest(r) {
+		WriteError(w, http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage)
+		return
+	}
+	receiptDisputes := listDisputes(func(dispute *Dispute) bool { return dispute.ReceiptID == receipt.ID })
+	json.NewEncoder(w).Encode(DisputeList{Disputes: receiptDisputes})
+}
+
+// Method to get a dispute with its messages
+func GetDispute(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	dispute, ok := findDispute(mux.Vars(r)["id"])
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeDisputeNotFound, "No dispute found for that ID.")
+		return
+	}
+	json.NewEncoder(w).Encode(dispute)
+}
+
+// Method for the user to add a message to their dispute
+func (s *Server) CreateUserDisputeMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	message, ok := readDisputeMessage(w, r)
+	if !ok {
+		return
+	}
+	dispute, rejection := s.AddDisputeMessage(mux.Vars(r)["id"], "", roleUser, message)
+	writeDispute(w, dispute, rejection)
+}
+
+// Method to list disputes for reviewers, oldest first, optionally only those with the
+// ?status= given; by default those not yet resolved
+func ListDisputeQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	status := r.URL.Query().Get("status")
+	if status != "" && status != disputeOpen && status != disputeInReview && status != disputeResolved {
+		WriteError(w, http.StatusBadRequest, codeInvalidQuery, "The status parameter must be open, in_review or resolved.")
+		return
+	}
+	queue := listDisputes(func(dispute *Dispute) bool {
+		if status == "" {
+			return dispute.Status != disputeResolved
+		}
+		return dispute.Status == status
+	})
+	json.NewEncoder(w).Encode(DisputeList{Disputes: queue})
+}
+
+// Method for a reviewer to reply on a dispute
+func (s *Server) CreateReviewerDisputeMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reviewer, ok := readReviewer(w, r)
+	if !ok {
+		return
+	}
+	message, ok := readDisputeMessage(w, r)
+	if !ok {
+		return
+	}
+	dispute, rejection := s.AddDisputeMessage(mux.Vars(r)["id"], reviewer, roleReviewer, message)
+	writeDispute(w, dispute, rejection)
+}
+
+// Method for a reviewer to move a dispute to another status, or resolve it without
+// changing the receipt
+func (s *Server) SetDisputeStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := readReviewer(w, r); !ok {
+		return
+	}
+	var request DisputeStatusRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidDispute, "The status request is not valid JSON.")
+		return
+	}
+	request.Resolution = strings.TrimSpace(request.Resolution)
+	dispute, rejection := s.SetDisputeStatus(mux.Vars(r)["id"], request)
+	writeDispute(w, dispute, rejection)
+}
+
+// Method for a reviewer to correct a disputed receipt, which scores it again and resolves
+// the dispute; responds with the dispute and the receipt as corrected
+func (s *Server) CorrectDispute(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reviewer, ok := readReviewer(w, r)
+	if !ok {
+		return
+	}
+	var request CorrectionRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidDispute, "The correction is not valid JSON.")
+		return
+	}
+	request.Resolution = strings.TrimSpace(request.Resolution)
+	dispute, receipt, rejection := s.CorrectDisputedReceipt(mux.Vars(r)["id"], reviewer, request)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	s.Announce(r.Context(), "receipt.corrected", receipt)
+	json.NewEncoder(w).Encode(struct {
+		Dispute Dispute `json:"dispute"`
+		Receipt Receipt `json:"receipt"`
+	}{dispute, receipt})
+}
+
+// Reads a message from the request body, writing an error if there isn't one
+func readDisputeMessage(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var request DisputeMessageRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	request.Message = strings.TrimSpace(request.Message)
+	if err != nil || request.Message == "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidDispute, "A message is required.")
+		return "", false
+	}
+	return request.Message, true
+}
+
+// Reads the reviewer RequireReviewer authenticated, writing an error if there isn't one
+func readReviewer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	reviewer := ReviewerFrom(r.Context())
+	if reviewer == "" {
+		WriteError(w, http.StatusUnauthorized, codeUnauthorized, "Reviews must be made by an authenticated reviewer.")
+		return "", false
+	}
+	return reviewer, true
+}
+
+// Writes a dispute, or the rejection of a change to it
+func writeDispute(w http.ResponseWriter, dispute Dispute, rejection *Rejection) {
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	json.NewEncoder(w).Encode(dispute)
+}
@@ -0,0 +1,348 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Stages of a receipt's lifecycle
+const (
+	statusDraft     = "draft"
+	statusSubmitted = "submitted"
+	statusProcessed = "processed"
+	statusRejected  = "rejected"
+)
+
+// Receipts still being built, and drafts that were finalized or rejected, keyed by ID.
+// Each is kept until DRAFT_TTL_SECONDS after it last changed.
+var drafts = map[string]Receipt{}
+
+// Guards drafts
+var draftsMu sync.Mutex
+
+// Returns an ID for a new draft, which it keeps once finalized. Its content isn't known
+// yet, so content derived IDs fall back to random ones.
+func (s *Server) newDraftID(sandbox bool) string {
+	if _, derived := s.IDs.(ContentIDGenerator); derived {
+		return IDPrefix(sandbox) + GenerateID()
+	}
+	return IDPrefix(sandbox) + s.IDs.NewID(Receipt{})
+}
+
+// Forgets drafts that haven't changed within DRAFT_TTL_SECONDS; the caller must hold
+// draftsMu
+func expireDrafts(now time.Time) {
+	ttl := time.Duration(config.DraftTTLSeconds) * time.Second
+	for id, draft := range drafts {
+		if draft.UpdatedAt == nil || !now.Before(draft.UpdatedAt.Add(ttl)) {
+			delete(drafts, id)
+		}
+	}
+}
+
+// Returns the draft with the ID if the partner started it, after forgetting expired
+// drafts; the caller must hold draftsMu. Other partners' drafts aren't found.
+func (s *Server) findDraft(id string, partner Partner) (Receipt, bool) {
+	expireDrafts(s.Clock.Now())
+	draft, ok := drafts[id]
+	if !ok || draft.Partner != partner.Name {
+		return Receipt{}, false
+	}
+	return draft, true
+}
+
+// Stores a draft as changed now; the caller must hold draftsMu
+func (s *Server) saveDraft(draft *Receipt) {
+	now := s.Clock.Now().UTC()
+	draft.UpdatedAt = &now
+	drafts[draft.ID] = *draft
+}
+
+// Returns the partner of a request for a draft, or writes 401 for an unknown API key
+func draftPartner(w http.ResponseWriter, r *http.Request) (Partner, bool) {
+	partner, ok := GetPartner(r)
+	if !ok {
+		WriteError(w, http.StatusUnauthorized, codeUnknownAPIKey, "The API key is not recognized.")
+	}
+	return partner, ok
+}
+
+// Method to start a draft receipt from whatever fields the body has so far. The draft
+// belongs to the partner whose API key started it.
+func (s *Server) CreateDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	partner, ok := draftPartner(w, r)
+	if !ok {
+		return
+	}
+	var draft Receipt
+	body := http.MaxBytesReader(w, r.Body, int64(config.MaxBodyBytes))
+	err := json.NewDecoder(body).Decode(&draft)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidReceipt, "The draft is not valid JSON.")
+		return
+	}
+
+	// Drafts started with a sandbox partner's key or for the sandbox tenant get sandbox IDs
+	draft = Receipt{
+		ID:               s.newDraftID(IsSandbox(partner, r.Header.Get("X-Tenant-ID"))),
+		Retailer:         draft.Retailer,
+		PurchaseDate:     draft.PurchaseDate,
+		PurchaseTime:     draft.PurchaseTime,
+		PurchaseDateTime: draft.PurchaseDateTime,
+		Items:            draft.Items,
+		Total:            draft.Total,
+		Locale:           draft.Locale,
+		PaymentMethod:    draft.PaymentMethod,
+		LoyaltyNumber:    draft.LoyaltyNumber,
+		Tenant:           r.Header.Get("X-Tenant-ID"),
+		Partner:          partner.Name,
+		Status:           statusDraft,
+	}
+	if draft.Items == nil {
+		draft.Items = []Item{}
+	}
+
+	draftsMu.Lock()
+	expireDrafts(s.Clock.Now())
+	s.saveDraft(&draft)
+	draftsMu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(draft)
+}
+
+// Method to look up one of the partner's drafts; finalized drafts are shown as they were
+// submitted, with their status, and the receipt itself is looked up as any other
+func (s *Server) GetDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+	partner, ok := draftPartner(w, r)
+	if !ok {
+		return
+	}
+	rejection := CheckIDPrefix(id, IsSandboxRequest(r))
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+
+	draftsMu.Lock()
+	draft, ok := s.findDraft(id, partner)
+	draftsMu.Unlock()
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeReceiptNotFound, "No draft found for that ID.")
+		return
+	}
+	json.NewEncoder(w).Encode(draft)
+}
+
+// Method to change the top level fields of a draft; fields missing from the body are kept
+func (s *Server) UpdateDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var changes Receipt
+	body := http.MaxBytesReader(w, r.Body, int64(config.MaxBodyBytes))
+	err := json.NewDecoder(body).Decode(&changes)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidReceipt, "The draft is not valid JSON.")
+		return
+	}
+
+	s.editDraft(w, r, func(draft *Receipt) *Rejection {
+		setIfGiven(&draft.Retailer, changes.Retailer)
+		setIfGiven(&draft.PurchaseDate, changes.PurchaseDate)
+		setIfGiven(&draft.PurchaseTime, changes.PurchaseTime)
+		setIfGiven(&draft.PurchaseDateTime, changes.PurchaseDateTime)
+		setIfGiven(&draft.Total, changes.Total)
+		setIfGiven(&draft.Locale, changes.Locale)
+		setIfGiven(&draft.PaymentMethod, changes.PaymentMethod)
+		setIfGiven(&draft.LoyaltyNumber, changes.LoyaltyNumber)
+		return nil
+	})
+}
+
+// Overwrites a field with a new value, unless the new value is empty
+func setIfGiven(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
+
+// Method to append an item to a draft
+func (s *Server) AddDraftItem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var item Item
+	body := http.MaxBytesReader(w, r.Body, int64(config.MaxBodyBytes))
+	err := json.NewDecoder(body).Decode(&item)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidReceipt, "The item is not valid JSON.")
+		return
+	}
+
+	s.editDraft(w, r, func(draft *Receipt) *Rejection {
+		maxItems := CurrentProgram().Limits.MaxItems
+		if len(draft.Items) >= maxItems {
+			message := fmt.Sprintf("The draft already has the limit of %d items.", maxItems)
+			return &Rejection{http.StatusBadRequest, codeLimitExceeded, message}
+		}
+		// Capping the capacity makes append copy, so earlier copies of the draft never change
+		draft.Items = append(draft.Items[:len(draft.Items):len(draft.Items)], Item{
+			ShortDescription: item.ShortDescription,
+			Price:            item.Price,
+		})
+		return nil
+	})
+}
+
+// Applies a change to the partner's draft named in the path, if it is still being built,
+// and writes the result
+func (s *Server) editDraft(w http.ResponseWriter, r *http.Request, edit func(draft *Receipt) *Rejection) {
+	id := mux.Vars(r)["id"]
+	partner, ok := draftPartner(w, r)
+	if !ok {
+		return
+	}
+	rejection := CheckIDPrefix(id, IsSandboxRequest(r))
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	draftsMu.Lock()
+	defer draftsMu.Unlock()
+	draft, ok := s.findDraft(id, partner)
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeReceiptNotFound, "No draft found for that ID.")
+		return
+	}
+	if draft.Status != statusDraft {
+		WriteError(w, http.StatusConflict, codeDraftNotEditable, "The draft has already been "+draft.Status+".")
+		return
+	}
+
+	rejection = edit(&draft)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	s.saveDraft(&draft)
+	json.NewEncoder(w).Encode(draft)
+}
+
+// Method to finalize one of the partner's drafts: it is submitted as /receipts/process
+// submissions are, with the same signature and submission token checks, and either
+// becomes a processed receipt under the same ID, waits in the spool under it while
+// changes can't be saved, or is marked rejected with the reason
+func (s *Server) FinalizeDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+
+	// Read in full, since signatures cover the exact bytes
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(config.MaxBodyBytes)))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		message := fmt.Sprintf("The request body is larger than %d bytes.", config.MaxBodyBytes)
+		WriteError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, message)
+		return
+	}
+	partner, ok := draftPartner(w, r)
+	if !ok {
+		return
+	}
+	release := func() {}
+	rejection := CheckIDPrefix(id, IsSandboxRequest(r))
+	if rejection == nil {
+		rejection = s.CheckSignature(r, partner, body)
+	}
+	if rejection == nil {
+		release, rejection = s.CheckSubmissionToken(r, partner)
+	}
+	provenance, invalid := RequestProvenance(r, sourceNative)
+	if rejection == nil {
+		rejection = invalid
+	}
+	if rejection != nil {
+		release()
+		CountRejection(rejection.Code, s.Clock.Now())
+		WriteRejection(w, rejection)
+		return
+	}
+
+	// Claim the draft so it can't be edited or finalized twice while processing
+	draftsMu.Lock()
+	draft, ok := s.findDraft(id, partner)
+	claimed := ok && draft.Status == statusDraft
+	if claimed {
+		draft.Status = statusSubmitted
+		s.saveDraft(&draft)
+	}
+	draftsMu.Unlock()
+	if !claimed {
+		release()
+	}
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeReceiptNotFound, "No draft found for that ID.")
+		return
+	}
+	if !claimed {
+		WriteError(w, http.StatusConflict, codeDraftNotEditable, "The draft has already been "+draft.Status+".")
+		return
+	}
+
+	submitted := draft
+	submitted.Status = ""
+	submitted.UpdatedAt = nil
+	submitted.Provenance = provenance
+
+	// While changes can't be saved, the draft waits in the spool to be processed, and
+	// stays submitted
+	if s.Spooling() {
+		_, rejection := s.SpoolReceipt(r.Context(), submitted, partner)
+		if rejection != nil {
+			release()
+			draftsMu.Lock()
+			draft.Status = statusDraft
+			s.saveDraft(&draft)
+			draftsMu.Unlock()
+			w.Header().Set("Retry-After", strconv.Itoa(config.ReadOnlyRetryAfterSeconds))
+			WriteRejection(w, rejection)
+			return
+		}
+		WritePending(w, id)
+		return
+	}
+
+	receipt, warnings, rejection := s.ProcessReceipt(r.Context(), submitted, partner)
+	if rejection != nil {
+		release()
+	}
+
+	draftsMu.Lock()
+	switch {
+	case rejection != nil && rejection.Code == codeDeadlineExceeded:
+		// Nothing was stored, so the draft can be finalized again
+		draft.Status = statusDraft
+	case rejection != nil:
+		draft.Status = statusRejected
+		draft.RejectionReason = rejection.Message
+	default:
+		draft.Status = statusProcessed
+	}
+	s.saveDraft(&draft)
+	draftsMu.Unlock()
+
+	if rejection != nil {
+		CountRejection(rejection.Code, s.Clock.Now())
+		WriteRejection(w, rejection)
+		return
+	}
+	s.Announce(r.Context(), "receipt."+receipt.Status, receipt)
+	WriteIDResponse(w, receipt, warnings)
+}
@@ -0,0 +1,286 @@
+package receiptapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Returns a server with an empty store, with no drafts until the test ends
+func newDraftServer(t *testing.T) *Server {
+	t.Helper()
+	saved := drafts
+	t.Cleanup(func() { drafts = saved })
+	drafts = map[string]Receipt{}
+	return New()
+}
+
+// Calls a draft handler with the body, and the draft ID as the {id} route variable
+func callDraft(handler http.HandlerFunc, id string, body string) *httptest.ResponseRecorder {
+	return callDraftAs(handler, "", id, body)
+}
+
+// Calls a draft handler as callDraft does, with a partner's API key
+func callDraftAs(handler http.HandlerFunc, key string, id string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/receipts/drafts/"+id, strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"id": id})
+	r.Header.Set("X-API-Key", key)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// Finalizes a draft with a partner's API key and a submission token issued to the
+// partner, and returns the response and the token
+func finalizeDraft(s *Server, key string, id string) (*httptest.ResponseRecorder, string) {
+	now := s.Clock.Now()
+	token := s.SubmissionTokens.Issue(partners[key].Name, now, now.Add(time.Hour))
+	r := httptest.NewRequest("POST", "/receipts/drafts/"+id+"/finalize", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": id})
+	r.Header.Set("X-API-Key", key)
+	r.Header.Set("X-Submission-Token", token)
+	w := httptest.NewRecorder()
+	s.FinalizeDraft(w, r)
+	return w, token
+}
+
+// Starts a draft with the body and returns it
+func createDraft(t *testing.T, s *Server, body string) Receipt {
+	t.Helper()
+	w := callDraft(s.CreateDraft, "", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("CreateDraft() status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var draft Receipt
+	json.NewDecoder(w.Body).Decode(&draft)
+	return draft
+}
+
+func TestDraftLifecycle(t *testing.T) {
+	s := newDraftServer(t)
+	draft := createDraft(t, s, `{"retailer": "Target"}`)
+	if draft.Status != statusDraft || draft.Retailer != "Target" || len(draft.Items) != 0 {
+		t.Fatalf("CreateDraft() = %+v, want an empty Target draft", draft)
+	}
+
+	steps := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"update", s.UpdateDraft, `{"purchaseDate": "2022-01-01", "purchaseTime": "13:01"}`},
+		{"add item", s.AddDraftItem, `{"shortDescription": "Mountain Dew 12PK", "price": "6.49"}`},
+		{"add item", s.AddDraftItem, `{"shortDescription": "Emils Cheese Pizza", "price": "12.25"}`},
+		{"update total", s.UpdateDraft, `{"total": "18.74"}`},
+	}
+	for _, step := range steps {
+		w := callDraft(step.handler, draft.ID, step.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, http.StatusOK, w.Body)
+		}
+	}
+
+	w := callDraft(s.GetDraft, draft.ID, "")
+	json.NewDecoder(w.Body).Decode(&draft)
+	if draft.Retailer != "Target" || draft.PurchaseTime != "13:01" || len(draft.Items) != 2 || draft.Total != "18.74" {
+		t.Fatalf("GetDraft() = %+v, want the fields set so far", draft)
+	}
+
+	w, _ = finalizeDraft(s, "", draft.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("FinalizeDraft() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var response IDResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	receipt, ok := s.Store.Find(draft.ID)
+	if response.ID != draft.ID || !ok || receipt.Status != statusProcessed {
+		t.Fatalf("FinalizeDraft() stored %+v as %q, want the draft processed under its own ID", receipt, response.ID)
+	}
+
+	for _, handler := range []http.HandlerFunc{s.UpdateDraft, s.AddDraftItem} {
+		w = callDraft(handler, draft.ID, `{"retailer": "Walmart"}`)
+		if w.Code != http.StatusConflict {
+			t.Errorf("changing a finalized draft: status = %d, want %d", w.Code, http.StatusConflict)
+		}
+	}
+	if w, _ = finalizeDraft(s, "", draft.ID); w.Code != http.StatusConflict {
+		t.Errorf("finalizing a finalized draft: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestFinalizeInvalidDraft(t *testing.T) {
+	s := newDraftServer(t)
+	draft := createDraft(t, s, `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01"}`)
+
+	w, token := finalizeDraft(s, "", draft.ID)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("FinalizeDraft() status = %d for a draft without items or total, want %d", w.Code, http.StatusBadRequest)
+	}
+	if rejection := s.SubmissionTokens.Use("", token, s.Clock.Now()); rejection != nil {
+		t.Errorf("submission token after the draft was turned away: %+v, want it usable again", rejection)
+	}
+	w = callDraft(s.GetDraft, draft.ID, "")
+	json.NewDecoder(w.Body).Decode(&draft)
+	if draft.Status != statusRejected || draft.RejectionReason == "" {
+		t.Errorf("GetDraft() = status %q, reason %q, want it rejected with a reason", draft.Status, draft.RejectionReason)
+	}
+	if _, ok := s.Store.Find(draft.ID); ok {
+		t.Error("FinalizeDraft() stored a rejected draft")
+	}
+
+	w = callDraft(s.AddDraftItem, draft.ID, `{"shortDescription": "Gatorade", "price": "2.25"}`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("AddDraftItem() status = %d for a rejected draft, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestEditDraftErrors(t *testing.T) {
+	s := newDraftServer(t)
+	withConfig(t, func(config *Config) { config.MaxItems = 1 })
+	draft := createDraft(t, s, `{"items": [{"shortDescription": "Gatorade", "price": "2.25"}]}`)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		id      string
+		body    string
+		status  int
+		code    string
+	}{
+		{"unknown draft", s.UpdateDraft, "missing", `{"total": "1.00"}`, http.StatusNotFound, codeReceiptNotFound},
+		{"unknown draft item", s.AddDraftItem, "missing", `{"price": "1.00"}`, http.StatusNotFound, codeReceiptNotFound},
+		{"lookup of unknown draft", s.GetDraft, "missing", "", http.StatusNotFound, codeReceiptNotFound},
+		{"invalid update", s.UpdateDraft, draft.ID, `{"total": `, http.StatusBadRequest, codeInvalidReceipt},
+		{"invalid item", s.AddDraftItem, draft.ID, `[]`, http.StatusBadRequest, codeInvalidReceipt},
+		{"too many items", s.AddDraftItem, draft.ID, `{"shortDescription": "Pizza", "price": "1.00"}`, http.StatusBadRequest, codeLimitExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := callDraft(test.handler, test.id, test.body)
+			var response ErrorResponse
+			json.NewDecoder(w.Body).Decode(&response)
+			if w.Code != test.status || response.Code != test.code {
+				t.Errorf("status = %d, code %q, want %d, %q", w.Code, response.Code, test.status, test.code)
+			}
+		})
+	}
+}
+
+func TestDraftsBelongToTheirPartner(t *testing.T) {
+	withoutPartners(t)
+	partners["acme-key"] = Partner{Name: "acme", Key: "acme-key"}
+	partners["other-key"] = Partner{Name: "other", Key: "other-key"}
+	s := newDraftServer(t)
+	w := callDraftAs(s.CreateDraft, "acme-key", "", `{"retailer": "Target"}`)
+	var draft Receipt
+	json.NewDecoder(w.Body).Decode(&draft)
+	stored := s.Store.Add(Receipt{ID: "stored", Retailer: "Walmart"})
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		key     string
+		id      string
+		status  int
+	}{
+		{"own draft", s.GetDraft, "acme-key", draft.ID, http.StatusOK},
+		{"another partner's draft", s.GetDraft, "other-key", draft.ID, http.StatusNotFound},
+		{"keyless lookup", s.GetDraft, "", draft.ID, http.StatusNotFound},
+		{"stored receipt that isn't a draft", s.GetDraft, "", stored.ID, http.StatusNotFound},
+		{"update of another partner's draft", s.UpdateDraft, "other-key", draft.ID, http.StatusNotFound},
+		{"finalizing another partner's draft", s.FinalizeDraft, "other-key", draft.ID, http.StatusNotFound},
+		{"unknown API key", s.GetDraft, "wrong-key", draft.ID, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := callDraftAs(test.handler, test.key, test.id, `{"total": "1.00"}`)
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestDraftsExpire(t *testing.T) {
+	withConfig(t, func(config *Config) { config.DraftTTLSeconds = 60 })
+	s := newDraftServer(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.Clock = FixedClock{start}
+	draft := createDraft(t, s, `{"retailer": "Target"}`)
+
+	// Each change keeps the draft for another TTL
+	s.Clock = FixedClock{start.Add(50 * time.Second)}
+	if w := callDraft(s.UpdateDraft, draft.ID, `{"total": "1.00"}`); w.Code != http.StatusOK {
+		t.Fatalf("UpdateDraft() status = %d before the draft expired, want %d", w.Code, http.StatusOK)
+	}
+	s.Clock = FixedClock{start.Add(100 * time.Second)}
+	if w := callDraft(s.GetDraft, draft.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("GetDraft() status = %d within the TTL of the last change, want %d", w.Code, http.StatusOK)
+	}
+	s.Clock = FixedClock{start.Add(110 * time.Second)}
+	if w := callDraft(s.GetDraft, draft.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("GetDraft() status = %d once expired, want %d", w.Code, http.StatusNotFound)
+	}
+	draftsMu.Lock()
+	_, kept := drafts[draft.ID]
+	draftsMu.Unlock()
+	if kept {
+		t.Error("expired draft is still kept")
+	}
+}
+
+func TestFinalizeDraftChecks(t *testing.T) {
+	withoutPartners(t)
+	partners["signed-key"] = Partner{Name: "signed", Key: "signed-key", SigningSecret: "secret", RequireSignature: true}
+	partners["token-key"] = Partner{Name: "token", Key: "token-key", RequireSubmissionToken: true}
+	tests := []struct {
+		name   string
+		key    string
+		status int
+		code   string
+	}{
+		{"unsigned", "signed-key", http.StatusUnauthorized, codeInvalidSignature},
+		{"without a token the partner requires", "token-key", http.StatusBadRequest, codeInvalidSubmissionToken},
+		{"without an API key or token", "", http.StatusBadRequest, codeInvalidSubmissionToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newDraftServer(t)
+			w := callDraftAs(s.CreateDraft, test.key, "", `{"retailer": "Target", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "total": "1.00", "items": [{"shortDescription": "Pizza", "price": "1.00"}]}`)
+			var draft Receipt
+			json.NewDecoder(w.Body).Decode(&draft)
+
+			w = callDraftAs(s.FinalizeDraft, test.key, draft.ID, "")
+			var response ErrorResponse
+			json.NewDecoder(w.Body).Decode(&response)
+			if w.Code != test.status || response.Code != test.code {
+				t.Errorf("FinalizeDraft() = %d, %q, want %d, %q", w.Code, response.Code, test.status, test.code)
+			}
+			if _, ok := s.Store.Find(draft.ID); ok {
+				t.Error("FinalizeDraft() stored a draft that failed the checks")
+			}
+			w = callDraftAs(s.GetDraft, test.key, draft.ID, "")
+			json.NewDecoder(w.Body).Decode(&draft)
+			if draft.Status != statusDraft {
+				t.Errorf("draft status = %q, want it still a draft", draft.Status)
+			}
+		})
+	}
+}
+
+func TestSpoolKeepsDraftID(t *testing.T) {
+	withSpool(t)
+	s := newDraftServer(t)
+	receipt := targetReceipt
+	receipt.ID = "draft-id"
+	id, rejection := s.SpoolReceipt(context.Background(), receipt, Partner{})
+	if rejection != nil || id != "draft-id" {
+		t.Errorf("SpoolReceipt() = %q, %+v, want the draft's own ID", id, rejection)
+	}
+}
@@ -0,0 +1,113 @@
+package receiptapi
+
+import (
+	"strings"
+	"time"
+)
+
+// Ways a partner's receipts are checked for duplicates of stored ones
+const (
+	duplicatesExact  = "exact"
+	duplicatesWindow = "window"
+	duplicatesOff    = "off"
+)
+
+// Checks a partner's duplicate detection settings, returning why they can't be used
+func checkDuplicateDetection(strategy string, windowMinutes int) string {
+	switch strategy {
+	case "", duplicatesExact, duplicatesOff:
+		if windowMinutes != 0 {
+			return "duplicateWindowMinutes is only used with the window duplicate detection."
+		}
+	case duplicatesWindow:
+		if windowMinutes <= 0 {
+			return "The window duplicate detection needs a positive duplicateWindowMinutes."
+		}
+	default:
+		return "Unknown duplicate detection " + strategy + "; it must be exact, window or off."
+	}
+	return ""
+}
+
+// Returns the stored receipt a partner's receipt looks like a duplicate of, with the
+// warning to give about it, and whether there is one. Partners without a duplicate
+// detection of their own get the near duplicate check with the configured window.
+func (s *Server) FindDuplicate(receipt Receipt, partner Partner) (Receipt, string, bool) {
+	var original Receipt
+	var found bool
+	switch partner.DuplicateDetection {
+	case duplicatesOff:
+		return Receipt{}, "", false
+	case duplicatesExact:
+		original, found = s.FindExactDuplicate(receipt)
+		return original, "Duplicate of receipt " + original.ID + " with the same content.", found
+	case duplicatesWindow:
+		original, found = s.FindNearDuplicate(receipt, time.Duration(partner.DuplicateWindowMinutes)*time.Minute)
+	default:
+		original, found = s.FindNearDuplicate(receipt, time.Duration(config.NearDuplicateWindowMinutes)*time.Minute)
+	}
+	return original, "Possible duplicate of receipt " + original.ID + " from the same retailer with the same total.", found
+}
+
+// Returns the first stored receipt with the same content fingerprint as this one, the
+// same one content derived IDs are made from but from any partner, and whether there is
+// one. This catches identical resubmissions whatever the ID scheme.
+func (s *Server) FindExactDuplicate(receipt Receipt) (Receipt, bool) {
+	receipt.Partner = ""
+	fingerprint := GenerateContentID(receipt)
+	for _, stored := range s.Store.All() {
+		if stored.ID == receipt.ID || stored.Status == statusDraft || stored.Status == statusRejected {
+			continue
+		}
+		unowned := stored
+		unowned.Partner = ""
+		if GenerateContentID(unowned) == fingerprint {
+			return stored, true
+		}
+	}
+	return Receipt{}, false
+}
+
+// Returns the first stored receipt from the same retailer, with the same total, bought
+// within the window of this one, and whether there is one. Unlike the content ID, which
+// only matches identical receipts, this catches the same purchase submitted again with
+// its time a few minutes off or its items typed differently.
+func (s *Server) FindNearDuplicate(receipt Receipt, window time.Duration) (Receipt, bool) {
+	if window <= 0 {
+		return Receipt{}, false
+	}
+	purchased, ok := purchaseInstant(s.Clock, receipt)
+	if !ok {
+		return Receipt{}, false
+	}
+	total, err := ParseCents(receipt.Total)
+	if err != nil {
+		return Receipt{}, false
+	}
+	retailer := strings.TrimSpace(receipt.Retailer)
+
+	for _, stored := range s.Store.All() {
+		// Drafts and rejected receipts earned nothing, so there's nothing to claim twice
+		if stored.ID == receipt.ID || stored.Sandbox != receipt.Sandbox || stored.Status == statusDraft || stored.Status == statusRejected {
+			continue
+		}
+		if !strings.EqualFold(strings.TrimSpace(stored.Retailer), retailer) {
+			continue
+		}
+		storedTotal, err := ParseCents(stored.Total)
+		if err != nil || storedTotal != total {
+			continue
+		}
+		storedPurchased, ok := purchaseInstant(s.Clock, stored)
+		if ok && storedPurchased.Sub(purchased).Abs() <= window {
+			return stored, true
+		}
+	}
+	return Receipt{}, false
+}
+
+// Returns when a receipt's purchase was made, in the clock's time zone
+func purchaseInstant(clock Clock, receipt Receipt) (time.Time, bool) {
+	purchased, err := time.ParseInLocation(dateLayout+" 15:04", receipt.PurchaseDate+" "+receipt.PurchaseTime, clock.Location())
+	return purchased, err == nil
+}
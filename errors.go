@@ -0,0 +1,142 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Codes identifying why a request failed
+const (
+	codeInvalidReceipt  = "invalid_receipt"
+	codeReceiptNotFound = "receipt_not_found"
+	codeInvalidCursor   = "invalid_cursor"
+	codeInvalidQuery    = "invalid_query"
+	codeFutureReceipt   = "receipt_in_future"
+	codeStaleReceipt    = "receipt_too_old"
+	codeLimitExceeded   = "limit_exceeded"
+	codePayloadTooLarge = "payload_too_large"
+	codeUnknownLocale   = "unknown_locale"
+	codeUnknownAPIKey   = "unknown_api_key"
+	codeUnauthorized    = "unauthorized"
+	codeWrongUser       = "wrong_user"
+
+	codeDraftNotEditable = "draft_not_editable"
+	codeInvalidReview    = "invalid_review"
+	codeNotPendingReview = "not_pending_review"
+	codeUnknownJobType   = "unknown_job_type"
+	codeJobNotFound      = "job_not_found"
+	codeJobFinished      = "job_finished"
+
+	codeDeletePreviewNotFound = "delete_preview_not_found"
+	codeInvalidLogLevel       = "invalid_log_level"
+	codeInvalidReadOnly       = "invalid_read_only"
+	codeReadOnly              = "read_only"
+	codeOverloaded            = "overloaded"
+	codeRateLimited           = "rate_limited"
+	codeInvalidRequestTimeout = "invalid_request_timeout"
+	codeDeadlineExceeded      = "deadline_exceeded"
+
+	codeInvalidLoyaltyNumber = "invalid_loyalty_number"
+	codeLoyaltyNumberTaken   = "loyalty_number_taken"
+
+	codeInvalidPartner  = "invalid_partner"
+	codePartnerExists   = "partner_exists"
+	codePartnerNotFound = "partner_not_found"
+
+	codeCredentialsManaged   = "credentials_managed"
+	codeWebhookEventNotFound = "webhook_event_not_found"
+	codeInvalidSubscription  = "invalid_subscription"
+	codeSubscriptionNotFound = "subscription_not_found"
+
+	codeInvalidSignature = "invalid_signature"
+	codeReplayedRequest  = "replayed_request"
+	codeBlobNotFound     = "blob_not_found"
+	codeInternal         = "internal_error"
+
+	codeInvalidSubmissionToken = "invalid_submission_token"
+	codeSubmissionTokenUsed    = "submission_token_used"
+
+	codeUnknownReceiptSource = "unknown_receipt_source"
+	codeWrongIDPrefix        = "wrong_id_prefix"
+	codeUnsupportedCurrency  = "unsupported_currency"
+
+	codeInvalidRedemption  = "invalid_redemption"
+	codeInsufficientPoints = "insufficient_points"
+	codeRedemptionNotFound = "redemption_not_found"
+	codeRedemptionSettled  = "redemption_settled"
+
+	codeInvalidTransfer       = "invalid_transfer"
+	codeTransferLimitExceeded = "transfer_limit_exceeded"
+
+	codeInvalidDispute  = "invalid_dispute"
+	codeDisputeNotFound = "dispute_not_found"
+	codeDisputeOpen     = "dispute_open"
+	codeDisputeResolved = "dispute_resolved"
+
+	codeInvalidProgram         = "invalid_program"
+	codeProgramVersionConflict = "program_version_conflict"
+	codeCandidateNotFound      = "candidate_not_found"
+
+	codeSigningNotConfigured    = "signing_not_configured"
+	codeInvalidProgramSignature = "invalid_program_signature"
+
+	codeInvalidImpersonation   = "invalid_impersonation"
+	codeImpersonationForbidden = "impersonation_forbidden"
+
+	codeInvalidChannel = "invalid_channel"
+
+	codeMigrationNotFound = "migration_not_found"
+	codeMigrationNotReady = "migration_not_ready"
+
+	codeInvalidStatement           = "invalid_statement"
+	codeNotificationsNotConfigured = "notifications_not_configured"
+	codeStatementNotDelivered      = "statement_not_delivered"
+
+	codeInvalidFeatureOverrides   = "invalid_feature_overrides"
+	codeFeatureOverridesForbidden = "feature_overrides_forbidden"
+
+	codeBudgetNotConfigured = "budget_not_configured"
+)
+
+// Response when a request fails
+type ErrorResponse struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// Reason a request was turned away, to be written as an error response
+type Rejection struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// Returns the rejection for a receipt that fails validation
+func InvalidReceipt() *Rejection {
+	return &Rejection{http.StatusBadRequest, codeInvalidReceipt, invalidReceiptMessage}
+}
+
+// Writes the error response for a rejection
+func WriteRejection(w http.ResponseWriter, rejection *Rejection) {
+	WriteError(w, rejection.Status, rejection.Code, rejection.Message)
+}
+
+// Writes an error response as JSON with a code, or in Fetch compatibility mode as
+// the exact plain text the spec uses for that status
+func WriteError(w http.ResponseWriter, status int, code string, message string) {
+	if config.FetchCompat {
+		switch status {
+		case http.StatusBadRequest:
+			message = invalidReceiptMessage
+		case http.StatusNotFound:
+			message = receiptNotFoundMessage
+		}
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Code: code, Error: message})
+}
@@ -0,0 +1,89 @@
+package receiptapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Event about a change to a receipt, published to the configured broker and sent to the
+// webhook of the partner that submitted it
+type ReceiptEvent struct {
+	ID        string       `json:"id"`
+	Type      string       `json:"type"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Partner   string       `json:"partner,omitempty"`
+	Receipt   EventReceipt `json:"receipt"`
+}
+
+// What an event tells about a receipt
+type EventReceipt struct {
+	ID              string `json:"id"`
+	ShortCode       string `json:"shortCode"`
+	ExternalID      string `json:"externalId,omitempty"`
+	Status          string `json:"status"`
+	Points          int64  `json:"points"`
+	RejectionReason string `json:"rejectionReason,omitempty"`
+	Sandbox         bool   `json:"sandbox,omitempty"`
+}
+
+// Publishes events to a message broker under a topic, such as "receipt.processed"
+type EventPublisher interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+	Close() error
+}
+
+// Returns the event publisher selected by the configuration, or nil if none is
+func NewEventPublisher(config Config) (EventPublisher, error) {
+	switch config.EventPublisher {
+	case "":
+		return nil, nil
+	case "nats":
+		return &NATSPublisher{URL: config.NATSURL, SubjectPrefix: config.NATSSubjectPrefix}, nil
+	case "amqp":
+		return &AMQPPublisher{URL: config.AMQPURL, Exchange: config.AMQPExchange}, nil
+	}
+	return nil, fmt.Errorf("unknown EVENT_PUBLISHER %q", config.EventPublisher)
+}
+
+// Announces a change to a receipt: publishes it to the broker, if there is one, and
+// sends it to the partner's webhook and every subscription it matches. All happen in the
+// background, continuing the context's trace.
+func (s *Server) Announce(ctx context.Context, eventType string, receipt Receipt) {
+	event := ReceiptEvent{
+		ID:        GenerateID(),
+		Type:      eventType,
+		CreatedAt: s.Clock.Now().UTC(),
+		Partner:   receipt.Partner,
+		Receipt: EventReceipt{
+			ID:              receipt.ID,
+			ShortCode:       receipt.ShortCode,
+			ExternalID:      receipt.ExternalID,
+			Status:          receipt.Status,
+			Points:          AwardedPoints(receipt),
+			RejectionReason: receipt.RejectionReason,
+			Sandbox:         receipt.Sandbox,
+		},
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logApp.Error("Could not encode event", "error", err)
+		return
+	}
+
+	if s.Events != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+			defer cancel()
+			ctx, span := StartSpan(ctx, "events.publish")
+			err := s.Events.Publish(ctx, eventType, body)
+			span.End(logApp, "type", eventType)
+			if err != nil {
+				logApp.ErrorContext(ctx, "Could not publish event", "type", eventType, "error", err)
+			}
+		}()
+	}
+	s.NotifyPartner(ctx, event, body)
+	s.NotifySubscribers(ctx, event, receipt, body)
+}
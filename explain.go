@@ -0,0 +1,212 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Language explanations are written in when the request's isn't one we have messages for
+const defaultExplanationLanguage = "en"
+
+// Messages explaining points, by language and then by rule or line. Arguments are
+// indexed, since languages order them differently.
+var explanationMessages = map[string]map[string]string{
+	"en": {
+		"retailerName":         "Retailer '%[1]s' has %[2]d alphanumeric characters: +%[3]d points",
+		"roundDollarTotal":     "Total %[1]s is a round dollar amount: +%[2]d points",
+		"quarterMultipleTotal": "Total %[1]s is a multiple of 0.25: +%[2]d points",
+		"itemPairs":            "%[1]d pairs of items: +%[2]d points",
+		"itemDescriptions":     "Item descriptions with a length that is a multiple of 3: +%[1]d points",
+		"oddDay":               "Purchased on day %[1]d of the month, an odd day: +%[2]d points",
+		"afternoon":            "Purchased at %[1]s, between 2:00pm and 4:00pm: +%[2]d points",
+		"merchantCategory":     "Bonus for merchant category %[1]s: +%[2]d points",
+		"paymentMethod":        "Bonus for paying by %[1]s: +%[2]d points",
+		"products":             "Bonus for sponsored products: +%[1]d points",
+		"rule":                 "%[1]s: +%[2]d points",
+		"none":                 "No rule awarded points",
+		"capped":               "Capped at %[1]d points per receipt: -%[2]d points",
+		"submitted":            "Held for review: the points are awarded once it is approved",
+		"rejected":             "Rejected in review: no points are awarded",
+		"total":                "Total: %[1]d points",
+	},
+	"es": {
+		"retailerName":         "El comercio '%[1]s' tiene %[2]d caracteres alfanuméricos: +%[3]d puntos",
+		"roundDollarTotal":     "El total %[1]s es una cantidad redonda: +%[2]d puntos",
+		"quarterMultipleTotal": "El total %[1]s es múltiplo de 0,25: +%[2]d puntos",
+		"itemPairs":            "%[1]d pares de artículos: +%[2]d puntos",
+		"itemDescriptions":     "Descripciones de artículos cuya longitud es múltiplo de 3: +%[1]d puntos",
+		"oddDay":               "Comprado el día %[1]d del mes, un día impar: +%[2]d puntos",
+		"afternoon":            "Comprado a las %[1]s, entre las 14:00 y las 16:00: +%[2]d puntos",
+		"merchantCategory":     "Bonificación por la categoría de comercio %[1]s: +%[2]d puntos",
+		"paymentMethod":        "Bonificación por pagar con %[1]s: +%[2]d puntos",
+		"products":             "Bonificación por productos patrocinados: +%[1]d puntos",
+		"rule":                 "%[1]s: +%[2]d puntos",
+		"none":                 "Ninguna regla otorgó puntos",
+		"capped":               "Limitado a %[1]d puntos por recibo: -%[2]d puntos",
+		"submitted":            "En revisión: los puntos se otorgan cuando se apruebe",
+		"rejected":             "Rechazado en la revisión: no se otorgan puntos",
+		"total":                "Total: %[1]d puntos",
+	},
+	"fr": {
+		"retailerName":         "Le commerçant « %[1]s » compte %[2]d caractères alphanumériques : +%[3]d points",
+		"roundDollarTotal":     "Le total %[1]s est un montant rond : +%[2]d points",
+		"quarterMultipleTotal": "Le total %[1]s est un multiple de 0,25 : +%[2]d points",
+		"itemPairs":            "%[1]d paires d'articles : +%[2]d points",
+		"itemDescriptions":     "Descriptions d'articles dont la longueur est un multiple de 3 : +%[1]d points",
+		"oddDay":               "Acheté le %[1]d du mois, un jour impair : +%[2]d points",
+		"afternoon":            "Acheté à %[1]s, entre 14 h et 16 h : +%[2]d points",
+		"merchantCategory":     "Bonus pour la catégorie de commerçant %[1]s : +%[2]d points",
+		"paymentMethod":        "Bonus pour le paiement par %[1]s : +%[2]d points",
+		"products":             "Bonus pour les produits sponsorisés : +%[1]d points",
+		"rule":                 "%[1]s : +%[2]d points",
+		"none":                 "Aucune règle n'a attribué de points",
+		"capped":               "Plafonné à %[1]d points par reçu : -%[2]d points",
+		"submitted":            "En cours de vérification : les points seront attribués après approbation",
+		"rejected":             "Refusé lors de la vérification : aucun point n'est attribué",
+		"total":                "Total : %[1]d points",
+	},
+	"de": {
+		"retailerName":         "Händler „%[1]s“ hat %[2]d alphanumerische Zeichen: +%[3]d Punkte",
+		"roundDollarTotal":     "Summe %[1]s ist ein runder Betrag: +%[2]d Punkte",
+		"quarterMultipleTotal": "Summe %[1]s ist ein Vielfaches von 0,25: +%[2]d Punkte",
+		"itemPairs":            "%[1]d Artikelpaare: +%[2]d Punkte",
+		"itemDescriptions":     "Artikelbeschreibungen, deren Länge ein Vielfaches von 3 ist: +%[1]d Punkte",
+		"oddDay":               "Am %[1]d. des Monats gekauft, einem ungeraden Tag: +%[2]d Punkte",
+		"afternoon":            "Um %[1]s gekauft, zwischen 14:00 und 16:00 Uhr: +%[2]d Punkte",
+		"merchantCategory":     "Bonus für die Händlerkategorie %[1]s: +%[2]d Punkte",
+		"paymentMethod":        "Bonus für die Zahlung mit %[1]s: +%[2]d Punkte",
+		"products":             "Bonus für gesponserte Produkte: +%[1]d Punkte",
+		"rule":                 "%[1]s: +%[2]d Punkte",
+		"none":                 "Keine Regel hat Punkte vergeben",
+		"capped":               "Begrenzt auf %[1]d Punkte pro Beleg: -%[2]d Punkte",
+		"submitted":            "In Prüfung: die Punkte werden nach der Freigabe vergeben",
+		"rejected":             "In der Prüfung abgelehnt: es werden keine Punkte vergeben",
+		"total":                "Gesamt: %[1]d Punkte",
+	},
+}
+
+// Response explaining a receipt's points in words, one line per rule that awarded any
+type ExplanationResponse struct {
+	ID     string   `json:"id"`
+	Locale string   `json:"locale"`
+	Points int64    `json:"points"`
+	Lines  []string `json:"lines"`
+}
+
+// Returns the locale to explain points in: the ?locale= parameter, or else the first
+// language in the Accept-Language header
+func explanationLocale(r *http.Request) string {
+	locale := r.URL.Query().Get("locale")
+	if locale == "" {
+		first, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+		locale, _, _ = strings.Cut(first, ";")
+	}
+	return strings.TrimSpace(locale)
+}
+
+// Returns the language of a locale that explanations are written in, falling back to the
+// default
+func explanationLanguage(locale string) string {
+	language, _, _ := strings.Cut(strings.ToLower(strings.ReplaceAll(locale, "_", "-")), "-")
+	if _, ok := explanationMessages[language]; ok {
+		return language
+	}
+	return defaultExplanationLanguage
+}
+
+// Returns a canonical amount such as "12.25" with the locale's decimal separator
+func localizeAmount(amount string, locale string) string {
+	format, ok := GetNumberFormat(locale)
+	if !ok {
+		return amount
+	}
+	return strings.Replace(amount, ".", format.Decimal, 1)
+}
+
+// Explains a receipt's points in the language of a locale, one line for each rule that
+// awarded any, then any cap, review status and the total awarded
+func ExplainPoints(receipt Receipt, rules Rules, locale string) []string {
+	messages := explanationMessages[explanationLanguage(locale)]
+	line := func(key string, args ...any) string {
+		return fmt.Sprintf(messages[key], args...)
+	}
+
+	lines := []string{}
+	var earned int64
+	for _, rule := range PointsByRule(receipt, rules) {
+		if rule.Points == 0 {
+			continue
+		}
+		earned += rule.Points
+		switch rule.Rule {
+		case "retailerName":
+			// Anonymized receipts have no retailer left to count
+			characters := rule.Points
+			if receipt.Retailer != "" {
+				characters = GetAlphanumeric(receipt.Retailer)
+			}
+			lines = append(lines, line(rule.Rule, receipt.Retailer, characters, rule.Points))
+		case "roundDollarTotal", "quarterMultipleTotal":
+			lines = append(lines, line(rule.Rule, localizeAmount(receipt.Total, locale), rule.Points))
+		case "itemPairs":
+			lines = append(lines, line(rule.Rule, rule.Points/5, rule.Points))
+		case "oddDay":
+			day, _ := strconv.Atoi(receipt.PurchaseDate[len(receipt.PurchaseDate)-2:])
+			lines = append(lines, line(rule.Rule, day, rule.Points))
+		case "afternoon":
+			lines = append(lines, line(rule.Rule, receipt.PurchaseTime, rule.Points))
+		case "merchantCategory":
+			lines = append(lines, line(rule.Rule, receipt.MCC, rule.Points))
+		case "paymentMethod":
+			lines = append(lines, line(rule.Rule, receipt.PaymentMethod, rule.Points))
+		case "itemDescriptions", "products":
+			lines = append(lines, line(rule.Rule, rule.Points))
+		default:
+			lines = append(lines, line("rule", rule.Rule, rule.Points))
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, line("none"))
+	}
+	if earned > receipt.Points {
+		lines = append(lines, line("capped", receipt.Points, earned-receipt.Points))
+	}
+	switch receipt.Status {
+	case statusSubmitted:
+		lines = append(lines, line("submitted"))
+	case statusRejected:
+		lines = append(lines, line("rejected"))
+	}
+	return append(lines, line("total", AwardedPoints(receipt)))
+}
+
+// Method to explain a receipt's points in words, for showing to its owner as is, in the
+// language of ?locale= or the Accept-Language header
+func (s *Server) GetReceiptExplanation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rejection := CheckIDPrefix(mux.Vars(r)["id"], IsSandboxRequest(r))
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	// A short code can be used in place of the ID
+	id := s.Store.ResolveShortCode(mux.Vars(r)["id"])
+	receipt, found := s.Store.Find(id)
+	if !found || receipt.Sandbox != IsSandboxRequest(r) {
+		WriteError(w, http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage)
+		return
+	}
+	locale := explanationLocale(r)
+	w.Header().Set("Content-Language", explanationLanguage(locale))
+	json.NewEncoder(w).Encode(ExplanationResponse{
+		ID:     receipt.ID,
+		Locale: explanationLanguage(locale),
+		Points: AwardedPoints(receipt),
+		Lines:  ExplainPoints(receipt, s.Rules, locale),
+	})
+}
@@ -0,0 +1,100 @@
+package receiptapi
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Minimum number of rows written between flushes of the CSV export
+const exportFlushRows = 100
+
+// Column headers of the CSV export, one row per item
+var exportHeader = []string{
+	"id",
+	"retailer",
+	"purchaseDate",
+	"purchaseTime",
+	"total",
+	"points",
+	"shortDescription",
+	"price",
+}
+
+// Method to stream all receipts as CSV; resumes after the receipt given in ?after=
+func (s *Server) ExportReceipts(w http.ResponseWriter, r *http.Request) {
+	// Take a copy of the receipts so new submissions and updates don't block the download
+	snapshot := s.Store.All()
+
+	// Find where to resume from if a cursor was given
+	start := 0
+	if after := r.URL.Query().Get("after"); after != "" {
+		start = -1
+		for i, receipt := range snapshot {
+			if receipt.ID == after {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			WriteError(w, http.StatusBadRequest, codeInvalidCursor, "No receipt found for that cursor.")
+			return
+		}
+	}
+
+	// No Content-Length is set, so the response is sent with chunked encoding
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="receipts.csv"`)
+	flusher, _ := w.(http.Flusher)
+
+	// An error means the client went away, so there's no one to tell
+	WriteReceiptsCSV(w, snapshot[start:], func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+}
+
+// Writes receipts as CSV, one row per item. flush, if given, is called periodically
+// between receipts to push out what has been written so far.
+func WriteReceiptsCSV(w io.Writer, receipts []Receipt, flush func()) error {
+	writer := csv.NewWriter(w)
+	writer.Write(exportHeader)
+
+	rows := 0
+	for _, receipt := range receipts {
+		// Sandbox receipts are test data
+		if receipt.Sandbox {
+			continue
+		}
+		points := strconv.FormatInt(AwardedPoints(receipt), 10)
+		for _, item := range receipt.Items {
+			writer.Write([]string{
+				receipt.ID,
+				receipt.Retailer,
+				receipt.PurchaseDate,
+				receipt.PurchaseTime,
+				receipt.Total,
+				points,
+				item.ShortDescription,
+				item.Price,
+			})
+			rows += 1
+		}
+
+		// Periodically push what we have, only between receipts
+		if rows >= exportFlushRows {
+			rows = 0
+			writer.Flush()
+			if writer.Error() != nil {
+				return writer.Error()
+			}
+			if flush != nil {
+				flush()
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
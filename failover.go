@@ -0,0 +1,258 @@
+package receiptapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+)
+
+// Readiness statuses: serving normally, serving with something failing or switched off,
+// or unable to save submissions at all
+const (
+	readinessReady       = "ready"
+	readinessDegraded    = "degraded"
+	readinessUnavailable = "unavailable"
+)
+
+// Health of the data file as last checked, and whether changes are being saved to the
+// fallback instead
+type StorageHealth struct {
+	Primary  string `json:"primary"`
+	Fallback string `json:"fallback,omitempty"`
+	Healthy  bool   `json:"healthy"`
+
+	// Set while changes are saved to the fallback, with when it failed over
+	FailedOver      bool       `json:"failedOver"`
+	FailedOverSince *time.Time `json:"failedOverSince,omitempty"`
+
+	// Checks in a row that failed or passed, when the last one was and why it failed
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	ConsecutivePasses   int        `json:"consecutivePasses"`
+	LastCheckedAt       *time.Time `json:"lastCheckedAt,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+
+	// Changes that couldn't be saved to the fallback either, and why the last one failed
+	// if it did
+	FallbackFailures int    `json:"fallbackFailures"`
+	FallbackError    string `json:"fallbackError,omitempty"`
+}
+
+// Response of the readiness endpoint, with the reasons it isn't simply ready
+type ReadinessResponse struct {
+	Status  string        `json:"status"`
+	Reasons []string      `json:"reasons,omitempty"`
+	Storage StorageHealth `json:"storage"`
+}
+
+// Sets the backend changes are saved to while the data file is failing
+func (s *ReceiptStore) SetFallback(fallback ReceiptBackend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = fallback
+}
+
+// Returns the health of the data file and the fallback
+func (s *ReceiptStore) Health() StorageHealth {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	health := s.health
+	health.Primary = "memory"
+	if s.path != "" {
+		health.Primary = "file:" + s.path
+		health.Healthy = health.ConsecutiveFailures == 0 && len(s.unsaved) == 0
+	} else {
+		health.Healthy = true
+	}
+	if s.fallback != nil {
+		health.Fallback = s.fallback.String()
+	}
+	return health
+}
+
+// Returns whether changes are being saved to the fallback, so those waiting for the data
+// file don't need to be refused
+func (s *ReceiptStore) FailedOver() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.health.FailedOver
+}
+
+// Saves a change that couldn't be appended to the data file to the fallback, if there is
+// one; the caller must hold mu. It still waits to be appended to the data file too.
+func (s *ReceiptStore) writeFallback(receipt Receipt) {
+	if s.fallback == nil {
+		return
+	}
+	err := s.fallback.Write(context.Background(), []Receipt{receipt})
+	if err != nil {
+		s.health.FallbackFailures += 1
+		s.health.FallbackError = err.Error()
+		logStorage.Error("Could not save receipt to the fallback either", "id", receipt.ID, "fallback", s.fallback.String(), "error", err)
+		return
+	}
+	s.health.FallbackError = ""
+}
+
+// Checks the data file can be written: saves any changes waiting for it, syncs it to
+// disk, and makes sure it is still the file at its path; the caller must hold mu
+func (s *ReceiptStore) checkDataFile() error {
+	if s.file == nil {
+		return errors.New("the data file is not open")
+	}
+	if len(s.unsaved) > 0 {
+		err := s.flush()
+		if err != nil {
+			return err
+		}
+	}
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+	open, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	current, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(open, current) {
+		return fmt.Errorf("%s was replaced or removed", s.path)
+	}
+	return nil
+}
+
+// Checks the data file, failing over to the fallback once enough checks in a row have
+// failed, and back once enough have passed. Changes waiting for the data file are saved
+// to it as soon as it can be written again.
+func (s *ReceiptStore) CheckHealth(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return
+	}
+	err := s.checkDataFile()
+	s.health.LastCheckedAt = &now
+	if err != nil {
+		s.health.ConsecutiveFailures += 1
+		s.health.ConsecutivePasses = 0
+		s.health.LastError = err.Error()
+		logStorage.Warn("Data file failed its health check", "failures", s.health.ConsecutiveFailures, "error", err)
+	} else {
+		s.health.ConsecutiveFailures = 0
+		s.health.ConsecutivePasses += 1
+		s.health.LastError = ""
+	}
+
+	switch {
+	case !s.health.FailedOver && s.fallback != nil && s.health.ConsecutiveFailures >= config.StorageFailoverAfter:
+		s.health.FailedOver, s.health.FailedOverSince = true, &now
+		logStorage.Error("Failed over to the fallback, so changes are saved there until the data file recovers", "fallback", s.fallback.String())
+	case s.health.FailedOver && s.health.ConsecutivePasses >= config.StorageFailoverAfter:
+		s.health.FailedOver, s.health.FailedOverSince = false, nil
+		logStorage.Info("Data file recovered, with every change saved to it, so failed back from the fallback")
+	}
+}
+
+// Checks the data file's health every interval until the context is done
+func (s *ReceiptStore) MonitorHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.CheckHealth(now.UTC())
+		}
+	}
+}
+
+// Saves changes the fallback has that the data file doesn't, made while the server was
+// failed over and lost when it stopped: receipts the data file lacks, or has an older
+// version of. Returns how many were recovered.
+func (s *ReceiptStore) RecoverFromFallback(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fallback == nil {
+		return 0, nil
+	}
+	saved, err := s.fallback.All(ctx)
+	if err != nil {
+		return 0, err
+	}
+	receipts := slices.Clone(s.receipts)
+	recovered := []Receipt{}
+	for _, receipt := range saved {
+		i := s.index(receipt.ID)
+		switch {
+		case i < 0:
+			receipts = append(receipts, receipt)
+		case receipt.UpdatedAt != nil && (receipts[i].UpdatedAt == nil || receipt.UpdatedAt.After(*receipts[i].UpdatedAt)):
+			receipts[i] = receipt
+		default:
+			continue
+		}
+		recovered = append(recovered, receipt)
+	}
+	if len(recovered) == 0 {
+		return 0, nil
+	}
+	s.replace(receipts)
+	for _, receipt := range recovered {
+		s.persist(receipt)
+	}
+	return len(recovered), nil
+}
+
+// Returns whether the server is ready, degraded or unavailable, and why
+func (s *Server) Readiness() ReadinessResponse {
+	readiness := ReadinessResponse{Status: readinessReady, Storage: s.Store.Health()}
+	readOnly := s.ReadOnlyStatus()
+	switch {
+	case readOnly.Automatic && !s.Spooling():
+		readiness.Status = readinessUnavailable
+		readiness.Reasons = append(readiness.Reasons, "changes can't be saved to the data file")
+	case readiness.Storage.FailedOver && readiness.Storage.FallbackError != "":
+		readiness.Status = readinessUnavailable
+		readiness.Reasons = append(readiness.Reasons, "changes can't be saved to the data file or the fallback")
+	case readiness.Storage.FailedOver:
+		readiness.Status = readinessDegraded
+		readiness.Reasons = append(readiness.Reasons, "failed over to "+readiness.Storage.Fallback)
+	case s.Spooling():
+		readiness.Status = readinessDegraded
+		readiness.Reasons = append(readiness.Reasons, "submissions are spooled until changes can be saved")
+	case !readiness.Storage.Healthy:
+		readiness.Status = readinessDegraded
+		readiness.Reasons = append(readiness.Reasons, "the data file is failing its health checks")
+	}
+	if readOnly.ReadOnly && !readOnly.Automatic {
+		readiness.Reasons = append(readiness.Reasons, "read-only: "+readOnly.Reason)
+		if readiness.Status == readinessReady {
+			readiness.Status = readinessDegraded
+		}
+	}
+	return readiness
+}
+
+/*
+	Below is the handler for load balancers and orchestrators to check readiness
+*/
+
+// Method to tell whether the server is ready for traffic. A degraded server still
+// answers 200, since it serves reads and takes submissions; only one that can't save
+// submissions anywhere answers 503.
+func (s *Server) GetReadiness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	readiness := s.Readiness()
+	if readiness.Status == readinessUnavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(readiness)
+}
@@ -0,0 +1,102 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// JSON names of the receipt fields ?fields= can select, in the order they're declared
+var receiptFieldNames = jsonFieldNames(reflect.TypeFor[Receipt]())
+
+// Response listing receipts with only some of their fields
+type PartialReceiptListResponse struct {
+	Receipts []map[string]json.RawMessage `json:"receipts"`
+}
+
+// Reads the comma separated receipt fields to return from ?fields=, or nil if it isn't
+// given and whole receipts are returned
+func ParseFields(query url.Values) ([]string, *Rejection) {
+	value := query.Get("fields")
+	if value == "" {
+		return nil, nil
+	}
+	fields := []string{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if !slices.Contains(receiptFieldNames, field) {
+			message := "Unknown field " + field + " in the fields parameter; receipts have " + strings.Join(receiptFieldNames, ", ") + "."
+			return nil, &Rejection{http.StatusBadRequest, codeInvalidQuery, message}
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Writes a list of receipts, with only the given fields if any are. Fields a receipt
+// leaves out when empty stay left out.
+func WriteReceiptList(w http.ResponseWriter, receipts []Receipt, fields []string) {
+	if fields == nil {
+		json.NewEncoder(w).Encode(ReceiptListResponse{Receipts: receipts})
+		return
+	}
+
+	partial := make([]map[string]json.RawMessage, 0, len(receipts))
+	for _, receipt := range receipts {
+		selected, err := selectFields(receipt, fields)
+		if err != nil {
+			WriteError(w, http.StatusInternalServerError, codeInternal, "The receipts could not be encoded.")
+			return
+		}
+		partial = append(partial, selected)
+	}
+	json.NewEncoder(w).Encode(PartialReceiptListResponse{Receipts: partial})
+}
+
+// Writes a single receipt, with only the given fields if any are
+func WriteReceipt(w http.ResponseWriter, receipt Receipt, fields []string) {
+	if fields == nil {
+		json.NewEncoder(w).Encode(receipt)
+		return
+	}
+	selected, err := selectFields(receipt, fields)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "The receipt could not be encoded.")
+		return
+	}
+	json.NewEncoder(w).Encode(selected)
+}
+
+// Returns the given fields of a receipt as they are encoded in JSON
+func selectFields(receipt Receipt, fields []string) (map[string]json.RawMessage, error) {
+	encoded, err := json.Marshal(receipt)
+	var all map[string]json.RawMessage
+	if err == nil {
+		err = json.Unmarshal(encoded, &all)
+	}
+	if err != nil {
+		return nil, err
+	}
+	selected := map[string]json.RawMessage{}
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected, nil
+}
+
+// Returns the names a struct's fields are encoded as in JSON
+func jsonFieldNames(structType reflect.Type) []string {
+	names := []string{}
+	for i := range structType.NumField() {
+		name, _, _ := strings.Cut(structType.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,55 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSingleReceiptFields(t *testing.T) {
+	withConfig(t, func(config *Config) { config.AdminToken = "admin" })
+	s := New()
+	s.Store.Add(Receipt{ID: "processed", Retailer: "Target", Total: "35.35", Status: statusProcessed, Points: 28, UserID: "alice"})
+	s.Store.Add(Receipt{ID: "flagged", Retailer: "Target", Total: "35.35", Status: statusSubmitted, Points: 28})
+
+	tests := []struct {
+		name  string
+		path  string
+		admin bool
+		want  map[string]any
+	}{
+		{"points", "/receipts/processed/points?fields=retailer,points", false, map[string]any{"retailer": "Target", "points": 28.0}},
+		{"points awarded", "/receipts/flagged/points?fields=total,points", false, map[string]any{"total": "35.35", "points": 0.0}},
+		{"admin only field", "/receipts/processed/points?fields=userId", false, map[string]any{}},
+		{"admin receipt", "/admin/receipts/processed?fields=userId,points", true, map[string]any{"userId": "alice", "points": 28.0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.path, nil)
+			if test.admin {
+				r.Header.Set("Authorization", "Bearer admin")
+			}
+			w := httptest.NewRecorder()
+			NewRouter(s).ServeHTTP(w, r)
+			var got map[string]any
+			json.NewDecoder(w.Body).Decode(&got)
+			if w.Code != http.StatusOK || len(got) != len(test.want) {
+				t.Fatalf("status = %d, body %v, want %d, %v", w.Code, got, http.StatusOK, test.want)
+			}
+			for field, value := range test.want {
+				if got[field] != value {
+					t.Errorf("%s = %v, want %v", field, got[field], value)
+				}
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	NewRouter(s).ServeHTTP(w, httptest.NewRequest("GET", "/receipts/processed/points?fields=nope", nil))
+	var response ErrorResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusBadRequest || response.Code != codeInvalidQuery {
+		t.Errorf("unknown field: status = %d, code %q, want %d, %q", w.Code, response.Code, http.StatusBadRequest, codeInvalidQuery)
+	}
+}
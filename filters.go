@@ -0,0 +1,95 @@
+package receiptapi
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Conditions a receipt must meet to be listed; zero values match everything
+type ReceiptFilter struct {
+	MCC string
+
+	// List sandbox receipts instead of production ones
+	Sandbox bool
+
+	// Inclusive bounds on the receipt's stored points
+	MinPoints *int64
+	MaxPoints *int64
+
+	// Words the retailer or an item description must contain, normalized and lower case
+	Search []string
+}
+
+// Reads the list filters from query parameters
+func ParseReceiptFilter(query url.Values) (ReceiptFilter, *Rejection) {
+	filter := ReceiptFilter{MCC: query.Get("mcc"), Search: searchWords(query.Get("q"))}
+
+	if value := query.Get("sandbox"); value != "" {
+		sandbox, err := strconv.ParseBool(value)
+		if err != nil {
+			return ReceiptFilter{}, &Rejection{http.StatusBadRequest, codeInvalidQuery, "The sandbox parameter must be true or false."}
+		}
+		filter.Sandbox = sandbox
+	}
+
+	var rejection *Rejection
+	filter.MinPoints, rejection = parsePointsParam(query, "minPoints")
+	if rejection != nil {
+		return ReceiptFilter{}, rejection
+	}
+	filter.MaxPoints, rejection = parsePointsParam(query, "maxPoints")
+	if rejection != nil {
+		return ReceiptFilter{}, rejection
+	}
+	return filter, nil
+}
+
+// Returns the whole number in a query parameter, or nil if it isn't given
+func parsePointsParam(query url.Values, name string) (*int64, *Rejection) {
+	value := query.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	points, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, &Rejection{http.StatusBadRequest, codeInvalidQuery, "The " + name + " parameter must be a whole number."}
+	}
+	return &points, nil
+}
+
+// Checks whether a receipt meets every condition of the filter
+func (f ReceiptFilter) Matches(receipt Receipt) bool {
+	if receipt.Sandbox != f.Sandbox {
+		return false
+	}
+	if f.MCC != "" && receipt.MCC != f.MCC {
+		return false
+	}
+	if f.MinPoints != nil && receipt.Points < *f.MinPoints {
+		return false
+	}
+	if f.MaxPoints != nil && receipt.Points > *f.MaxPoints {
+		return false
+	}
+	if len(f.Search) > 0 {
+		text := searchWords(receipt.Retailer)
+		for _, item := range receipt.Items {
+			text = append(text, searchWords(item.ShortDescription)...)
+		}
+		for _, word := range f.Search {
+			if !slices.ContainsFunc(text, func(w string) bool { return strings.Contains(w, word) }) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Splits text into lower case words, normalized as item descriptions are, so accented
+// text written either way finds the same receipts
+func searchWords(text string) []string {
+	return strings.Fields(strings.ToLower(NormalizeDescription(text)))
+}
@@ -0,0 +1,299 @@
+package receiptapi
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Namespace for content derived receipt IDs
+var receiptNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/heathercerise/receipt-api/receipts"))
+
+// Crockford's base32 alphabet, used to encode ULIDs
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Length of the short codes given to receipts
+const shortCodeLength = 8
+
+// The last ULID issued, so IDs within the same millisecond still sort in order
+var lastULID [16]byte
+
+// Guards lastULID
+var ulidMu sync.Mutex
+
+// Returned once every ULID within a millisecond has been issued
+var errULIDOverflow = errors.New("every ULID for this millisecond has been issued")
+
+// Fields of a receipt that identify it when deriving its ID from content
+type receiptContent struct {
+	// Partner that submitted it, left out without one, and the tenant the partner named
+	Partner       string `json:"partner,omitempty"`
+	Tenant        string `json:"tenant"`
+	Retailer      string `json:"retailer"`
+	PurchaseDate  string `json:"purchaseDate"`
+	PurchaseTime  string `json:"purchaseTime"`
+	Items         []Item `json:"items"`
+	Total         string `json:"total"`
+	PaymentMethod string `json:"paymentMethod"`
+	LoyaltyNumber string `json:"loyaltyNumber"`
+
+	// Left out for production receipts, so their IDs are the same as before sandboxes
+	Sandbox bool `json:"sandbox,omitempty"`
+}
+
+// Returns the prefix for the IDs of new receipts, production or sandbox
+func IDPrefix(sandbox bool) string {
+	if sandbox {
+		return config.SandboxIDPrefix
+	}
+	return config.IDPrefix
+}
+
+// Returns the prefix an ID was issued with: the lower case letters and digits before its
+// first underscore, and the underscore. IDs without one have no prefix.
+func idPrefix(id string) string {
+	before, _, found := strings.Cut(id, "_")
+	if !found || before == "" || strings.Trim(before, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+		return ""
+	}
+	return before + "_"
+}
+
+// Checks an ID given in a request from production, or the sandbox, could have been
+// issued there, refusing one with the other environment's prefix, such as a sandbox ID
+// sent to production. IDs without a prefix, issued before prefixes were configured, and
+// short codes are looked up as usual.
+func CheckIDPrefix(id string, sandbox bool) *Rejection {
+	prefix := idPrefix(id)
+	expected := IDPrefix(sandbox)
+	if prefix == "" || (config.IDPrefix == "" && config.SandboxIDPrefix == "") || prefix == expected {
+		return nil
+	}
+	if expected == "" {
+		return &Rejection{http.StatusNotFound, codeWrongIDPrefix, "The ID starts with " + prefix + ", but IDs here have no prefix; it may be from another environment."}
+	}
+	return &Rejection{http.StatusNotFound, codeWrongIDPrefix, "The ID starts with " + prefix + ", but IDs here start with " + expected + "; it may be from another environment."}
+}
+
+// Checks an ID given by an admin or reviewer, who see both environments, could have been
+// issued in either, as CheckIDPrefix does for one
+func CheckAnyIDPrefix(id string) *Rejection {
+	prefix := idPrefix(id)
+	if prefix == "" || (config.IDPrefix == "" && config.SandboxIDPrefix == "") {
+		return nil
+	}
+	if prefix == config.IDPrefix || prefix == config.SandboxIDPrefix {
+		return nil
+	}
+	expected := strings.Join(slices.DeleteFunc([]string{config.IDPrefix, config.SandboxIDPrefix}, func(p string) bool { return p == "" }), " or ")
+	return &Rejection{http.StatusNotFound, codeWrongIDPrefix, "The ID starts with " + prefix + ", but IDs here start with " + expected + "; it may be from another environment."}
+}
+
+// Assigns IDs to new receipts, before any prefix is put on them
+type IDGenerator interface {
+	NewID(receipt Receipt) string
+}
+
+// Function assigning receipt IDs, such as a deterministic one for tests
+type IDGeneratorFunc func(receipt Receipt) string
+
+// Returns the function's ID for the receipt
+func (f IDGeneratorFunc) NewID(receipt Receipt) string {
+	return f(receipt)
+}
+
+// Gives random UUIDs
+type UUIDGenerator struct{}
+
+// Returns a random UUID
+func (UUIDGenerator) NewID(receipt Receipt) string {
+	return GenerateID()
+}
+
+// Gives UUIDv5s derived from receipts' content, so the same receipt gets the same ID
+type ContentIDGenerator struct{}
+
+// Returns the receipt's content derived UUID
+func (ContentIDGenerator) NewID(receipt Receipt) string {
+	return GenerateContentID(receipt)
+}
+
+// Gives ULIDs, which sort by creation time
+type ULIDGenerator struct {
+	// Tells the time IDs are made at; the system clock when nil
+	Clock Clock
+}
+
+// Returns a ULID for now, waiting for the clock's next millisecond once every ULID for
+// the current one has been issued
+func (g ULIDGenerator) NewID(receipt Receipt) string {
+	clock := clockOrSystem(g.Clock)
+	for {
+		id, err := GenerateULID(clock.Now())
+		if err == nil {
+			return id
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Gives Sonyflake IDs: 64 bit numbers made of the time since sonyflakeEpoch in 10
+// millisecond units, a sequence number within that time and the machine ID, written in
+// decimal. They sort by creation time and are unique across machines with their own IDs.
+type SonyflakeGenerator struct {
+	MachineID uint16
+
+	// Tells the time IDs are made at; the system clock when nil
+	Clock Clock
+
+	mu       sync.Mutex
+	elapsed  int64
+	sequence uint16
+}
+
+// Time Sonyflake IDs count from, the same as the original implementation's default
+var sonyflakeEpoch = time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC)
+
+// Returns the time since sonyflakeEpoch in 10 millisecond units
+func sonyflakeElapsed(now time.Time) int64 {
+	return now.Sub(sonyflakeEpoch).Milliseconds() / 10
+}
+
+// Returns a Sonyflake ID for now. Once 256 are given within 10 milliseconds, it waits for
+// the next 10.
+func (g *SonyflakeGenerator) NewID(receipt Receipt) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	clock := clockOrSystem(g.Clock)
+	current := sonyflakeElapsed(clock.Now())
+	if g.elapsed < current {
+		g.elapsed = current
+		g.sequence = 0
+	} else {
+		g.sequence = (g.sequence + 1) & 0xff
+		if g.sequence == 0 {
+			g.elapsed += 1
+			time.Sleep(sonyflakeEpoch.Add(time.Duration(g.elapsed) * 10 * time.Millisecond).Sub(clock.Now()))
+		}
+	}
+	id := uint64(g.elapsed)<<24 | uint64(g.sequence)<<16 | uint64(g.MachineID)
+	return strconv.FormatUint(id, 10)
+}
+
+// Returns the ID generator for the configured scheme, telling the time with a clock
+func NewIDGenerator(config Config, clock Clock) IDGenerator {
+	switch config.IDScheme {
+	case "uuidv5":
+		return ContentIDGenerator{}
+	case "ulid":
+		return ULIDGenerator{Clock: clock}
+	case "sonyflake":
+		return &SonyflakeGenerator{MachineID: uint16(config.SonyflakeMachineID), Clock: clock}
+	}
+	return UUIDGenerator{}
+}
+
+// Returns a UUIDv5 derived from the receipt's partner, tenant and normalized content, so
+// the same receipt submitted twice gets the same ID. The tenant is whatever the partner
+// sent, so only counts within the partner that authenticated; another partner naming the
+// same tenant gets IDs of its own.
+func GenerateContentID(receipt Receipt) string {
+	content := receiptContent{
+		Partner:       receipt.Partner,
+		Tenant:        receipt.Tenant,
+		Retailer:      receipt.Retailer,
+		PurchaseDate:  receipt.PurchaseDate,
+		PurchaseTime:  receipt.PurchaseTime,
+		Total:         receipt.Total,
+		PaymentMethod: receipt.PaymentMethod,
+		LoyaltyNumber: receipt.LoyaltyNumber,
+		Sandbox:       receipt.Sandbox,
+	}
+	for _, item := range receipt.Items {
+		content.Items = append(content.Items, Item{ShortDescription: item.ShortDescription, Price: item.Price})
+	}
+
+	// Marshalling these plain fields can't fail
+	name, _ := json.Marshal(content)
+	return uuid.NewSHA1(receiptNamespace, name).String()
+}
+
+// Returns a ULID: a 48 bit millisecond timestamp followed by 80 random bits, so IDs sort by
+// creation time. Within one millisecond the random part is incremented instead of redrawn,
+// and once it can't be without carrying into the timestamp, errULIDOverflow is returned
+// until the next millisecond.
+func GenerateULID(now time.Time) (string, error) {
+	ulidMu.Lock()
+	defer ulidMu.Unlock()
+
+	var id [16]byte
+	ms := uint64(now.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		id[i] = byte(ms)
+		ms >>= 8
+	}
+
+	if [6]byte(id[:6]) == [6]byte(lastULID[:6]) {
+		// Same millisecond; carry the increment through the random bytes
+		id = lastULID
+		carried := true
+		for i := 15; i >= 6 && carried; i-- {
+			id[i]++
+			carried = id[i] == 0
+		}
+		if carried {
+			return "", errULIDOverflow
+		}
+	} else {
+		rand.Read(id[6:])
+	}
+	lastULID = id
+	return EncodeULID(id), nil
+}
+
+// Encodes 128 bits as 26 characters of Crockford's base32
+func EncodeULID(id [16]byte) string {
+	out := make([]byte, 26)
+	// The first character holds only the top 3 bits, the rest 5 bits each
+	var bits uint
+	var buffer uint64
+	pos := 25
+	for i := 15; i >= 0; i-- {
+		buffer |= uint64(id[i]) << bits
+		bits += 8
+		for bits >= 5 {
+			out[pos] = crockfordAlphabet[buffer&31]
+			pos--
+			buffer >>= 5
+			bits -= 5
+		}
+	}
+	out[pos] = crockfordAlphabet[buffer&31]
+	return string(out)
+}
+
+// Returns a random short code of Crockford base32 characters
+func GenerateShortCode() string {
+	code := make([]byte, shortCodeLength)
+	rand.Read(code)
+	for i := range code {
+		// 256 is a multiple of 32, so masking keeps the characters uniform
+		code[i] = crockfordAlphabet[code[i]&31]
+	}
+	return string(code)
+}
+
+// Returns a short code as it is stored, forgiving lower case, dashes and the letters
+// Crockford's base32 leaves out because they look like digits
+func NormalizeShortCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(code, "-", ""))
+	return strings.NewReplacer("I", "1", "L", "1", "O", "0").Replace(code)
+}
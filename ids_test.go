@@ -0,0 +1,202 @@
+package receiptapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateShortCode(t *testing.T) {
+	seen := map[string]bool{}
+	for range 100 {
+		code := GenerateShortCode()
+		if len(code) != shortCodeLength {
+			t.Fatalf("GenerateShortCode() = %q, want %d characters", code, shortCodeLength)
+		}
+		for _, c := range code {
+			if !strings.ContainsRune(crockfordAlphabet, c) {
+				t.Fatalf("GenerateShortCode() = %q, which has %q outside Crockford's base32", code, c)
+			}
+		}
+		if NormalizeShortCode(code) != code {
+			t.Errorf("NormalizeShortCode(%q) = %q, want it unchanged", code, NormalizeShortCode(code))
+		}
+		seen[code] = true
+	}
+	if len(seen) < 99 {
+		t.Errorf("GenerateShortCode() gave %d distinct codes in 100", len(seen))
+	}
+}
+
+func TestNormalizeShortCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"7K3QX9MD", "7K3QX9MD"},
+		{"7k3qx9md", "7K3QX9MD"},
+		{"7K3Q-X9MD", "7K3QX9MD"},
+		{"7k3q-x9md", "7K3QX9MD"},
+		{"IL0O1234", "11001234"},
+		{"il0o-1234", "11001234"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got := NormalizeShortCode(test.code)
+		if got != test.want {
+			t.Errorf("NormalizeShortCode(%q) = %q, want %q", test.code, got, test.want)
+		}
+	}
+}
+
+func TestSonyflakeGeneratorClock(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	generator := NewIDGenerator(Config{IDScheme: "sonyflake", SonyflakeMachineID: 7}, FixedClock{now})
+	first, _ := strconv.ParseUint(generator.NewID(Receipt{}), 10, 64)
+	second, _ := strconv.ParseUint(generator.NewID(Receipt{}), 10, 64)
+
+	if elapsed := int64(first >> 24); elapsed != sonyflakeElapsed(now) {
+		t.Errorf("first ID has time %d, want %d from the clock", elapsed, sonyflakeElapsed(now))
+	}
+	if first&0xffff != 7 || second != first+1<<16 {
+		t.Errorf("IDs = %d, %d; want machine 7 and the next sequence number", first, second)
+	}
+}
+
+// Clock that moves on a millisecond every time it is read
+type tickingClock struct {
+	now *time.Time
+}
+
+func (c tickingClock) Now() time.Time {
+	now := *c.now
+	*c.now = now.Add(time.Millisecond)
+	return now
+}
+
+func (c tickingClock) Location() *time.Location {
+	return time.UTC
+}
+
+// Makes every ULID for the millisecond look issued, as if the last had its random part
+// at the maximum, and puts the last ULID back when the test ends
+func exhaustULIDs(t *testing.T, now time.Time) {
+	t.Helper()
+	ulidMu.Lock()
+	saved := lastULID
+	ulidMu.Unlock()
+	t.Cleanup(func() {
+		ulidMu.Lock()
+		lastULID = saved
+		ulidMu.Unlock()
+	})
+	GenerateULID(now)
+	ulidMu.Lock()
+	for i := 6; i < 16; i++ {
+		lastULID[i] = 0xff
+	}
+	ulidMu.Unlock()
+}
+
+func TestGenerateULIDOverflow(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	exhaustULIDs(t, now)
+	exhausted := EncodeULID(lastULID)
+
+	if id, err := GenerateULID(now); err != errULIDOverflow {
+		t.Fatalf("GenerateULID() = %q, %v once the millisecond is used up, want errULIDOverflow", id, err)
+	}
+	next, err := GenerateULID(now.Add(time.Millisecond))
+	if err != nil || next <= exhausted {
+		t.Errorf("GenerateULID() in the next millisecond = %q, %v, want an ID after %q", next, err, exhausted)
+	}
+}
+
+func TestULIDGeneratorWaitsForTheNextMillisecond(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	exhaustULIDs(t, now)
+	exhausted := EncodeULID(lastULID)
+
+	clock := now
+	id := ULIDGenerator{Clock: tickingClock{&clock}}.NewID(Receipt{})
+	// The first 10 characters hold the timestamp
+	if id <= exhausted || id[:10] == exhausted[:10] {
+		t.Errorf("NewID() = %q, want an ID from the next millisecond after %q", id, exhausted)
+	}
+}
+
+func TestContentIDsArePartnersOwn(t *testing.T) {
+	s := New(WithIDs(ContentIDGenerator{}))
+	receipt := targetReceipt
+	receipt.Tenant = "store-1"
+
+	first, _, rejection := s.ProcessReceipt(context.Background(), receipt, Partner{Name: "acme"})
+	if rejection != nil {
+		t.Fatalf("ProcessReceipt() rejected the receipt: %+v", rejection)
+	}
+	again, _, _ := s.ProcessReceipt(context.Background(), receipt, Partner{Name: "acme"})
+	other, _, _ := s.ProcessReceipt(context.Background(), receipt, Partner{Name: "globex"})
+	if again.ID != first.ID {
+		t.Errorf("resubmitting gave ID %q, want %q", again.ID, first.ID)
+	}
+	if other.ID == first.ID || other.Partner != "globex" {
+		t.Errorf("another partner naming the same tenant got receipt %q of %q, want one of its own", other.ID, other.Partner)
+	}
+}
+
+func TestCheckIDPrefix(t *testing.T) {
+	withConfig(t, func(config *Config) { config.IDPrefix, config.SandboxIDPrefix = "prod_", "sbx_" })
+	tests := []struct {
+		id      string
+		sandbox bool
+		valid   bool
+		any     bool
+	}{
+		{"prod_01HX", false, true, true},
+		{"sbx_01HX", true, true, true},
+		{"sbx_01HX", false, false, true},
+		{"prod_01HX", true, false, true},
+		{"dev_01HX", false, false, false},
+		{"5c8d2f1e-0b7a-4c1e-9a5d-3f2b1c0e9d8a", true, true, true},
+	}
+	for _, test := range tests {
+		if got := CheckIDPrefix(test.id, test.sandbox) == nil; got != test.valid {
+			t.Errorf("CheckIDPrefix(%q, %v) accepted %v, want %v", test.id, test.sandbox, got, test.valid)
+		}
+		if got := CheckAnyIDPrefix(test.id) == nil; got != test.any {
+			t.Errorf("CheckAnyIDPrefix(%q) accepted %v, want %v", test.id, got, test.any)
+		}
+	}
+}
+
+func TestReceiptPointsStayInTheirEnvironment(t *testing.T) {
+	withoutPartners(t)
+	partners["sandbox-key"] = Partner{Name: "tester", Key: "sandbox-key", Sandbox: true}
+	s := New()
+	s.Store.Add(Receipt{ID: "production", Retailer: "Target", Points: 10})
+	s.Store.Add(Receipt{ID: "sandbox", Retailer: "Target", Points: 10, Sandbox: true})
+
+	tests := []struct {
+		id     string
+		key    string
+		status int
+	}{
+		{"production", "", http.StatusOK},
+		{"sandbox", "", http.StatusNotFound},
+		{"sandbox", "sandbox-key", http.StatusOK},
+		{"production", "sandbox-key", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/receipts/"+test.id+"/points", nil)
+		r.Header.Set("X-API-Key", test.key)
+		w := httptest.NewRecorder()
+		NewRouter(s).ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("GET %s points with key %q: status = %d, want %d", test.id, test.key, w.Code, test.status)
+		}
+	}
+}
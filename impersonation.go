@@ -0,0 +1,231 @@
+package receiptapi
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Record of a request made by support staff as a user, whether or not it was allowed
+type AuditEntry struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+
+	// Who made the request, empty when the token wasn't recognized, and who it was made as
+	Impersonator string `json:"impersonator"`
+	User         string `json:"user"`
+	Reason       string `json:"reason"`
+
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+}
+
+// Response listing audit entries
+type AuditListResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// Key of the impersonated user in a request's context
+type impersonatedUserKey struct{}
+
+// Audit entries, oldest first
+var auditEntries []AuditEntry
+
+// Guards auditEntries and the log file
+var auditMu sync.Mutex
+
+// Log file every audit entry is appended to, if one is open
+var auditLog *os.File
+
+// Loads audit entries from a log file, then keeps it open to append to. Each line holds
+// an entry as JSON.
+func OpenAuditLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		line := 0
+		for scanner.Scan() {
+			line += 1
+			var entry AuditEntry
+			err = json.Unmarshal(scanner.Bytes(), &entry)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			auditEntries = append(auditEntries, entry)
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+	}
+
+	auditLog, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	return err
+}
+
+// Records an audit entry, appending it to the log file if one is open
+func RecordAudit(entry AuditEntry) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditEntries = append(auditEntries, entry)
+	if auditLog == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = auditLog.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logApp.Error("Could not write audit log", "id", entry.ID, "error", err)
+	}
+}
+
+// Returns the name of the impersonator whose token a request has as a bearer token, and
+// whether there is one
+func impersonatorFor(r *http.Request) (string, bool) {
+	given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return "", false
+	}
+	for name, token := range config.Impersonators {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Returns the user whose data the matched route reads, whether that could be told, and
+// whether the route can be used while impersonating at all. Only routes a user reads their
+// own points, receipts, redemptions and disputes through can be.
+func (s *Server) impersonatedOwner(r *http.Request) (string, bool, bool) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "", false, false
+	}
+	template, _ := route.GetPathTemplate()
+	id := mux.Vars(r)["id"]
+	switch template {
+	case "/users/{id}/summary", "/users/{id}/points", "/users/{id}/ledger", "/users/{id}/statement":
+		return id, true, true
+	case "/receipts/{id}/points", "/receipts/{id}/breakdown", "/receipts/{id}/explanation", "/receipts/{id}/disputes":
+		receipt, found := s.Store.Find(s.Store.ResolveShortCode(id))
+		return receipt.UserID, found, true
+	case "/disputes/{id}":
+		dispute, found := findDispute(id)
+		if !found {
+			return "", false, true
+		}
+		receipt, found := s.Store.Find(dispute.ReceiptID)
+		return receipt.UserID, found, true
+	case "/redemptions/{id}":
+		pointsMu.Lock()
+		redemption, found := redemptions[id]
+		var owner string
+		if found {
+			owner = redemption.UserID
+		}
+		pointsMu.Unlock()
+		return owner, found, true
+	}
+	return "", false, false
+}
+
+// Lets support staff make read-only requests as a user with an X-Impersonate-User header,
+// their own impersonator token and an X-Impersonation-Reason. The request only reaches the
+// handler when it reads that user's own data, and every one is recorded in the audit log.
+// Requests without the header are passed on untouched.
+func (s *Server) Impersonate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := strings.TrimSpace(r.Header.Get("X-Impersonate-User"))
+		if user == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		impersonator, known := impersonatorFor(r)
+		entry := AuditEntry{
+			ID:           GenerateID(),
+			Time:         s.Clock.Now().UTC(),
+			Impersonator: impersonator,
+			User:         user,
+			Reason:       strings.TrimSpace(r.Header.Get("X-Impersonation-Reason")),
+			Method:       r.Method,
+			Path:         r.URL.RequestURI(),
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			entry.Status = recorder.status
+			RecordAudit(entry)
+			logApp.Info("Impersonated request", "impersonator", entry.Impersonator, "user", user, "path", entry.Path, "status", entry.Status)
+		}()
+
+		owner, found, allowed := s.impersonatedOwner(r)
+		var rejection *Rejection
+		switch {
+		case !known:
+			recorder.Header().Set("WWW-Authenticate", "Bearer")
+			rejection = &Rejection{http.StatusUnauthorized, codeUnauthorized, "The Authorization header must hold an impersonator token as a bearer token."}
+		case entry.Reason == "":
+			rejection = &Rejection{http.StatusBadRequest, codeInvalidImpersonation, "Impersonated requests need an X-Impersonation-Reason header, such as the dispute being investigated."}
+		case r.Method != http.MethodGet && r.Method != http.MethodHead:
+			rejection = &Rejection{http.StatusForbidden, codeImpersonationForbidden, "Only reads can be made as a user."}
+		case !allowed:
+			rejection = &Rejection{http.StatusForbidden, codeImpersonationForbidden, "This can't be read as a user; only their own points, receipts, redemptions and disputes can."}
+		case found && owner != user:
+			rejection = &Rejection{http.StatusForbidden, codeImpersonationForbidden, "This belongs to another user."}
+		}
+		if rejection != nil {
+			recorder.Header().Set("Content-Type", "application/json")
+			WriteRejection(recorder, rejection)
+			return
+		}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), impersonatedUserKey{}, user)))
+	})
+}
+
+// Returns the user Impersonate let support staff read as, empty if there is none
+func ImpersonatedUser(ctx context.Context) string {
+	user, _ := ctx.Value(impersonatedUserKey{}).(string)
+	return user
+}
+
+/*
+	Below are the handlers for reading the audit log
+*/
+
+// Method to list audit entries, oldest first, optionally only those ?user= or
+// ?impersonator= given
+func ListAuditEntries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := r.URL.Query().Get("user")
+	impersonator := r.URL.Query().Get("impersonator")
+	entries := []AuditEntry{}
+	auditMu.Lock()
+	for _, entry := range auditEntries {
+		if (user == "" || entry.User == user) && (impersonator == "" || entry.Impersonator == impersonator) {
+			entries = append(entries, entry)
+		}
+	}
+	auditMu.Unlock()
+	json.NewEncoder(w).Encode(AuditListResponse{Entries: entries})
+}
@@ -0,0 +1,116 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserReads(t *testing.T) {
+	withoutPartners(t)
+	partners["acme-key"] = Partner{Name: "acme", Key: "acme-key"}
+	withConfig(t, func(config *Config) { config.Impersonators = map[string]string{"sam": "sam-token"} })
+	savedAudit := auditEntries
+	t.Cleanup(func() { auditEntries = savedAudit })
+	auditEntries = nil
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+		code    string
+	}{
+		{
+			name:    "user's own points",
+			path:    "/users/alice/points",
+			headers: map[string]string{"X-API-Key": "acme-key", "X-User-ID": "alice"},
+			status:  http.StatusOK,
+		},
+		{
+			name:    "another user's ledger",
+			path:    "/users/alice/ledger",
+			headers: map[string]string{"X-API-Key": "acme-key", "X-User-ID": "bob"},
+			status:  http.StatusForbidden,
+			code:    codeWrongUser,
+		},
+		{
+			name:    "summary without a user",
+			path:    "/users/alice/summary",
+			headers: map[string]string{"X-API-Key": "acme-key"},
+			status:  http.StatusUnauthorized,
+			code:    codeUnauthorized,
+		},
+		{
+			name:   "statement without credentials",
+			path:   "/users/alice/statement",
+			status: http.StatusUnauthorized,
+			code:   codeUnauthorized,
+		},
+		{
+			name:    "impersonated user's summary",
+			path:    "/users/alice/summary",
+			headers: map[string]string{"Authorization": "Bearer sam-token", "X-Impersonate-User": "alice", "X-Impersonation-Reason": "dispute 12"},
+			status:  http.StatusOK,
+		},
+		{
+			name:    "another user's points while impersonating",
+			path:    "/users/bob/points",
+			headers: map[string]string{"Authorization": "Bearer sam-token", "X-Impersonate-User": "alice", "X-Impersonation-Reason": "dispute 12"},
+			status:  http.StatusForbidden,
+			code:    codeImpersonationForbidden,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newLedgerServer(t)
+			r := httptest.NewRequest("GET", test.path, nil)
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			NewRouter(s).ServeHTTP(w, r)
+			var response ErrorResponse
+			json.NewDecoder(w.Body).Decode(&response)
+			if w.Code != test.status || response.Code != test.code {
+				t.Errorf("status = %d, code %q, want %d, %q", w.Code, response.Code, test.status, test.code)
+			}
+		})
+	}
+	if len(auditEntries) != 2 || auditEntries[0].Status != http.StatusOK || auditEntries[1].Status != http.StatusForbidden {
+		t.Errorf("audit entries = %+v, want the two impersonated requests", auditEntries)
+	}
+}
+
+func TestGetRedemptionCaller(t *testing.T) {
+	withoutPartners(t)
+	partners["acme-key"] = Partner{Name: "acme", Key: "acme-key"}
+	partners["other-key"] = Partner{Name: "other", Key: "other-key"}
+	s := newLedgerServer(t)
+	hold, _, _ := s.HoldPoints("alice", "acme", HoldRequest{Points: 30})
+
+	tests := []struct {
+		name   string
+		key    string
+		user   string
+		status int
+	}{
+		{"partner that placed the hold", "acme-key", "", http.StatusOK},
+		{"user the hold is for", "other-key", "alice", http.StatusOK},
+		{"another partner", "other-key", "", http.StatusForbidden},
+		{"no API key", "", "alice", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/redemptions/"+hold.ID, nil)
+			r.Header.Set("X-API-Key", test.key)
+			r.Header.Set("X-User-ID", test.user)
+			w := httptest.NewRecorder()
+			NewRouter(s).ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package receiptapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// States of a background job
+const (
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobCancelled = "cancelled"
+)
+
+// Background job working through every stored receipt
+type Job struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Status     string     `json:"status"`
+	Total      int        `json:"total"`
+	Processed  int        `json:"processed"`
+	Errors     []string   `json:"errors"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+
+	// What a reporting job found, once it has completed
+	Report JobReport `json:"report,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// Jobs keyed by ID, kept after they finish so their results can be read
+var jobs = map[string]*Job{}
+
+// Guards jobs and every field of every job
+var jobsMu sync.Mutex
+
+// Work a job does on the receipt with the given ID
+type jobStep func(s *Server, id string) error
+
+// Job types and the work they do on each receipt
+var jobSteps = map[string]jobStep{
+	"recalculate": (*Server).RecalculateReceipt,
+	"reindex":     (*Server).ReindexReceipt,
+	"compact":     (*Server).CompactReceipt,
+}
+
+// Report a job builds from every receipt without changing them. Each receipt is added
+// in turn, then Finish is called once the job completes and the report is kept with it.
+type JobReport interface {
+	Add(receipt Receipt)
+	Finish()
+}
+
+// Job types that build reports, and the empty report each starts from
+var jobReports = map[string]func() JobReport{
+	"similarity": NewSimilarityReport,
+}
+
+// Returns the step that adds each receipt to a report
+func reportStep(report JobReport) jobStep {
+	return func(s *Server, id string) error {
+		receipt, found := s.Store.Find(id)
+		if found {
+			report.Add(receipt)
+		}
+		return nil
+	}
+}
+
+// Re-enriches a receipt with the current merchant registry and catalog, then scores it
+// again with the current rules, keeping any feature overrides and budget reduction it was
+// scored with, and announces it if its points change. The change in its points counts
+// against the daily budget of the day it was processed. Points its user has already
+// spent, by transferring or redeeming them, stay awarded, so no balance goes below zero.
+func (s *Server) RecalculateReceipt(id string) error {
+	receipt, found := s.Store.Find(id)
+	if !found {
+		return fmt.Errorf("receipt %s no longer exists", id)
+	}
+	if receipt.Anonymized != nil || receipt.Compacted != nil {
+		// Without the retailer, descriptions or items it would score differently, so it
+		// keeps the points it had
+		return nil
+	}
+
+	// Looked up outside the lock, since it may call the external provider
+	mcc := LookupMCC(receipt.Retailer)
+
+	// Scored again with the feature overrides it was first scored with
+	rules := CurrentProgram().Rules
+	overrides, overridden := RecordedFeatureOverrides(receipt)
+	if overridden {
+		rules = overrides.Rules(rules)
+	}
+
+	// Held until the points change, so the user's balance can't be spent in the meantime
+	pointsMu.Lock()
+	before, awarded := receipt.Points, AwardedPoints(receipt)
+	kept := int64(0)
+	if receipt.UserID != "" && !receipt.Sandbox {
+		expireHolds(s.Clock.Now().UTC())
+		kept = min(max(awarded-s.pointsBalance(receipt.UserID).Available, 0), awarded)
+	}
+	recalculated, found := s.Store.Modify(id, func(receipt *Receipt) bool {
+		receipt.MCC = mcc
+		// Replace the items rather than changing them, since copies of the receipt share them
+		receipt.Items = slices.Clone(receipt.Items)
+		MatchItems(receipt)
+		budgetPercent := 0
+		if receipt.Scoring != nil {
+			budgetPercent = receipt.Scoring.BudgetPercent
+		}
+		scoring := s.scoringRules(rules, overridden)
+		receipt.CappedRules = rules.ExceededPointCaps(*receipt)
+		receipt.Points = scoring.Points(*receipt)
+		receipt.LengthMode = rules.LengthMode()
+		receipt.Scoring = rules.Snapshot(*receipt, scoring.PointsByRule(*receipt), s.Clock.Now().UTC())
+
+		// Keeps earning the share of its points the budget left it
+		if budgetPercent > 0 {
+			ReducePoints(receipt, budgetPercent)
+		}
+		if AwardedPoints(*receipt) < kept {
+			logApp.Warn("Recalculation kept points the user has spent", "id", receipt.ID, "user", receipt.UserID, "points", receipt.Points, "kept", kept)
+			receipt.Points = kept
+		}
+		return true
+	})
+	pointsMu.Unlock()
+	if !found {
+		return fmt.Errorf("receipt %s no longer exists", id)
+	}
+	if !recalculated.Sandbox && recalculated.ProcessedAt != nil {
+		AdjustPointsBudget(*recalculated.ProcessedAt, AwardedPoints(recalculated)-awarded)
+	}
+	if recalculated.Points != before {
+		s.Announce(context.Background(), "receipt.recalculated", recalculated)
+	}
+	return nil
+}
+
+// Makes sure a receipt has a short code of its own and the index points at it
+func (s *Server) ReindexReceipt(id string) error {
+	found := s.Store.Reindex(id)
+	if !found {
+		return fmt.Errorf("receipt %s no longer exists", id)
+	}
+	return nil
+}
+
+// Method to start a job of the type in the path; responds with the job so it can be tracked
+func (s *Server) StartJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	jobType := mux.Vars(r)["type"]
+	step, ok := jobSteps[jobType]
+	var report JobReport
+	if newReport, reporting := jobReports[jobType]; reporting {
+		report = newReport()
+		step, ok = reportStep(report), true
+	}
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeUnknownJobType, "No job of that type.")
+		return
+	}
+
+	// Work from the IDs stored now; receipts added later are already up to date
+	stored := s.Store.All()
+	ids := make([]string, len(stored))
+	for i, receipt := range stored {
+		ids[i] = receipt.ID
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        GenerateID(),
+		Type:      jobType,
+		Status:    jobRunning,
+		Total:     len(ids),
+		Errors:    []string{},
+		StartedAt: s.Clock.Now().UTC(),
+		cancel:    cancel,
+	}
+	jobsMu.Lock()
+	jobs[job.ID] = job
+	snapshot := *job
+	jobsMu.Unlock()
+
+	logJobs.Info("Started job", "id", job.ID, "type", jobType, "total", len(ids))
+	go s.RunJob(ctx, job, ids, step, report)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// Applies a job's step to each receipt in turn, stopping early if the job is cancelled.
+// A report the steps built is finished and kept with the job once it completes.
+func (s *Server) RunJob(ctx context.Context, job *Job, ids []string, step jobStep, report JobReport) {
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+
+		err := step(s, id)
+		if err != nil {
+			logJobs.Warn("Job step failed", "id", job.ID, "error", err)
+		}
+
+		jobsMu.Lock()
+		job.Processed += 1
+		if err != nil {
+			job.Errors = append(job.Errors, err.Error())
+		}
+		jobsMu.Unlock()
+	}
+
+	if report != nil && ctx.Err() == nil {
+		report.Finish()
+	}
+
+	jobsMu.Lock()
+	finished := s.Clock.Now().UTC()
+	job.FinishedAt = &finished
+	if ctx.Err() != nil {
+		job.Status = jobCancelled
+	} else {
+		job.Status = jobCompleted
+		job.Report = report
+	}
+	logJobs.Info("Finished job", "id", job.ID, "status", job.Status, "processed", job.Processed, "errors", len(job.Errors))
+	jobsMu.Unlock()
+	job.cancel()
+}
+
+// Method to report a job's progress
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	jobsMu.Lock()
+	job, ok := jobs[mux.Vars(r)["id"]]
+	var snapshot Job
+	if ok {
+		snapshot = *job
+		snapshot.Errors = append([]string{}, job.Errors...)
+	}
+	jobsMu.Unlock()
+
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeJobNotFound, "No job found for that ID.")
+		return
+	}
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// Method to cancel a running job; receipts already processed keep their changes
+func CancelJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	jobsMu.Lock()
+	job, ok := jobs[mux.Vars(r)["id"]]
+	var snapshot Job
+	if ok {
+		job.cancel()
+		snapshot = *job
+		snapshot.Errors = append([]string{}, job.Errors...)
+	}
+	jobsMu.Unlock()
+
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeJobNotFound, "No job found for that ID.")
+		return
+	}
+	if snapshot.Status != jobRunning {
+		WriteError(w, http.StatusConflict, codeJobFinished, "The job has already finished.")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(snapshot)
+}
@@ -0,0 +1,165 @@
+package receiptapi
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Key points responses are signed with, if one is configured, and its key ID
+var (
+	responseSigningKey ed25519.PrivateKey
+	responseSigningKID string
+)
+
+// Claims of a signed points response: which receipt, its points and status, and when
+// they were signed
+type PointsClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Points   int64  `json:"points"`
+	Status   string `json:"status"`
+}
+
+// Ed25519 public key in JWK form
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// Response listing the keys points responses may be signed with
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Reads the Ed25519 private key points responses are signed with from a PEM encoded
+// PKCS #8 block, as written by "openssl genpkey -algorithm ed25519". Does nothing if
+// none is configured.
+func SetupResponseSigning(keyPEM string) error {
+	if keyPEM == "" {
+		return nil
+	}
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return errors.New("RESPONSE_SIGNING_KEY is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return errors.New("RESPONSE_SIGNING_KEY must be an Ed25519 key")
+	}
+	responseSigningKey = key
+	responseSigningKID = publicJWK(key).thumbprint()
+	return nil
+}
+
+// Returns the public half of a key as a JWK
+func publicJWK(key ed25519.PrivateKey) JSONWebKey {
+	public := key.Public().(ed25519.PublicKey)
+	return JSONWebKey{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(public),
+		Use:       "sig",
+		Algorithm: "EdDSA",
+	}
+}
+
+// Returns the RFC 7638 thumbprint of a key, the SHA-256 of its required members in
+// lexical order
+func (k JSONWebKey) thumbprint() string {
+	members := `{"crv":"` + k.Curve + `","kty":"` + k.KeyType + `","x":"` + k.X + `"}`
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Returns the points of a receipt as a compact JWS signed with EdDSA, or false if no
+// signing key is configured
+func SignPoints(receipt Receipt, points int64, now time.Time) (string, bool) {
+	if responseSigningKey == nil {
+		return "", false
+	}
+	claims, _ := json.Marshal(PointsClaims{
+		Issuer:   "receipt-api",
+		Subject:  receipt.ID,
+		IssuedAt: now.Unix(),
+		Points:   points,
+		Status:   receipt.Status,
+	})
+	return signCompact("JWT", claims), true
+}
+
+// Returns a payload as a compact JWS of the given type, signed with EdDSA by the response
+// signing key, which must be configured
+func signCompact(typ string, payload []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "kid": responseSigningKID, "typ": typ})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(responseSigningKey, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Returns the payload of a compact JWS signed with EdDSA by one of the given keys, or an
+// error if it isn't
+func verifyCompact(token string, keys []ed25519.PublicKey) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the signature is not a compact JWS")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(rawHeader, &header)
+	}
+	if err != nil || header.Algorithm != "EdDSA" {
+		return nil, errors.New("the signature is not an EdDSA JWS")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("the signature is not base64url encoded")
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+			return base64.RawURLEncoding.DecodeString(parts[1])
+		}
+	}
+	return nil, errors.New("the signature is not from a trusted key")
+}
+
+// Returns an Ed25519 public key from its base64url encoding, the "x" of its JWK
+func parsePublicKey(x string) (ed25519.PublicKey, error) {
+	key, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("not a base64url encoded Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Method to list the public keys points responses are signed with, for verifiers to
+// fetch; empty when responses aren't signed
+func GetSigningKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	keys := JSONWebKeySet{Keys: []JSONWebKey{}}
+	if responseSigningKey != nil {
+		key := publicJWK(responseSigningKey)
+		key.KeyID = responseSigningKID
+		keys.Keys = append(keys.Keys, key)
+	}
+	json.NewEncoder(w).Encode(keys)
+}
@@ -0,0 +1,112 @@
+package receiptapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a PEM encoded PKCS #8 block for a private key
+func pkcs8PEM(t *testing.T, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// Sets up signing with the key for a test, and stops signing when it ends
+func withResponseSigning(t *testing.T, keyPEM string) error {
+	t.Helper()
+	t.Cleanup(func() { responseSigningKey, responseSigningKID = nil, "" })
+	return SetupResponseSigning(keyPEM)
+}
+
+func TestSetupResponseSigning(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name    string
+		keyPEM  string
+		wantErr bool
+	}{
+		{"none", "", false},
+		{"ed25519", pkcs8PEM(t, edKey), false},
+		{"not PEM", "key", true},
+		{"not PKCS #8", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")})), true},
+		{"not Ed25519", pkcs8PEM(t, ecKey), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := withResponseSigning(t, test.keyPEM)
+			if (err != nil) != test.wantErr {
+				t.Errorf("SetupResponseSigning() = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignPoints(t *testing.T) {
+	receipt := Receipt{ID: "r1", Status: statusProcessed}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if _, signed := SignPoints(receipt, 28, now); signed {
+		t.Fatal("SignPoints() signed without a key")
+	}
+
+	public, key, _ := ed25519.GenerateKey(rand.Reader)
+	err := withResponseSigning(t, pkcs8PEM(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, signed := SignPoints(receipt, 28, now)
+	parts := strings.Split(token, ".")
+	if !signed || len(parts) != 3 {
+		t.Fatalf("SignPoints() = %q, %v, want a compact JWS", token, signed)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if !ed25519.Verify(public, []byte(parts[0]+"."+parts[1]), signature) {
+		t.Error("SignPoints() signature doesn't verify with the public key")
+	}
+
+	var header map[string]string
+	var claims PointsClaims
+	headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(headerJSON, &header)
+	json.Unmarshal(claimsJSON, &claims)
+	if header["alg"] != "EdDSA" || header["kid"] != responseSigningKID {
+		t.Errorf("SignPoints() header = %v, want EdDSA with the key ID", header)
+	}
+	want := PointsClaims{Issuer: "receipt-api", Subject: "r1", IssuedAt: now.Unix(), Points: 28, Status: statusProcessed}
+	if claims != want {
+		t.Errorf("SignPoints() claims = %+v, want %+v", claims, want)
+	}
+
+	// Verifiers find the key by its ID in the key set
+	w := httptest.NewRecorder()
+	GetSigningKeys(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var keys JSONWebKeySet
+	json.NewDecoder(w.Body).Decode(&keys)
+	if len(keys.Keys) != 1 || keys.Keys[0].KeyID != header["kid"] || keys.Keys[0].X != base64.RawURLEncoding.EncodeToString(public) {
+		t.Errorf("GetSigningKeys() = %+v, want the public key with ID %q", keys.Keys, header["kid"])
+	}
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// The Ed25519 example from RFC 8037, appendix A.3
+	key := JSONWebKey{KeyType: "OKP", Curve: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	want := "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"
+	if got := key.thumbprint(); got != want {
+		t.Errorf("thumbprint() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,301 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Severities of lint issues
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Problem found in a receipt payload, with a suggestion for fixing it
+type LintIssue struct {
+	Field      string `json:"field"`
+	Severity   string `json:"severity"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// Response when linting a receipt
+type LintResponse struct {
+	// Whether the receipt would be accepted as it is
+	Valid  bool        `json:"valid"`
+	Issues []LintIssue `json:"issues"`
+}
+
+// Layouts partners commonly send dates in, tried to suggest the fix
+var commonDateLayouts = []string{"01/02/2006", "1/2/2006", "2006/01/02", "20060102", "02.01.2006", "Jan 2, 2006", "2 Jan 2006"}
+
+// Method to check a receipt without storing it, reporting every problem found along with
+// how to fix it
+func (s *Server) LintReceipt(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	partner, ok := GetPartner(r)
+	if !ok {
+		WriteError(w, http.StatusUnauthorized, codeUnknownAPIKey, "The API key is not recognized.")
+		return
+	}
+
+	var receipt Receipt
+	body := http.MaxBytesReader(w, r.Body, int64(config.MaxBodyBytes))
+	err := json.NewDecoder(body).Decode(&receipt)
+	if err != nil {
+		json.NewEncoder(w).Encode(LintResponse{Valid: false, Issues: []LintIssue{lintDecodeError(err)}})
+		return
+	}
+
+	if overrides, ok := FeatureOverridesFrom(r.Context()); ok {
+		partner = overrides.Partner(partner)
+	}
+	issues := s.Lint(receipt, partner)
+	valid := true
+	for _, issue := range issues {
+		if issue.Severity == severityError {
+			valid = false
+		}
+	}
+	json.NewEncoder(w).Encode(LintResponse{Valid: valid, Issues: issues})
+}
+
+// Describes why a payload couldn't be decoded at all
+func lintDecodeError(err error) LintIssue {
+	issue := LintIssue{Field: "", Severity: severityError, Code: codeInvalidReceipt}
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &typeErr):
+		issue.Field = typeErr.Field
+		issue.Message = fmt.Sprintf("%s is a JSON %s, expected a %s.", typeErr.Field, typeErr.Value, typeErr.Type)
+		if typeErr.Type.Kind().String() == "string" {
+			issue.Suggestion = fmt.Sprintf("Send %s as a string, e.g. \"35.35\" rather than 35.35.", typeErr.Field)
+		}
+	case errors.As(err, &syntaxErr):
+		issue.Message = fmt.Sprintf("The body is not valid JSON at byte %d.", syntaxErr.Offset)
+		issue.Suggestion = "Check for missing commas, quotes or braces near that position."
+	case errors.As(err, &tooLarge):
+		issue.Code = codePayloadTooLarge
+		issue.Message = fmt.Sprintf("The request body is larger than %d bytes.", config.MaxBodyBytes)
+	default:
+		issue.Message = "The body is not a valid JSON receipt."
+	}
+	return issue
+}
+
+// Runs the receipt validation without stopping at the first problem, returning every
+// issue found. Issues a lenient partner would only get warnings for are warnings.
+func (s *Server) Lint(receipt Receipt, partner Partner) []LintIssue {
+	issues := []LintIssue{}
+	add := func(field string, code string, message string, suggestion string) {
+		issues = append(issues, LintIssue{field, severityError, code, message, suggestion})
+	}
+	soft := func(field string, message string, suggestion string) {
+		severity := severityError
+		if partner.Lenient {
+			severity = severityWarning
+		}
+		issues = append(issues, LintIssue{field, severity, codeInvalidReceipt, message, suggestion})
+	}
+
+	// Same order of normalization as processing, so issues refer to what is validated
+	if !ApplyPurchaseDateTime(&receipt) {
+		add("purchaseDateTime", codeInvalidReceipt, "purchaseDateTime is not RFC 3339 or disagrees with purchaseDate and purchaseTime.",
+			"Send it like 2022-01-01T13:01:00-05:00, or send only purchaseDate and purchaseTime.")
+	}
+	receipt.PurchaseTime = NormalizePurchaseTime(receipt.PurchaseTime)
+	if !NormalizeLocaleAmounts(&receipt) {
+		add("locale", codeUnknownLocale, fmt.Sprintf("The locale %q is not supported.", receipt.Locale),
+			"Use a locale like en-US or de-DE, or leave it out and send dollars and cents.")
+	}
+	if !CheckCurrency(receipt.Currency) {
+		accepted := CurrentProgram().AcceptedCurrencies
+		suggestion := "Use a three letter code such as USD."
+		if len(accepted) > 0 {
+			suggestion = "Use one of " + strings.Join(accepted, ", ") + "."
+		}
+		add("currency", codeUnsupportedCurrency, fmt.Sprintf("The currency %q is not accepted.", receipt.Currency), suggestion)
+	}
+
+	message := CheckLimits(receipt)
+	if message != "" {
+		add("", codeLimitExceeded, message, "")
+	}
+
+	// Retailer
+	if receipt.Retailer == "" {
+		add("retailer", codeInvalidReceipt, "retailer is missing.", "")
+	} else if !CheckValidDescription(receipt.Retailer) {
+		soft("retailer", "retailer has characters other than "+allowedNameChars(config.RetailerExtraCharacters)+".",
+			"Remove "+quoteChars(disallowedChars(receipt.Retailer, config.RetailerExtraCharacters))+".")
+	}
+
+	// Date and time
+	_, dateErr := time.Parse(dateLayout, receipt.PurchaseDate)
+	if dateErr != nil {
+		add("purchaseDate", codeInvalidReceipt, "purchaseDate is not a date like 2022-01-01.", suggestDate(receipt.PurchaseDate))
+	} else {
+		code, message := CheckPurchaseDateWindow(receipt.PurchaseDate, s.Clock)
+		if code != "" {
+			add("purchaseDate", code, message, "")
+		}
+	}
+	_, timeErr := time.Parse("15:04", receipt.PurchaseTime)
+	if timeErr != nil {
+		message, suggestion := diagnoseTime(receipt.PurchaseTime)
+		add("purchaseTime", codeInvalidReceipt, message, suggestion)
+	}
+
+	// Items
+	if len(receipt.Items) == 0 {
+		add("items", codeInvalidReceipt, "The receipt has no items.", "Send at least one item.")
+	}
+	for i, item := range receipt.Items {
+		field := fmt.Sprintf("items[%d]", i)
+		if !CheckPriceValidity(item.Price) {
+			message, suggestion := diagnoseAmount("The price of item "+fmt.Sprint(i+1), item.Price)
+			add(field+".price", codeInvalidReceipt, message, suggestion)
+		}
+		if item.ShortDescription == "" {
+			soft(field+".shortDescription", fmt.Sprintf("The description of item %d is missing.", i+1), "")
+		} else if len(CheckItemDescriptions(Receipt{Items: []Item{item}})) > 0 {
+			soft(field+".shortDescription",
+				fmt.Sprintf("The description of item %d has characters other than %s.", i+1, allowedNameChars(config.DescriptionExtraCharacters)),
+				"Remove "+quoteChars(disallowedChars(item.ShortDescription, config.DescriptionExtraCharacters))+".")
+		}
+	}
+
+	// Total
+	if !CheckPriceValidity(receipt.Total) {
+		message, suggestion := diagnoseAmount("total", receipt.Total)
+		add("total", codeInvalidReceipt, message, suggestion)
+	}
+
+	// Optional fields
+	if !CheckPaymentMethod(receipt.PaymentMethod) {
+		add("paymentMethod", codeInvalidReceipt, fmt.Sprintf("%q is not a known payment method.", receipt.PaymentMethod),
+			"Use cash, credit, debit or giftcard, or leave it out.")
+	}
+	if receipt.LoyaltyNumber != "" && !CheckLoyaltyNumber(receipt.LoyaltyNumber) {
+		suggestion := "Check the number for typos; its last digit is a Luhn check digit."
+		if config.LoyaltyNumberPattern != "" {
+			suggestion = "Loyalty numbers must match " + config.LoyaltyNumberPattern + "."
+		}
+		add("loyaltyNumber", codeInvalidLoyaltyNumber, "The loyalty number is invalid.", suggestion)
+	}
+	return issues
+}
+
+// Explains what is wrong with an amount that failed validation
+func diagnoseAmount(name string, amount string) (string, string) {
+	trimmed := strings.TrimSpace(amount)
+	switch {
+	case trimmed == "":
+		return name + " is missing.", "Send it as dollars and cents, e.g. \"35.35\"."
+	case trimmed != amount:
+		return name + " has spaces around it.", "Send \"" + trimmed + "\"."
+	case strings.HasPrefix(trimmed, "-"):
+		return name + " is negative.", ""
+	case strings.IndexAny(trimmed, "$€£¥") == 0:
+		amount = strings.TrimLeft(trimmed, "$€£¥ ")
+		if CheckPriceValidity(amount) {
+			return name + " starts with a currency symbol.", "Send the amount alone: \"" + amount + "\"."
+		}
+		_, suggestion := diagnoseAmount(name, amount)
+		return name + " starts with a currency symbol.", "Remove it, then " + strings.ToLower(suggestion[:1]) + suggestion[1:]
+	case strings.Contains(trimmed, ",") && strings.Contains(trimmed, "."):
+		return name + " has thousands separators.", "Remove them, e.g. \"" + strings.ReplaceAll(trimmed, ",", "") + "\", or declare the receipt's locale."
+	case strings.Contains(trimmed, ","):
+		return name + " uses a comma as the decimal point.", "Use a period, e.g. \"" + strings.ReplaceAll(trimmed, ",", ".") + "\", or declare the receipt's locale."
+	}
+
+	units, cents, hasPoint := strings.Cut(trimmed, ".")
+	if regexp.MustCompile(`^\d*$`).MatchString(units) && regexp.MustCompile(`^\d*$`).MatchString(cents) {
+		switch {
+		case units == "":
+			return name + " has no dollars before the decimal point.", "Add a leading zero, e.g. \"0" + trimmed + "\"."
+		case !hasPoint:
+			return name + " has no decimal places, expected two.", "Send \"" + trimmed + ".00\"."
+		case len(cents) == 1:
+			return name + " has one decimal place, expected two.", "Send \"" + trimmed + "0\"."
+		case len(cents) == 0:
+			return name + " ends in a decimal point.", "Send \"" + trimmed + "00\"."
+		default:
+			return fmt.Sprintf("%s has %d decimal places, expected two.", name, len(cents)), "Round it to cents."
+		}
+	}
+	return name + " is not an amount of dollars and cents.", "Send it like \"35.35\"."
+}
+
+// Explains what is wrong with a purchase time that failed validation
+func diagnoseTime(value string) (string, string) {
+	if value == "" {
+		return "purchaseTime is missing.", "Send it as 24 hour HH:MM, e.g. \"13:01\"."
+	}
+	if parsed, err := time.Parse("15:04:05", value); err == nil {
+		return "purchaseTime is 24 hour with seconds.", "Drop the seconds: \"" + parsed.Format("15:04") + "\"."
+	}
+	if parsed, err := time.Parse("3:04", value); err == nil {
+		return "purchaseTime has a one digit hour.", "Pad the hour to two digits: \"" + parsed.Format("15:04") + "\"."
+	}
+	upper := strings.ToUpper(value)
+	if strings.Contains(upper, "AM") || strings.Contains(upper, "PM") {
+		if config.FetchCompat {
+			return "purchaseTime is 12 hour.", "Send 24 hour HH:MM, e.g. \"13:01\"."
+		}
+		return "purchaseTime is 12 hour but not in a layout we accept.", "Send it like \"1:01 PM\", or as 24 hour \"13:01\"."
+	}
+	return "purchaseTime is not a 24 hour time like 13:01.", "Send hours from 00 to 23 and minutes from 00 to 59 as HH:MM."
+}
+
+// Suggests a fix for a purchase date in the wrong layout
+func suggestDate(value string) string {
+	if value == "" {
+		return "Send it as YYYY-MM-DD, e.g. \"2022-01-01\"."
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return "Send only the date, \"" + parsed.Format(dateLayout) + "\", or send the full value as purchaseDateTime."
+	}
+	for _, layout := range commonDateLayouts {
+		parsed, err := time.Parse(layout, value)
+		if err == nil {
+			return "Send it as YYYY-MM-DD: \"" + parsed.Format(dateLayout) + "\"."
+		}
+	}
+	return "Send it as YYYY-MM-DD, e.g. \"2022-01-01\"."
+}
+
+// Returns the distinct characters of a name that validation doesn't allow, besides
+// letters, digits, spaces, dashes and the extra characters given
+func disallowedChars(str string, extra string) []string {
+	var found []string
+	seen := map[rune]bool{}
+	for _, r := range str {
+		if seen[r] || allowedNameChar(r, extra) {
+			continue
+		}
+		seen[r] = true
+		found = append(found, string(r))
+	}
+	return found
+}
+
+// Quotes characters for a message, e.g. `"!" and "@"`
+func quoteChars(chars []string) string {
+	quoted := make([]string, len(chars))
+	for i, char := range chars {
+		quoted[i] = fmt.Sprintf("%q", char)
+	}
+	if len(quoted) <= 1 {
+		return strings.Join(quoted, "")
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " and " + quoted[len(quoted)-1]
+}
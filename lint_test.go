@@ -0,0 +1,131 @@
+package receiptapi
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name    string
+		receipt Receipt
+		lenient bool
+		want    []LintIssue
+	}{
+		{name: "valid", receipt: targetReceipt, want: []LintIssue{}},
+		{
+			name: "every problem reported",
+			receipt: Receipt{
+				Retailer:     "Target!",
+				PurchaseDate: "01/02/2022",
+				PurchaseTime: "13:01:05",
+				Items:        []Item{{ShortDescription: "Pizza", Price: "$12.5"}},
+				Total:        "12,50",
+			},
+			want: []LintIssue{
+				{"retailer", severityError, codeInvalidReceipt, "", ""},
+				{"purchaseDate", severityError, codeInvalidReceipt, "", ""},
+				{"purchaseTime", severityError, codeInvalidReceipt, "", ""},
+				{"items[0].price", severityError, codeInvalidReceipt, "", ""},
+				{"total", severityError, codeInvalidReceipt, "", ""},
+			},
+		},
+		{
+			name:    "lenient partner warned",
+			receipt: Receipt{Retailer: "Target!", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Items: []Item{{Price: "1.00"}}, Total: "1.00"},
+			lenient: true,
+			want: []LintIssue{
+				{"retailer", severityWarning, codeInvalidReceipt, "", ""},
+				{"items[0].shortDescription", severityWarning, codeInvalidReceipt, "", ""},
+			},
+		},
+		{
+			name:    "no items",
+			receipt: Receipt{Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "1.00", PaymentMethod: "cheque"},
+			want: []LintIssue{
+				{"items", severityError, codeInvalidReceipt, "", ""},
+				{"paymentMethod", severityError, codeInvalidReceipt, "", ""},
+			},
+		},
+	}
+	s := New()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issues := s.Lint(test.receipt, Partner{Lenient: test.lenient})
+			// Only where and how bad; the wording is checked by the diagnose tests
+			got := []LintIssue{}
+			for _, issue := range issues {
+				got = append(got, LintIssue{Field: issue.Field, Severity: issue.Severity, Code: issue.Code})
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("Lint() = %+v, want %+v", issues, test.want)
+			}
+		})
+	}
+}
+
+func TestDiagnoseAmount(t *testing.T) {
+	tests := []struct {
+		amount         string
+		wantMessage    string
+		wantSuggestion string
+	}{
+		{"", "total is missing.", `Send it as dollars and cents, e.g. "35.35".`},
+		{" 1.00", "total has spaces around it.", `Send "1.00".`},
+		{"-1.00", "total is negative.", ""},
+		{"$1.00", "total starts with a currency symbol.", `Send the amount alone: "1.00".`},
+		{"$1.5", "total starts with a currency symbol.", `Remove it, then send "1.50".`},
+		{"1,234.50", "total has thousands separators.", `Remove them, e.g. "1234.50", or declare the receipt's locale.`},
+		{"1,50", "total uses a comma as the decimal point.", `Use a period, e.g. "1.50", or declare the receipt's locale.`},
+		{".50", "total has no dollars before the decimal point.", `Add a leading zero, e.g. "0.50".`},
+		{"12", "total has no decimal places, expected two.", `Send "12.00".`},
+		{"12.5", "total has one decimal place, expected two.", `Send "12.50".`},
+		{"12.", "total ends in a decimal point.", `Send "12.00".`},
+		{"12.505", "total has 3 decimal places, expected two.", "Round it to cents."},
+		{"twelve", "total is not an amount of dollars and cents.", `Send it like "35.35".`},
+	}
+	for _, test := range tests {
+		message, suggestion := diagnoseAmount("total", test.amount)
+		if message != test.wantMessage || suggestion != test.wantSuggestion {
+			t.Errorf("diagnoseAmount(%q) = %q, %q, want %q, %q", test.amount, message, suggestion, test.wantMessage, test.wantSuggestion)
+		}
+	}
+}
+
+func TestDiagnoseTime(t *testing.T) {
+	tests := []struct {
+		value          string
+		wantSuggestion string
+	}{
+		{"", `Send it as 24 hour HH:MM, e.g. "13:01".`},
+		{"13:01:05", `Drop the seconds: "13:01".`},
+		{"9:05", `Pad the hour to two digits: "09:05".`},
+		{"1 o'clock PM", `Send it like "1:01 PM", or as 24 hour "13:01".`},
+		{"25:00", "Send hours from 00 to 23 and minutes from 00 to 59 as HH:MM."},
+	}
+	for _, test := range tests {
+		_, suggestion := diagnoseTime(test.value)
+		if suggestion != test.wantSuggestion {
+			t.Errorf("diagnoseTime(%q) suggests %q, want %q", test.value, suggestion, test.wantSuggestion)
+		}
+	}
+}
+
+func TestSuggestDate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", `Send it as YYYY-MM-DD, e.g. "2022-01-01".`},
+		{"01/02/2022", `Send it as YYYY-MM-DD: "2022-01-02".`},
+		{"20220102", `Send it as YYYY-MM-DD: "2022-01-02".`},
+		{"Jan 2, 2022", `Send it as YYYY-MM-DD: "2022-01-02".`},
+		{"2022-01-02T13:01:00Z", `Send only the date, "2022-01-02", or send the full value as purchaseDateTime.`},
+		{"yesterday", `Send it as YYYY-MM-DD, e.g. "2022-01-01".`},
+	}
+	for _, test := range tests {
+		if got := suggestDate(test.value); got != test.want {
+			t.Errorf("suggestDate(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package receiptapi
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Counts of submissions turned away under overload, how many are being processed, and
+// how many are let through at once, published at /admin/debug/vars
+var (
+	submissionsShed     = expvar.NewInt("submissions_shed")
+	submissionsInFlight = expvar.NewInt("submissions_in_flight")
+	submissionLimit     = expvar.NewInt("submission_limit")
+)
+
+// Submissions being processed and how many may be. With a target latency the limit
+// adapts: it is cut by a tenth while submissions take longer than the target, at most
+// once per target interval, and grows by one for each limit's worth of faster ones.
+var shedding struct {
+	mu           sync.Mutex
+	inFlight     int
+	limit        float64
+	latency      time.Duration
+	lastDecrease time.Time
+}
+
+// Takes a place for a submission if fewer than the limit are being processed; returns
+// false if it should be shed
+func admitSubmission() bool {
+	shedding.mu.Lock()
+	defer shedding.mu.Unlock()
+	if shedding.limit == 0 {
+		shedding.limit = float64(config.ShedMaxInFlight)
+		submissionLimit.Set(int64(shedding.limit))
+	}
+	if shedding.inFlight >= int(shedding.limit) {
+		return false
+	}
+	shedding.inFlight += 1
+	submissionsInFlight.Set(int64(shedding.inFlight))
+	return true
+}
+
+// Gives up a submission's place, adapting the limit to how long it took
+func finishSubmission(took time.Duration, now time.Time) {
+	shedding.mu.Lock()
+	defer shedding.mu.Unlock()
+	shedding.inFlight -= 1
+	submissionsInFlight.Set(int64(shedding.inFlight))
+	target := time.Duration(config.ShedTargetLatencyMS) * time.Millisecond
+	if target <= 0 {
+		return
+	}
+
+	// A moving average, so one slow submission doesn't cut the limit on its own
+	if shedding.latency == 0 {
+		shedding.latency = took
+	}
+	shedding.latency = (shedding.latency*4 + took) / 5
+	switch {
+	case shedding.latency > target && now.Sub(shedding.lastDecrease) >= target:
+		shedding.limit = max(1, shedding.limit*0.9)
+		shedding.lastDecrease = now
+	case shedding.latency <= target:
+		shedding.limit = min(float64(config.ShedMaxInFlight), shedding.limit+1/shedding.limit)
+	}
+	submissionLimit.Set(int64(shedding.limit))
+}
+
+// Answers 503 with a Retry-After header instead of calling next when as many submissions
+// as allowed are already being processed, so excess load is turned away early rather than
+// slowing down every request
+func (s *Server) ShedLoad(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.ShedMaxInFlight <= 0 {
+			next(w, r)
+			return
+		}
+		if !admitSubmission() {
+			submissionsShed.Add(1)
+			CountRejection(codeOverloaded, s.Clock.Now())
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(config.ShedRetryAfterSeconds))
+			WriteError(w, http.StatusServiceUnavailable, codeOverloaded, "The server is busy processing other receipts; try again shortly.")
+			return
+		}
+
+		// Timed with the system clock, since it's how long processing really took
+		start := time.Now()
+		defer func() { finishSubmission(time.Since(start), time.Now()) }()
+		next(w, r)
+	}
+}
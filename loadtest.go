@@ -0,0 +1,303 @@
+package receiptapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Receipt as it is submitted, without anything the server adds when storing it
+type loadTestReceipt struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Total        string `json:"total"`
+	Items        []Item `json:"items"`
+}
+
+// Submission sent by the load test, and whether the server should accept it
+type loadTestRequest struct {
+	Body  []byte
+	Valid bool
+}
+
+// Outcome of one submission
+type loadTestResult struct {
+	Latency time.Duration
+	Status  int
+	Valid   bool
+
+	// Set if no response was received
+	Err error
+}
+
+// Retailers and items synthetic receipts are made up from
+var (
+	loadTestRetailers = []string{"Target", "M&M Corner Market", "Walgreens", "Corner Deli & Bakery", "Shell 24-7"}
+	loadTestItems     = []string{"Mountain Dew 12PK", "Emils Cheese Pizza", "Knorr Creamy Chicken", "Doritos Nacho Cheese", "Gatorade", "Pepsi - 12-oz"}
+)
+
+// Ways a synthetic receipt is made invalid
+var loadTestBreakages = []func(receipt *loadTestReceipt){
+	func(receipt *loadTestReceipt) { receipt.Retailer = "" },
+	func(receipt *loadTestReceipt) { receipt.PurchaseDate = "2022-13-45" },
+	func(receipt *loadTestReceipt) { receipt.PurchaseTime = "25:61" },
+	func(receipt *loadTestReceipt) { receipt.Items[0].Price = "free" },
+	func(receipt *loadTestReceipt) { receipt.Items = nil },
+}
+
+// Returns a synthetic receipt bought yesterday, so it passes the purchase date checks,
+// with between one and six items that add up to its total
+func syntheticReceipt(now time.Time) loadTestReceipt {
+	receipt := loadTestReceipt{
+		Retailer:     loadTestRetailers[rand.IntN(len(loadTestRetailers))],
+		PurchaseDate: now.AddDate(0, 0, -1).Format(time.DateOnly),
+		PurchaseTime: fmt.Sprintf("%02d:%02d", rand.IntN(24), rand.IntN(60)),
+	}
+	var total int64
+	for range 1 + rand.IntN(6) {
+		cents := 50 + rand.Int64N(2000)
+		total += cents
+		receipt.Items = append(receipt.Items, Item{
+			ShortDescription: loadTestItems[rand.IntN(len(loadTestItems))],
+			Price:            formatCents(cents),
+		})
+	}
+	receipt.Total = formatCents(total)
+	return receipt
+}
+
+// Returns the submissions to send: synthetic receipts, invalidPercent of them made
+// invalid, or the receipts in an archive in turn
+func loadTestSource(archive []archivedReceipt, invalidPercent int) func(i int) loadTestRequest {
+	return func(i int) loadTestRequest {
+		var receipt loadTestReceipt
+		valid := true
+		if len(archive) > 0 {
+			stored := archive[i%len(archive)].Receipt
+			receipt = loadTestReceipt{stored.Retailer, stored.PurchaseDate, stored.PurchaseTime, stored.Total, stored.Items}
+		} else {
+			receipt = syntheticReceipt(time.Now())
+			if rand.IntN(100) < invalidPercent {
+				loadTestBreakages[rand.IntN(len(loadTestBreakages))](&receipt)
+				valid = false
+			}
+		}
+		body, _ := json.Marshal(receipt)
+		return loadTestRequest{Body: body, Valid: valid}
+	}
+}
+
+// Sends a submission to the server at the base URL and times it. Without an API key, a
+// submission token is fetched first, outside the time taken.
+func sendLoadTestRequest(ctx context.Context, client *http.Client, base string, apiKey string, request loadTestRequest) loadTestResult {
+	result := loadTestResult{Valid: request.Valid}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/receipts/process", bytes.NewReader(request.Body))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		httpRequest.Header.Set("X-API-Key", apiKey)
+	} else {
+		token, err := FetchSubmissionToken(ctx, client, base)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		httpRequest.Header.Set("X-Submission-Token", token)
+	}
+	started := time.Now()
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	result.Latency = time.Since(started)
+	result.Status = response.StatusCode
+	return result
+}
+
+// Returns whether a submission got the response it should have: valid receipts are
+// accepted, and invalid ones turned away with 400
+func (result loadTestResult) expected() bool {
+	if result.Err != nil {
+		return false
+	}
+	if result.Valid {
+		return result.Status >= 200 && result.Status < 300
+	}
+	return result.Status == http.StatusBadRequest
+}
+
+// Returns the latency below which a fraction of the sorted latencies fall, by nearest rank
+func latencyPercentile(sorted []time.Duration, fraction float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(float64(len(sorted))*fraction+0.999999) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+// Prints the latency percentiles, the responses by status and the error rate
+func printLoadTestReport(results []loadTestResult, skipped int, elapsed time.Duration) {
+	latencies := []time.Duration{}
+	statuses := map[int]int{}
+	failed, unexpected := 0, 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed += 1
+		} else {
+			latencies = append(latencies, result.Latency)
+			statuses[result.Status] += 1
+		}
+		if !result.expected() {
+			unexpected += 1
+		}
+	}
+	slices.Sort(latencies)
+
+	fmt.Printf("Sent %d requests in %s (%.1f/s)", len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds())
+	if skipped > 0 {
+		fmt.Printf(", skipping %d while too many were in flight", skipped)
+	}
+	fmt.Println()
+	if len(latencies) > 0 {
+		fmt.Printf("Latency: p50 %s, p90 %s, p95 %s, p99 %s, max %s\n",
+			latencyPercentile(latencies, 0.5), latencyPercentile(latencies, 0.9), latencyPercentile(latencies, 0.95),
+			latencyPercentile(latencies, 0.99), latencies[len(latencies)-1])
+	}
+	for _, status := range slices.Sorted(maps.Keys(statuses)) {
+		fmt.Printf("  %d %s: %d\n", status, http.StatusText(status), statuses[status])
+	}
+	if failed > 0 {
+		fmt.Printf("  no response: %d\n", failed)
+	}
+	rate := 0.0
+	if len(results) > 0 {
+		rate = float64(unexpected) / float64(len(results)) * 100
+	}
+	fmt.Printf("Errors: %d (%.2f%%) did not get the response they should have\n", unexpected, rate)
+}
+
+// Sends receipts to a running server at a steady rate for a while, then reports how long
+// they took and how many failed. Receipts are synthetic, some of them invalid, unless an
+// archive is given to send instead.
+func RunLoadTest(args []string) error {
+	flags := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	url := flags.String("url", "http://localhost:8000", "base URL of the server to load")
+	rate := flags.Float64("rate", 10, "requests to send per second")
+	duration := flags.Duration("duration", 30*time.Second, "how long to send requests for")
+	invalidPercent := flags.Int("invalid-percent", 10, "percent of synthetic receipts to make invalid")
+	maxInFlight := flags.Int("max-in-flight", 100, "most requests to wait on at once; more are skipped")
+	apiKey := flags.String("api-key", "", "API key to submit with")
+	from := flags.String("from", "", "NDJSON or CSV archive of receipts to send instead of synthetic ones")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	switch {
+	case flags.NArg() != 0:
+		return errors.New("loadtest takes no arguments")
+	case *rate <= 0:
+		return errors.New("-rate must be positive")
+	case *invalidPercent < 0 || *invalidPercent > 100:
+		return errors.New("-invalid-percent must be between 0 and 100")
+	case *maxInFlight < 1:
+		return errors.New("-max-in-flight must be at least 1")
+	}
+
+	var archive []archivedReceipt
+	if *from != "" {
+		file, err := os.Open(*from)
+		if err != nil {
+			return err
+		}
+		var records []archivedReceipt
+		if strings.EqualFold(filepath.Ext(*from), ".csv") {
+			records, err = ReadReceiptsCSV(file)
+		} else {
+			records, err = ReadReceiptsNDJSON(file)
+		}
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", *from, err)
+		}
+		for _, record := range records {
+			if record.Err == nil {
+				archive = append(archive, record)
+			}
+		}
+		if len(archive) == 0 {
+			return fmt.Errorf("%s has no readable receipts", *from)
+		}
+	}
+	next := loadTestSource(archive, *invalidPercent)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	base := strings.TrimSuffix(*url, "/")
+	target := base + "/receipts/process"
+	client := &http.Client{Timeout: 30 * time.Second}
+	fmt.Printf("Sending %.1f requests per second to %s for %s\n", *rate, target, *duration)
+
+	var (
+		results []loadTestResult
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	inFlight := make(chan struct{}, *maxInFlight)
+	skipped := 0
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+	started := time.Now()
+	for i := 0; ctx.Err() == nil; i++ {
+		select {
+		case <-ctx.Done():
+			continue
+		case <-ticker.C:
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			skipped += 1
+			continue
+		}
+		wg.Add(1)
+		go func(request loadTestRequest) {
+			defer wg.Done()
+			// Requests already sent are waited on, not cut short
+			result := sendLoadTestRequest(context.WithoutCancel(ctx), client, base, *apiKey, request)
+			<-inFlight
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}(next(i))
+	}
+	elapsed := time.Since(started)
+	wg.Wait()
+
+	printLoadTestReport(results, skipped, elapsed)
+	return nil
+}
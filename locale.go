@@ -0,0 +1,121 @@
+package receiptapi
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Separators a locale writes numbers with
+type NumberFormat struct {
+	Decimal string
+	Group   []string
+}
+
+// Number formats by language, used unless the full locale has its own entry
+var numberFormats = map[string]NumberFormat{
+	"en": {Decimal: ".", Group: []string{","}},
+	"ja": {Decimal: ".", Group: []string{","}},
+	"zh": {Decimal: ".", Group: []string{","}},
+	"de": {Decimal: ",", Group: []string{"."}},
+	"es": {Decimal: ",", Group: []string{"."}},
+	"it": {Decimal: ",", Group: []string{"."}},
+	"nl": {Decimal: ",", Group: []string{"."}},
+	"pt": {Decimal: ",", Group: []string{"."}},
+	"da": {Decimal: ",", Group: []string{"."}},
+	"tr": {Decimal: ",", Group: []string{"."}},
+	"fr": {Decimal: ",", Group: []string{" ", "\u00a0", "\u202f"}},
+	"sv": {Decimal: ",", Group: []string{" ", "\u00a0"}},
+	"fi": {Decimal: ",", Group: []string{" ", "\u00a0"}},
+	"nb": {Decimal: ",", Group: []string{" ", "\u00a0"}},
+	"pl": {Decimal: ",", Group: []string{" ", "\u00a0"}},
+	"cs": {Decimal: ",", Group: []string{" ", "\u00a0"}},
+	"ru": {Decimal: ",", Group: []string{" ", "\u00a0"}},
+}
+
+// Number formats for locales that differ from their language's default
+var localeNumberFormats = map[string]NumberFormat{
+	"de-ch": {Decimal: ".", Group: []string{"'", "\u2019"}},
+	"fr-ch": {Decimal: ".", Group: []string{"'", "\u2019"}},
+	"it-ch": {Decimal: ".", Group: []string{"'", "\u2019"}},
+	"es-mx": {Decimal: ".", Group: []string{","}},
+}
+
+// Returns the number format of a locale such as "de-DE" or "fr_FR"
+func GetNumberFormat(locale string) (NumberFormat, bool) {
+	tag := strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	format, ok := localeNumberFormats[tag]
+	if ok {
+		return format, true
+	}
+	language, _, _ := strings.Cut(tag, "-")
+	format, ok = numberFormats[language]
+	return format, ok
+}
+
+// Rewrites an amount written in the given format as canonical dollars and cents, e.g.
+// "1.234,56" in German becomes "1234.56". Amounts that don't fit the format are returned
+// unchanged so that validation rejects them.
+func NormalizeAmount(amount string, format NumberFormat) string {
+	groups := make([]string, len(format.Group))
+	for i, group := range format.Group {
+		groups[i] = regexp.QuoteMeta(group)
+	}
+	pattern := fmt.Sprintf(`^(\d{1,3}(?:(?:%s)\d{3})+|\d+)%s(\d{2})$`,
+		strings.Join(groups, "|"), regexp.QuoteMeta(format.Decimal))
+	match := regexp.MustCompile(pattern).FindStringSubmatch(strings.TrimSpace(amount))
+	if match == nil {
+		return amount
+	}
+
+	units := match[1]
+	for _, group := range format.Group {
+		units = strings.ReplaceAll(units, group, "")
+	}
+	return units + "." + match[2]
+}
+
+// Normalizes the total and item prices of a receipt that declares a locale; returns false
+// if the locale isn't one we know
+func NormalizeLocaleAmounts(receipt *Receipt) bool {
+	if receipt.Locale == "" {
+		return true
+	}
+	format, ok := GetNumberFormat(receipt.Locale)
+	if !ok {
+		logScoring.Debug("Unknown locale")
+		return false
+	}
+
+	receipt.Total = NormalizeAmount(receipt.Total, format)
+	items := make([]Item, len(receipt.Items))
+	for i, item := range receipt.Items {
+		item.Price = NormalizeAmount(item.Price, format)
+		items[i] = item
+	}
+	receipt.Items = items
+	return true
+}
+
+// Returns whether a currency code is three upper case letters, as ISO 4217 codes are
+func isCurrencyCode(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, c := range currency {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks a receipt's currency, if it gives one, is a currency code the program accepts
+func CheckCurrency(currency string) bool {
+	if currency == "" {
+		return true
+	}
+	accepted := CurrentProgram().AcceptedCurrencies
+	return isCurrencyCode(currency) && (len(accepted) == 0 || slices.Contains(accepted, currency))
+}
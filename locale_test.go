@@ -0,0 +1,83 @@
+package receiptapi
+
+import "testing"
+
+func TestGetNumberFormat(t *testing.T) {
+	tests := []struct {
+		locale  string
+		decimal string
+		ok      bool
+	}{
+		{"de-DE", ",", true},
+		{"de_DE", ",", true},
+		{"DE", ",", true},
+		{"de-CH", ".", true},
+		{"en-US", ".", true},
+		{"fr-FR", ",", true},
+		{"xx-XX", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		format, ok := GetNumberFormat(test.locale)
+		if ok != test.ok || format.Decimal != test.decimal {
+			t.Errorf("GetNumberFormat(%q) = %q, %v, want %q, %v", test.locale, format.Decimal, ok, test.decimal, test.ok)
+		}
+	}
+}
+
+func TestNormalizeAmount(t *testing.T) {
+	tests := []struct {
+		amount string
+		locale string
+		want   string
+	}{
+		{"1.234,56", "de-DE", "1234.56"},
+		{"1.234.567,89", "de-DE", "1234567.89"},
+		{"12,50", "de-DE", "12.50"},
+		{"1234,56", "de-DE", "1234.56"},
+		{" 6,49 ", "de-DE", "6.49"},
+		{"1 234,56", "fr-FR", "1234.56"},
+		{"1\u00a0234,56", "fr-FR", "1234.56"},
+		{"1\u202f234,56", "fr-FR", "1234.56"},
+		{"1'234.56", "de-CH", "1234.56"},
+		{"1,234.56", "en-US", "1234.56"},
+		{"12.50", "en-US", "12.50"},
+
+		// Amounts that don't fit the format are left for validation to reject
+		{"12.50", "de-DE", "12.50"},
+		{"1.23,45", "de-DE", "1.23,45"},
+		{"12,5", "de-DE", "12,5"},
+		{"-1,00", "de-DE", "-1,00"},
+	}
+	for _, test := range tests {
+		format, _ := GetNumberFormat(test.locale)
+		got := NormalizeAmount(test.amount, format)
+		if got != test.want {
+			t.Errorf("NormalizeAmount(%q, %s) = %q, want %q", test.amount, test.locale, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeLocaleAmounts(t *testing.T) {
+	receipt := Receipt{
+		Locale: "de-DE",
+		Items:  []Item{{ShortDescription: "Gatorade", Price: "2,25"}, {ShortDescription: "Pizza", Price: "1.012,25"}},
+		Total:  "1.014,50",
+	}
+	if !NormalizeLocaleAmounts(&receipt) {
+		t.Fatal("NormalizeLocaleAmounts() = false, want true")
+	}
+	if receipt.Total != "1014.50" || receipt.Items[0].Price != "2.25" || receipt.Items[1].Price != "1012.25" {
+		t.Errorf("NormalizeLocaleAmounts() gave total %q and prices %q and %q", receipt.Total, receipt.Items[0].Price, receipt.Items[1].Price)
+	}
+
+	unknown := Receipt{Locale: "xx-XX", Total: "1,00"}
+	if NormalizeLocaleAmounts(&unknown) {
+		t.Error("NormalizeLocaleAmounts() = true for an unknown locale, want false")
+	}
+
+	plain := Receipt{Total: "1,00"}
+	if !NormalizeLocaleAmounts(&plain) || plain.Total != "1,00" {
+		t.Errorf("NormalizeLocaleAmounts() changed a receipt without a locale to %q", plain.Total)
+	}
+}
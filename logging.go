@@ -0,0 +1,434 @@
+package receiptapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parts of the program whose log levels can be set separately
+var logComponents = []string{"app", "http", "storage", "scoring", "jobs"}
+
+// Minimum level logged by each component, adjustable at runtime
+var logLevels = map[string]*slog.LevelVar{}
+
+// Loggers for each component
+var (
+	logApp     = componentLogger("app")
+	logHTTP    = componentLogger("http")
+	logStorage = componentLogger("storage")
+	logScoring = componentLogger("scoring")
+	logJobs    = componentLogger("jobs")
+)
+
+// Where every component's logs go once SetupLogging runs; standard output as text until
+// then
+var (
+	logSink   slog.Handler
+	logSinkMu sync.RWMutex
+)
+
+// Response listing each component's log level
+type LogLevelsResponse struct {
+	Levels map[string]string `json:"levels"`
+}
+
+// Returns a logger that tags records with a component and drops those below its level
+func componentLogger(component string) *slog.Logger {
+	level := &slog.LevelVar{}
+	logLevels[component] = level
+	return slog.New(&componentHandler{component: component, level: level})
+}
+
+// Sends the logs of the configured components, at their configured levels, to the
+// configured sink
+func SetupLogging(config Config) error {
+	levels, err := parseLogLevels(config.LogLevel, config.LogLevels)
+	if err != nil {
+		return err
+	}
+
+	var sink slog.Handler
+	switch config.LogSink {
+	case "stdout":
+		sink = newLogHandler(config.LogFormat, os.Stdout)
+	case "file":
+		file := &rotatingFile{Path: config.LogFile, MaxBytes: int64(config.LogFileMaxMB) << 20, Backups: config.LogFileBackups}
+		err = file.open()
+		if err != nil {
+			return fmt.Errorf("could not open log file: %w", err)
+		}
+		sink = newLogHandler(config.LogFormat, file)
+	case "syslog":
+		writer, err := dialSyslog(config.SyslogAddr, config.SyslogTag)
+		if err != nil {
+			return fmt.Errorf("could not connect to syslog: %w", err)
+		}
+		handler := &syslogHandler{writer: writer, buffer: &bytes.Buffer{}, mu: &sync.Mutex{}}
+		sink = handler.format(config.LogFormat)
+	default:
+		return fmt.Errorf("unknown LOG_SINK %q", config.LogSink)
+	}
+
+	logSinkMu.Lock()
+	logSink = sink
+	logSinkMu.Unlock()
+	for component, level := range levels {
+		logLevels[component].Set(level)
+	}
+	return nil
+}
+
+// Returns a handler writing every record to w as text or JSON lines
+func newLogHandler(format string, w io.Writer) slog.Handler {
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == "json" {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// Reads a default level and per component overrides such as "http:warn,jobs:debug"
+// into the level of every component
+func parseLogLevels(fallback string, overrides string) (map[string]slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(fallback))
+	if err != nil {
+		return nil, fmt.Errorf("unknown LOG_LEVEL %q", fallback)
+	}
+	levels := map[string]slog.Level{}
+	for _, component := range logComponents {
+		levels[component] = level
+	}
+	for _, pair := range strings.Split(overrides, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		component, value, _ := strings.Cut(pair, ":")
+		component = strings.TrimSpace(component)
+		if !slices.Contains(logComponents, component) {
+			return nil, fmt.Errorf("unknown component %q in LOG_LEVELS", component)
+		}
+		err = level.UnmarshalText([]byte(strings.TrimSpace(value)))
+		if err != nil {
+			return nil, fmt.Errorf("unknown level %q for %s in LOG_LEVELS", value, component)
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
+
+// Passes a component's records at or above its level to the current sink, with the
+// trace and span of their context, if it has one
+type componentHandler struct {
+	component string
+	level     *slog.LevelVar
+
+	// Attributes and groups added with With, applied to the sink in order
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	logSinkMu.RLock()
+	sink := logSink
+	logSinkMu.RUnlock()
+	if sink == nil {
+		sink = newLogHandler("text", os.Stdout)
+	}
+	attrs := []slog.Attr{slog.String("component", h.component)}
+	if trace, ok := TraceFrom(ctx); ok {
+		attrs = append(attrs, slog.String("traceId", trace.TraceID), slog.String("spanId", trace.SpanID))
+	}
+	sink = sink.WithAttrs(attrs)
+	for _, apply := range h.with {
+		sink = apply(sink)
+	}
+	return sink.Handle(ctx, record)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(sink slog.Handler) slog.Handler { return sink.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.extend(func(sink slog.Handler) slog.Handler { return sink.WithGroup(name) })
+}
+
+// Returns a copy of the handler that also applies with to the sink
+func (h *componentHandler) extend(with func(slog.Handler) slog.Handler) slog.Handler {
+	return &componentHandler{component: h.component, level: h.level, with: append(slices.Clip(h.with), with)}
+}
+
+// Logs every request with its status and how long it took
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		}
+		logHTTP.Log(r.Context(), level, "Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"durationMs", time.Since(start).Milliseconds())
+	})
+}
+
+// Remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Lets streamed responses such as exports keep flushing
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/*
+	Below are the handlers for reading and changing log levels at runtime
+*/
+
+// Method to list each component's log level
+func GetLogLevels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response := LogLevelsResponse{Levels: map[string]string{}}
+	for _, component := range logComponents {
+		response.Levels[component] = strings.ToLower(logLevels[component].Level().String())
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Method to change the log levels of the components in the request, leaving the others
+// as they are; responds with every component's level
+func SetLogLevels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request LogLevelsResponse
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || len(request.Levels) == 0 {
+		WriteError(w, http.StatusBadRequest, codeInvalidLogLevel, "The body must be a JSON object with the levels to set, e.g. {\"levels\": {\"http\": \"debug\"}}.")
+		return
+	}
+
+	// Check everything before changing anything
+	levels := map[string]slog.Level{}
+	for component, value := range request.Levels {
+		if !slices.Contains(logComponents, component) {
+			WriteError(w, http.StatusBadRequest, codeInvalidLogLevel, "Unknown component "+component+"; components are "+strings.Join(logComponents, ", ")+".")
+			return
+		}
+		var level slog.Level
+		err = level.UnmarshalText([]byte(value))
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, codeInvalidLogLevel, "Unknown level "+value+" for "+component+"; levels are debug, info, warn and error.")
+			return
+		}
+		levels[component] = level
+	}
+	for component, level := range levels {
+		logLevels[component].Set(level)
+		logApp.Info("Changed log level", "target", component, "level", level.String())
+	}
+	GetLogLevels(w, r)
+}
+
+/*
+	Below are the rotating file and syslog sinks
+*/
+
+// Log file that is renamed aside once it grows too large, keeping a number of old ones
+// as PATH.1, PATH.2 and so on, newest first
+type rotatingFile struct {
+	Path     string
+	MaxBytes int64
+	Backups  int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Opens the log file to append to
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.MaxBytes {
+		err := f.rotate()
+		if err != nil {
+			// Keep logging to the file we have rather than losing records
+			fmt.Fprintln(os.Stderr, "Could not rotate log file:", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Shifts the backups along, dropping the oldest, and starts a new file; the caller must
+// hold mu
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	for i := f.Backups; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.Path, i-1), fmt.Sprintf("%s.%d", f.Path, i))
+	}
+	var err error
+	if f.Backups > 0 {
+		err = os.Rename(f.Path, f.Path+".1")
+	} else {
+		err = os.Truncate(f.Path, 0)
+	}
+	openErr := f.open()
+	if openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// Sends messages to a syslog server in the RFC 5424 format
+type syslogWriter struct {
+	network string
+	address string
+	tag     string
+	host    string
+
+	conn net.Conn
+}
+
+// Connects to syslog at an address such as "udp://host:514" or "tcp://host:601", or
+// the local daemon when the address is empty
+func dialSyslog(address string, tag string) (*syslogWriter, error) {
+	writer := &syslogWriter{network: "unixgram", address: "/dev/log", tag: tag}
+	if address != "" {
+		target, err := url.Parse(address)
+		if err != nil || (target.Scheme != "udp" && target.Scheme != "tcp") || target.Host == "" {
+			return nil, fmt.Errorf("SYSLOG_ADDR must look like udp://host:514 or tcp://host:601")
+		}
+		writer.network, writer.address = target.Scheme, target.Host
+	}
+	writer.host, _ = os.Hostname()
+	if writer.host == "" {
+		writer.host = "-"
+	}
+	return writer, writer.connect()
+}
+
+func (s *syslogWriter) connect() error {
+	conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// Sends a message with the syslog severity matching a level, reconnecting once if the
+// connection was lost
+func (s *syslogWriter) send(level slog.Level, message []byte) error {
+	severity := 6
+	switch {
+	case level >= slog.LevelError:
+		severity = 3
+	case level >= slog.LevelWarn:
+		severity = 4
+	case level < slog.LevelInfo:
+		severity = 7
+	}
+	// Facility 1 is user level messages
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", 1*8+severity, time.Now().UTC().Format(time.RFC3339Nano), s.host, s.tag, os.Getpid(), bytes.TrimRight(message, "\n"))
+	if s.network == "tcp" {
+		// Octet counting frames messages over a stream
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	var err error
+	if s.conn != nil {
+		_, err = s.conn.Write([]byte(line))
+		if err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	err = s.connect()
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.Write([]byte(line))
+	return err
+}
+
+// Formats records as text or JSON and sends each to syslog as a message of its own
+type syslogHandler struct {
+	slog.Handler
+
+	writer *syslogWriter
+
+	// Where the formatting handler writes a record before it's sent; mu guards it and
+	// the connection, and is shared with every handler derived from this one
+	buffer *bytes.Buffer
+	mu     *sync.Mutex
+}
+
+// Returns the handler formatting records in the given format
+func (h *syslogHandler) format(format string) *syslogHandler {
+	h.Handler = newLogHandler(format, h.buffer)
+	return h
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buffer.Reset()
+	err := h.Handler.Handle(ctx, record)
+	if err != nil {
+		return err
+	}
+	return h.writer.send(record.Level, h.buffer.Bytes())
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithAttrs(attrs), writer: h.writer, buffer: h.buffer, mu: h.mu}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithGroup(name), writer: h.writer, buffer: h.buffer, mu: h.mu}
+}
@@ -0,0 +1,193 @@
+package receiptapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Request to link a loyalty number to a user
+type LoyaltyLinkRequest struct {
+	LoyaltyNumber string `json:"loyaltyNumber"`
+}
+
+// Response when a loyalty number is linked to a user
+type LoyaltyLinkResponse struct {
+	UserID         string `json:"userId"`
+	LoyaltyNumber  string `json:"loyaltyNumber"`
+	ReceiptsLinked int    `json:"receiptsLinked"`
+}
+
+// Loyalty number linked to a user, as kept in the loyalty file
+type LoyaltyLink struct {
+	LoyaltyNumber string    `json:"loyaltyNumber"`
+	UserID        string    `json:"userId"`
+	LinkedAt      time.Time `json:"linkedAt"`
+}
+
+// User IDs keyed by the loyalty numbers linked to them
+var loyaltyAccounts = map[string]string{}
+
+// Users with a loyalty number linked to them
+var loyaltyUsers = map[string]bool{}
+
+// Guards loyaltyAccounts, loyaltyUsers and loyaltyLog
+var loyaltyMu sync.RWMutex
+
+// Log file every link is appended to, if one is open
+var loyaltyLog *os.File
+
+// Loads linked loyalty numbers from a log file, then keeps it open to append to. Each
+// line holds one link as JSON.
+func OpenLoyaltyLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	loyaltyMu.Lock()
+	defer loyaltyMu.Unlock()
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		line := 0
+		for scanner.Scan() {
+			line += 1
+			var link LoyaltyLink
+			err = json.Unmarshal(scanner.Bytes(), &link)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			loyaltyAccounts[link.LoyaltyNumber] = link.UserID
+			loyaltyUsers[link.UserID] = true
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+	}
+
+	loyaltyLog, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	return err
+}
+
+// Appends a link to the log file, if one is open, syncing it to disk before the link
+// counts; the caller must hold loyaltyMu
+func persistLoyaltyLink(link LoyaltyLink) error {
+	if loyaltyLog == nil {
+		return nil
+	}
+	line, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	_, err = loyaltyLog.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return loyaltyLog.Sync()
+}
+
+// Checks a loyalty number against the configured pattern, which must match all of it, or
+// the Luhn checksum if none is set
+func CheckLoyaltyNumber(number string) bool {
+	if config.LoyaltyNumberPattern != "" {
+		valid, err := regexp.MatchString("^(?:"+config.LoyaltyNumberPattern+")$", number)
+		return valid && err == nil
+	}
+	return CheckLuhn(number)
+}
+
+// Checks a string of digits has a valid Luhn check digit
+func CheckLuhn(number string) bool {
+	if len(number) < 2 {
+		return false
+	}
+	var sum int
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		digit := int(number[i] - '0')
+		if digit < 0 || digit > 9 {
+			return false
+		}
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// Returns the user a loyalty number is linked to, or an empty string
+func GetLoyaltyUser(number string) string {
+	if number == "" {
+		return ""
+	}
+	loyaltyMu.RLock()
+	defer loyaltyMu.RUnlock()
+	return loyaltyAccounts[number]
+}
+
+// Method to link a loyalty number to a user; receipts already submitted with that
+// number and no user are associated with the user too. Routed behind RequireUser.
+func (s *Server) LinkLoyaltyNumber(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := mux.Vars(r)["id"]
+
+	var request LoyaltyLinkRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || !CheckLoyaltyNumber(request.LoyaltyNumber) {
+		WriteError(w, http.StatusBadRequest, codeInvalidLoyaltyNumber, "The loyalty number is invalid.")
+		return
+	}
+
+	loyaltyMu.Lock()
+	owner, linked := loyaltyAccounts[request.LoyaltyNumber]
+	if linked && owner != userID {
+		loyaltyMu.Unlock()
+		WriteError(w, http.StatusConflict, codeLoyaltyNumberTaken, "The loyalty number is linked to another user.")
+		return
+	}
+	if !linked {
+		err = persistLoyaltyLink(LoyaltyLink{request.LoyaltyNumber, userID, s.Clock.Now().UTC()})
+		if err != nil {
+			loyaltyMu.Unlock()
+			logApp.Error("Could not write loyalty log", "error", err)
+			WriteError(w, http.StatusInternalServerError, codeInternal, "The loyalty number could not be saved.")
+			return
+		}
+	}
+	loyaltyAccounts[request.LoyaltyNumber] = userID
+	loyaltyUsers[userID] = true
+	loyaltyMu.Unlock()
+
+	// Associate receipts that came in before the number was linked
+	count := s.Store.ModifyAll(func(receipt *Receipt) bool {
+		if receipt.LoyaltyNumber != request.LoyaltyNumber || receipt.UserID != "" || receipt.Sandbox {
+			return false
+		}
+		receipt.UserID = userID
+		return true
+	})
+	logApp.Info("Linked loyalty number to user", "receipts", count)
+
+	json.NewEncoder(w).Encode(LoyaltyLinkResponse{
+		UserID:         userID,
+		LoyaltyNumber:  request.LoyaltyNumber,
+		ReceiptsLinked: count,
+	})
+}
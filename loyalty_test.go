@@ -0,0 +1,121 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Forgets every linked loyalty number for a test, and puts them back when it ends
+func withoutLoyaltyLinks(t *testing.T) {
+	t.Helper()
+	savedAccounts, savedUsers := loyaltyAccounts, loyaltyUsers
+	t.Cleanup(func() { loyaltyAccounts, loyaltyUsers = savedAccounts, savedUsers })
+	loyaltyAccounts, loyaltyUsers = map[string]string{}, map[string]bool{}
+}
+
+func TestCheckLoyaltyNumber(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		number  string
+		want    bool
+	}{
+		{"luhn", "", "79927398713", true},
+		{"bad luhn check digit", "", "79927398710", false},
+		{"pattern", `[A-Z]{2}\d{6}`, "AB123456", true},
+		{"pattern in a longer number", `[A-Z]{2}\d{6}`, "xAB1234567", false},
+		{"alternatives match in full", `\d{4}|[A-Z]{4}`, "1234ABCD", false},
+		{"one of the alternatives", `\d{4}|[A-Z]{4}`, "ABCD", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withConfig(t, func(config *Config) { config.LoyaltyNumberPattern = test.pattern })
+			if got := CheckLoyaltyNumber(test.number); got != test.want {
+				t.Errorf("CheckLoyaltyNumber(%q) = %v, want %v", test.number, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLinkLoyaltyNumber(t *testing.T) {
+	withoutLoyaltyLinks(t)
+	withoutPartners(t)
+	partners["acme-key"] = Partner{Name: "acme", Key: "acme-key"}
+	s := New()
+	s.Store.Add(Receipt{ID: "unlinked", Retailer: "Target", LoyaltyNumber: "79927398713"})
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"without credentials", nil, http.StatusUnauthorized},
+		{"as another user", map[string]string{"X-API-Key": "acme-key", "X-User-ID": "bob"}, http.StatusForbidden},
+		{"as the user", map[string]string{"X-API-Key": "acme-key", "X-User-ID": "alice"}, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/users/alice/loyalty", strings.NewReader(`{"loyaltyNumber": "79927398713"}`))
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		NewRouter(s).ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+	}
+	if GetLoyaltyUser("79927398713") != "alice" {
+		t.Fatalf("GetLoyaltyUser() = %q, want alice", GetLoyaltyUser("79927398713"))
+	}
+	if receipt, _ := s.Store.Find("unlinked"); receipt.UserID != "alice" {
+		t.Errorf("receipt submitted before linking has user %q, want alice", receipt.UserID)
+	}
+
+	// The receipt list doesn't say whose receipts are
+	w := httptest.NewRecorder()
+	NewRouter(s).ServeHTTP(w, httptest.NewRequest("GET", "/receipts", nil))
+	var list ReceiptListResponse
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Receipts) != 1 || list.Receipts[0].UserID != "" || list.Receipts[0].LoyaltyNumber != "" {
+		t.Errorf("ListReceipts() = %+v, want the receipt without its user or loyalty number", list.Receipts)
+	}
+}
+
+func TestLoyaltyLog(t *testing.T) {
+	withoutLoyaltyLinks(t)
+	path := filepath.Join(t.TempDir(), "loyalty.jsonl")
+	closeLog := func() {
+		if loyaltyLog != nil {
+			loyaltyLog.Close()
+			loyaltyLog = nil
+		}
+	}
+	t.Cleanup(closeLog)
+	err := OpenLoyaltyLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/users/alice/loyalty", strings.NewReader(`{"loyaltyNumber": "79927398713"}`))
+	r = mux.SetURLVars(r, map[string]string{"id": "alice"})
+	w := httptest.NewRecorder()
+	New().LinkLoyaltyNumber(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("LinkLoyaltyNumber() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	closeLog()
+	loyaltyAccounts, loyaltyUsers = map[string]string{}, map[string]bool{}
+	err = OpenLoyaltyLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GetLoyaltyUser("79927398713") != "alice" || !loyaltyUsers["alice"] {
+		t.Errorf("loaded links = %v, want the number linked to alice", loyaltyAccounts)
+	}
+}
@@ -1,19 +1,25 @@
-package main
+package receiptapi
 
 // @title Receipt API
 // @description A simple receipt processor
 // @version 1.0.0
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -21,18 +27,116 @@ import (
 
 // Receipt structure
 type Receipt struct {
-	ID           string
+	ID           string `json:"id"`
 	Retailer     string `json:"retailer"`
 	PurchaseDate string `json:"purchaseDate"`
 	PurchaseTime string `json:"purchaseTime"`
 	Items        []Item `json:"items"`
 	Total        string `json:"total"`
+
+	// Where the receipt is in its lifecycle: draft, submitted, processed or rejected
+	Status string `json:"status"`
+
+	// Why the receipt was rejected, for drafts that failed to finalize
+	RejectionReason string `json:"rejectionReason,omitempty"`
+
+	// Short code that can be used in place of the ID, e.g. when talking to support
+	ShortCode string `json:"shortCode"`
+
+	// Optional RFC 3339 alternative to purchaseDate and purchaseTime
+	PurchaseDateTime string `json:"purchaseDateTime,omitempty"`
+
+	// Optional; one of cash, credit, debit or giftcard
+	PaymentMethod string `json:"paymentMethod,omitempty"`
+
+	// Optional locale the total and prices are written in, e.g. "de-DE" for "1.234,56"
+	Locale string `json:"locale,omitempty"`
+
+	// Optional ISO 4217 code of the currency the total and prices are in, e.g. "USD"
+	Currency string `json:"currency,omitempty"`
+
+	// Optional loyalty or membership number, used to find the user the receipt belongs to
+	LoyaltyNumber string `json:"loyaltyNumber,omitempty"`
+
+	// Tenant the receipt was submitted for, from the X-Tenant-ID header
+	Tenant string `json:"tenant,omitempty"`
+
+	// Set for test receipts from sandbox partners and tenants, which are kept apart from
+	// production: they aren't linked to users, held for review, exported or counted in stats
+	Sandbox bool `json:"sandbox,omitempty"`
+
+	// Partner that submitted the receipt, and the partner's own ID for it if given; a
+	// partner can only submit each of its IDs once
+	Partner    string `json:"partner,omitempty"`
+	ExternalID string `json:"externalId,omitempty"`
+
+	// Where the receipt came from and how it was read, only shown to admins
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	// User the receipt is associated with, through its loyalty number
+	UserID string `json:"userId,omitempty"`
+
+	// Merchant category code, looked up when the receipt is processed
+	MCC string `json:"mcc"`
+
+	// Problems found that didn't make the receipt invalid
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Points scored when the receipt was processed or last recalculated
+	Points int64 `json:"points"`
+
+	// How item description lengths were counted when the points were scored, e.g. "bytes"
+	// or "runes-collapsed-normalized"
+	LengthMode string `json:"lengthMode,omitempty"`
+
+	// Set when the receipt should be checked by a person
+	Flagged bool `json:"flagged"`
+
+	// Receipt from the same retailer with the same total bought around the same time,
+	// which this one may be a resubmission of
+	NearDuplicateOf string `json:"nearDuplicateOf,omitempty"`
+
+	// When the receipt was processed and stored
+	ProcessedAt *time.Time `json:"processedAt,omitempty"`
+
+	// Rules whose points were cut to their configured cap, and "total" if the receipt's
+	// points were cut to the maximum per receipt
+	CappedRules []string `json:"cappedRules,omitempty"`
+
+	// Decision on a flagged receipt, once reviewed
+	Review *Review `json:"review,omitempty"`
+
+	// Rule settings the points were scored with
+	Scoring *RuleSnapshot `json:"scoring,omitempty"`
+
+	// Points the candidate rules being tried when the receipt was scored would have
+	// awarded, which it isn't awarded
+	Shadow *ShadowScore `json:"shadow,omitempty"`
+
+	// Set once the retailer and item descriptions have been scrubbed from the receipt
+	Anonymized *Anonymization `json:"anonymized,omitempty"`
+
+	// When the receipt was last stored or changed, set by the store
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+
+	// Place in the hash chain over accepted production receipts, set by the store, and
+	// the links of the changes made to it since, oldest first
+	Chain        *ChainLink  `json:"chain,omitempty"`
+	ChainChanges []ChainLink `json:"chainChanges,omitempty"`
+
+	// Changes reviewers made to resolve disputes, oldest first
+	Corrections []Correction `json:"corrections,omitempty"`
+
+	// Set once the receipt has been reduced to a summary, its full payload moved to the
+	// blob store
+	Compacted *Compaction `json:"compacted,omitempty"`
 }
 
 // Item structure to be contained in receipts
 type Item struct {
 	ShortDescription string `json:"shortDescription"`
 	Price            string `json:"price"`
+	SKU              string `json:"sku,omitempty"`
 }
 
 // Response when request for points
@@ -40,61 +144,218 @@ type PointsResponse struct {
 	Points int64 `json:"points"`
 }
 
+// Response when listing receipts
+type ReceiptListResponse struct {
+	Receipts []Receipt `json:"receipts"`
+}
+
+// Response when counting receipts
+type CountResponse struct {
+	Count int `json:"count"`
+}
+
 // Response when creating a new receipt
 type IDResponse struct {
-	ID string `json:"id"`
+	ID        string   `json:"id"`
+	ShortCode string   `json:"shortCode,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
 }
 
-// Holds all receipts in program, normally would be a database
-var receipts []Receipt
-
-// Method to find a receipt given an ID in request
-func GetReceiptByID(w http.ResponseWriter, r *http.Request) {
+// Method to find a receipt given an ID in request, and return its points or, with
+// ?fields=, the receipt fields given
+func (s *Server) GetReceiptByID(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	params := mux.Vars(r)
 	id, ok := params["id"]
 	if !ok {
-		fmt.Println("ID isn't in the params")
+		logHTTP.Debug("ID isn't in the params")
+	}
+	sandbox := IsSandboxRequest(r)
+	rejection := CheckIDPrefix(id, sandbox)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
 	}
+	fields, rejection := ParseFields(r.URL.Query())
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+
+	// A short code can be used in place of the ID
+	id = s.Store.ResolveShortCode(id)
 
-	for _, receipt := range receipts {
-		if receipt.ID == id {
-			// If found, calculate points and return JSON points object
-			points := GetReceiptPoints(receipt)
-			pointsStruct := PointsResponse{Points: points}
-			json.NewEncoder(w).Encode(pointsStruct)
+	// Only receipts from the request's own environment are found
+	receipt, found := s.Store.Find(id)
+	if found && receipt.Sandbox == sandbox {
+		// If found, calculate points and return JSON points object
+		points := AwardedPoints(receipt)
+		pointsStruct := PointsResponse{Points: points}
+		if token, signed := SignPoints(receipt, points, s.Clock.Now()); signed {
+			w.Header().Set("X-Points-Signature", token)
+		}
+		if fields != nil {
+			// The receipt's fields instead, as it's listed, with the points awarded
+			receipt.Points = points
+			receipt.Provenance = nil
+			receipt.LoyaltyNumber, receipt.UserID = "", ""
+			WriteReceipt(w, receipt, fields)
 			return
 		}
+		json.NewEncoder(w).Encode(pointsStruct)
+		return
+	}
+
+	// A spooled submission is pending until it's processed, and may then be turned away
+	pending, rejection := SpoolOutcome(id)
+	if pending {
+		WritePending(w, id)
+		return
+	}
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
 	}
 
 	// If receipt not found, return 404 error
-	http.Error(w, "No receipt found for that ID.", http.StatusNotFound)
+	WriteError(w, http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage)
+}
+
+// Method to list receipts, optionally filtered by ?mcc=, ?minPoints= and ?maxPoints=
+// and with only the ?fields= given; the number of matches is also sent in the
+// X-Total-Count header
+func (s *Server) ListReceipts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	filter, rejection := ParseReceiptFilter(r.URL.Query())
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	fields, rejection := ParseFields(r.URL.Query())
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	if IsSandboxRequest(r) {
+		filter.Sandbox = true
+	}
+
+	matches := s.FilterReceipts(filter)
+	for i := range matches {
+		// Only admins see where receipts came from, and whose they are
+		matches[i].Provenance = nil
+		matches[i].LoyaltyNumber, matches[i].UserID = "", ""
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(matches)))
+	WriteReceiptList(w, matches, fields)
+}
+
+// Method to count the receipts the list endpoint would return for the same filters
+func (s *Server) CountReceipts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	filter, rejection := ParseReceiptFilter(r.URL.Query())
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	if IsSandboxRequest(r) {
+		filter.Sandbox = true
+	}
+
+	count := len(s.FilterReceipts(filter))
+	w.Header().Set("X-Total-Count", strconv.Itoa(count))
+	json.NewEncoder(w).Encode(CountResponse{Count: count})
+}
+
+// Returns the stored receipts that match a filter, in the order they were stored
+func (s *Server) FilterReceipts(filter ReceiptFilter) []Receipt {
+	matches := []Receipt{}
+	for _, receipt := range s.Store.All() {
+		if filter.Matches(receipt) {
+			matches = append(matches, receipt)
+		}
+	}
+	return matches
 }
 
 // Calculates receipts points with given instructions
 func GetReceiptPoints(receipt Receipt) int64 {
-	// One point for every alphanumeric character in retailer name
-	retailer := receipt.Retailer
-	points := GetAlphanumeric(retailer)
+	return CurrentProgram().Rules.Points(receipt)
+}
+
+// Returns the points a receipt earns with these rule values
+func (rules ProgramRules) Points(receipt Receipt) int64 {
+	var points int64
+	for _, rule := range rules.PointsByRule(receipt) {
+		points += rule.Points
+	}
+	return CapReceiptPoints(points, rules)
+}
+
+// Points a receipt earned from one scoring rule
+type RulePoints struct {
+	Rule   string `json:"rule"`
+	Points int64  `json:"points"`
+}
+
+// Returns the points a receipt earns from each rule, cut to any configured caps, always
+// listing every rule in the same order
+func GetPointsByRule(receipt Receipt) []RulePoints {
+	return CurrentProgram().Rules.PointsByRule(receipt)
+}
+
+// Returns the points a receipt earns from each rule with these rule values, cut to their
+// caps
+func (rules ProgramRules) PointsByRule(receipt Receipt) []RulePoints {
+	return CapRulePoints(rules.UncappedPointsByRule(receipt), rules)
+}
+
+// Returns the points a receipt earns from each rule before any caps
+func GetUncappedPointsByRule(receipt Receipt) []RulePoints {
+	return CurrentProgram().Rules.UncappedPointsByRule(receipt)
+}
+
+// Returns the points a receipt earns from each rule with these rule values, before caps
+func (rules ProgramRules) UncappedPointsByRule(receipt Receipt) []RulePoints {
+	items := receipt
+	if rules.CollapseDuplicateItems {
+		items.Items = CollapseDuplicateItems(receipt.Items)
+	}
+	points := []RulePoints{
+		// One point for every alphanumeric character in retailer name
+		{"retailerName", GetAlphanumeric(receipt.Retailer)},
+
+		// Points for total cost
+		{"roundDollarTotal", GetRoundDollarPoints(receipt, rules)},
+		{"quarterMultipleTotal", GetQuarterMultiplePoints(receipt, rules)},
 
-	// Points for total cost
-	costStr := receipt.Total
-	points += GetTotalCostPoints(costStr)
+		// 5 points for every two items
+		{"itemPairs", GetItemPairPoints(items)},
+		{"itemDescriptions", GetItemDescriptionPoints(items, rules)},
 
-	// 5 points for every two items
-	points += GetItemPoints(receipt)
+		//iff generated using a large language model, 5 points if total is greater than 10.0
+		// I assume this is a safeguard against using AI so skipping this?
 
-	//iff generated using a large language model, 5 points if total is greater than 10.0
-	// I assume this is a safeguard against using AI so skipping this?
+		// 6 points if day in purchase date is odd
+		{"oddDay", GetDatePoints(receipt.PurchaseDate)},
 
-	// 6 points if day in purchase date is odd
-	dateString := receipt.PurchaseDate
-	points += GetDatePoints(dateString)
+		// 10 points if purchase between 2-4pm
+		{"afternoon", GetTimePoints(receipt.PurchaseTime)},
 
-	// 10 points if purchase between 2-4pm
-	timeString := receipt.PurchaseTime
-	points += GetTimePoints(timeString)
+		// Bonus points configured for the merchant category
+		{"merchantCategory", GetMCCPoints(receipt, rules)},
 
+		// Bonus points configured for the payment method
+		{"paymentMethod", rules.PaymentMethodBonuses[receipt.PaymentMethod]},
+
+		// Sponsored bonus points for catalog products
+		{"products", GetProductPoints(receipt)},
+	}
+	for i := range points {
+		if slices.Contains(rules.disabledRules, points[i].Rule) {
+			points[i].Points = 0
+		}
+	}
 	return points
 }
 
@@ -113,58 +374,164 @@ func GetAlphanumeric(str string) int64 {
 	return total
 }
 
-// Returns points given for total cost
-func GetTotalCostPoints(costStr string) int64 {
-	var points int64
-	costFloat, err := strconv.ParseFloat(costStr, 64)
-	if err == nil {
-		costInt := int(math.Round(costFloat * 100))
-		// 50 points if total is round dollar amount
-		if costInt%100 == 0 {
-			points += 50
+// 50 points if total is round dollar amount
+func GetRoundDollarPoints(receipt Receipt, rules ProgramRules) int64 {
+	cents, ok := totalRuleCents(receipt, rules)
+	if ok && cents%100 == 0 {
+		return 50
+	}
+	return 0
+}
+
+// 25 points if total is multiple of .25
+func GetQuarterMultiplePoints(receipt Receipt, rules ProgramRules) int64 {
+	cents, ok := totalRuleCents(receipt, rules)
+	if ok && cents%25 == 0 {
+		return 25
+	}
+	return 0
+}
+
+// Returns the amount in cents the total rules are evaluated on, as configured, and false
+// if there is none or it doesn't qualify
+func totalRuleCents(receipt Receipt, rules ProgramRules) (int64, bool) {
+	var cents int64
+	switch rules.TotalRulesBasis {
+	case "string":
+		// Exactly as written, so "5.001" is not a round dollar amount
+		var ok bool
+		cents, ok = exactCents(receipt.Total)
+		if !ok {
+			return 0, false
+		}
+	case "items":
+		for _, item := range receipt.Items {
+			price, err := ParseCents(item.Price)
+			if err != nil {
+				return 0, false
+			}
+			cents += price
 		}
-		// 25 points if total is multiple of .25
-		if costInt%25 == 0 {
-			points += 25
+	default:
+		var err error
+		cents, err = ParseCents(receipt.Total)
+		if err != nil {
+			return 0, false
 		}
 	}
+	if cents == 0 && !rules.ZeroTotalQualifies {
+		return 0, false
+	}
+	return cents, true
+}
 
-	return points
+// Returns a decimal amount such as "5.25" in cents without rounding, and false if it
+// isn't a whole number of cents
+func exactCents(amount string) (int64, bool) {
+	whole, fraction, _ := strings.Cut(amount, ".")
+	fraction = strings.TrimRight(fraction, "0")
+	if whole == "" || len(fraction) > 2 {
+		return 0, false
+	}
+	for _, c := range whole + fraction {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	dollars, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	var cents int64
+	if fraction != "" {
+		cents, _ = strconv.ParseInt(fraction+strings.Repeat("0", 2-len(fraction)), 10, 64)
+	}
+	return dollars*100 + cents, true
 }
 
-// Returns points for the items
-func GetItemPoints(receipt Receipt) int64 {
-	var numItems int
-	var points int64
+// Five points for every two items
+func GetItemPairPoints(receipt Receipt) int64 {
+	return int64(len(receipt.Items)/2) * 5
+}
 
-	// Five points for every two items
-	for _, item := range receipt.Items {
-		numItems += 1
-		if numItems%2 == 0 {
-			points += 5
+// Returns items with identical ones, with the same trimmed description and price, made
+// into one item whose price is theirs added up, in the order each first appears
+func CollapseDuplicateItems(items []Item) []Item {
+	collapsed := []Item{}
+	index := map[Item]int{}
+	for _, item := range items {
+		key := Item{ShortDescription: strings.TrimSpace(item.ShortDescription), Price: item.Price}
+		cents, err := ParseCents(item.Price)
+		if err == nil {
+			key.Price = formatCents(cents)
+		}
+		i, found := index[key]
+		if !found || err != nil {
+			index[key] = len(collapsed)
+			collapsed = append(collapsed, item)
+			continue
 		}
+		total, _ := ParseCents(collapsed[i].Price)
+		collapsed[i].Price = formatCents(total + cents)
+	}
+	return collapsed
+}
 
-		// Trim item description and add points if multiple of 3
-		desc := item.ShortDescription
-		trimmed := strings.TrimSpace(desc)
-		length := len(trimmed)
+// Points for items whose trimmed description length is a multiple of 3
+func GetItemDescriptionPoints(receipt Receipt, rules ProgramRules) int64 {
+	var points int64
+	for _, item := range receipt.Items {
+		length := DescriptionLength(item.ShortDescription, rules)
 		if length%3 == 0 {
-			itemPriceFloat, err := strconv.ParseFloat(item.Price, 64)
+			// Multiply in whole cents, since floats turn e.g. 5.00 * 0.2 into 1.0000000000000002
+			cents, err := ParseCents(item.Price)
 			if err == nil {
-				itemPriceFloat *= .2
-				itemPrice := int(math.Ceil(itemPriceFloat))
-				points += int64(itemPrice)
+				points += ScaleCents(cents, rules.ItemPriceMultiplier, rules.ItemPriceRounding)
 			}
-
 		}
 	}
-
 	return points
 }
 
+// Returns the trimmed length of an item description, counted in bytes or characters as
+// configured, optionally normalized first and with runs of spaces inside it counted once
+func DescriptionLength(desc string, rules ProgramRules) int {
+	trimmed := strings.TrimSpace(normalizeDescription(desc, rules))
+	if rules.CollapseDescriptionSpaces {
+		trimmed = strings.Join(strings.Fields(trimmed), " ")
+	}
+	if rules.DescriptionLengthUnit == "runes" {
+		return utf8.RuneCountInString(trimmed)
+	}
+	return len(trimmed)
+}
+
+// Returns how description lengths are counted, to record with the receipts scored that way
+func DescriptionLengthMode() string {
+	return CurrentProgram().Rules.LengthMode()
+}
+
+// Returns how description lengths are counted with these rule values
+func (rules ProgramRules) LengthMode() string {
+	mode := rules.DescriptionLengthUnit
+	if rules.CollapseDescriptionSpaces {
+		mode += "-collapsed"
+	}
+	switch {
+	case rules.TransliterateDescriptions:
+		mode += "-transliterated"
+	case rules.NormalizeDescriptions:
+		mode += "-normalized"
+	}
+	return mode
+}
+
 // 6 points if bought on an odd day
 func GetDatePoints(dateString string) int64 {
 	var points int64
+	if len(dateString) < 2 {
+		return 0
+	}
 	day, err := strconv.Atoi(dateString[len(dateString)-2:])
 	if err == nil {
 		if day%2 == 1 {
@@ -177,6 +544,9 @@ func GetDatePoints(dateString string) int64 {
 // 10 points if after 2 and before 4 (14:00:00 to 15:59:59 is my assumption here)
 func GetTimePoints(timeString string) int64 {
 	var points int64
+	if len(timeString) < 2 {
+		return 0
+	}
 	time, err := strconv.Atoi(timeString[:2])
 	if err == nil {
 		if time >= 14 && time < 16 {
@@ -187,92 +557,385 @@ func GetTimePoints(timeString string) int64 {
 }
 
 // Method to create a receipt with receipt json in the request; ensures valid receipt
-func CreateReceipt(w http.ResponseWriter, r *http.Request) {
+func (s *Server) CreateReceipt(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	var receipt Receipt
-	_ = json.NewDecoder(r.Body).Decode(&receipt)
+	// Read in full, since signatures cover the exact bytes
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(config.MaxBodyBytes)))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		message := fmt.Sprintf("The request body is larger than %d bytes.", config.MaxBodyBytes)
+		WriteError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, message)
+		return
+	}
+
+	// The partner's settings decide whether non-critical issues are only warnings
+	partner, ok := GetPartner(r)
+	if !ok {
+		WriteError(w, http.StatusUnauthorized, codeUnknownAPIKey, "The API key is not recognized.")
+		return
+	}
+	release := func() {}
+	rejection := s.CheckSignature(r, partner, body)
+	if rejection == nil {
+		release, rejection = s.CheckSubmissionToken(r, partner)
+	}
+
+	// Read the receipt with the adapter for the format it was sent in
+	source := ReceiptSource(r, partner)
+	receipt, err := ParseReceipt(source, body)
+	if rejection == nil {
+		rejection = UnreadableReceipt(source, err)
+	}
+	provenance, invalid := RequestProvenance(r, source)
+	if rejection == nil {
+		rejection = invalid
+	}
+	if rejection == nil {
+		rejection = deadlineRejection(r.Context(), "the receipt was read")
+	}
+	if rejection != nil {
+		release()
+		RecordPartnerActivity(partner.Name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "receipt_rejected", Detail: rejection.Code})
+		CountRejection(rejection.Code, s.Clock.Now())
+		WriteRejection(w, rejection)
+		return
+	}
+
+	// IDs are always ours to assign
+	receipt.ID = ""
+	receipt.Tenant = r.Header.Get("X-Tenant-ID")
+	receipt.Provenance = provenance
+
+	// Fix what OCR is known to misread before the receipt is validated
+	if provenance.Channel == channelOCR {
+		provenance.Corrections = CorrectOCRReceipt(&receipt)
+	}
+
+	// A partner's own ID is only accepted once, so retries get the receipt already stored
+	existing, exists := s.Store.FindExternal(partner.Name, receipt.ExternalID, IsSandbox(partner, receipt.Tenant))
+	if exists {
+		release()
+		RecordPartnerActivity(partner.Name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "receipt_duplicate", ReceiptID: existing.ID})
+		w.WriteHeader(http.StatusConflict)
+		WriteIDResponse(w, existing, nil)
+		return
+	}
+
+	// While changes can't be saved, the receipt waits in the spool to be processed
+	if s.Spooling() {
+		id, rejection := s.SpoolReceipt(r.Context(), receipt, partner)
+		if rejection != nil {
+			release()
+			w.Header().Set("Retry-After", strconv.Itoa(config.ReadOnlyRetryAfterSeconds))
+			WriteRejection(w, rejection)
+			return
+		}
+		RecordPartnerActivity(partner.Name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "receipt_spooled", ReceiptID: id})
+		WritePending(w, id)
+		return
+	}
+
+	receipt, warnings, rejection := s.ProcessReceipt(r.Context(), receipt, partner)
+	CountOCROutcome(provenance.Corrections, receipt.Status, rejection != nil)
+	if rejection != nil {
+		release()
+		RecordPartnerActivity(partner.Name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "receipt_rejected", Detail: rejection.Code})
+		CountRejection(rejection.Code, s.Clock.Now())
+		WriteRejection(w, rejection)
+		return
+	}
+	RecordPartnerActivity(partner.Name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "receipt_accepted", ReceiptID: receipt.ID})
+	s.Announce(r.Context(), "receipt."+receipt.Status, receipt)
+
+	// Return the ID JSON object of the created Receipt
+	WriteIDResponse(w, receipt, warnings)
+}
+
+// Validates, scores and stores a receipt, returning it as stored along with any warnings
+// for the submitter. Receipts that already have an ID keep it; otherwise one is generated.
+func (s *Server) ProcessReceipt(ctx context.Context, receipt Receipt, partner Partner) (Receipt, []string, *Rejection) {
+	receipt.Sandbox = IsSandbox(partner, receipt.Tenant)
+
+	// Rules and validation as an admin overrode them for this request, if they did
+	rules := CurrentProgram().Rules
+	overrides, overridden := FeatureOverridesFrom(ctx)
+	if overridden {
+		rules = overrides.Rules(rules)
+		partner = overrides.Partner(partner)
+	}
+
+	// Derive the purchase date and time from the combined field, if given
+	validReceipt := ApplyPurchaseDateTime(&receipt)
+	if !validReceipt {
+		return Receipt{}, nil, InvalidReceipt()
+	}
+
+	// Accept 12 hour and other configured time layouts
+	receipt.PurchaseTime = NormalizePurchaseTime(receipt.PurchaseTime)
+
+	// Rewrite amounts in the receipt's locale as dollars and cents before anything else
+	validReceipt = NormalizeLocaleAmounts(&receipt)
+	if !validReceipt {
+		return Receipt{}, nil, &Rejection{http.StatusBadRequest, codeUnknownLocale, "The receipt's locale is not supported."}
+	}
+	if !CheckCurrency(receipt.Currency) {
+		return Receipt{}, nil, &Rejection{http.StatusBadRequest, codeUnsupportedCurrency, "The receipt's currency is not accepted."}
+	}
+
+	// Limits on size, so pathological receipts can't blow up scoring or storage
+	message := CheckLimits(receipt)
+	if message != "" {
+		return Receipt{}, nil, &Rejection{http.StatusBadRequest, codeLimitExceeded, message}
+	}
+	var warnings []string
 
 	// Validate fields
 	// Description
-	validReceipt := CheckValidDescription(receipt.Retailer)
+	validReceipt = CheckValidDescription(receipt.Retailer)
 	if !validReceipt {
-		// Invalid receipt, set 400 error
-		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
-		return
+		if !partner.Lenient {
+			// Invalid receipt, set 400 error
+			return Receipt{}, nil, InvalidReceipt()
+		}
+		warnings = append(warnings, "The retailer has characters other than "+allowedNameChars(config.RetailerExtraCharacters)+".")
 	}
 
 	// PurchaseDate and PurchaseTime
 	validReceipt = CheckValidTime(receipt.PurchaseDate, receipt.PurchaseTime)
 	if !validReceipt {
 		// Invalid receipt, set 400 error
-		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
-		return
+		return Receipt{}, nil, InvalidReceipt()
+	}
+
+	// Business rules on how recent the purchase must be
+	code, message := CheckPurchaseDateWindow(receipt.PurchaseDate, s.Clock)
+	if code != "" {
+		return Receipt{}, nil, &Rejection{http.StatusBadRequest, code, message}
 	}
 
-	// Checks valid regex for both price and description
+	// Checks valid regex for item prices
 	validReceipt = CheckItemsValidity(receipt)
 	if !validReceipt {
 		// Invalid receipt, set 400 error
-		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
-		return
+		return Receipt{}, nil, InvalidReceipt()
+	}
+
+	// Checks valid regex for item descriptions
+	issues := CheckItemDescriptions(receipt)
+	if len(issues) > 0 {
+		if !partner.Lenient {
+			// Invalid receipt, set 400 error
+			return Receipt{}, nil, InvalidReceipt()
+		}
+		warnings = append(warnings, issues...)
+	}
+
+	// Payment method
+	validReceipt = CheckPaymentMethod(receipt.PaymentMethod)
+	if !validReceipt {
+		// Invalid receipt, set 400 error
+		return Receipt{}, nil, InvalidReceipt()
+	}
+
+	// Loyalty number
+	if receipt.LoyaltyNumber != "" && !CheckLoyaltyNumber(receipt.LoyaltyNumber) {
+		logScoring.Debug("Invalid loyalty number")
+		return Receipt{}, nil, &Rejection{http.StatusBadRequest, codeInvalidLoyaltyNumber, "The loyalty number is invalid."}
 	}
 
 	// Total cost
 	validReceipt = CheckPriceValidity(receipt.Total)
 	if !validReceipt {
 		// Invalid receipt, set 400 error
-		http.Error(w, "The receipt is invalid.", http.StatusBadRequest)
-		return
-	} else {
-		// Generate a unique ID for each receipt
-		receipt.ID = GenerateID()
-		receipts = append(receipts, receipt)
+		return Receipt{}, nil, InvalidReceipt()
+	}
+
+	// Generate a unique ID for each receipt; content derived ones are the partner's own
+	receipt.Partner = partner.Name
+	if receipt.ID == "" {
+		receipt.ID = IDPrefix(receipt.Sandbox) + s.IDs.NewID(receipt)
+	}
+
+	// Content derived IDs make resubmitting the same receipt a no-op
+	existing, exists := s.Store.Find(receipt.ID)
+	if exists {
+		return existing, nil, nil
+	}
+
+	// Associate with the user who linked the loyalty number, if any
+	receipt.UserID = ""
+	if !receipt.Sandbox {
+		receipt.UserID = GetLoyaltyUser(receipt.LoyaltyNumber)
+	}
+
+	// Enrich with the merchant category code, never trusting one sent by the client
+	receipt.MCC = LookupMCC(receipt.Retailer)
+
+	// Match items to products in the catalog
+	MatchItems(&receipt)
+
+	// Warn about, and optionally flag, prices far from the norm for their product
+	anomalies := CheckPriceAnomalies(receipt)
+	receipt.Warnings = append(warnings, anomalies...)
+	receipt.Flagged = len(anomalies) > 0 && config.PriceAnomalyReview && !receipt.Sandbox
+
+	// Checking for duplicates reads every stored receipt, so give up first if out of time
+	rejection := deadlineRejection(ctx, "duplicates were checked")
+	if rejection != nil {
+		return Receipt{}, nil, rejection
+	}
+
+	// Flag what looks like a purchase that was already submitted
+	original, warning, found := s.FindDuplicate(receipt, partner)
+	if found {
+		receipt.NearDuplicateOf = original.ID
+		receipt.Warnings = append(receipt.Warnings, warning)
+		receipt.Flagged = !receipt.Sandbox
+	}
+
+	// Hold for review what would have earned more than the caps allow
+	receipt.CappedRules = rules.ExceededPointCaps(receipt)
+	if len(receipt.CappedRules) > 0 {
+		receipt.Warnings = append(receipt.Warnings, PointCapWarning(receipt.CappedRules))
+		receipt.Flagged = !receipt.Sandbox
+	}
+	now := s.Clock.Now().UTC()
+	receipt.ProcessedAt = &now
+	scoring := s.scoringRules(rules, overridden)
+	receipt.Points = scoring.Points(receipt)
+	if overridden {
+		if receipt.Provenance == nil {
+			receipt.Provenance = &Provenance{}
+		}
+		receipt.Provenance.FeatureOverrides = overrides.String()
+	}
+	receipt.LengthMode = rules.LengthMode()
+	receipt.Scoring = rules.Snapshot(receipt, scoring.PointsByRule(receipt), now)
+
+	// Fall back as the day's points budget is nearly spent
+	warning, reserved := s.ApplyPointsBudget(ctx, &receipt, now)
+	if warning != "" {
+		receipt.Warnings = append(receipt.Warnings, warning)
+	}
+	receipt.Shadow = ShadowScoreReceipt(receipt)
+	receipt.Status = statusProcessed
+	if receipt.Flagged {
+		// Flagged receipts wait in the review queue before points are awarded
+		receipt.Status = statusSubmitted
+	}
+
+	// Once stored, the receipt is kept even if the deadline passes while announcing it
+	rejection = deadlineRejection(ctx, "the receipt was stored")
+	if rejection != nil {
+		AdjustPointsBudget(now, -reserved)
+		return Receipt{}, nil, rejection
+	}
 
-		// Return the ID JSON object of the created Receipt
-		idStruct := IDResponse{ID: receipt.ID}
-		json.NewEncoder(w).Encode(idStruct)
+	// If an identical receipt was stored while we were enriching this one, it's returned
+	// instead, and the points reserved for this one are given back
+	_, span := StartSpan(ctx, "storage.add")
+	receipt, added := s.Store.Insert(receipt)
+	span.End(logStorage, "receiptId", receipt.ID)
+	if !added {
+		AdjustPointsBudget(now, -reserved)
 	}
 
+	return receipt, warnings, nil
 }
 
 /*
 	Below are helper functions for creating and validating a receipt
 */
 
+// Writes the ID JSON object of a receipt with any validation warnings; the Fetch spec
+// has neither short codes nor warnings
+func WriteIDResponse(w http.ResponseWriter, receipt Receipt, warnings []string) {
+	idStruct := IDResponse{ID: receipt.ID, ShortCode: receipt.ShortCode, Warnings: warnings}
+	if config.FetchCompat {
+		idStruct = IDResponse{ID: receipt.ID}
+	}
+	json.NewEncoder(w).Encode(idStruct)
+}
+
 // Checks validity of description
 func CheckValidDescription(str string) bool {
-	valid, err := regexp.MatchString("^[\\w\\s\\-&]+$", str)
-	if !valid || err != nil {
-		fmt.Println("Retailer wrong format")
+	if !validName(str, config.RetailerExtraCharacters) {
+		logScoring.Debug("Retailer wrong format")
 		return false
 	}
 	return true
 }
 
+// Returns whether a character may be in a retailer name or item description: a letter,
+// digit or underscore of the configured character set, whitespace, a dash, or one of the
+// extra characters given
+func allowedNameChar(r rune, extra string) bool {
+	switch {
+	case r == '_' || r == '-' || strings.ContainsRune(extra, r):
+		return true
+	case config.NameCharacters == "unicode":
+		return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsNumber(r) || unicode.IsSpace(r)
+	}
+	// As \w and \s match them
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(" \t\n\f\r", r)
+}
+
+// Returns whether a name has at least one character, and only allowed ones
+func validName(str string, extra string) bool {
+	for _, r := range str {
+		if !allowedNameChar(r, extra) {
+			return false
+		}
+	}
+	return str != ""
+}
+
+// Describes the characters allowed in names with the extra characters given, for messages
+func allowedNameChars(extra string) string {
+	var chars []string
+	for _, r := range extra {
+		chars = append(chars, string(r))
+	}
+	if len(chars) == 0 {
+		return "letters, digits, spaces and dashes"
+	}
+	return "letters, digits, spaces, dashes and " + quoteChars(chars)
+}
+
 // Checks validity of price
 func CheckPriceValidity(str string) bool {
-	valid, err := regexp.MatchString("\\d+\\.\\d{2}$", str)
+	valid, err := regexp.MatchString(GetPricePattern(), str)
 	if !valid || err != nil {
-		fmt.Println("Issue with total cost format")
+		logScoring.Debug("Issue with total cost format")
 		return false
 	}
 
 	return true
 }
 
+// Checks the payment method, if given, is one we know
+func CheckPaymentMethod(method string) bool {
+	switch method {
+	case "", "cash", "credit", "debit", "giftcard":
+		return true
+	}
+	logScoring.Debug("Unknown payment method")
+	return false
+}
+
 // Checks validity of date and time formatting
 func CheckValidTime(dateString string, timeString string) bool {
 	// PurchaseDate
 	_, err := time.Parse("2006-01-02", dateString)
 	if err != nil {
-		fmt.Println("Invalid date format")
+		logScoring.Debug("Invalid date format")
 		return false
 	}
 
 	// PurchaseTime
 	_, err = time.Parse("15:04", timeString)
 	if err != nil {
-		fmt.Println("Invalid time format")
+		logScoring.Debug("Invalid time format")
 		return false
 	}
 
@@ -280,30 +943,74 @@ func CheckValidTime(dateString string, timeString string) bool {
 	return true
 }
 
+// Checks the purchase date is neither in the future nor older than allowed by the clock;
+// returns an error code and message, or empty strings if the date is acceptable
+func CheckPurchaseDateWindow(dateString string, clock Clock) (string, string) {
+	purchaseDate, err := ParseDate(clock, dateString)
+	if err != nil {
+		return codeInvalidReceipt, invalidReceiptMessage
+	}
+	today := Today(clock)
+	limits := CurrentProgram().Limits
+
+	if limits.RejectFutureReceipts && purchaseDate.After(today) {
+		logScoring.Debug("Purchase date is in the future")
+		return codeFutureReceipt, "The receipt's purchase date is in the future."
+	}
+	if limits.MaxReceiptAgeDays > 0 && purchaseDate.Before(today.AddDate(0, 0, -limits.MaxReceiptAgeDays)) {
+		logScoring.Debug("Purchase date is too old")
+		return codeStaleReceipt, fmt.Sprintf("The receipt is older than %d days.", limits.MaxReceiptAgeDays)
+	}
+	return "", ""
+}
+
+// Checks the receipt is within the configured size limits; returns a message saying
+// which limit was exceeded, or an empty string
+func CheckLimits(receipt Receipt) string {
+	limits := CurrentProgram().Limits
+	if len(receipt.Items) > limits.MaxItems {
+		logScoring.Debug("Too many items")
+		return fmt.Sprintf("The receipt has %d items, more than the limit of %d.", len(receipt.Items), limits.MaxItems)
+	}
+	if utf8.RuneCountInString(receipt.Retailer) > limits.MaxDescriptionLength {
+		logScoring.Debug("Retailer too long")
+		return fmt.Sprintf("The retailer is longer than %d characters.", limits.MaxDescriptionLength)
+	}
+	if utf8.RuneCountInString(receipt.ExternalID) > limits.MaxDescriptionLength {
+		logScoring.Debug("External ID too long")
+		return fmt.Sprintf("The externalId is longer than %d characters.", limits.MaxDescriptionLength)
+	}
+	for i, item := range receipt.Items {
+		if utf8.RuneCountInString(item.ShortDescription) > limits.MaxDescriptionLength {
+			logScoring.Debug("Description too long")
+			return fmt.Sprintf("The description of item %d is longer than %d characters.", i+1, limits.MaxDescriptionLength)
+		}
+	}
+	if limits.MaxTotal > 0 {
+		total, err := ParseCents(receipt.Total)
+		if err == nil && total > int64(math.Round(limits.MaxTotal*100)) {
+			logScoring.Debug("Total too large")
+			return fmt.Sprintf("The total is more than the limit of %.2f.", limits.MaxTotal)
+		}
+	}
+	return ""
+}
+
 // Checks validity of items
 func CheckItemsValidity(receipt Receipt) bool {
 	// Must be at least one item
 	if len(receipt.Items) < 1 {
-		fmt.Println("Not enough items")
+		logScoring.Debug("Not enough items")
 		return false
 	}
 
-	// Checks prices and description of each item
-	pricePattern := "\\d+\\.\\d{2}$"
-	descPattern := "^[\\w\\s\\-]+$"
-	rePrice := regexp.MustCompile(pricePattern)
-	reDesc := regexp.MustCompile(descPattern)
+	// Checks prices of each item
+	rePrice := regexp.MustCompile(GetPricePattern())
 	for _, item := range receipt.Items {
 		// Price validity
 		valid := rePrice.MatchString(item.Price)
 		if !valid {
-			fmt.Println("Issue with price format")
-			return false
-		}
-		// Description validity
-		valid = reDesc.MatchString(item.ShortDescription)
-		if !valid {
-			fmt.Println("Issue with description format")
+			logScoring.Debug("Issue with price format")
 			return false
 		}
 	}
@@ -311,22 +1018,318 @@ func CheckItemsValidity(receipt Receipt) bool {
 	return true
 }
 
+// Checks validity of item descriptions; returns a message for each invalid one
+func CheckItemDescriptions(receipt Receipt) []string {
+	var issues []string
+	for i, item := range receipt.Items {
+		valid := validName(item.ShortDescription, config.DescriptionExtraCharacters)
+		if !valid {
+			logScoring.Debug("Issue with description format")
+			issues = append(issues, fmt.Sprintf("The description of item %d has characters other than %s.", i+1, allowedNameChars(config.DescriptionExtraCharacters)))
+		}
+	}
+	return issues
+}
+
+// Returns a validated price string as a whole number of cents
+func ParseCents(str string) (int64, error) {
+	price, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(price * 100)), nil
+}
+
+// Multiplies a price in cents by a decimal such as "0.2" and rounds the result to whole
+// points: "ceil" rounds up, "floor" down and "round" to the nearest, halves up
+func ScaleCents(cents int64, multiplier string, rounding string) int64 {
+	numerator, denominator, err := ParseDecimal(multiplier)
+	if err != nil {
+		return 0
+	}
+	value := cents * numerator
+	divisor := denominator * 100
+
+	switch rounding {
+	case "floor":
+		return floorDiv(value, divisor)
+	case "round":
+		return floorDiv(2*value+divisor, 2*divisor)
+	}
+	return -floorDiv(-value, divisor)
+}
+
+// Divides and rounds down, towards negative infinity for negative results too
+func floorDiv(a int64, b int64) int64 {
+	quotient := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		quotient -= 1
+	}
+	return quotient
+}
+
+// Parses a decimal such as "0.25" exactly, as a numerator over a power of ten
+func ParseDecimal(str string) (int64, int64, error) {
+	units, fraction, _ := strings.Cut(strings.TrimSpace(str), ".")
+	if units == "" && fraction == "" {
+		return 0, 0, fmt.Errorf("%q is not a decimal", str)
+	}
+	if len(fraction) > 6 {
+		return 0, 0, fmt.Errorf("%q has more than 6 decimal places", str)
+	}
+	numerator, err := strconv.ParseInt(units+fraction, 10, 64)
+	if err != nil || strings.ContainsAny(units+fraction, "+-") {
+		return 0, 0, fmt.Errorf("%q is not a decimal", str)
+	}
+	denominator := int64(1)
+	for range fraction {
+		denominator *= 10
+	}
+	return numerator, denominator, nil
+}
+
 // Returns unique ID
 func GenerateID() string {
 	id := uuid.New()
 	return id.String()
 }
 
-// Handles routing, listens on localhost:8000
-func main() {
+// Runs the command named by the first of the program's arguments, or the server if there
+// isn't one, and returns the status to exit with
+func Main(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		fmt.Println("Unknown command:", name)
+		PrintUsage()
+		return 2
+	}
+	err := command.Run(args)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// Checks the configuration and loads the merchant registry, catalog, partners and program
+func Setup() error {
+	err := SetupSecrets()
+	if err != nil {
+		return err
+	}
+	err = ValidateConfig(config)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	err = SetupLogging(config)
+	if err != nil {
+		return err
+	}
+	err = SetupResponseSigning(config.ResponseSigningKey)
+	if err != nil {
+		return fmt.Errorf("invalid RESPONSE_SIGNING_KEY: %w", err)
+	}
+	err = LoadMerchantRegistry(config.MerchantsFile)
+	if err != nil {
+		return fmt.Errorf("could not load merchant registry: %w", err)
+	}
+	err = LoadCatalog(config.CatalogFile)
+	if err != nil {
+		return fmt.Errorf("could not load product catalog: %w", err)
+	}
+	err = LoadOCRCorrections(config.OCRCorrectionsFile)
+	if err != nil {
+		return fmt.Errorf("could not load OCR corrections: %w", err)
+	}
+	err = LoadPartners(config.PartnersFile)
+	if err != nil {
+		return fmt.Errorf("could not load partners: %w", err)
+	}
+	err = LoadProgram(config.ProgramFile)
+	if err != nil {
+		return fmt.Errorf("could not load program file: %w", err)
+	}
+	return nil
+}
+
+// Handles routing to the server's handlers
+func NewRouter(s *Server) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(TraceRequests)
+	router.Use(LogRequests)
+	router.Use(RequestDeadline)
+	router.Use(s.Impersonate)
+	router.Use(OverrideFeatures)
+
+	// Admin routes need the admin token, and review routes a reviewer's token or the
+	// admin token. Their paths are given in full rather than under a PathPrefix, which mux
+	// would match first for every route and so answer a wrong method with 404, not 405.
+	admin := router.NewRoute().Subrouter()
+	admin.Use(AdminOnly)
+	review := router.NewRoute().Subrouter()
+	review.Use(ReviewersOnly)
 
 	// GET method to get points given a valid receipt ID
-	router.HandleFunc("/receipts/process", CreateReceipt).Methods("POST")
+	router.HandleFunc("/receipts/process", s.SpoolWhenUnsaved(s.ShedLoad(s.LimitRate(s.CreateReceipt)))).Methods("POST")
+
+	// POST method to get a single use token for a submission, against double submits
+	router.HandleFunc("/receipts/submission-tokens", s.CreateSubmissionToken).Methods("POST")
+
+	// POST method to check a receipt and suggest fixes, without storing it
+	router.HandleFunc("/receipts/lint", s.LintReceipt).Methods("POST")
 
 	// POST method to create receipt given valid JSON
-	router.HandleFunc("/receipts/{id}/points", GetReceiptByID).Methods("GET")
+	router.HandleFunc("/receipts/{id}/points", s.GetReceiptByID).Methods("GET")
+
+	// GET method to explain a receipt's points rule by rule
+	router.HandleFunc("/receipts/{id}/breakdown", s.GetReceiptBreakdown).Methods("GET")
+	router.HandleFunc("/receipts/{id}/explanation", s.GetReceiptExplanation).Methods("GET")
+
+	// GET method to get the public keys points responses are signed with
+	router.HandleFunc("/.well-known/jwks.json", GetSigningKeys).Methods("GET")
+
+	// GET method to list receipts, filtered by query parameters; HEAD gives only the count
+	router.HandleFunc("/receipts", s.ListReceipts).Methods("GET", "HEAD")
+	router.HandleFunc("/receipts/count", s.CountReceipts).Methods("GET", "HEAD")
+
+	// Methods to build a draft receipt step by step, then finalize it for scoring
+	router.HandleFunc("/receipts/drafts", s.CreateDraft).Methods("POST")
+	router.HandleFunc("/receipts/drafts/{id}", s.GetDraft).Methods("GET")
+	router.HandleFunc("/receipts/drafts/{id}", s.UpdateDraft).Methods("PATCH")
+	router.HandleFunc("/receipts/drafts/{id}/items", s.AddDraftItem).Methods("POST")
+	router.HandleFunc("/receipts/drafts/{id}/finalize", s.RejectWhenReadOnly(s.ShedLoad(s.LimitRate(s.FinalizeDraft)))).Methods("POST")
+
+	// Methods for reviewers to work through flagged receipts
+	review.HandleFunc("/review/receipts", s.ListReviewQueue).Methods("GET")
+	review.HandleFunc("/review/receipts/{id}/approve", s.RejectWhenReadOnly(s.ApproveReceipt)).Methods("POST")
+	review.HandleFunc("/review/receipts/{id}/reject", s.RejectWhenReadOnly(s.RejectReceipt)).Methods("POST")
+
+	// Methods to run and track background jobs over all receipts
+	admin.HandleFunc("/admin/jobs/{type}", s.RejectWhenReadOnly(s.StartJob)).Methods("POST")
+	admin.HandleFunc("/admin/jobs/{id}", GetJob).Methods("GET")
+	admin.HandleFunc("/admin/jobs/{id}/cancel", CancelJob).Methods("POST")
+
+	// Methods to preview deleting receipts that match a filter, then confirm it
+	admin.HandleFunc("/admin/receipts/delete/preview", s.PreviewDelete).Methods("POST")
+	admin.HandleFunc("/admin/receipts/delete/{id}", s.RejectWhenReadOnly(s.ConfirmDelete)).Methods("POST")
+
+	// GET method to download all receipts as CSV; before the receipt lookup, which would
+	// take "export" as an ID
+	admin.HandleFunc("/admin/receipts/export", s.ExportReceipts).Methods("GET")
+
+	// GET method for admins to see a stored receipt in full, with where it came from
+	admin.HandleFunc("/admin/receipts/{id}", s.GetAdminReceipt).Methods("GET")
+
+	// GET method for load balancers to check the server is ready, or degraded
+	router.HandleFunc("/readyz", s.GetReadiness).Methods("GET")
+
+	// GET method to follow the points issued today against the daily budget
+	admin.HandleFunc("/admin/points-budget", s.GetPointsBudget).Methods("GET")
+
+	// GET method to see how the corrections to OCR receipts are doing
+	admin.HandleFunc("/admin/ocr/corrections", ListOCRCorrections).Methods("GET")
+
+	// Methods to follow a storage migration, verify it and cut over to its target
+	admin.HandleFunc("/admin/migration", s.GetMigration).Methods("GET")
+	admin.HandleFunc("/admin/migration/verify", s.PostMigrationVerify).Methods("POST")
+	admin.HandleFunc("/admin/migration/cutover", s.PostMigrationCutover).Methods("POST")
+
+	// POST method to restore a compacted receipt's full payload from the blob store
+	admin.HandleFunc("/admin/receipts/{id}/rehydrate", s.RejectWhenReadOnly(s.RehydrateReceiptHandler)).Methods("POST")
+
+	// Methods to see the program's rules, limits and retention, change them and see how
+	// they were changed
+	admin.HandleFunc("/admin/program", GetProgram).Methods("GET")
+	admin.HandleFunc("/admin/program", s.PutProgram).Methods("PUT")
+	admin.HandleFunc("/admin/program/history", GetProgramHistory).Methods("GET")
+	admin.HandleFunc("/admin/program/export", s.GetProgramExport).Methods("GET")
+	admin.HandleFunc("/admin/program/import", s.PostProgramImport).Methods("POST")
+
+	// Methods to try candidate rules on live traffic alongside the program's, compare how
+	// they score and promote them
+	admin.HandleFunc("/admin/program/candidate", s.GetCandidate).Methods("GET")
+	admin.HandleFunc("/admin/program/candidate", s.PutCandidate).Methods("PUT")
+	admin.HandleFunc("/admin/program/candidate", DeleteCandidate).Methods("DELETE")
+	admin.HandleFunc("/admin/program/candidate/promote", s.PromoteCandidateHandler).Methods("POST")
+
+	// Methods to register partners, rotate their credentials and see what they've been doing
+	admin.HandleFunc("/admin/partners", s.RegisterPartner).Methods("POST")
+	admin.HandleFunc("/admin/partners", ListPartners).Methods("GET")
+	admin.HandleFunc("/admin/partners/{name}/rotate", s.RotatePartnerCredentials).Methods("POST")
+	admin.HandleFunc("/admin/partners/{name}/activity", GetPartnerActivity).Methods("GET")
+
+	// Methods to read and change each component's log level at runtime
+	admin.HandleFunc("/admin/logging", GetLogLevels).Methods("GET")
+	admin.HandleFunc("/admin/logging", SetLogLevels).Methods("PUT")
+
+	// GET method to read counters such as rejected replays
+	admin.Handle("/admin/debug/vars", expvar.Handler()).Methods("GET")
+
+	// Methods to see whether changes to receipts are refused, and to start or stop refusing them
+	admin.HandleFunc("/admin/read-only", s.GetReadOnly).Methods("GET")
+	admin.HandleFunc("/admin/read-only", s.SetReadOnlyMode).Methods("PUT")
+
+	// Methods to find webhook deliveries that failed and send them again
+	admin.HandleFunc("/admin/webhooks/events", ListWebhookEvents).Methods("GET")
+	admin.HandleFunc("/admin/webhooks/events/{id}", GetWebhookEvent).Methods("GET")
+	admin.HandleFunc("/admin/webhooks/events/{id}/redeliver", s.RedeliverWebhookEvent).Methods("POST")
+
+	// Methods to subscribe URLs to the receipt events that match their filters
+	admin.HandleFunc("/admin/subscriptions", s.CreateSubscription).Methods("POST")
+	admin.HandleFunc("/admin/subscriptions", ListSubscriptions).Methods("GET")
+	admin.HandleFunc("/admin/subscriptions/{id}", GetSubscription).Methods("GET")
+	admin.HandleFunc("/admin/subscriptions/{id}", s.UpdateSubscription).Methods("PUT")
+	admin.HandleFunc("/admin/subscriptions/{id}", s.DeleteSubscription).Methods("DELETE")
+
+	// GET method to see the requests support staff made as users
+	admin.HandleFunc("/admin/audit", ListAuditEntries).Methods("GET")
+
+	// GET method for auditors to check stored receipts weren't changed or removed
+	admin.HandleFunc("/admin/chain/verify", s.GetChainVerification).Methods("GET")
+
+	// POST method to link a loyalty number to a user
+	router.HandleFunc("/users/{id}/loyalty", s.RejectWhenReadOnly(RequireUser(s.LinkLoyaltyNumber))).Methods("POST")
+
+	// GET method to summarize a user's points and receipts for their profile
+	router.HandleFunc("/users/{id}/summary", RequireUser(s.GetUserSummary)).Methods("GET")
+
+	// Methods for fulfillment systems to see a user's points and redeem them in two steps
+	router.HandleFunc("/users/{id}/points", RequireUser(s.GetPointsBalance)).Methods("GET")
+	router.HandleFunc("/users/{id}/redemptions", s.RejectWhenReadOnly(RequireUser(s.CreateHold))).Methods("POST")
+	router.HandleFunc("/redemptions/{id}", s.GetRedemption).Methods("GET")
+	router.HandleFunc("/redemptions/{id}/capture", s.RejectWhenReadOnly(s.CaptureRedemption)).Methods("POST")
+	router.HandleFunc("/redemptions/{id}/release", s.RejectWhenReadOnly(s.ReleaseRedemption)).Methods("POST")
+
+	// Methods for users to send each other points and see the entries it made
+	router.HandleFunc("/users/{id}/transfers", s.RejectWhenReadOnly(RequireUser(s.CreateTransfer))).Methods("POST")
+	router.HandleFunc("/users/{id}/ledger", RequireUser(GetLedger)).Methods("GET")
+
+	// Methods to download a user's points statement for a month, or deliver it to them
+	router.HandleFunc("/users/{id}/statement", RequireUser(s.GetStatement)).Methods("GET")
+	router.HandleFunc("/users/{id}/statement/deliver", RequireUser(s.DeliverStatement)).Methods("POST")
+
+	// Disputes over how receipts were read, and their review
+	router.HandleFunc("/receipts/{id}/disputes", s.RejectWhenReadOnly(s.CreateDispute)).Methods("POST")
+	router.HandleFunc("/receipts/{id}/disputes", s.ListReceiptDisputes).Methods("GET")
+	router.HandleFunc("/disputes/{id}", GetDispute).Methods("GET")
+	router.HandleFunc("/disputes/{id}/messages", s.RejectWhenReadOnly(s.CreateUserDisputeMessage)).Methods("POST")
+	review.HandleFunc("/review/disputes", ListDisputeQueue).Methods("GET")
+	review.HandleFunc("/review/disputes/{id}/messages", s.RejectWhenReadOnly(s.CreateReviewerDisputeMessage)).Methods("POST")
+	review.HandleFunc("/review/disputes/{id}/status", s.RejectWhenReadOnly(s.SetDisputeStatusHandler)).Methods("PUT")
+	review.HandleFunc("/review/disputes/{id}/correction", s.RejectWhenReadOnly(s.CorrectDispute)).Methods("POST")
+
+	// GET method to rank users or retailers by points
+	router.HandleFunc("/stats/leaderboard", s.GetLeaderboard).Methods("GET")
+	router.HandleFunc("/stats/points-by-rule", s.GetPointsByRuleReport).Methods("GET")
+	router.HandleFunc("/stats/heatmap", s.GetHeatmap).Methods("GET")
 
-	http.ListenAndServe(":8000", router)
+	// GET method to download a file from the disk blob store through a signed link
+	router.HandleFunc("/blobs/{key:.+}", s.ServeBlob).Methods("GET")
 
+	return router
 }
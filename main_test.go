@@ -0,0 +1,275 @@
+package receiptapi
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+// Example receipts from the exercise's README, with the points they are documented to earn
+var (
+	targetReceipt = Receipt{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items: []Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+			{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+			{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+			{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+		},
+		Total: "35.35",
+	}
+	cornerMarketReceipt = Receipt{
+		Retailer:     "M&M Corner Market",
+		PurchaseDate: "2022-03-20",
+		PurchaseTime: "14:33",
+		Items: []Item{
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+			{ShortDescription: "Gatorade", Price: "2.25"},
+		},
+		Total: "9.00",
+	}
+)
+
+func TestPoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		receipt Receipt
+		change  func(rules *ProgramRules)
+		mcc     string
+		want    int64
+	}{
+		{name: "target", receipt: targetReceipt, want: 28},
+		{name: "corner market", receipt: cornerMarketReceipt, want: 109},
+		{
+			name:    "prices rounded down",
+			receipt: targetReceipt,
+			change:  func(rules *ProgramRules) { rules.ItemPriceRounding = "floor" },
+			want:    26,
+		},
+		{
+			name:    "capped per receipt",
+			receipt: cornerMarketReceipt,
+			change:  func(rules *ProgramRules) { rules.MaxReceiptPoints = 100 },
+			want:    100,
+		},
+		{
+			name:    "capped per rule",
+			receipt: cornerMarketReceipt,
+			change:  func(rules *ProgramRules) { rules.RulePointCaps = map[string]int64{"roundDollarTotal": 10} },
+			want:    69,
+		},
+		{
+			name:    "merchant category bonus",
+			receipt: targetReceipt,
+			mcc:     "5411",
+			change:  func(rules *ProgramRules) { rules.MerchantCategoryBonuses = map[string]int64{"5411": 15} },
+			want:    43,
+		},
+		{
+			name:    "duplicate items collapsed",
+			receipt: cornerMarketReceipt,
+			change:  func(rules *ProgramRules) { rules.CollapseDuplicateItems = true },
+			want:    99,
+		},
+		{
+			name:    "rule switched off",
+			receipt: cornerMarketReceipt,
+			change:  func(rules *ProgramRules) { rules.disabledRules = []string{"afternoon"} },
+			want:    99,
+		},
+		{
+			name:    "zero total",
+			receipt: Receipt{Retailer: "Shop", PurchaseDate: "2022-01-02", PurchaseTime: "12:00", Total: "0.00"},
+			want:    79,
+		},
+		{
+			name:    "zero total doesn't qualify",
+			receipt: Receipt{Retailer: "Shop", PurchaseDate: "2022-01-02", PurchaseTime: "12:00", Total: "0.00"},
+			change:  func(rules *ProgramRules) { rules.ZeroTotalQualifies = false },
+			want:    4,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := ProgramFromConfig(config).Rules
+			if test.change != nil {
+				test.change(&rules)
+			}
+			receipt := test.receipt
+			receipt.MCC = test.mcc
+			got := rules.Points(receipt)
+			if got != test.want {
+				t.Errorf("Points() = %d, want %d; by rule %v", got, test.want, rules.PointsByRule(receipt))
+			}
+		})
+	}
+}
+
+func TestPointsByRule(t *testing.T) {
+	rules := ProgramFromConfig(config).Rules
+	want := []RulePoints{
+		{"retailerName", 6},
+		{"roundDollarTotal", 0},
+		{"quarterMultipleTotal", 0},
+		{"itemPairs", 10},
+		{"itemDescriptions", 6},
+		{"oddDay", 6},
+		{"afternoon", 0},
+		{"merchantCategory", 0},
+		{"paymentMethod", 0},
+		{"products", 0},
+	}
+	got := rules.PointsByRule(targetReceipt)
+	if !slices.Equal(got, want) {
+		t.Errorf("PointsByRule() = %v, want %v", got, want)
+	}
+}
+
+func TestCollapseDuplicateItems(t *testing.T) {
+	items := []Item{
+		{ShortDescription: "Gatorade", Price: "2.25"},
+		{ShortDescription: "Pizza", Price: "12.25"},
+		{ShortDescription: " Gatorade ", Price: "2.250"},
+		{ShortDescription: "Gatorade", Price: "2.50"},
+		{ShortDescription: "Gift card", Price: "free"},
+		{ShortDescription: "Gift card", Price: "free"},
+	}
+	want := []Item{
+		{ShortDescription: "Gatorade", Price: "4.50"},
+		{ShortDescription: "Pizza", Price: "12.25"},
+		{ShortDescription: "Gatorade", Price: "2.50"},
+		{ShortDescription: "Gift card", Price: "free"},
+		{ShortDescription: "Gift card", Price: "free"},
+	}
+	got := CollapseDuplicateItems(items)
+	if !slices.Equal(got, want) {
+		t.Errorf("CollapseDuplicateItems() = %v, want %v", got, want)
+	}
+}
+
+func TestExceededPointCaps(t *testing.T) {
+	withConfig(t, func(config *Config) {
+		config.RulePointCaps = map[string]int64{"afternoon": 5, "oddDay": 6}
+		config.MaxReceiptPoints = 50
+	})
+	want := []string{"afternoon", capTotal}
+	got := ExceededPointCaps(cornerMarketReceipt)
+	if !slices.Equal(got, want) {
+		t.Errorf("ExceededPointCaps() = %v, want %v", got, want)
+	}
+}
+
+func TestValidatePointCaps(t *testing.T) {
+	tests := []struct {
+		caps    map[string]int64
+		wantErr bool
+	}{
+		{map[string]int64{"afternoon": 5}, false},
+		{map[string]int64{"afternoon": 0}, false},
+		{map[string]int64{"evening": 5}, true},
+		{map[string]int64{"afternoon": -1}, true},
+	}
+	for _, test := range tests {
+		err := validatePointCaps(test.caps)
+		if (err != nil) != test.wantErr {
+			t.Errorf("validatePointCaps(%v) = %v, want error %v", test.caps, err, test.wantErr)
+		}
+	}
+}
+
+func TestTotalRuleCents(t *testing.T) {
+	tests := []struct {
+		basis  string
+		total  string
+		items  []Item
+		want   int64
+		wantOK bool
+	}{
+		{"cents", "5.00", nil, 500, true},
+		{"cents", "5.001", nil, 500, true},
+		{"cents", "five", nil, 0, false},
+		{"string", "5.001", nil, 0, false},
+		{"string", "5.10", nil, 510, true},
+		{"string", "5.5", nil, 550, true},
+		{"string", "-5.00", nil, 0, false},
+		{"items", "1.00", []Item{{Price: "2.25"}, {Price: "2.75"}}, 500, true},
+		{"items", "1.00", []Item{{Price: "free"}}, 0, false},
+	}
+	for _, test := range tests {
+		rules := ProgramFromConfig(config).Rules
+		rules.TotalRulesBasis = test.basis
+		got, ok := totalRuleCents(Receipt{Total: test.total, Items: test.items}, rules)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("totalRuleCents(%q) by %s = %d, %v, want %d, %v", test.total, test.basis, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestScaleCents(t *testing.T) {
+	tests := []struct {
+		cents      int64
+		multiplier string
+		rounding   string
+		want       int64
+	}{
+		{1225, "0.2", "ceil", 3},
+		{1225, "0.2", "floor", 2},
+		{1225, "0.2", "round", 2},
+		{1250, "0.2", "round", 3},
+		{1200, "0.2", "ceil", 3},
+		{500, "0.2", "ceil", 1},
+		{1000, "0.25", "ceil", 3},
+		{1000, "x", "ceil", 0},
+	}
+	for _, test := range tests {
+		got := ScaleCents(test.cents, test.multiplier, test.rounding)
+		if got != test.want {
+			t.Errorf("ScaleCents(%d, %q, %q) = %d, want %d", test.cents, test.multiplier, test.rounding, got, test.want)
+		}
+	}
+}
+
+func TestGetReceiptPointsFollowsConfig(t *testing.T) {
+	withConfig(t, func(config *Config) { config.MaxReceiptPoints = 20 })
+	got := GetReceiptPoints(targetReceipt)
+	if got != 20 {
+		t.Errorf("GetReceiptPoints() = %d, want 20", got)
+	}
+}
+
+// Rules awarding a point per item, and nothing from any other rule
+type itemCountRules struct{}
+
+func (itemCountRules) Points(receipt Receipt) int64 {
+	return int64(len(receipt.Items))
+}
+
+func (itemCountRules) PointsByRule(receipt Receipt) []RulePoints {
+	return []RulePoints{{Rule: "items", Points: int64(len(receipt.Items))}}
+}
+
+func TestInjectedRules(t *testing.T) {
+	s := New(WithRules(itemCountRules{}))
+	receipt, _, rejection := s.ProcessReceipt(context.Background(), targetReceipt, Partner{})
+	if rejection != nil {
+		t.Fatalf("ProcessReceipt() = %+v", rejection)
+	}
+	want := []RulePoints{{Rule: "items", Points: 5}}
+	if receipt.Points != 5 || !slices.Equal(receipt.Scoring.Rules, want) || !slices.Equal(PointsByRule(receipt, s.Rules), want) {
+		t.Errorf("ProcessReceipt() scored %d, by rule %v, want 5 from the injected rules", receipt.Points, receipt.Scoring.Rules)
+	}
+
+	s.Rules = StandardRules{}
+	err := s.RecalculateReceipt(receipt.ID)
+	if err != nil {
+		t.Fatalf("RecalculateReceipt() = %v", err)
+	}
+	if recalculated, _ := s.Store.Find(receipt.ID); recalculated.Points != 28 {
+		t.Errorf("RecalculateReceipt() scored %d, want the standard rules' 28", recalculated.Points)
+	}
+}
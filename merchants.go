@@ -0,0 +1,118 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Merchant category codes are always four digits
+var mccPattern = regexp.MustCompile(`^\d{4}$`)
+
+// Known merchants, keyed by normalized retailer name
+var merchantRegistry = map[string]string{}
+
+// Guards merchantRegistry, since provider lookups are cached into it
+var merchantsMu sync.RWMutex
+
+// Client used to call the external MCC provider
+var mccClient = &http.Client{Timeout: 2 * time.Second}
+
+// Response expected from the external MCC provider
+type MCCProviderResponse struct {
+	MCC string `json:"mcc"`
+}
+
+// Loads the merchant registry from a JSON object of retailer name to MCC
+func LoadMerchantRegistry(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries map[string]string
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+
+	merchantsMu.Lock()
+	defer merchantsMu.Unlock()
+	for retailer, mcc := range entries {
+		if !mccPattern.MatchString(mcc) {
+			return fmt.Errorf("invalid MCC %q for retailer %q", mcc, retailer)
+		}
+		merchantRegistry[NormalizeRetailer(retailer)] = mcc
+	}
+	return nil
+}
+
+// Returns the retailer name in the form used as a registry key
+func NormalizeRetailer(retailer string) string {
+	return strings.ToLower(strings.Join(strings.Fields(retailer), " "))
+}
+
+// Returns the MCC for a retailer from the registry, then the external provider; empty if unknown
+func LookupMCC(retailer string) string {
+	key := NormalizeRetailer(retailer)
+	merchantsMu.RLock()
+	mcc, ok := merchantRegistry[key]
+	merchantsMu.RUnlock()
+	if ok || config.MCCProviderURL == "" {
+		return mcc
+	}
+
+	mcc, err := FetchProviderMCC(retailer)
+	if err != nil {
+		logScoring.Warn("MCC lookup failed", "error", err)
+		return ""
+	}
+
+	// Remember the answer, including unknown merchants, so we only ask once
+	merchantsMu.Lock()
+	merchantRegistry[key] = mcc
+	merchantsMu.Unlock()
+	return mcc
+}
+
+// Asks the external provider for a retailer's MCC
+func FetchProviderMCC(retailer string) (string, error) {
+	resp, err := mccClient.Get(config.MCCProviderURL + "?retailer=" + url.QueryEscape(retailer))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("provider returned %s", resp.Status)
+	}
+
+	var body MCCProviderResponse
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+	if body.MCC != "" && !mccPattern.MatchString(body.MCC) {
+		return "", fmt.Errorf("provider returned invalid MCC %q", body.MCC)
+	}
+	return body.MCC, nil
+}
+
+// Returns bonus points configured for the receipt's MCC
+func GetMCCPoints(receipt Receipt, rules ProgramRules) int64 {
+	if receipt.MCC == "" {
+		return 0
+	}
+	return rules.MerchantCategoryBonuses[receipt.MCC]
+}
@@ -0,0 +1,459 @@
+package receiptapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases of a storage migration: copying the stored receipts to the target while new
+// changes are written to both, writing to both once they are copied, and after cutover,
+// when the target is where receipts are kept and the old data file is written to as well
+const (
+	migrationBackfilling = "backfilling"
+	migrationDualWriting = "dual-writing"
+	migrationCutOver     = "cut-over"
+)
+
+// Most receipts copied to the target at once while backfilling
+const migrationBatchReceipts = 500
+
+// Most IDs of each kind of difference listed in a verification report
+const migrationReportIDs = 100
+
+// Storage receipts can be kept in and migrated to. Receipts written again replace the
+// version there.
+type ReceiptBackend interface {
+	Write(ctx context.Context, receipts []Receipt) error
+	Delete(ctx context.Context, ids []string) error
+	All(ctx context.Context) ([]Receipt, error)
+
+	// Describes where receipts are kept, e.g. "file:/data/receipts.ndjson"
+	String() string
+}
+
+// Returns the backend a setting such as MIGRATION_TARGET names, e.g.
+// "file:/data/receipts.ndjson". Data files are the only backend so far, so a migration
+// moves receipts to a data file elsewhere, such as on another volume; other storage is
+// added by implementing ReceiptBackend and naming it here.
+func NewReceiptBackend(setting string, target string) (ReceiptBackend, error) {
+	kind, location, _ := strings.Cut(target, ":")
+	switch kind {
+	case "file":
+		if location == "" {
+			return nil, fmt.Errorf("%s file needs a path, as file:/path/to/receipts.ndjson", setting)
+		}
+		return &FileBackend{Path: filepath.Clean(location)}, nil
+	}
+	return nil, fmt.Errorf("unknown %s backend %q; the backends are file", setting, kind)
+}
+
+/*
+	Below is the data file backend
+*/
+
+// Data file in the server's own format, one receipt per line with later lines winning
+type FileBackend struct {
+	Path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (b *FileBackend) String() string {
+	return "file:" + b.Path
+}
+
+// Appends the receipts to the file, opening it the first time
+func (b *FileBackend) Write(ctx context.Context, receipts []Receipt) error {
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, receipt := range receipts {
+		err := encoder.Encode(receipt)
+		if err != nil {
+			return err
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file == nil {
+		file, err := os.OpenFile(b.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		b.file = file
+	}
+	_, err := b.file.Write(lines.Bytes())
+	return err
+}
+
+// Rewrites the file without the receipts with the given IDs
+func (b *FileBackend) Delete(ctx context.Context, ids []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stored, err := LoadReceipts(b.Path)
+	if err != nil {
+		return err
+	}
+	kept := slices.DeleteFunc(stored, func(receipt Receipt) bool {
+		return slices.Contains(ids, receipt.ID)
+	})
+	err = SaveReceipts(b.Path, kept)
+	if err != nil {
+		return err
+	}
+	// The old file was replaced, so it is opened again for the next write
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+	return nil
+}
+
+func (b *FileBackend) All(ctx context.Context) ([]Receipt, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return LoadReceipts(b.Path)
+}
+
+// Closes the file, if it is open
+func (b *FileBackend) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+}
+
+/*
+	Below are the store's writes to the backend being migrated to
+*/
+
+// Sets the backend every change is also written to, or none
+func (s *ReceiptStore) SetMirror(mirror ReceiptBackend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mirror = mirror
+}
+
+// Returns how many changes couldn't be written to the mirror
+func (s *ReceiptStore) MirrorFailures() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mirrorFailures
+}
+
+// Writes changed receipts to the mirror, if there is one; the caller must hold mu. A
+// change that can't be written is counted and logged, not refused, since the data file
+// still has it; backfilling again or verifying shows what the mirror is missing.
+func (s *ReceiptStore) writeMirror(receipts ...Receipt) {
+	if s.mirror == nil {
+		return
+	}
+	err := s.mirror.Write(context.Background(), receipts)
+	if err != nil {
+		s.mirrorFailures += 1
+		logStorage.Error("Could not write receipts to the migration target", "target", s.mirror.String(), "count", len(receipts), "error", err)
+	}
+}
+
+// Deletes receipts from the mirror, if there is one; the caller must hold mu
+func (s *ReceiptStore) deleteMirror(ids []string) {
+	if s.mirror == nil {
+		return
+	}
+	err := s.mirror.Delete(context.Background(), ids)
+	if err != nil {
+		s.mirrorFailures += 1
+		logStorage.Error("Could not delete receipts from the migration target", "target", s.mirror.String(), "count", len(ids), "error", err)
+	}
+}
+
+// Copies the receipts with the given IDs to the mirror as they are stored now. The lock
+// is held while they are written, so a change made meanwhile can't be overwritten by an
+// older version.
+func (s *ReceiptStore) copyToMirror(ids []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	batch := make([]Receipt, 0, len(ids))
+	for _, id := range ids {
+		if i := s.index(id); i >= 0 {
+			batch = append(batch, s.receipts[i])
+		}
+	}
+	if len(batch) == 0 || s.mirror == nil {
+		return
+	}
+	err := s.mirror.Write(context.Background(), batch)
+	if err != nil {
+		s.mirrorFailures += 1
+		logStorage.Error("Could not copy receipts to the migration target", "target", s.mirror.String(), "count", len(batch), "error", err)
+	}
+}
+
+// Makes a file backend the data file, which changes are appended to from then on, and
+// the old data file the mirror, so changes still reach it in case of a rollback. Changes
+// waiting to be saved must be saved first.
+func (s *ReceiptStore) CutOver(target *FileBackend) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.unsaved) > 0 {
+		return errors.New("changes are waiting to be saved to the data file")
+	}
+	target.Close()
+	file, err := os.OpenFile(target.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	old := s.path
+	s.file, s.path = file, target.Path
+	s.mirror = &FileBackend{Path: old}
+	return nil
+}
+
+/*
+	Below is the migration itself
+*/
+
+// Result of comparing the stored receipts with the migration target
+type MigrationVerification struct {
+	VerifiedAt time.Time `json:"verifiedAt"`
+
+	// Receipts compared, and those the same in both
+	Checked  int `json:"checked"`
+	Matching int `json:"matching"`
+
+	// IDs of receipts the target is missing, has a different version of, or has that
+	// aren't stored, up to 100 of each, with how many there are
+	Missing         []string `json:"missing"`
+	MissingCount    int      `json:"missingCount"`
+	Mismatched      []string `json:"mismatched"`
+	MismatchedCount int      `json:"mismatchedCount"`
+	Extra           []string `json:"extra"`
+	ExtraCount      int      `json:"extraCount"`
+
+	// Set when the target couldn't be read
+	Error string `json:"error,omitempty"`
+
+	// Whether both hold the same receipts
+	Consistent bool `json:"consistent"`
+}
+
+// Response with the state of the storage migration
+type MigrationStatus struct {
+	Phase string `json:"phase"`
+
+	// Data file receipts are kept in, and the backend changes are also written to
+	DataFile string `json:"dataFile"`
+	Target   string `json:"target"`
+
+	// Receipts copied to the target so far, of those stored when backfilling began, and
+	// when they all were
+	Backfilled    int        `json:"backfilled"`
+	BackfillTotal int        `json:"backfillTotal"`
+	BackfilledAt  *time.Time `json:"backfilledAt,omitempty"`
+
+	// Changes that couldn't be written to the target
+	MirrorFailures int `json:"mirrorFailures"`
+
+	LastVerified *MigrationVerification `json:"lastVerification,omitempty"`
+	CutOverAt    *time.Time             `json:"cutOverAt,omitempty"`
+}
+
+// Storage migration under way, if MIGRATION_TARGET is set
+var migration *MigrationStatus
+
+// Mirror failures when the last verification was made, so cutover can tell whether
+// writes failed since
+var verifiedFailures int
+
+// Guards the migration
+var migrationMu sync.Mutex
+
+// Starts migrating to a backend: changes are written to it from now on, and the receipts
+// already stored are copied to it in the background
+func (s *Server) StartMigration(ctx context.Context, target ReceiptBackend) {
+	ids := []string{}
+	for _, receipt := range s.Store.All() {
+		ids = append(ids, receipt.ID)
+	}
+	migrationMu.Lock()
+	migration = &MigrationStatus{Phase: migrationBackfilling, DataFile: config.DataFile, Target: target.String(), BackfillTotal: len(ids)}
+	migrationMu.Unlock()
+	s.Store.SetMirror(target)
+	logStorage.Info("Migrating receipts", "target", target.String(), "count", len(ids))
+
+	go func() {
+		for start := 0; start < len(ids); start += migrationBatchReceipts {
+			if ctx.Err() != nil {
+				return
+			}
+			batch := ids[start:min(start+migrationBatchReceipts, len(ids))]
+			s.Store.copyToMirror(batch)
+			migrationMu.Lock()
+			migration.Backfilled += len(batch)
+			migrationMu.Unlock()
+		}
+		now := s.Clock.Now().UTC()
+		migrationMu.Lock()
+		migration.Phase = migrationDualWriting
+		migration.BackfilledAt = &now
+		migrationMu.Unlock()
+		logStorage.Info("Copied the stored receipts to the migration target; run a verification before cutting over", "target", target.String(), "count", len(ids))
+	}()
+}
+
+// Compares every stored receipt with the version in the backend changes are mirrored to
+func (s *Server) VerifyMigration(ctx context.Context, target ReceiptBackend, now time.Time) MigrationVerification {
+	report := MigrationVerification{VerifiedAt: now, Missing: []string{}, Mismatched: []string{}, Extra: []string{}}
+	failures := s.Store.MirrorFailures()
+	stored := s.Store.All()
+	mirrored, err := target.All(ctx)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	byID := map[string]Receipt{}
+	for _, receipt := range mirrored {
+		byID[receipt.ID] = receipt
+	}
+	for _, receipt := range stored {
+		report.Checked += 1
+		copied, found := byID[receipt.ID]
+		delete(byID, receipt.ID)
+		if !found {
+			report.MissingCount += 1
+			if len(report.Missing) < migrationReportIDs {
+				report.Missing = append(report.Missing, receipt.ID)
+			}
+			continue
+		}
+		want, _ := json.Marshal(receipt)
+		got, _ := json.Marshal(copied)
+		if !bytes.Equal(want, got) {
+			report.MismatchedCount += 1
+			if len(report.Mismatched) < migrationReportIDs {
+				report.Mismatched = append(report.Mismatched, receipt.ID)
+			}
+			continue
+		}
+		report.Matching += 1
+	}
+	for _, receipt := range mirrored {
+		if _, extra := byID[receipt.ID]; extra {
+			report.ExtraCount += 1
+			if len(report.Extra) < migrationReportIDs {
+				report.Extra = append(report.Extra, receipt.ID)
+			}
+		}
+	}
+	report.Consistent = report.MissingCount == 0 && report.MismatchedCount == 0 && report.ExtraCount == 0
+
+	migrationMu.Lock()
+	migration.LastVerified = &report
+	verifiedFailures = failures
+	migrationMu.Unlock()
+	return report
+}
+
+// Returns the migration as it stands
+func CurrentMigration() (MigrationStatus, bool) {
+	migrationMu.Lock()
+	defer migrationMu.Unlock()
+	if migration == nil {
+		return MigrationStatus{}, false
+	}
+	return *migration, true
+}
+
+/*
+	Below are the handlers for following the migration, verifying it and cutting over
+*/
+
+// Method to see how far the storage migration has got
+func (s *Server) GetMigration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	status, ok := CurrentMigration()
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeMigrationNotFound, "No storage migration is under way; set MIGRATION_TARGET to start one.")
+		return
+	}
+	status.MirrorFailures = s.Store.MirrorFailures()
+	json.NewEncoder(w).Encode(status)
+}
+
+// Method to compare the stored receipts with the migration target and report the
+// differences
+func (s *Server) PostMigrationVerify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := CurrentMigration(); !ok {
+		WriteError(w, http.StatusNotFound, codeMigrationNotFound, "No storage migration is under way; set MIGRATION_TARGET to start one.")
+		return
+	}
+	s.Store.mu.RLock()
+	target := s.Store.mirror
+	s.Store.mu.RUnlock()
+	json.NewEncoder(w).Encode(s.VerifyMigration(r.Context(), target, s.Clock.Now().UTC()))
+}
+
+// Method to make the migration target the data file, once every receipt was copied to it
+// and a verification since found it the same, with no writes to it failing after
+func (s *Server) PostMigrationCutover(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	migrationMu.Lock()
+	defer migrationMu.Unlock()
+	if migration == nil {
+		WriteError(w, http.StatusNotFound, codeMigrationNotFound, "No storage migration is under way; set MIGRATION_TARGET to start one.")
+		return
+	}
+	s.Store.mu.RLock()
+	target, isFile := s.Store.mirror.(*FileBackend)
+	s.Store.mu.RUnlock()
+
+	var problem string
+	switch {
+	case migration.Phase == migrationCutOver:
+		problem = "The migration was already cut over."
+	case migration.Phase == migrationBackfilling:
+		problem = "The stored receipts are still being copied to the target."
+	case migration.LastVerified == nil || migration.LastVerified.VerifiedAt.Before(*migration.BackfilledAt):
+		problem = "Verify the migration once the receipts are copied, then cut over."
+	case !migration.LastVerified.Consistent:
+		problem = "The last verification found differences; backfill again by restarting, and verify again."
+	case s.Store.MirrorFailures() != verifiedFailures:
+		problem = "Writes to the target failed since the last verification; verify again."
+	case !isFile:
+		problem = "Cutover to " + migration.Target + " isn't supported."
+	}
+	if problem != "" {
+		WriteError(w, http.StatusConflict, codeMigrationNotReady, problem)
+		return
+	}
+
+	err := s.Store.CutOver(target)
+	if err != nil {
+		logStorage.Error("Could not cut over to the migration target", "target", migration.Target, "error", err)
+		WriteError(w, http.StatusConflict, codeMigrationNotReady, "Could not cut over: "+err.Error()+".")
+		return
+	}
+	now := s.Clock.Now().UTC()
+	migration.Phase = migrationCutOver
+	migration.CutOverAt = &now
+	migration.DataFile, migration.Target = target.Path, "file:"+migration.DataFile
+	logStorage.Warn("Cut over to the migration target; set DATA_FILE to it and unset MIGRATION_TARGET before restarting", "dataFile", target.Path)
+	json.NewEncoder(w).Encode(migration)
+}
@@ -0,0 +1,205 @@
+package receiptapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Message a fake NATS server received, with the options the client connected with
+type natsMessage struct {
+	options map[string]any
+	subject string
+	header  string
+	payload string
+}
+
+// NATS server that accepts connections one at a time and acknowledges what is published
+type fakeNATS struct {
+	t        *testing.T
+	listener net.Listener
+
+	// JSON the server introduces itself with on its INFO line
+	info string
+
+	// Error to answer each message with, if any, and whether to drop the connection after
+	// each message
+	reject string
+	hangUp bool
+
+	// Messages received
+	messages chan natsMessage
+}
+
+// Starts a NATS server with the given settings listening on a local port
+func newFakeNATS(t *testing.T, server *fakeNATS) *fakeNATS {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.t, server.listener, server.messages = t, listener, make(chan natsMessage, 10)
+	t.Cleanup(func() { listener.Close() })
+	go server.serve()
+	return server
+}
+
+func (n *fakeNATS) serve() {
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		n.handle(conn, bufio.NewReader(conn))
+		conn.Close()
+	}
+}
+
+// Reads the client's CONNECT, then each message it publishes, answering its PINGs
+func (n *fakeNATS) handle(conn net.Conn, reader *bufio.Reader) {
+	fmt.Fprintf(conn, "INFO %s\r\n", n.info)
+	var options map[string]any
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb, rest, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		switch verb {
+		case "CONNECT":
+			json.Unmarshal([]byte(rest), &options)
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "PUB", "HPUB":
+			fields := strings.Fields(rest)
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, size+2)
+			_, err = io.ReadFull(reader, data)
+			if err != nil {
+				return
+			}
+			message := natsMessage{options: options, subject: fields[0], payload: string(data[:size])}
+			if verb == "HPUB" {
+				headerSize, _ := strconv.Atoi(fields[1])
+				message.header, message.payload = message.payload[:headerSize], message.payload[headerSize:]
+			}
+			n.messages <- message
+			if n.reject != "" {
+				fmt.Fprintf(conn, "-ERR '%s'\r\n", n.reject)
+			}
+			if n.hangUp {
+				// Answer the PING that follows, then go away
+				reader.ReadString('\n')
+				io.WriteString(conn, "PONG\r\n")
+				return
+			}
+		default:
+			n.t.Errorf("unexpected line from client: %q", line)
+			return
+		}
+	}
+}
+
+func TestNATSPublish(t *testing.T) {
+	tests := []struct {
+		name        string
+		info        string
+		credentials string
+		traced      bool
+		wantAuth    map[string]any
+		wantHeader  bool
+	}{
+		{name: "anonymous", info: `{"server_id":"test"}`},
+		{name: "token", info: `{}`, credentials: "s3cret@", wantAuth: map[string]any{"auth_token": "s3cret"}},
+		{name: "user and password", info: `{}`, credentials: "user:pass@", wantAuth: map[string]any{"user": "user", "pass": "pass"}},
+		{name: "traced without header support", info: `{"headers":false}`, traced: true},
+		{name: "traced", info: `{"headers":true}`, traced: true, wantHeader: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFakeNATS(t, &fakeNATS{info: test.info})
+			publisher := &NATSPublisher{URL: "nats://" + test.credentials + server.listener.Addr().String(), SubjectPrefix: "receipts"}
+			defer publisher.Close()
+
+			ctx := context.Background()
+			trace := NewTrace()
+			if test.traced {
+				ctx = WithTrace(ctx, trace)
+			}
+			err := publisher.Publish(ctx, "receipt.processed", []byte(`{"id":"1"}`))
+			if err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+			message := <-server.messages
+			if message.subject != "receipts.receipt.processed" || message.payload != `{"id":"1"}` {
+				t.Errorf("server received %q on %s", message.payload, message.subject)
+			}
+			if message.options["verbose"] != false || message.options["name"] != "receipt-api" {
+				t.Errorf("client connected with %v, want verbose off and its name", message.options)
+			}
+			for name, want := range test.wantAuth {
+				if message.options[name] != want {
+					t.Errorf("client connected with %s = %v, want %v", name, message.options[name], want)
+				}
+			}
+			wantHeader := ""
+			if test.wantHeader {
+				wantHeader = "NATS/1.0\r\ntraceparent: " + trace.Traceparent() + "\r\nb3: " + trace.B3() + "\r\n\r\n"
+			}
+			if message.header != wantHeader {
+				t.Errorf("server received header %q, want %q", message.header, wantHeader)
+			}
+		})
+	}
+}
+
+func TestNATSPublishRejected(t *testing.T) {
+	server := newFakeNATS(t, &fakeNATS{info: `{}`, reject: "Permissions Violation for Publish to receipts.receipt.processed"})
+	publisher := &NATSPublisher{URL: "nats://" + server.listener.Addr().String(), SubjectPrefix: "receipts"}
+	defer publisher.Close()
+
+	err := publisher.Publish(context.Background(), "receipt.processed", []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Errorf("Publish() = %v, want the server's error", err)
+	}
+}
+
+func TestNATSReconnects(t *testing.T) {
+	server := newFakeNATS(t, &fakeNATS{info: `{}`, hangUp: true})
+	publisher := &NATSPublisher{URL: "nats://" + server.listener.Addr().String()}
+	defer publisher.Close()
+
+	// The server hangs up after each message, so each publish after the first finds the
+	// connection gone and opens another
+	for i := range 3 {
+		err := publisher.Publish(context.Background(), "receipt.processed", []byte("{}"))
+		if err != nil {
+			t.Fatalf("Publish() %d = %v", i+1, err)
+		}
+		<-server.messages
+	}
+}
+
+func TestNATSConnectErrors(t *testing.T) {
+	server := newFakeNATS(t, &fakeNATS{info: `{"tls_required":true}`})
+	tests := []struct {
+		url     string
+		wantErr string
+	}{
+		{"tls://" + server.listener.Addr().String(), "unsupported NATS URL scheme"},
+		{"nats://" + server.listener.Addr().String(), "requires TLS"},
+	}
+	for _, test := range tests {
+		publisher := &NATSPublisher{URL: test.url}
+		err := publisher.Publish(context.Background(), "receipt.processed", []byte("{}"))
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("Publish() to %s = %v, want an error saying %q", test.url, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package receiptapi
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Accented Latin letters, from Latin-1 and Latin Extended-A, and the letter and combining
+// mark they are written with when decomposed, as OCR output often has them
+var latinDecompositions = map[rune][2]rune{
+	'À': {'A', '\u0300'}, 'Á': {'A', '\u0301'}, 'Â': {'A', '\u0302'}, 'Ã': {'A', '\u0303'},
+	'Ä': {'A', '\u0308'}, 'Å': {'A', '\u030A'}, 'à': {'a', '\u0300'}, 'á': {'a', '\u0301'},
+	'â': {'a', '\u0302'}, 'ã': {'a', '\u0303'}, 'ä': {'a', '\u0308'}, 'å': {'a', '\u030A'},
+	'Ā': {'A', '\u0304'}, 'ā': {'a', '\u0304'}, 'Ă': {'A', '\u0306'}, 'ă': {'a', '\u0306'},
+	'Ą': {'A', '\u0328'}, 'ą': {'a', '\u0328'},
+	'Ç': {'C', '\u0327'}, 'ç': {'c', '\u0327'}, 'Ć': {'C', '\u0301'}, 'ć': {'c', '\u0301'},
+	'Ĉ': {'C', '\u0302'}, 'ĉ': {'c', '\u0302'}, 'Ċ': {'C', '\u0307'}, 'ċ': {'c', '\u0307'},
+	'Č': {'C', '\u030C'}, 'č': {'c', '\u030C'},
+	'Ď': {'D', '\u030C'}, 'ď': {'d', '\u030C'},
+	'È': {'E', '\u0300'}, 'É': {'E', '\u0301'}, 'Ê': {'E', '\u0302'}, 'Ë': {'E', '\u0308'},
+	'è': {'e', '\u0300'}, 'é': {'e', '\u0301'}, 'ê': {'e', '\u0302'}, 'ë': {'e', '\u0308'},
+	'Ē': {'E', '\u0304'}, 'ē': {'e', '\u0304'}, 'Ĕ': {'E', '\u0306'}, 'ĕ': {'e', '\u0306'},
+	'Ė': {'E', '\u0307'}, 'ė': {'e', '\u0307'}, 'Ę': {'E', '\u0328'}, 'ę': {'e', '\u0328'},
+	'Ě': {'E', '\u030C'}, 'ě': {'e', '\u030C'},
+	'Ĝ': {'G', '\u0302'}, 'ĝ': {'g', '\u0302'}, 'Ğ': {'G', '\u0306'}, 'ğ': {'g', '\u0306'},
+	'Ġ': {'G', '\u0307'}, 'ġ': {'g', '\u0307'}, 'Ģ': {'G', '\u0327'}, 'ģ': {'g', '\u0327'},
+	'Ĥ': {'H', '\u0302'}, 'ĥ': {'h', '\u0302'},
+	'Ì': {'I', '\u0300'}, 'Í': {'I', '\u0301'}, 'Î': {'I', '\u0302'}, 'Ï': {'I', '\u0308'},
+	'ì': {'i', '\u0300'}, 'í': {'i', '\u0301'}, 'î': {'i', '\u0302'}, 'ï': {'i', '\u0308'},
+	'Ĩ': {'I', '\u0303'}, 'ĩ': {'i', '\u0303'}, 'Ī': {'I', '\u0304'}, 'ī': {'i', '\u0304'},
+	'Ĭ': {'I', '\u0306'}, 'ĭ': {'i', '\u0306'}, 'Į': {'I', '\u0328'}, 'į': {'i', '\u0328'},
+	'İ': {'I', '\u0307'},
+	'Ĵ': {'J', '\u0302'}, 'ĵ': {'j', '\u0302'},
+	'Ķ': {'K', '\u0327'}, 'ķ': {'k', '\u0327'},
+	'Ĺ': {'L', '\u0301'}, 'ĺ': {'l', '\u0301'}, 'Ļ': {'L', '\u0327'}, 'ļ': {'l', '\u0327'},
+	'Ľ': {'L', '\u030C'}, 'ľ': {'l', '\u030C'},
+	'Ñ': {'N', '\u0303'}, 'ñ': {'n', '\u0303'}, 'Ń': {'N', '\u0301'}, 'ń': {'n', '\u0301'},
+	'Ņ': {'N', '\u0327'}, 'ņ': {'n', '\u0327'}, 'Ň': {'N', '\u030C'}, 'ň': {'n', '\u030C'},
+	'Ò': {'O', '\u0300'}, 'Ó': {'O', '\u0301'}, 'Ô': {'O', '\u0302'}, 'Õ': {'O', '\u0303'},
+	'Ö': {'O', '\u0308'}, 'ò': {'o', '\u0300'}, 'ó': {'o', '\u0301'}, 'ô': {'o', '\u0302'},
+	'õ': {'o', '\u0303'}, 'ö': {'o', '\u0308'}, 'Ō': {'O', '\u0304'}, 'ō': {'o', '\u0304'},
+	'Ŏ': {'O', '\u0306'}, 'ŏ': {'o', '\u0306'}, 'Ő': {'O', '\u030B'}, 'ő': {'o', '\u030B'},
+	'Ŕ': {'R', '\u0301'}, 'ŕ': {'r', '\u0301'}, 'Ŗ': {'R', '\u0327'}, 'ŗ': {'r', '\u0327'},
+	'Ř': {'R', '\u030C'}, 'ř': {'r', '\u030C'},
+	'Ś': {'S', '\u0301'}, 'ś': {'s', '\u0301'}, 'Ŝ': {'S', '\u0302'}, 'ŝ': {'s', '\u0302'},
+	'Ş': {'S', '\u0327'}, 'ş': {'s', '\u0327'}, 'Š': {'S', '\u030C'}, 'š': {'s', '\u030C'},
+	'Ţ': {'T', '\u0327'}, 'ţ': {'t', '\u0327'}, 'Ť': {'T', '\u030C'}, 'ť': {'t', '\u030C'},
+	'Ù': {'U', '\u0300'}, 'Ú': {'U', '\u0301'}, 'Û': {'U', '\u0302'}, 'Ü': {'U', '\u0308'},
+	'ù': {'u', '\u0300'}, 'ú': {'u', '\u0301'}, 'û': {'u', '\u0302'}, 'ü': {'u', '\u0308'},
+	'Ũ': {'U', '\u0303'}, 'ũ': {'u', '\u0303'}, 'Ū': {'U', '\u0304'}, 'ū': {'u', '\u0304'},
+	'Ŭ': {'U', '\u0306'}, 'ŭ': {'u', '\u0306'}, 'Ů': {'U', '\u030A'}, 'ů': {'u', '\u030A'},
+	'Ű': {'U', '\u030B'}, 'ű': {'u', '\u030B'}, 'Ų': {'U', '\u0328'}, 'ų': {'u', '\u0328'},
+	'Ŵ': {'W', '\u0302'}, 'ŵ': {'w', '\u0302'},
+	'Ý': {'Y', '\u0301'}, 'ý': {'y', '\u0301'}, 'ÿ': {'y', '\u0308'}, 'Ŷ': {'Y', '\u0302'},
+	'ŷ': {'y', '\u0302'}, 'Ÿ': {'Y', '\u0308'},
+	'Ź': {'Z', '\u0301'}, 'ź': {'z', '\u0301'}, 'Ż': {'Z', '\u0307'}, 'ż': {'z', '\u0307'},
+	'Ž': {'Z', '\u030C'}, 'ž': {'z', '\u030C'},
+}
+
+// Accented letters keyed by the letter and combining mark they are made of
+var latinCompositions = func() map[[2]rune]rune {
+	compositions := map[[2]rune]rune{}
+	for composed, parts := range latinDecompositions {
+		compositions[parts] = composed
+	}
+	return compositions
+}()
+
+// ASCII spellings of Latin letters that aren't an ASCII letter with a mark
+var latinTransliterations = map[rune]string{
+	'ß': "ss", 'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'Ø': "O", 'ø': "o",
+	'Đ': "D", 'đ': "d", 'Ð': "D", 'ð': "d", 'Þ': "TH", 'þ': "th", 'Ł': "L",
+	'ł': "l", 'Ħ': "H", 'ħ': "h", 'ı': "i", 'Ŀ': "L", 'ŀ': "l", 'ŉ': "'n",
+}
+
+// Returns an item description as the description rules and product matching see it,
+// with the steps the program turns on: accented letters composed and whitespace folded,
+// then optionally spelled in ASCII. The receipt keeps the description as submitted.
+func NormalizeDescription(desc string) string {
+	return normalizeDescription(desc, CurrentProgram().Rules)
+}
+
+// Returns an item description normalized as these rule values say
+func normalizeDescription(desc string, rules ProgramRules) string {
+	if !rules.NormalizeDescriptions && !rules.TransliterateDescriptions {
+		return desc
+	}
+	normalized := foldSpaces(composeLatin(desc))
+	if rules.TransliterateDescriptions {
+		normalized = transliterate(normalized)
+	}
+	return normalized
+}
+
+// Replaces letters followed by a combining mark with the accented letter they make, as
+// NFC does for Latin-1 and Latin Extended-A, so "é" counts the same however it was written
+func composeLatin(text string) string {
+	runes := []rune(text)
+	composed := make([]rune, 0, len(runes))
+	for _, r := range runes {
+		if last := len(composed) - 1; last >= 0 && unicode.Is(unicode.Mn, r) {
+			accented, ok := latinCompositions[[2]rune{composed[last], r}]
+			if ok {
+				composed[last] = accented
+				continue
+			}
+		}
+		composed = append(composed, r)
+	}
+	return string(composed)
+}
+
+// Turns every run of whitespace, including non-breaking and other Unicode spaces, into
+// one space, drops zero width characters and trims the ends
+func foldSpaces(text string) string {
+	text = strings.Map(func(r rune) rune {
+		switch r {
+		case '\u200b', '\u200c', '\u200d', '\u2060', '\ufeff':
+			return -1
+		}
+		return r
+	}, text)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// Spells accented and other Latin letters in ASCII, e.g. "Crème brûlée" as "Creme
+// brulee" and "Straße" as "Strasse", dropping combining marks left over
+func transliterate(text string) string {
+	var builder strings.Builder
+	for _, r := range text {
+		if parts, ok := latinDecompositions[r]; ok {
+			builder.WriteRune(parts[0])
+		} else if spelled, ok := latinTransliterations[r]; ok {
+			builder.WriteString(spelled)
+		} else if !unicode.Is(unicode.Mn, r) {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,203 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// Fix for a misreading OCR makes of a receipt field: a pattern replaced wherever it
+// matches, or a lookup of misread values, matched ignoring case and extra spaces, to the
+// value they should be
+type OCRCorrection struct {
+	Name    string            `json:"name"`
+	Field   string            `json:"field"`
+	Pattern string            `json:"pattern,omitempty"`
+	Replace string            `json:"replace,omitempty"`
+	Lookup  map[string]string `json:"lookup,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// How often a correction changed a receipt, and what became of the receipts it changed
+type OCRCorrectionMetrics struct {
+	Name     string `json:"name"`
+	Field    string `json:"field"`
+	Applied  int    `json:"applied"`
+	Accepted int    `json:"accepted"`
+	Flagged  int    `json:"flagged"`
+	Rejected int    `json:"rejected"`
+}
+
+// Response listing the corrections, with how many OCR receipts were submitted and how
+// many of them were corrected
+type OCRCorrectionsResponse struct {
+	Submitted   int                    `json:"submitted"`
+	Corrected   int                    `json:"corrected"`
+	Corrections []OCRCorrectionMetrics `json:"corrections"`
+}
+
+// Returns the values of a receipt field corrections can be made to, so they can be
+// changed in place
+var ocrCorrectionFields = map[string]func(receipt *Receipt) []*string{
+	"retailer":     func(receipt *Receipt) []*string { return []*string{&receipt.Retailer} },
+	"purchaseDate": func(receipt *Receipt) []*string { return []*string{&receipt.PurchaseDate} },
+	"purchaseTime": func(receipt *Receipt) []*string { return []*string{&receipt.PurchaseTime} },
+	"total":        func(receipt *Receipt) []*string { return []*string{&receipt.Total} },
+	"items.shortDescription": func(receipt *Receipt) []*string {
+		values := []*string{}
+		for i := range receipt.Items {
+			values = append(values, &receipt.Items[i].ShortDescription)
+		}
+		return values
+	},
+	"items.price": func(receipt *Receipt) []*string {
+		values := []*string{}
+		for i := range receipt.Items {
+			values = append(values, &receipt.Items[i].Price)
+		}
+		return values
+	},
+}
+
+// Corrections made to OCR receipts, in the order they are made, and their metrics
+var (
+	ocrCorrections      []OCRCorrection
+	ocrCorrectionCounts = map[string]*OCRCorrectionMetrics{}
+	ocrSubmitted        int
+	ocrCorrected        int
+	ocrMu               sync.Mutex
+)
+
+// Loads the corrections made to OCR receipts from a JSON array
+func LoadOCRCorrections(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var corrections []OCRCorrection
+	err = json.Unmarshal(data, &corrections)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for i, correction := range corrections {
+		switch {
+		case correction.Name == "":
+			return fmt.Errorf("correction %d has no name", i)
+		case seen[correction.Name]:
+			return fmt.Errorf("duplicate correction %q", correction.Name)
+		case ocrCorrectionFields[correction.Field] == nil:
+			return fmt.Errorf("correction %q has an unknown field %q", correction.Name, correction.Field)
+		case (correction.Pattern == "") == (len(correction.Lookup) == 0):
+			return fmt.Errorf("correction %q needs either a pattern or a lookup", correction.Name)
+		}
+		seen[correction.Name] = true
+
+		if correction.Pattern != "" {
+			correction.pattern, err = regexp.Compile(correction.Pattern)
+			if err != nil {
+				return fmt.Errorf("correction %q has an invalid pattern: %w", correction.Name, err)
+			}
+		}
+		lookup := map[string]string{}
+		for misread, value := range correction.Lookup {
+			lookup[NormalizeRetailer(misread)] = value
+		}
+		correction.Lookup = lookup
+		corrections[i] = correction
+	}
+
+	ocrMu.Lock()
+	defer ocrMu.Unlock()
+	ocrCorrections = corrections
+	for _, correction := range corrections {
+		if ocrCorrectionCounts[correction.Name] == nil {
+			ocrCorrectionCounts[correction.Name] = &OCRCorrectionMetrics{Name: correction.Name}
+		}
+		ocrCorrectionCounts[correction.Name].Field = correction.Field
+	}
+	return nil
+}
+
+// Returns a value as a correction would correct it
+func (correction OCRCorrection) Correct(value string) string {
+	if correction.pattern != nil {
+		return correction.pattern.ReplaceAllString(value, correction.Replace)
+	}
+	fixed, ok := correction.Lookup[NormalizeRetailer(value)]
+	if ok {
+		return fixed
+	}
+	return value
+}
+
+// Makes the configured corrections to a receipt read by OCR, in order, returning the
+// names of those that changed it
+func CorrectOCRReceipt(receipt *Receipt) []string {
+	ocrMu.Lock()
+	defer ocrMu.Unlock()
+	ocrSubmitted += 1
+
+	applied := []string{}
+	for _, correction := range ocrCorrections {
+		changed := false
+		for _, value := range ocrCorrectionFields[correction.Field](receipt) {
+			fixed := correction.Correct(*value)
+			if fixed != *value {
+				*value = fixed
+				changed = true
+			}
+		}
+		if changed {
+			applied = append(applied, correction.Name)
+			ocrCorrectionCounts[correction.Name].Applied += 1
+		}
+	}
+	if len(applied) > 0 {
+		ocrCorrected += 1
+	}
+	return applied
+}
+
+// Counts what became of a corrected receipt against each correction made to it: accepted
+// with its points, flagged for review, or rejected
+func CountOCROutcome(applied []string, status string, rejected bool) {
+	ocrMu.Lock()
+	defer ocrMu.Unlock()
+	for _, name := range applied {
+		counts := ocrCorrectionCounts[name]
+		switch {
+		case rejected:
+			counts.Rejected += 1
+		case status == statusSubmitted:
+			counts.Flagged += 1
+		default:
+			counts.Accepted += 1
+		}
+	}
+}
+
+/*
+	Below are the handlers for admins to see how OCR corrections are doing
+*/
+
+// Method to list the corrections made to OCR receipts with their metrics, in the order
+// they are made
+func ListOCRCorrections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ocrMu.Lock()
+	response := OCRCorrectionsResponse{Submitted: ocrSubmitted, Corrected: ocrCorrected, Corrections: []OCRCorrectionMetrics{}}
+	for _, correction := range ocrCorrections {
+		response.Corrections = append(response.Corrections, *ocrCorrectionCounts[correction.Name])
+	}
+	ocrMu.Unlock()
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,217 @@
+package receiptapi
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// How strictly validation treats retailer names and item descriptions with characters
+// outside the allowed set: rejected, or accepted with a warning as for lenient partners
+const (
+	validationStrict  = "strict"
+	validationLenient = "lenient"
+)
+
+// Prefix of the overrides that switch off a scoring rule, e.g. "rule.afternoon=off"
+const ruleOverridePrefix = "rule."
+
+// Features an X-Feature-Overrides header changes for a single request: scoring rules
+// switched off, rule settings turned on or off, and how strict validation is
+type FeatureOverrides struct {
+	DisabledRules []string
+	Settings      map[string]bool
+	Validation    string
+}
+
+// Key the feature overrides are kept under in a context
+type featureOverridesKey struct{}
+
+// JSON names of the rule settings that can be turned on or off for a request
+var overridableSettings = boolFieldNames(reflect.TypeFor[ProgramRules]())
+
+// Returns the JSON names of a struct's bool fields
+func boolFieldNames(structType reflect.Type) []string {
+	names := []string{}
+	for i := range structType.NumField() {
+		name, _, _ := strings.Cut(structType.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" && structType.Field(i).Type.Kind() == reflect.Bool {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Parses an on or off value, also accepted as true or false
+func parseSwitch(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "on", "true":
+		return true, true
+	case "off", "false":
+		return false, true
+	}
+	return false, false
+}
+
+// Parses an X-Feature-Overrides header: comma separated name=value pairs such as
+// "rule.afternoon=off, collapseDuplicateItems=on, validation=lenient"
+func ParseFeatureOverrides(header string) (FeatureOverrides, error) {
+	overrides := FeatureOverrides{Settings: map[string]bool{}}
+	rules := GetUncappedPointsByRule(Receipt{})
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, found := strings.Cut(pair, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !found || value == "" {
+			return FeatureOverrides{}, fmt.Errorf("%q is not a name=value pair", pair)
+		}
+
+		rule, isRule := strings.CutPrefix(name, ruleOverridePrefix)
+		switch {
+		case isRule:
+			known := slices.ContainsFunc(rules, func(r RulePoints) bool { return r.Rule == rule })
+			if !known {
+				return FeatureOverrides{}, fmt.Errorf("unknown rule %q", rule)
+			}
+			if on, ok := parseSwitch(value); !ok || on {
+				return FeatureOverrides{}, fmt.Errorf("rules can only be switched off, not %q", value)
+			}
+			if !slices.Contains(overrides.DisabledRules, rule) {
+				overrides.DisabledRules = append(overrides.DisabledRules, rule)
+			}
+		case name == "validation":
+			value = strings.ToLower(value)
+			if value != validationStrict && value != validationLenient {
+				return FeatureOverrides{}, fmt.Errorf("validation must be %s or %s, not %q", validationStrict, validationLenient, value)
+			}
+			overrides.Validation = value
+		case slices.Contains(overridableSettings, name):
+			on, ok := parseSwitch(value)
+			if !ok {
+				return FeatureOverrides{}, fmt.Errorf("%s must be on or off, not %q", name, value)
+			}
+			overrides.Settings[name] = on
+		default:
+			return FeatureOverrides{}, fmt.Errorf("unknown feature %q", name)
+		}
+	}
+	return overrides, nil
+}
+
+// Returns whether the overrides change anything
+func (overrides FeatureOverrides) Empty() bool {
+	return len(overrides.DisabledRules) == 0 && len(overrides.Settings) == 0 && overrides.Validation == ""
+}
+
+// Formats the overrides as a header in a stable order, to log and record with receipts
+func (overrides FeatureOverrides) String() string {
+	pairs := []string{}
+	for _, rule := range overrides.DisabledRules {
+		pairs = append(pairs, ruleOverridePrefix+rule+"=off")
+	}
+	for _, name := range slices.Sorted(maps.Keys(overrides.Settings)) {
+		value := "off"
+		if overrides.Settings[name] {
+			value = "on"
+		}
+		pairs = append(pairs, name+"="+value)
+	}
+	if overrides.Validation != "" {
+		pairs = append(pairs, "validation="+overrides.Validation)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// Returns the rule values with the overridden settings changed and rules switched off
+func (overrides FeatureOverrides) Rules(rules ProgramRules) ProgramRules {
+	value := reflect.ValueOf(&rules).Elem()
+	for i := range value.NumField() {
+		name, _, _ := strings.Cut(value.Type().Field(i).Tag.Get("json"), ",")
+		on, overridden := overrides.Settings[name]
+		if overridden && value.Field(i).Kind() == reflect.Bool {
+			value.Field(i).SetBool(on)
+		}
+	}
+	rules.disabledRules = slices.Concat(rules.disabledRules, overrides.DisabledRules)
+	return rules
+}
+
+// Returns the partner with validation as strict as the overrides make it
+func (overrides FeatureOverrides) Partner(partner Partner) Partner {
+	switch overrides.Validation {
+	case validationStrict:
+		partner.Lenient = false
+	case validationLenient:
+		partner.Lenient = true
+	}
+	return partner
+}
+
+// Returns the feature overrides a receipt was scored with, as recorded in its provenance,
+// and whether it was scored with any
+func RecordedFeatureOverrides(receipt Receipt) (FeatureOverrides, bool) {
+	if receipt.Provenance == nil || receipt.Provenance.FeatureOverrides == "" {
+		return FeatureOverrides{}, false
+	}
+	overrides, err := ParseFeatureOverrides(receipt.Provenance.FeatureOverrides)
+	if err != nil {
+		logScoring.Warn("Ignoring recorded feature overrides", "receiptId", receipt.ID, "error", err)
+		return FeatureOverrides{}, false
+	}
+	return overrides, !overrides.Empty()
+}
+
+// Returns a copy of the context carrying the feature overrides
+func WithFeatureOverrides(ctx context.Context, overrides FeatureOverrides) context.Context {
+	return context.WithValue(ctx, featureOverridesKey{}, overrides)
+}
+
+// Returns the feature overrides the context carries, if any
+func FeatureOverridesFrom(ctx context.Context) (FeatureOverrides, bool) {
+	overrides, ok := ctx.Value(featureOverridesKey{}).(FeatureOverrides)
+	return overrides, ok
+}
+
+// Lets admins change scoring rules and validation strictness for a single request with an
+// X-Feature-Overrides header and the admin token, for experiments and reproducing support
+// cases. Submissions and lint requests honor them. Requests without the header are passed
+// on untouched.
+func OverrideFeatures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := strings.TrimSpace(r.Header.Get("X-Feature-Overrides"))
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rejection := checkAdminToken(r)
+		if rejection != nil {
+			w.Header().Set("Content-Type", "application/json")
+			if rejection.Status == http.StatusForbidden {
+				WriteError(w, http.StatusForbidden, codeFeatureOverridesForbidden, "Feature overrides need ADMIN_TOKEN to be set.")
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			WriteError(w, http.StatusUnauthorized, codeFeatureOverridesForbidden, "X-Feature-Overrides needs the admin token as a bearer token.")
+			return
+		}
+		overrides, err := ParseFeatureOverrides(header)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			WriteError(w, http.StatusBadRequest, codeInvalidFeatureOverrides, "X-Feature-Overrides is invalid: "+err.Error()+".")
+			return
+		}
+		if overrides.Empty() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logApp.Info("Request with feature overrides", "method", r.Method, "path", r.URL.Path, "overrides", overrides.String())
+		next.ServeHTTP(w, r.WithContext(WithFeatureOverrides(r.Context(), overrides)))
+	})
+}
@@ -0,0 +1,423 @@
+package receiptapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Most recent activity kept for each partner
+const partnerActivitySize = 100
+
+// Settings for a partner that calls the API with its own key
+type Partner struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+
+	// Accept receipts with non-critical issues, returning them as warnings instead of a 400
+	Lenient bool `json:"lenient"`
+
+	// Keep the partner's receipts in the sandbox, apart from production data
+	Sandbox bool `json:"sandbox"`
+
+	// Where events about the partner's receipts are sent, signed with the signing secret
+	WebhookURL    string `json:"webhookUrl,omitempty"`
+	SigningSecret string `json:"signingSecret,omitempty"`
+
+	// Turn away submissions that aren't signed with the signing secret
+	RequireSignature bool `json:"requireSignature,omitempty"`
+
+	// Turn away submissions without a single use token from POST /receipts/submission-tokens
+	RequireSubmissionToken bool `json:"requireSubmissionToken,omitempty"`
+
+	// Rate limit tier the partner is on, e.g. "standard"
+	RateLimitTier string `json:"rateLimitTier,omitempty"`
+
+	// Format the partner's receipts are sent in, e.g. "poslog", when it isn't the API's
+	// own JSON; a submission's X-Receipt-Source header overrides it
+	Source string `json:"source,omitempty"`
+
+	// How the partner's receipts are checked for duplicates: "exact", "window" with its
+	// own window in minutes, or "off"; the server's near duplicate window when empty
+	DuplicateDetection     string `json:"duplicateDetection,omitempty"`
+	DuplicateWindowMinutes int    `json:"duplicateWindowMinutes,omitempty"`
+}
+
+// Partners keyed by API key
+var partners = map[string]Partner{}
+
+// Recent activity keyed by partner name, oldest first
+var partnerActivity = map[string][]PartnerActivity{}
+
+// Guards partners and partnerActivity, since partners can be registered while serving
+var partnersMu sync.RWMutex
+
+// Something a partner did, or that was done to its registration
+type PartnerActivity struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	ReceiptID string    `json:"receiptId,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// Body of a request to register a partner
+type PartnerRegistration struct {
+	Name          string `json:"name"`
+	WebhookURL    string `json:"webhookUrl"`
+	RateLimitTier string `json:"rateLimitTier"`
+	Lenient       bool   `json:"lenient"`
+	Sandbox       bool   `json:"sandbox"`
+
+	RequireSignature       bool `json:"requireSignature"`
+	RequireSubmissionToken bool `json:"requireSubmissionToken"`
+
+	Source string `json:"source"`
+
+	DuplicateDetection     string `json:"duplicateDetection"`
+	DuplicateWindowMinutes int    `json:"duplicateWindowMinutes"`
+}
+
+// Partner as listed, without its credentials
+type PartnerSummary struct {
+	Name          string `json:"name"`
+	WebhookURL    string `json:"webhookUrl,omitempty"`
+	RateLimitTier string `json:"rateLimitTier"`
+	Lenient       bool   `json:"lenient"`
+	Sandbox       bool   `json:"sandbox"`
+
+	RequireSignature       bool `json:"requireSignature"`
+	RequireSubmissionToken bool `json:"requireSubmissionToken"`
+
+	Source string `json:"source,omitempty"`
+
+	DuplicateDetection     string `json:"duplicateDetection,omitempty"`
+	DuplicateWindowMinutes int    `json:"duplicateWindowMinutes,omitempty"`
+
+	// Last characters of the API key, to tell which one a caller has
+	KeyHint string `json:"keyHint"`
+}
+
+// Response listing partners
+type PartnerListResponse struct {
+	Partners []PartnerSummary `json:"partners"`
+}
+
+// Response with a partner's recent activity, newest first
+type PartnerActivityResponse struct {
+	Name     string            `json:"name"`
+	Activity []PartnerActivity `json:"activity"`
+}
+
+// Loads partners from a JSON array
+func LoadPartners(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var list []Partner
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+	partnersMu.Lock()
+	defer partnersMu.Unlock()
+	for _, partner := range list {
+		partner = withPartnerSecrets(partner)
+		if partner.Key == "" {
+			return fmt.Errorf("partner %q has no key", partner.Name)
+		}
+		if _, ok := partners[partner.Key]; ok {
+			return fmt.Errorf("partner %q reuses another partner's key", partner.Name)
+		}
+		// Partners are managed by name, so names must be unique too
+		if _, ok := findPartner(partner.Name); ok {
+			return fmt.Errorf("partner %q is listed twice", partner.Name)
+		}
+		if _, ok := receiptAdapters[partner.Source]; partner.Source != "" && !ok {
+			return fmt.Errorf("partner %q has unknown source %q", partner.Name, partner.Source)
+		}
+		if message := checkDuplicateDetection(partner.DuplicateDetection, partner.DuplicateWindowMinutes); message != "" {
+			return fmt.Errorf("partner %q: %s", partner.Name, message)
+		}
+		if partner.RateLimitTier == "" {
+			partner.RateLimitTier = "standard"
+		}
+		partners[partner.Key] = partner
+	}
+	return nil
+}
+
+// Writes every partner back to the partners file, so registrations and rotated keys
+// survive a restart; the caller must hold partnersMu. Without a partners file they are
+// only kept in memory.
+func savePartners() error {
+	if config.PartnersFile == "" {
+		return nil
+	}
+	list := make([]Partner, 0, len(partners))
+	for _, partner := range partners {
+		// Credentials kept in the secrets provider stay there
+		if _, ok := Secret(partnerSecretName("KEY", partner.Name)); ok {
+			partner.Key = ""
+		}
+		if _, ok := Secret(partnerSecretName("SIGNING_SECRET", partner.Name)); ok {
+			partner.SigningSecret = ""
+		}
+		list = append(list, partner)
+	}
+	slices.SortFunc(list, func(a, b Partner) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The file holds keys, so only its owner may read it
+	temp, err := os.CreateTemp(filepath.Dir(config.PartnersFile), filepath.Base(config.PartnersFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(append(data, '\n'))
+	closeErr := temp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(temp.Name(), config.PartnersFile)
+}
+
+// Returns the partner identified by the request's X-API-Key header. Requests without a
+// key get the default settings; false is returned only for a key we don't know.
+func GetPartner(r *http.Request) (Partner, bool) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return Partner{}, true
+	}
+	partnersMu.RLock()
+	defer partnersMu.RUnlock()
+	partner, ok := partners[key]
+	return partner, ok
+}
+
+// Returns the partner with the given name, or the default settings and false if there
+// is none
+func FindPartner(name string) (Partner, bool) {
+	partnersMu.RLock()
+	defer partnersMu.RUnlock()
+	return findPartner(name)
+}
+
+// Returns the partner with the given name; the caller must hold partnersMu
+func findPartner(name string) (Partner, bool) {
+	for _, partner := range partners {
+		if partner.Name == name {
+			return partner, true
+		}
+	}
+	return Partner{}, false
+}
+
+// Adds to a partner's recent activity, dropping the oldest once there is too much.
+// Requests without a key belong to no partner and aren't recorded.
+func RecordPartnerActivity(name string, activity PartnerActivity) {
+	if name == "" {
+		return
+	}
+	partnersMu.Lock()
+	defer partnersMu.Unlock()
+	recent := append(partnerActivity[name], activity)
+	if len(recent) > partnerActivitySize {
+		recent = recent[len(recent)-partnerActivitySize:]
+	}
+	partnerActivity[name] = recent
+}
+
+// Returns a new random secret for API keys and signing
+func generateSecret() string {
+	secret := make([]byte, 24)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+/*
+	Below are the handlers for registering and managing partners
+*/
+
+// Method to register a partner, returning it with a new API key and signing secret.
+// The credentials are only ever returned here and when they are rotated.
+func (s *Server) RegisterPartner(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var registration PartnerRegistration
+	err := json.NewDecoder(r.Body).Decode(&registration)
+	if err != nil || strings.TrimSpace(registration.Name) == "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidPartner, "The partner needs a name.")
+		return
+	}
+	if registration.WebhookURL != "" && !CheckWebhookURL(registration.WebhookURL) {
+		WriteError(w, http.StatusBadRequest, codeInvalidPartner, "The webhook URL must be an absolute http or https URL.")
+		return
+	}
+	if _, ok := receiptAdapters[registration.Source]; registration.Source != "" && !ok {
+		WriteError(w, http.StatusBadRequest, codeInvalidPartner, "Unknown source "+registration.Source+"; sources are "+strings.Join(ReceiptSources(), ", ")+".")
+		return
+	}
+	if message := checkDuplicateDetection(registration.DuplicateDetection, registration.DuplicateWindowMinutes); message != "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidPartner, message)
+		return
+	}
+	if registration.RateLimitTier == "" {
+		registration.RateLimitTier = "standard"
+	}
+
+	partner := Partner{
+		Name:          registration.Name,
+		Key:           generateSecret(),
+		Lenient:       registration.Lenient,
+		Sandbox:       registration.Sandbox,
+		WebhookURL:    registration.WebhookURL,
+		SigningSecret: generateSecret(),
+		RateLimitTier: registration.RateLimitTier,
+
+		RequireSignature:       registration.RequireSignature,
+		RequireSubmissionToken: registration.RequireSubmissionToken,
+
+		Source: registration.Source,
+
+		DuplicateDetection:     registration.DuplicateDetection,
+		DuplicateWindowMinutes: registration.DuplicateWindowMinutes,
+	}
+	partner = withPartnerSecrets(partner)
+
+	partnersMu.Lock()
+	if _, exists := findPartner(partner.Name); exists {
+		partnersMu.Unlock()
+		WriteError(w, http.StatusConflict, codePartnerExists, "A partner with that name is already registered.")
+		return
+	}
+	partners[partner.Key] = partner
+	err = savePartners()
+	if err != nil {
+		delete(partners, partner.Key)
+		partnersMu.Unlock()
+		logApp.Error("Could not save partners", "error", err)
+		WriteError(w, http.StatusInternalServerError, codeInternal, "The partner could not be saved.")
+		return
+	}
+	partnersMu.Unlock()
+	RecordPartnerActivity(partner.Name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "registered"})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(partner)
+}
+
+// Method to list registered partners, without their credentials
+func ListPartners(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	partnersMu.RLock()
+	summaries := make([]PartnerSummary, 0, len(partners))
+	for _, partner := range partners {
+		summaries = append(summaries, PartnerSummary{
+			Name:          partner.Name,
+			WebhookURL:    partner.WebhookURL,
+			RateLimitTier: partner.RateLimitTier,
+			Lenient:       partner.Lenient,
+			Sandbox:       partner.Sandbox,
+			KeyHint:       partner.Key[max(0, len(partner.Key)-4):],
+
+			RequireSignature:       partner.RequireSignature,
+			RequireSubmissionToken: partner.RequireSubmissionToken,
+
+			Source: partner.Source,
+
+			DuplicateDetection:     partner.DuplicateDetection,
+			DuplicateWindowMinutes: partner.DuplicateWindowMinutes,
+		})
+	}
+	partnersMu.RUnlock()
+	slices.SortFunc(summaries, func(a, b PartnerSummary) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	json.NewEncoder(w).Encode(PartnerListResponse{Partners: summaries})
+}
+
+// Method to replace a partner's API key and signing secret. The old key stops working
+// straight away.
+func (s *Server) RotatePartnerCredentials(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	name := mux.Vars(r)["name"]
+
+	partnersMu.Lock()
+	old, ok := findPartner(name)
+	if !ok {
+		partnersMu.Unlock()
+		WriteError(w, http.StatusNotFound, codePartnerNotFound, "No partner found with that name.")
+		return
+	}
+	if hasPartnerSecrets(name) {
+		partnersMu.Unlock()
+		WriteError(w, http.StatusConflict, codeCredentialsManaged, "The partner's key comes from the secrets provider, so rotate it there.")
+		return
+	}
+	partner := old
+	partner.Key = generateSecret()
+	partner.SigningSecret = generateSecret()
+	delete(partners, old.Key)
+	partners[partner.Key] = partner
+	err := savePartners()
+	if err != nil {
+		delete(partners, partner.Key)
+		partners[old.Key] = old
+		partnersMu.Unlock()
+		logApp.Error("Could not save partners", "error", err)
+		WriteError(w, http.StatusInternalServerError, codeInternal, "The new credentials could not be saved.")
+		return
+	}
+	partnersMu.Unlock()
+	RecordPartnerActivity(name, PartnerActivity{Time: s.Clock.Now().UTC(), Event: "credentials_rotated"})
+
+	json.NewEncoder(w).Encode(partner)
+}
+
+// Method to list a partner's recent activity, newest first
+func GetPartnerActivity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	name := mux.Vars(r)["name"]
+
+	partnersMu.RLock()
+	_, ok := findPartner(name)
+	recent := slices.Clone(partnerActivity[name])
+	partnersMu.RUnlock()
+	if !ok {
+		WriteError(w, http.StatusNotFound, codePartnerNotFound, "No partner found with that name.")
+		return
+	}
+	slices.Reverse(recent)
+	if recent == nil {
+		recent = []PartnerActivity{}
+	}
+	json.NewEncoder(w).Encode(PartnerActivityResponse{Name: name, Activity: recent})
+}
+
+// Checks a webhook URL is absolute and uses http or https
+func CheckWebhookURL(value string) bool {
+	target, err := url.Parse(value)
+	return err == nil && (target.Scheme == "http" || target.Scheme == "https") && target.Host != ""
+}
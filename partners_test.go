@@ -0,0 +1,181 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Empties the partners for a test, and puts them back when it ends
+func withoutPartners(t *testing.T) {
+	t.Helper()
+	savedPartners, savedActivity := partners, partnerActivity
+	t.Cleanup(func() { partners, partnerActivity = savedPartners, savedActivity })
+	partners, partnerActivity = map[string]Partner{}, map[string][]PartnerActivity{}
+}
+
+func TestLoadPartners(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+	}{
+		{"valid", `[{"name": "a", "key": "a-key"}, {"name": "b", "key": "b-key", "rateLimitTier": "bulk"}]`, ""},
+		{"no key", `[{"name": "a"}]`, `partner "a" has no key`},
+		{"key reused", `[{"name": "a", "key": "key"}, {"name": "b", "key": "key"}]`, `partner "b" reuses another partner's key`},
+		{"name reused", `[{"name": "a", "key": "a-key"}, {"name": "a", "key": "b-key"}]`, `partner "a" is listed twice`},
+		{"not a list", `{"name": "a"}`, "cannot unmarshal"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withoutPartners(t)
+			path := filepath.Join(t.TempDir(), "partners.json")
+			os.WriteFile(path, []byte(test.file), 0o600)
+			err := LoadPartners(path)
+			if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("LoadPartners() = %v, want %q", err, test.wantErr)
+			}
+			if test.wantErr == "" && (partners["a-key"].RateLimitTier != "standard" || partners["b-key"].RateLimitTier != "bulk") {
+				t.Errorf("LoadPartners() = %+v, want the tiers defaulted to standard", partners)
+			}
+		})
+	}
+}
+
+func TestGetPartner(t *testing.T) {
+	withoutPartners(t)
+	partners["a-key"] = Partner{Name: "a", Key: "a-key"}
+	tests := []struct {
+		key    string
+		want   string
+		wantOK bool
+	}{
+		{"a-key", "a", true},
+		{"", "", true},
+		{"b-key", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/receipts/process", nil)
+		r.Header.Set("X-API-Key", test.key)
+		partner, ok := GetPartner(r)
+		if partner.Name != test.want || ok != test.wantOK {
+			t.Errorf("GetPartner() with key %q = %q, %v, want %q, %v", test.key, partner.Name, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+// Calls a partner admin handler with the body, and the partner name as the {name} route variable
+func callPartners(handler http.HandlerFunc, name string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/admin/partners/"+name, strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"name": name})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestManagePartners(t *testing.T) {
+	withoutPartners(t)
+	path := filepath.Join(t.TempDir(), "partners.json")
+	withConfig(t, func(config *Config) { config.PartnersFile = path })
+	s := New()
+
+	w := callPartners(s.RegisterPartner, "", `{"name": "acme", "webhookUrl": "https://acme.example/hooks"}`)
+	var registered Partner
+	json.NewDecoder(w.Body).Decode(&registered)
+	if w.Code != http.StatusCreated || registered.Key == "" || registered.SigningSecret == "" || registered.RateLimitTier != "standard" {
+		t.Fatalf("RegisterPartner() = %d, %+v, want a partner with credentials", w.Code, registered)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"name taken", `{"name": "acme"}`, http.StatusConflict, codePartnerExists},
+		{"no name", `{"name": " "}`, http.StatusBadRequest, codeInvalidPartner},
+		{"relative webhook", `{"name": "other", "webhookUrl": "/hooks"}`, http.StatusBadRequest, codeInvalidPartner},
+	}
+	for _, test := range tests {
+		w := callPartners(s.RegisterPartner, "", test.body)
+		var response ErrorResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		if w.Code != test.status || response.Code != test.code {
+			t.Errorf("%s: status = %d, code %q, want %d, %q", test.name, w.Code, response.Code, test.status, test.code)
+		}
+	}
+
+	w = callPartners(s.RotatePartnerCredentials, "acme", "")
+	var rotated Partner
+	json.NewDecoder(w.Body).Decode(&rotated)
+	if w.Code != http.StatusOK || rotated.Key == registered.Key || rotated.SigningSecret == registered.SigningSecret {
+		t.Fatalf("RotatePartnerCredentials() = %d, %+v, want new credentials", w.Code, rotated)
+	}
+	if _, ok := partners[registered.Key]; ok {
+		t.Error("RotatePartnerCredentials() kept the old key working")
+	}
+	if w := callPartners(s.RotatePartnerCredentials, "nobody", ""); w.Code != http.StatusNotFound {
+		t.Errorf("RotatePartnerCredentials() status = %d for an unknown partner, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w = callPartners(ListPartners, "", "")
+	var list PartnerListResponse
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Partners) != 1 || list.Partners[0].KeyHint != rotated.Key[len(rotated.Key)-4:] || strings.Contains(w.Body.String(), rotated.Key) {
+		t.Errorf("ListPartners() = %s, want acme with only a hint of its key", w.Body)
+	}
+
+	w = callPartners(GetPartnerActivity, "acme", "")
+	var activity PartnerActivityResponse
+	json.NewDecoder(w.Body).Decode(&activity)
+	if len(activity.Activity) != 2 || activity.Activity[0].Event != "credentials_rotated" || activity.Activity[1].Event != "registered" {
+		t.Errorf("GetPartnerActivity() = %+v, want the rotation then the registration", activity.Activity)
+	}
+
+	// The partners file has the rotated key, so it survives a restart
+	partners = map[string]Partner{}
+	err := LoadPartners(path)
+	if err != nil || partners[rotated.Key].Name != "acme" {
+		t.Errorf("LoadPartners() = %v, %+v, want acme with its rotated key", err, partners)
+	}
+}
+
+func TestRecordPartnerActivity(t *testing.T) {
+	withoutPartners(t)
+	for i := range partnerActivitySize + 5 {
+		RecordPartnerActivity("acme", PartnerActivity{Event: "submitted", ReceiptID: string(rune('a' + i%26))})
+	}
+	RecordPartnerActivity("", PartnerActivity{Event: "submitted"})
+	if len(partnerActivity["acme"]) != partnerActivitySize || partnerActivity["acme"][0].ReceiptID != "f" {
+		t.Errorf("RecordPartnerActivity() kept %d, starting at %q, want the latest %d", len(partnerActivity["acme"]),
+			partnerActivity["acme"][0].ReceiptID, partnerActivitySize)
+	}
+	if _, ok := partnerActivity[""]; ok {
+		t.Error("RecordPartnerActivity() recorded a request without a key")
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"https://acme.example/hooks", true},
+		{"http://localhost:8080", true},
+		{"ftp://acme.example", false},
+		{"/hooks", false},
+		{"https://", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := CheckWebhookURL(test.value); got != test.want {
+			t.Errorf("CheckWebhookURL(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
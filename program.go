@@ -0,0 +1,380 @@
+package receiptapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings of the loyalty program that can be changed while serving: what the rules
+// award, which receipts are accepted, and how long they keep their detail. They start
+// out as configured by environment variables, and changes made through the API are kept
+// in PROGRAM_FILE, overriding those variables from then on.
+type Program struct {
+	Rules              ProgramRules     `json:"rules"`
+	Limits             SubmissionLimits `json:"limits"`
+	AcceptedCurrencies []string         `json:"acceptedCurrencies"`
+	Retention          RetentionWindows `json:"retention"`
+}
+
+// Rule values, as ITEM_PRICE_MULTIPLIER, MCC_BONUSES, RULE_POINT_CAPS and so on set them
+type ProgramRules struct {
+	ItemPriceMultiplier       string           `json:"itemPriceMultiplier"`
+	ItemPriceRounding         string           `json:"itemPriceRounding"`
+	DescriptionLengthUnit     string           `json:"descriptionLengthUnit"`
+	CollapseDescriptionSpaces bool             `json:"collapseDescriptionSpaces"`
+	NormalizeDescriptions     bool             `json:"normalizeDescriptions"`
+	TransliterateDescriptions bool             `json:"transliterateDescriptions"`
+	TotalRulesBasis           string           `json:"totalRulesBasis"`
+	ZeroTotalQualifies        bool             `json:"zeroTotalQualifies"`
+	MerchantCategoryBonuses   map[string]int64 `json:"merchantCategoryBonuses"`
+	PaymentMethodBonuses      map[string]int64 `json:"paymentMethodBonuses"`
+	MaxReceiptPoints          int64            `json:"maxReceiptPoints"`
+	RulePointCaps             map[string]int64 `json:"rulePointCaps"`
+
+	CollapseDuplicateItems bool `json:"collapseDuplicateItems"`
+
+	// Rules switched off for a single request by its feature overrides
+	disabledRules []string
+}
+
+// Limits receipts are submitted within, as MAX_ITEMS, MAX_RECEIPT_AGE_DAYS and so on
+// set them
+type SubmissionLimits struct {
+	MaxItems             int     `json:"maxItems"`
+	MaxDescriptionLength int     `json:"maxDescriptionLength"`
+	MaxTotal             float64 `json:"maxTotal"`
+	MaxReceiptAgeDays    int     `json:"maxReceiptAgeDays"`
+	RejectFutureReceipts bool    `json:"rejectFutureReceipts"`
+}
+
+// How long receipts keep their detail, as DETAIL_RETENTION_DAYS sets it
+type RetentionWindows struct {
+	DetailRetentionDays int `json:"detailRetentionDays"`
+}
+
+// Program in effect, with its version, which goes up by one with each change
+type ProgramState struct {
+	Version   int        `json:"version"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	Program
+}
+
+// Request to replace the program. Version must be the one being replaced, so a change
+// made meanwhile by someone else isn't overwritten.
+type ProgramUpdate struct {
+	Version   int    `json:"version"`
+	ChangedBy string `json:"changedBy"`
+	Reason    string `json:"reason"`
+	Program
+
+	// Ignored, so the program as it was got can be sent back with changes
+	UpdatedAt *time.Time `json:"updatedAt"`
+}
+
+// Change made to the program, kept in its history
+type ProgramChange struct {
+	Version   int       `json:"version"`
+	ChangedAt time.Time `json:"changedAt"`
+	ChangedBy string    `json:"changedBy,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Program   Program   `json:"program"`
+}
+
+// Response listing the changes made to the program, newest first
+type ProgramHistory struct {
+	Changes []ProgramChange `json:"changes"`
+}
+
+// Program in effect, and the changes made to it in order; the program is taken from the
+// configuration until it is first asked for
+var (
+	program        ProgramState
+	programLoaded  bool
+	programChanges []ProgramChange
+)
+
+// Guards the program, its history and log file
+var programMu sync.RWMutex
+
+// Log file every change to the program is appended to, if one is open
+var programLog *os.File
+
+// Returns the program as the configuration sets it
+func ProgramFromConfig(config Config) Program {
+	return Program{
+		Rules: ProgramRules{
+			ItemPriceMultiplier:       config.ItemPriceMultiplier,
+			ItemPriceRounding:         config.ItemPriceRounding,
+			DescriptionLengthUnit:     config.DescriptionLengthUnit,
+			CollapseDescriptionSpaces: config.CollapseDescriptionSpaces,
+			NormalizeDescriptions:     config.NormalizeDescriptions,
+			TransliterateDescriptions: config.TransliterateDescriptions,
+			TotalRulesBasis:           config.TotalRulesBasis,
+			ZeroTotalQualifies:        config.ZeroTotalQualifies,
+			MerchantCategoryBonuses:   clonePoints(config.MCCBonuses),
+			PaymentMethodBonuses:      clonePoints(config.PaymentMethodBonuses),
+			MaxReceiptPoints:          config.MaxReceiptPoints,
+			RulePointCaps:             clonePoints(config.RulePointCaps),
+			CollapseDuplicateItems:    config.CollapseDuplicateItems,
+		},
+		Limits: SubmissionLimits{
+			MaxItems:             config.MaxItems,
+			MaxDescriptionLength: config.MaxDescriptionLength,
+			MaxTotal:             config.MaxTotal,
+			MaxReceiptAgeDays:    config.MaxReceiptAgeDays,
+			RejectFutureReceipts: config.RejectFutureReceipts,
+		},
+		AcceptedCurrencies: append([]string{}, config.AcceptedCurrencies...),
+		Retention: RetentionWindows{
+			DetailRetentionDays: config.DetailRetentionDays,
+		},
+	}
+}
+
+// Sets the configuration's program settings to a program's
+func (p Program) applyTo(config *Config) {
+	config.ItemPriceMultiplier = p.Rules.ItemPriceMultiplier
+	config.ItemPriceRounding = p.Rules.ItemPriceRounding
+	config.DescriptionLengthUnit = p.Rules.DescriptionLengthUnit
+	config.CollapseDescriptionSpaces = p.Rules.CollapseDescriptionSpaces
+	config.NormalizeDescriptions = p.Rules.NormalizeDescriptions
+	config.TransliterateDescriptions = p.Rules.TransliterateDescriptions
+	config.TotalRulesBasis = p.Rules.TotalRulesBasis
+	config.ZeroTotalQualifies = p.Rules.ZeroTotalQualifies
+	config.MCCBonuses = p.Rules.MerchantCategoryBonuses
+	config.PaymentMethodBonuses = p.Rules.PaymentMethodBonuses
+	config.MaxReceiptPoints = p.Rules.MaxReceiptPoints
+	config.RulePointCaps = p.Rules.RulePointCaps
+	config.CollapseDuplicateItems = p.Rules.CollapseDuplicateItems
+	config.MaxItems = p.Limits.MaxItems
+	config.MaxDescriptionLength = p.Limits.MaxDescriptionLength
+	config.MaxTotal = p.Limits.MaxTotal
+	config.MaxReceiptAgeDays = p.Limits.MaxReceiptAgeDays
+	config.RejectFutureReceipts = p.Limits.RejectFutureReceipts
+	config.AcceptedCurrencies = p.AcceptedCurrencies
+	config.DetailRetentionDays = p.Retention.DetailRetentionDays
+}
+
+// Returns a copy of points keyed by name, empty rather than nil
+func clonePoints(points map[string]int64) map[string]int64 {
+	cloned := maps.Clone(points)
+	if cloned == nil {
+		cloned = map[string]int64{}
+	}
+	return cloned
+}
+
+// Returns the rule values with copies of their maps, empty rather than nil
+func (rules ProgramRules) withEmptyMaps() ProgramRules {
+	rules.MerchantCategoryBonuses = clonePoints(rules.MerchantCategoryBonuses)
+	rules.PaymentMethodBonuses = clonePoints(rules.PaymentMethodBonuses)
+	rules.RulePointCaps = clonePoints(rules.RulePointCaps)
+	return rules
+}
+
+// Checks a program could be configured: the same checks the configuration gets at startup
+func ValidateProgram(p Program) error {
+	candidate := config
+	p.applyTo(&candidate)
+	return ValidateConfig(candidate)
+}
+
+// Returns the program in effect. Its maps are shared and must not be changed.
+func CurrentProgram() Program {
+	return currentProgramState().Program
+}
+
+// Returns the program in effect with its version
+func currentProgramState() ProgramState {
+	programMu.RLock()
+	if programLoaded {
+		defer programMu.RUnlock()
+		return program
+	}
+	programMu.RUnlock()
+
+	programMu.Lock()
+	defer programMu.Unlock()
+	loadProgram()
+	return program
+}
+
+// Takes the program from the configuration if it hasn't been yet; the caller must hold
+// programMu for writing
+func loadProgram() {
+	if !programLoaded {
+		program = ProgramState{Program: ProgramFromConfig(config)}
+		programLoaded = true
+	}
+}
+
+// Loads the program's history from a log file, putting its last change in effect. Each
+// line holds one change as JSON. Commands only read the file; the server keeps it open
+// to append to.
+func LoadProgram(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var changes []ProgramChange
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		var change ProgramChange
+		err = json.Unmarshal(scanner.Bytes(), &change)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		changes = append(changes, change)
+	}
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	// Checked before taking the lock, since the checks score a receipt with the program
+	last := changes[len(changes)-1]
+	err = ValidateProgram(last.Program)
+	if err != nil {
+		return fmt.Errorf("version %d: %w", last.Version, err)
+	}
+	programMu.Lock()
+	defer programMu.Unlock()
+	programChanges = changes
+	program = ProgramState{Version: last.Version, UpdatedAt: &last.ChangedAt, Program: last.Program}
+	programLoaded = true
+	return nil
+}
+
+// Opens the program's log file to append changes to
+func OpenProgramLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	var err error
+	programMu.Lock()
+	defer programMu.Unlock()
+	programLog, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	return err
+}
+
+// Appends a change to the log file, if one is open, syncing it to disk before the change
+// takes effect; the caller must hold programMu
+func persistProgramChange(change ProgramChange) error {
+	if programLog == nil {
+		return nil
+	}
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	_, err = programLog.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return programLog.Sync()
+}
+
+// Replaces the program, if it is valid and still at the version the update replaces.
+// Receipts already scored keep their points until they are recalculated.
+func (s *Server) UpdateProgram(update ProgramUpdate) (ProgramState, *Rejection) {
+	if update.AcceptedCurrencies == nil {
+		update.AcceptedCurrencies = []string{}
+	}
+	update.Rules = update.Rules.withEmptyMaps()
+	// Checked before taking the lock, since the checks score a receipt with the program
+	err := ValidateProgram(update.Program)
+	if err != nil {
+		return ProgramState{}, &Rejection{http.StatusBadRequest, codeInvalidProgram, "The program is not valid: " + err.Error() + "."}
+	}
+
+	programMu.Lock()
+	defer programMu.Unlock()
+	loadProgram()
+	if update.Version != program.Version {
+		message := fmt.Sprintf("The program is at version %d, not %d; get it again and reapply the change.", program.Version, update.Version)
+		return ProgramState{}, &Rejection{http.StatusConflict, codeProgramVersionConflict, message}
+	}
+	change := ProgramChange{
+		Version:   program.Version + 1,
+		ChangedAt: s.Clock.Now().UTC(),
+		ChangedBy: update.ChangedBy,
+		Reason:    update.Reason,
+		Program:   update.Program,
+	}
+	err = persistProgramChange(change)
+	if err != nil {
+		logApp.Error("Could not write program log", "error", err)
+		return ProgramState{}, &Rejection{http.StatusInternalServerError, codeInternal, "The program change could not be saved."}
+	}
+	programChanges = append(programChanges, change)
+	program = ProgramState{Version: change.Version, UpdatedAt: &change.ChangedAt, Program: change.Program}
+	logApp.Info("Program changed", "version", change.Version, "changedBy", change.ChangedBy)
+	return program, nil
+}
+
+/*
+	Below are the handlers for the program
+*/
+
+// Method to get the program in effect
+func GetProgram(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentProgramState())
+}
+
+// Method to replace the program; responds with the program as it now is
+func (s *Server) PutProgram(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var update ProgramUpdate
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&update)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidProgram, "The program is not valid JSON with only known fields.")
+		return
+	}
+	update.ChangedBy = strings.TrimSpace(update.ChangedBy)
+	update.Reason = strings.TrimSpace(update.Reason)
+	state, rejection := s.UpdateProgram(update)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	json.NewEncoder(w).Encode(state)
+}
+
+// Method to list the changes made to the program, newest first
+func GetProgramHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	programMu.RLock()
+	history := ProgramHistory{Changes: slices.Clone(programChanges)}
+	programMu.RUnlock()
+	if history.Changes == nil {
+		history.Changes = []ProgramChange{}
+	}
+	slices.Reverse(history.Changes)
+	json.NewEncoder(w).Encode(history)
+}
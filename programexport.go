@@ -0,0 +1,198 @@
+package receiptapi
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Receipts scored in a dry run of an import unless ?sample= says otherwise
+const defaultImportSample = 100
+
+// Program as exported from one environment to be imported into another. Signature is a
+// compact JWS, signed with the response signing key, whose payload is the rest of the
+// document; the other fields are there to be read and diffed, and imports only trust the
+// signed copy.
+type ProgramExport struct {
+	Issuer     string    `json:"issuer"`
+	ExportedAt time.Time `json:"exportedAt"`
+	Version    int       `json:"version"`
+	Program    Program   `json:"program"`
+
+	Signature string `json:"signature,omitempty"`
+}
+
+// Request to import an exported program. Version must be this environment's program
+// version, as for a change to the program.
+type ProgramImport struct {
+	Document  ProgramExport `json:"document"`
+	Version   int           `json:"version"`
+	ChangedBy string        `json:"changedBy"`
+	Reason    string        `json:"reason"`
+}
+
+// Result of an import: the program as it now is, or would be in a dry run, and how the
+// sampled receipts would score under the imported rules compared to the points they have
+type ProgramImportResult struct {
+	DryRun     bool             `json:"dryRun"`
+	Program    ProgramState     `json:"program"`
+	Comparison ShadowComparison `json:"comparison"`
+}
+
+// Returns the keys imported programs may be signed with: those of PROGRAM_IMPORT_KEYS,
+// and this environment's own signing key
+func programImportKeys() []ed25519.PublicKey {
+	var keys []ed25519.PublicKey
+	for _, x := range config.ProgramImportKeys {
+		// Checked when the configuration was validated
+		key, err := parsePublicKey(x)
+		if err == nil {
+			keys = append(keys, key)
+		}
+	}
+	if responseSigningKey != nil {
+		keys = append(keys, responseSigningKey.Public().(ed25519.PublicKey))
+	}
+	return keys
+}
+
+// Returns the current program as a signed export document
+func ExportProgram(now time.Time) (ProgramExport, *Rejection) {
+	if responseSigningKey == nil {
+		return ProgramExport{}, &Rejection{http.StatusServiceUnavailable, codeSigningNotConfigured, "RESPONSE_SIGNING_KEY must be set to sign exported programs."}
+	}
+	state := currentProgramState()
+	document := ProgramExport{
+		Issuer:     "receipt-api",
+		ExportedAt: now,
+		Version:    state.Version,
+		Program:    state.Program,
+	}
+	payload, err := json.Marshal(document)
+	if err != nil {
+		logApp.Error("Could not encode program export", "error", err)
+		return ProgramExport{}, &Rejection{http.StatusInternalServerError, codeInternal, "The program could not be exported."}
+	}
+	document.Signature = signCompact("receipt-api-program+jwt", payload)
+	return document, nil
+}
+
+// Returns the program signed in an export document, if it is signed by a trusted key
+func verifyProgramExport(document ProgramExport) (ProgramExport, *Rejection) {
+	payload, err := verifyCompact(document.Signature, programImportKeys())
+	if err != nil {
+		return ProgramExport{}, &Rejection{http.StatusBadRequest, codeInvalidProgramSignature, "The exported program can't be trusted: " + err.Error() + "."}
+	}
+	var signed ProgramExport
+	err = json.Unmarshal(payload, &signed)
+	if err != nil {
+		return ProgramExport{}, &Rejection{http.StatusBadRequest, codeInvalidProgramSignature, "The signed program is not valid JSON."}
+	}
+	return signed, nil
+}
+
+// Scores the most recent production receipts, up to the sample size, with an imported
+// program's rules and compares them with the points they have. Compacted and anonymized
+// receipts are left out, since they can't be scored again.
+func (s *Server) compareImportedRules(rules ProgramRules, sample int) ShadowComparison {
+	comparison := newShadowComparison()
+	stored := s.Store.All()
+	for i := len(stored) - 1; i >= 0 && comparison.Receipts < sample; i-- {
+		receipt := stored[i]
+		if receipt.Sandbox || receipt.Compacted != nil || receipt.Anonymized != nil {
+			continue
+		}
+		comparison.add(receipt.Points, PointsByRule(receipt, s.Rules), rules.Points(receipt), rules.PointsByRule(receipt))
+	}
+	return comparison
+}
+
+// Imports an exported program after checking its signature and validating it, or only
+// reports what it would do in a dry run
+func (s *Server) ImportProgram(request ProgramImport, dryRun bool, sample int) (ProgramImportResult, *Rejection) {
+	signed, rejection := verifyProgramExport(request.Document)
+	if rejection != nil {
+		return ProgramImportResult{}, rejection
+	}
+	imported := signed.Program
+	imported.Rules = imported.Rules.withEmptyMaps()
+	if imported.AcceptedCurrencies == nil {
+		imported.AcceptedCurrencies = []string{}
+	}
+	err := ValidateProgram(imported)
+	if err != nil {
+		return ProgramImportResult{}, &Rejection{http.StatusBadRequest, codeInvalidProgram, "The program is not valid: " + err.Error() + "."}
+	}
+
+	result := ProgramImportResult{DryRun: dryRun, Comparison: s.compareImportedRules(imported.Rules, sample)}
+	if dryRun {
+		result.Program = currentProgramState()
+		result.Program.Program = imported
+		return result, nil
+	}
+	update := ProgramUpdate{
+		Version:   request.Version,
+		ChangedBy: request.ChangedBy,
+		Reason:    request.Reason,
+		Program:   imported,
+	}
+	if update.Reason == "" {
+		update.Reason = "Imported version " + strconv.Itoa(signed.Version) + " exported at " + signed.ExportedAt.Format(time.RFC3339)
+	}
+	result.Program, rejection = s.UpdateProgram(update)
+	if rejection != nil {
+		return ProgramImportResult{}, rejection
+	}
+	return result, nil
+}
+
+/*
+	Below are the handlers for exporting and importing the program
+*/
+
+// Method to export the program as a signed document another environment can import
+func (s *Server) GetProgramExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	document, rejection := ExportProgram(s.Clock.Now().UTC())
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	json.NewEncoder(w).Encode(document)
+}
+
+// Method to import a program exported from another environment. With ?dryRun=true it is
+// only checked and scored against a ?sample= of recent receipts, without changing the
+// program.
+func (s *Server) PostProgramImport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	dryRun := query.Get("dryRun") == "true"
+	sample := defaultImportSample
+	if query.Get("sample") != "" {
+		var err error
+		sample, err = strconv.Atoi(query.Get("sample"))
+		if err != nil || sample < 0 {
+			WriteError(w, http.StatusBadRequest, codeInvalidQuery, "The sample parameter must be a number of receipts.")
+			return
+		}
+	}
+
+	var request ProgramImport
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidProgram, "The import is not valid JSON.")
+		return
+	}
+	request.ChangedBy = strings.TrimSpace(request.ChangedBy)
+	request.Reason = strings.TrimSpace(request.Reason)
+	result, rejection := s.ImportProgram(request, dryRun, sample)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
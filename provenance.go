@@ -0,0 +1,126 @@
+package receiptapi
+
+import (
+	"net"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Channels receipts come in through: straight to the API, or read by OCR or from an email
+// and then sent to it, from a partner's queue, or replayed from an archive
+const (
+	channelAPI    = "api"
+	channelOCR    = "ocr"
+	channelEmail  = "email"
+	channelQueue  = "queue"
+	channelImport = "import"
+)
+
+// Channels a submission to the API can say it came in through
+var submissionChannels = []string{channelAPI, channelOCR, channelEmail}
+
+// Where a receipt came from and how it was read, kept for debugging and fraud analysis.
+// Only admins see it.
+type Provenance struct {
+	Channel string `json:"channel"`
+
+	// Last characters of the API key it was submitted with, as partners list them
+	KeyHint string `json:"keyHint,omitempty"`
+
+	// Address and user agent of the client that submitted it
+	ClientIP  string `json:"clientIp,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+
+	// Format it was read from, and the build of the server that read it
+	Format        string `json:"format,omitempty"`
+	ParserVersion string `json:"parserVersion,omitempty"`
+
+	// Names of the OCR corrections made to it
+	Corrections []string `json:"corrections,omitempty"`
+
+	// Feature overrides it was validated and scored with, as an admin sent them
+	FeatureOverrides string `json:"featureOverrides,omitempty"`
+}
+
+// Build of the server, as the VCS revision it was built from, or "devel" when unknown
+var parserVersion = func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return "devel"
+}()
+
+// Returns the address of the client that made a request: the first X-Forwarded-For
+// address when TRUST_FORWARDED_FOR is set, or else the connection's
+func ClientIP(r *http.Request) string {
+	if config.TrustForwardedFor {
+		first, _, _ := strings.Cut(r.Header.Get("X-Forwarded-For"), ",")
+		if first = strings.TrimSpace(first); first != "" {
+			return first
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Returns the provenance of a receipt submitted to the API in a format, with the channel
+// its X-Submission-Channel header names
+func RequestProvenance(r *http.Request, format string) (*Provenance, *Rejection) {
+	channel := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Submission-Channel")))
+	if channel == "" {
+		channel = channelAPI
+	}
+	if !slices.Contains(submissionChannels, channel) {
+		message := "X-Submission-Channel must be one of " + strings.Join(submissionChannels, ", ") + "."
+		return nil, &Rejection{http.StatusBadRequest, codeInvalidChannel, message}
+	}
+	key := r.Header.Get("X-API-Key")
+	return &Provenance{
+		Channel:       channel,
+		KeyHint:       key[max(0, len(key)-4):],
+		ClientIP:      ClientIP(r),
+		UserAgent:     r.UserAgent(),
+		Format:        format,
+		ParserVersion: parserVersion,
+	}, nil
+}
+
+/*
+	Below are the handlers for admins to see stored receipts
+*/
+
+// Method to get a stored receipt in full, by its ID or short code, with its provenance,
+// or only the ?fields= given
+func (s *Server) GetAdminReceipt(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+	rejection := CheckAnyIDPrefix(id)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	fields, rejection := ParseFields(r.URL.Query())
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	receipt, found := s.Store.Find(s.Store.ResolveShortCode(id))
+	if !found {
+		WriteError(w, http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage)
+		return
+	}
+	WriteReceipt(w, receipt, fields)
+}
@@ -0,0 +1,228 @@
+package receiptapi
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of limit on how many submissions a partner makes
+const (
+	limitRate  = "rate_limit"
+	limitQuota = "daily_quota"
+)
+
+// Count of submissions turned away for going over a partner's rate limit or quota,
+// published at /admin/debug/vars
+var submissionsRateLimited = expvar.NewInt("submissions_rate_limited")
+
+// Event sent to a partner's webhook the first time in a window it uses the warning
+// percentage of its rate limit or quota, so it can slow down before submissions are
+// turned away
+type UsageWarningEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	Partner   string    `json:"partner"`
+	Limit     string    `json:"limit"`
+	Allowed   int64     `json:"allowed"`
+	Used      int64     `json:"used"`
+	ResetsAt  time.Time `json:"resetsAt"`
+}
+
+// Submissions counted in a window, and whether the partner was warned in it
+type usageWindow struct {
+	start  time.Time
+	used   int64
+	warned bool
+}
+
+// Where a partner stands against one of its limits after a submission
+type usageLimit struct {
+	kind     string
+	allowed  int64
+	used     int64
+	resetsAt time.Time
+
+	// Whether the submission took it past the warning percentage for the first time in
+	// the window
+	warn bool
+}
+
+// Windows of each partner's submissions, keyed by partner name and kind of limit
+var (
+	usageWindows = map[string]map[string]*usageWindow{}
+	usageMu      sync.Mutex
+)
+
+// Returns when the window of a kind of limit that now falls in started and ends
+func usagePeriod(kind string, now time.Time) (time.Time, time.Time) {
+	if kind == limitRate {
+		start := now.Truncate(time.Minute)
+		return start, start.Add(time.Minute)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// Returns the whole seconds from now until a time, rounded up, for a header
+func secondsUntil(t time.Time, now time.Time) string {
+	return strconv.FormatFloat(math.Ceil(t.Sub(now).Seconds()), 'f', 0, 64)
+}
+
+// Counts a submission against the partner's limits, unless it would go over one of them.
+// Returns where the partner stands against each limit its tier has, and whether the
+// submission was allowed.
+func countSubmission(partner Partner, now time.Time) ([]usageLimit, bool) {
+	allowed := map[string]int64{}
+	if limit, ok := config.RateLimitTiers[partner.RateLimitTier]; ok {
+		allowed[limitRate] = limit
+	}
+	if quota, ok := config.DailyQuotaTiers[partner.RateLimitTier]; ok {
+		allowed[limitQuota] = quota
+	}
+	if partner.Name == "" || len(allowed) == 0 {
+		return nil, true
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	windows := usageWindows[partner.Name]
+	if windows == nil {
+		windows = map[string]*usageWindow{}
+		usageWindows[partner.Name] = windows
+	}
+	limits := []usageLimit{}
+	admitted := true
+	for _, kind := range []string{limitRate, limitQuota} {
+		if _, ok := allowed[kind]; !ok {
+			continue
+		}
+		start, end := usagePeriod(kind, now)
+		window := windows[kind]
+		if window == nil || !window.start.Equal(start) {
+			window = &usageWindow{start: start}
+			windows[kind] = window
+		}
+		if window.used >= allowed[kind] {
+			admitted = false
+		}
+		limits = append(limits, usageLimit{kind: kind, allowed: allowed[kind], used: window.used, resetsAt: end})
+	}
+	if !admitted {
+		return limits, false
+	}
+
+	// Counted against every limit only once it's known none turns it away
+	for i := range limits {
+		window := windows[limits[i].kind]
+		window.used += 1
+		limits[i].used = window.used
+		if !window.warned && window.used*100 >= limits[i].allowed*int64(config.RateLimitWarningPercent) {
+			window.warned = true
+			limits[i].warn = true
+		}
+	}
+	return limits, true
+}
+
+// Sets the headers telling a partner where it stands against its limits: the limit, what
+// remains and the seconds until it resets, and a warning once it has used the warning
+// percentage
+func setUsageHeaders(header http.Header, limits []usageLimit, now time.Time) {
+	for _, limit := range limits {
+		prefix, period := "X-RateLimit-", "minute"
+		if limit.kind == limitQuota {
+			prefix, period = "X-Quota-", "day"
+		}
+		header.Set(prefix+"Limit", strconv.FormatInt(limit.allowed, 10))
+		header.Set(prefix+"Remaining", strconv.FormatInt(max(0, limit.allowed-limit.used), 10))
+		header.Set(prefix+"Reset", secondsUntil(limit.resetsAt, now))
+		if limit.used*100 >= limit.allowed*int64(config.RateLimitWarningPercent) {
+			header.Set(prefix+"Warning", fmt.Sprintf("%d of %d submissions this %s used", limit.used, limit.allowed, period))
+		}
+	}
+}
+
+// Tells a partner it has used the warning percentage of a limit: records it in the
+// partner's activity and sends an event to its webhook, if it has one
+func (s *Server) warnPartner(ctx context.Context, partner Partner, limit usageLimit, now time.Time) {
+	logApp.Warn("Partner is nearing a limit", "partner", partner.Name, "limit", limit.kind, "used", limit.used, "allowed", limit.allowed)
+	RecordPartnerActivity(partner.Name, PartnerActivity{Time: now, Event: "usage_warning", Detail: limit.kind})
+	if partner.WebhookURL == "" {
+		return
+	}
+
+	warning := UsageWarningEvent{
+		ID:        GenerateID(),
+		Type:      "partner.usage_warning",
+		CreatedAt: now,
+		Partner:   partner.Name,
+		Limit:     limit.kind,
+		Allowed:   limit.allowed,
+		Used:      limit.used,
+		ResetsAt:  limit.resetsAt,
+	}
+	body, err := json.Marshal(warning)
+	if err != nil {
+		logApp.Error("Could not encode usage warning", "error", err)
+		return
+	}
+	event := &WebhookEvent{
+		ID:        warning.ID,
+		Type:      warning.Type,
+		Partner:   partner.Name,
+		CreatedAt: now,
+		Status:    webhookPending,
+		Payload:   body,
+		Attempts:  []WebhookAttempt{},
+	}
+	if trace, ok := TraceFrom(ctx); ok {
+		event.TraceParent = trace.Traceparent()
+	}
+	s.sendWebhook(event)
+}
+
+// Answers 429 with a Retry-After header instead of calling next when the partner has made
+// as many submissions as its tier allows this minute or day. Otherwise the submission is
+// counted, and the response tells the partner where it stands.
+func (s *Server) LimitRate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Unknown keys are turned away by the handler
+		partner, ok := GetPartner(r)
+		if !ok {
+			next(w, r)
+			return
+		}
+		now := s.Clock.Now().UTC()
+		limits, admitted := countSubmission(partner, now)
+		setUsageHeaders(w.Header(), limits, now)
+		if !admitted {
+			submissionsRateLimited.Add(1)
+			CountRejection(codeRateLimited, now)
+			RecordPartnerActivity(partner.Name, PartnerActivity{Time: now, Event: "receipt_rejected", Detail: codeRateLimited})
+			var retry time.Time
+			for _, limit := range limits {
+				if limit.used >= limit.allowed && limit.resetsAt.After(retry) {
+					retry = limit.resetsAt
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", secondsUntil(retry, now))
+			WriteError(w, http.StatusTooManyRequests, codeRateLimited, "The partner has made as many submissions as its rate limit tier allows; try again once it resets.")
+			return
+		}
+		for _, limit := range limits {
+			if limit.warn {
+				s.warnPartner(r.Context(), partner, limit, now)
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,117 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Forgets every partner's usage for a test, and when it ends
+func withoutUsage(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		usageMu.Lock()
+		usageWindows = map[string]map[string]*usageWindow{}
+		usageMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestUsagePeriod(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 30, 45, 0, time.UTC)
+	tests := []struct {
+		kind      string
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{limitRate, time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC), time.Date(2024, 5, 1, 12, 31, 0, 0, time.UTC)},
+		{limitQuota, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		start, end := usagePeriod(test.kind, now)
+		if !start.Equal(test.wantStart) || !end.Equal(test.wantEnd) {
+			t.Errorf("usagePeriod(%s) = %s, %s, want %s, %s", test.kind, start, end, test.wantStart, test.wantEnd)
+		}
+	}
+}
+
+func TestCountSubmission(t *testing.T) {
+	withoutUsage(t)
+	withConfig(t, func(config *Config) {
+		config.RateLimitTiers = map[string]int64{"standard": 2}
+		config.DailyQuotaTiers = map[string]int64{"standard": 3}
+		config.RateLimitWarningPercent = 50
+	})
+	partner := Partner{Name: "acme", RateLimitTier: "standard"}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		at        time.Duration
+		admitted  bool
+		rateUsed  int64
+		quotaUsed int64
+		warned    []string
+	}{
+		{0, true, 1, 1, []string{limitRate}},
+		{time.Second, true, 2, 2, []string{limitQuota}},
+		{2 * time.Second, false, 2, 2, nil},
+		{time.Minute, true, 1, 3, []string{limitRate}},
+		{time.Minute + time.Second, false, 1, 3, nil},
+	}
+	for i, step := range steps {
+		limits, admitted := countSubmission(partner, start.Add(step.at))
+		var warned []string
+		for _, limit := range limits {
+			if limit.warn {
+				warned = append(warned, limit.kind)
+			}
+		}
+		if admitted != step.admitted || len(limits) != 2 || limits[0].used != step.rateUsed || limits[1].used != step.quotaUsed ||
+			len(warned) != len(step.warned) || len(warned) > 0 && warned[0] != step.warned[0] {
+			t.Errorf("submission %d: %+v, admitted %v, want admitted %v with %d and %d used, warning %v",
+				i+1, limits, admitted, step.admitted, step.rateUsed, step.quotaUsed, step.warned)
+		}
+	}
+
+	// Requests without a key and tiers without limits aren't counted
+	for _, partner := range []Partner{{}, {Name: "globex", RateLimitTier: "unlimited"}} {
+		limits, admitted := countSubmission(partner, start)
+		if !admitted || limits != nil {
+			t.Errorf("countSubmission(%+v) = %+v, %v, want no limits", partner, limits, admitted)
+		}
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	withoutUsage(t)
+	withoutPartners(t)
+	withConfig(t, func(config *Config) {
+		config.RateLimitTiers = map[string]int64{"standard": 1}
+		config.RateLimitWarningPercent = 100
+	})
+	partners["acme-key"] = Partner{Name: "acme", Key: "acme-key", RateLimitTier: "standard"}
+	s := New(WithClock(FixedClock{time.Date(2024, 5, 1, 12, 0, 15, 0, time.UTC)}))
+	handler := s.LimitRate(func(w http.ResponseWriter, r *http.Request) {})
+	submit := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/receipts/process", nil)
+		r.Header.Set("X-API-Key", "acme-key")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	w := submit()
+	if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "0" || w.Header().Get("X-RateLimit-Reset") != "45" ||
+		w.Header().Get("X-RateLimit-Warning") == "" {
+		t.Errorf("first submission = %d with %v, want it allowed with none remaining and a warning", w.Code, w.Header())
+	}
+	w = submit()
+	var response ErrorResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusTooManyRequests || response.Code != codeRateLimited || w.Header().Get("Retry-After") != "45" {
+		t.Errorf("second submission = %d, %q, Retry-After %q, want 429 %s after 45 seconds",
+			w.Code, response.Code, w.Header().Get("Retry-After"), codeRateLimited)
+	}
+}
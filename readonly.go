@@ -0,0 +1,112 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Whether an admin has made the server read-only, why and since when
+var (
+	readOnlyManual bool
+	readOnlyReason string
+	readOnlySince  time.Time
+	readOnlyMu     sync.Mutex
+)
+
+// Whether the server refuses changes to receipts, and why. It is read-only while an admin
+// says so, and by itself while changes can't be saved to the data file or a fallback.
+type ReadOnlyResponse struct {
+	ReadOnly bool       `json:"readOnly"`
+	Reason   string     `json:"reason,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+
+	// Set when changes can't be saved, with how many bytes of them are waiting
+	Automatic    bool `json:"automatic,omitempty"`
+	UnsavedBytes int  `json:"unsavedBytes,omitempty"`
+
+	// Submissions waiting in the spool to be processed
+	Spooled int `json:"spooled,omitempty"`
+}
+
+// Request to make the server read-only, or writable again
+type ReadOnlyRequest struct {
+	ReadOnly *bool  `json:"readOnly"`
+	Reason   string `json:"reason"`
+}
+
+// Makes the server read-only, or writable unless changes can't be saved
+func SetReadOnly(readOnly bool, reason string, now time.Time) {
+	readOnlyMu.Lock()
+	defer readOnlyMu.Unlock()
+	if readOnly && !readOnlyManual {
+		readOnlySince = now
+	}
+	readOnlyManual, readOnlyReason = readOnly, reason
+	if !readOnly {
+		readOnlyReason = ""
+	}
+}
+
+// Returns whether the server refuses changes to receipts, and why
+func (s *Server) ReadOnlyStatus() ReadOnlyResponse {
+	var status ReadOnlyResponse
+	unsaved, since := s.Store.Unsaved()
+	if unsaved > 0 && !s.Store.FailedOver() {
+		since = since.UTC()
+		status = ReadOnlyResponse{ReadOnly: true, Reason: "changes can't be saved to the data file", Since: &since, Automatic: true, UnsavedBytes: unsaved}
+	}
+	readOnlyMu.Lock()
+	if readOnlyManual {
+		since := readOnlySince.UTC()
+		status.ReadOnly, status.Reason, status.Since = true, readOnlyReason, &since
+		if status.Reason == "" {
+			status.Reason = "the server was made read-only"
+		}
+	}
+	readOnlyMu.Unlock()
+	status.Spooled = SpooledCount()
+	return status
+}
+
+// Answers 503 with a Retry-After header instead of calling next while the server is
+// read-only
+func (s *Server) RejectWhenReadOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := s.ReadOnlyStatus()
+		if !status.ReadOnly {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", strconv.Itoa(config.ReadOnlyRetryAfterSeconds))
+		WriteError(w, http.StatusServiceUnavailable, codeReadOnly, "Receipts can't be changed right now: "+status.Reason+". Points can still be read; try again later.")
+	}
+}
+
+/*
+	Below are the handlers for reading and changing the read-only mode at runtime
+*/
+
+// Method to tell whether the server is read-only and why
+func (s *Server) GetReadOnly(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.ReadOnlyStatus())
+}
+
+// Method to make the server read-only, with an optional reason shown to clients, or
+// writable again; responds as GetReadOnly does
+func (s *Server) SetReadOnlyMode(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request ReadOnlyRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.ReadOnly == nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidReadOnly, "The body must be a JSON object with readOnly true or false, e.g. {\"readOnly\": true, \"reason\": \"maintenance\"}.")
+		return
+	}
+	SetReadOnly(*request.ReadOnly, request.Reason, s.Clock.Now())
+	logApp.Warn("Changed read-only mode", "readOnly", *request.ReadOnly, "reason", request.Reason)
+	s.GetReadOnly(w, r)
+}
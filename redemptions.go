@@ -0,0 +1,400 @@
+package receiptapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Longest a hold can be asked to last
+const maxHoldTTL = 7 * 24 * time.Hour
+
+// Statuses of a redemption: points are held until captured, released by the caller, or
+// released when the hold expires
+const (
+	redemptionHeld     = "held"
+	redemptionCaptured = "captured"
+	redemptionReleased = "released"
+	redemptionExpired  = "expired"
+)
+
+// Points a fulfillment system redeems for a user in two steps: they are held first, then
+// the hold is captured once the reward is sent, or released if it isn't
+type Redemption struct {
+	ID     string `json:"id"`
+	UserID string `json:"userId"`
+	Points int64  `json:"points"`
+	Status string `json:"status"`
+
+	// Caller's own ID for the redemption, e.g. an order number; a user's hold with the
+	// same reference is only placed once
+	Reference string `json:"reference,omitempty"`
+
+	// Partner that placed the hold, which can settle it as well as the user can
+	Partner string `json:"partner,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+
+	// When the hold is released if it isn't captured first
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// When the hold was captured, released or expired
+	SettledAt *time.Time `json:"settledAt,omitempty"`
+
+	// Points given back when the hold was captured for less than it held, as when a
+	// basket changes at checkout
+	ReleasedPoints int64 `json:"releasedPoints,omitempty"`
+}
+
+// Request to hold a user's points
+type HoldRequest struct {
+	Points     int64  `json:"points"`
+	Reference  string `json:"reference"`
+	TTLSeconds int    `json:"ttlSeconds"`
+}
+
+// Optional request to capture fewer points than a hold holds; the rest are released
+type CaptureRequest struct {
+	Points int64 `json:"points"`
+}
+
+// A user's points: those awarded for their receipts, sent to and by them including
+// fees, those held and redeemed, and what is left to redeem
+type PointsBalance struct {
+	UserID    string `json:"userId"`
+	Earned    int64  `json:"earned"`
+	Held      int64  `json:"held"`
+	Redeemed  int64  `json:"redeemed"`
+	Available int64  `json:"available"`
+
+	TransferredIn  int64 `json:"transferredIn"`
+	TransferredOut int64 `json:"transferredOut"`
+}
+
+// Redemptions keyed by ID
+var redemptions = map[string]*Redemption{}
+
+// Guards redemptions, transfers and their log files, so a balance can't change between
+// being checked and points being held or sent against it
+var pointsMu sync.Mutex
+
+// Log file every change to a redemption is appended to, if one is open
+var redemptionLog *os.File
+
+// Loads redemptions from a log file, then keeps it open to append to. Each line holds a
+// redemption as JSON; a redemption appears again each time it changes, and its last line
+// wins.
+func OpenRedemptionLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	pointsMu.Lock()
+	defer pointsMu.Unlock()
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line += 1
+			var redemption Redemption
+			err = json.Unmarshal(scanner.Bytes(), &redemption)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			redemptions[redemption.ID] = &redemption
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+	}
+
+	redemptionLog, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	return err
+}
+
+// Appends a redemption as it is now to the log file, if one is open, syncing it to disk
+// before the change counts; the caller must hold pointsMu
+func persistRedemption(redemption *Redemption) error {
+	if redemptionLog == nil {
+		return nil
+	}
+	line, err := json.Marshal(redemption)
+	if err != nil {
+		return err
+	}
+	_, err = redemptionLog.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return redemptionLog.Sync()
+}
+
+// Releases holds that expired before now; the caller must hold pointsMu
+func expireHolds(now time.Time) {
+	for _, redemption := range redemptions {
+		if redemption.Status == redemptionHeld && !now.Before(redemption.ExpiresAt) {
+			redemption.Status = redemptionExpired
+			settled := redemption.ExpiresAt
+			redemption.SettledAt = &settled
+			err := persistRedemption(redemption)
+			if err != nil {
+				logApp.Error("Could not write redemption log", "error", err)
+			}
+		}
+	}
+}
+
+// Returns a user's points; the caller must hold pointsMu and have expired holds
+func (s *Server) pointsBalance(userID string) PointsBalance {
+	balance := PointsBalance{UserID: userID}
+	for _, receipt := range s.Store.All() {
+		if receipt.UserID == userID && !receipt.Sandbox {
+			balance.Earned += AwardedPoints(receipt)
+		}
+	}
+	for _, redemption := range redemptions {
+		switch {
+		case redemption.UserID != userID:
+		case redemption.Status == redemptionHeld:
+			balance.Held += redemption.Points
+		case redemption.Status == redemptionCaptured:
+			balance.Redeemed += redemption.Points
+		}
+	}
+	balance.TransferredIn, balance.TransferredOut = transferredPoints(userID)
+	balance.Available = balance.Earned + balance.TransferredIn - balance.TransferredOut - balance.Held - balance.Redeemed
+	return balance
+}
+
+// Places a hold on a user's points for a partner, or returns the hold already placed
+// with the same reference. Returns whether a new hold was placed.
+func (s *Server) HoldPoints(userID string, partner string, request HoldRequest) (Redemption, bool, *Rejection) {
+	ttl := time.Duration(config.RedemptionHoldTTLSeconds) * time.Second
+	if request.TTLSeconds != 0 {
+		ttl = time.Duration(request.TTLSeconds) * time.Second
+	}
+	if request.Points <= 0 || ttl <= 0 || ttl > maxHoldTTL {
+		message := fmt.Sprintf("A hold needs a positive number of points and a ttlSeconds of at most %d.", int(maxHoldTTL.Seconds()))
+		return Redemption{}, false, &Rejection{http.StatusBadRequest, codeInvalidRedemption, message}
+	}
+
+	now := s.Clock.Now().UTC()
+	pointsMu.Lock()
+	defer pointsMu.Unlock()
+	expireHolds(now)
+	if request.Reference != "" {
+		for _, redemption := range redemptions {
+			if redemption.UserID == userID && redemption.Reference == request.Reference {
+				return *redemption, false, nil
+			}
+		}
+	}
+	balance := s.pointsBalance(userID)
+	if balance.Available < request.Points {
+		message := fmt.Sprintf("The user has %d points available, fewer than the %d asked for.", balance.Available, request.Points)
+		return Redemption{}, false, &Rejection{http.StatusConflict, codeInsufficientPoints, message}
+	}
+
+	redemption := &Redemption{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Points:    request.Points,
+		Status:    redemptionHeld,
+		Reference: request.Reference,
+		Partner:   partner,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	err := persistRedemption(redemption)
+	if err != nil {
+		logApp.Error("Could not write redemption log", "error", err)
+		return Redemption{}, false, &Rejection{http.StatusInternalServerError, codeInternal, "The hold could not be saved."}
+	}
+	redemptions[redemption.ID] = redemption
+	return *redemption, true, nil
+}
+
+// Captures or releases a held redemption for its caller, capturing only the given points
+// when they are fewer than it holds. Settling it the same way again changes nothing, so a
+// caller can safely retry.
+func (s *Server) SettleRedemption(id string, caller RedemptionCaller, status string, points int64) (Redemption, *Rejection) {
+	now := s.Clock.Now().UTC()
+	pointsMu.Lock()
+	defer pointsMu.Unlock()
+	expireHolds(now)
+	redemption, ok := redemptions[id]
+	if !ok {
+		return Redemption{}, &Rejection{http.StatusNotFound, codeRedemptionNotFound, "No redemption found for that ID."}
+	}
+	if !caller.Owns(*redemption) {
+		return Redemption{}, &Rejection{http.StatusForbidden, codeWrongUser, "The redemption belongs to another partner and user."}
+	}
+	if redemption.Status == status && (points == 0 || points == redemption.Points) {
+		return *redemption, nil
+	}
+	if redemption.Status == status {
+		message := fmt.Sprintf("The redemption was already %s for %d points.", status, redemption.Points)
+		return Redemption{}, &Rejection{http.StatusConflict, codeRedemptionSettled, message}
+	}
+	if redemption.Status != redemptionHeld {
+		return Redemption{}, &Rejection{http.StatusConflict, codeRedemptionSettled, "The redemption was already " + redemption.Status + "."}
+	}
+	if points < 0 || points > redemption.Points {
+		message := fmt.Sprintf("A capture can take at most the %d points held.", redemption.Points)
+		return Redemption{}, &Rejection{http.StatusBadRequest, codeInvalidRedemption, message}
+	}
+
+	settled := *redemption
+	settled.Status = status
+	settled.SettledAt = &now
+	if points > 0 && points < redemption.Points {
+		settled.ReleasedPoints = redemption.Points - points
+		settled.Points = points
+	}
+	err := persistRedemption(&settled)
+	if err != nil {
+		logApp.Error("Could not write redemption log", "error", err)
+		return Redemption{}, &Rejection{http.StatusInternalServerError, codeInternal, "The redemption could not be saved."}
+	}
+	*redemption = settled
+	return settled, nil
+}
+
+// Who a redemption is settled by: the partner whose API key the request has, and the
+// user its X-User-ID header names, if any
+type RedemptionCaller struct {
+	Partner string
+	UserID  string
+}
+
+// Returns who a request for a redemption is made by, or 401 for a request without a
+// known partner's API key. Support staff impersonating a user make it as that user.
+func redemptionCaller(r *http.Request) (RedemptionCaller, *Rejection) {
+	if user := ImpersonatedUser(r.Context()); user != "" {
+		return RedemptionCaller{UserID: user}, nil
+	}
+	partner, known := GetPartner(r)
+	if !known || partner.Name == "" {
+		return RedemptionCaller{}, &Rejection{http.StatusUnauthorized, codeUnauthorized, "Redemptions can only be read or settled with a partner's X-API-Key."}
+	}
+	return RedemptionCaller{Partner: partner.Name, UserID: strings.TrimSpace(r.Header.Get("X-User-ID"))}, nil
+}
+
+// Returns whether the caller can read or settle a redemption: the partner that placed
+// it, or the user it is for
+func (caller RedemptionCaller) Owns(redemption Redemption) bool {
+	return (redemption.Partner != "" && caller.Partner == redemption.Partner) || (caller.UserID != "" && caller.UserID == redemption.UserID)
+}
+
+/*
+	Below are the handlers for balances and redemptions
+*/
+
+// Method to get a user's points balance
+func (s *Server) GetPointsBalance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	pointsMu.Lock()
+	expireHolds(s.Clock.Now().UTC())
+	balance := s.pointsBalance(mux.Vars(r)["id"])
+	pointsMu.Unlock()
+	json.NewEncoder(w).Encode(balance)
+}
+
+// Method to hold a user's points for a redemption, made for the user with RequireUser
+func (s *Server) CreateHold(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request HoldRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidRedemption, "The hold request is not valid JSON.")
+		return
+	}
+	request.Reference = strings.TrimSpace(request.Reference)
+	partner, _ := GetPartner(r)
+	redemption, created, rejection := s.HoldPoints(mux.Vars(r)["id"], partner.Name, request)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(redemption)
+}
+
+// Method to get a redemption, for the partner that placed it or the user it is for
+func (s *Server) GetRedemption(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	caller, rejection := redemptionCaller(r)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	pointsMu.Lock()
+	expireHolds(s.Clock.Now().UTC())
+	redemption, ok := redemptions[mux.Vars(r)["id"]]
+	var found Redemption
+	if ok {
+		found = *redemption
+	}
+	pointsMu.Unlock()
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeRedemptionNotFound, "No redemption found for that ID.")
+		return
+	}
+	if !caller.Owns(found) {
+		WriteError(w, http.StatusForbidden, codeWrongUser, "The redemption belongs to another partner and user.")
+		return
+	}
+	json.NewEncoder(w).Encode(found)
+}
+
+// Method to capture a held redemption, redeeming its points for good, or only the fewer
+// points given in the body
+func (s *Server) CaptureRedemption(w http.ResponseWriter, r *http.Request) {
+	var request CaptureRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil && !errors.Is(err, io.EOF) {
+		w.Header().Set("Content-Type", "application/json")
+		WriteError(w, http.StatusBadRequest, codeInvalidRedemption, "The capture request is not valid JSON.")
+		return
+	}
+	s.writeSettlement(w, r, redemptionCaptured, request.Points)
+}
+
+// Method to release a held redemption, making its points available again
+func (s *Server) ReleaseRedemption(w http.ResponseWriter, r *http.Request) {
+	s.writeSettlement(w, r, redemptionReleased, 0)
+}
+
+// Settles the redemption named in the path for the caller and writes it as it is now
+func (s *Server) writeSettlement(w http.ResponseWriter, r *http.Request, status string, points int64) {
+	w.Header().Set("Content-Type", "application/json")
+	caller, rejection := redemptionCaller(r)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	redemption, rejection := s.SettleRedemption(mux.Vars(r)["id"], caller, status, points)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	json.NewEncoder(w).Encode(redemption)
+}
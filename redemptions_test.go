@@ -0,0 +1,70 @@
+package receiptapi
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestSettleRedemptionCaller(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller RedemptionCaller
+		status int
+	}{
+		{name: "partner that placed the hold", caller: RedemptionCaller{Partner: "acme"}},
+		{name: "user the hold is for", caller: RedemptionCaller{Partner: "other", UserID: "alice"}},
+		{name: "another partner", caller: RedemptionCaller{Partner: "other"}, status: http.StatusForbidden},
+		{name: "another partner's user", caller: RedemptionCaller{Partner: "other", UserID: "bob"}, status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newLedgerServer(t)
+			hold, _, rejection := s.HoldPoints("alice", "acme", HoldRequest{Points: 30})
+			if rejection != nil {
+				t.Fatalf("HoldPoints() rejection = %+v", rejection)
+			}
+			captured, rejection := s.SettleRedemption(hold.ID, test.caller, redemptionCaptured, 0)
+			if test.status != 0 {
+				if rejection == nil || rejection.Status != test.status {
+					t.Errorf("SettleRedemption() rejection = %+v, want %d", rejection, test.status)
+				}
+				return
+			}
+			if rejection != nil || captured.Status != redemptionCaptured {
+				t.Errorf("SettleRedemption() = %+v, %+v, want it captured", captured, rejection)
+			}
+		})
+	}
+}
+
+func TestRedemptionLog(t *testing.T) {
+	s := newLedgerServer(t)
+	path := filepath.Join(t.TempDir(), "redemptions.jsonl")
+	closeLog := func() {
+		if redemptionLog != nil {
+			redemptionLog.Close()
+			redemptionLog = nil
+		}
+	}
+	t.Cleanup(closeLog)
+	err := OpenRedemptionLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hold, _, _ := s.HoldPoints("alice", "acme", HoldRequest{Points: 30, Reference: "order-1"})
+	s.SettleRedemption(hold.ID, RedemptionCaller{Partner: "acme"}, redemptionCaptured, 20)
+
+	closeLog()
+	resetLedger()
+	err = OpenRedemptionLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pointsMu.Lock()
+	loaded := *redemptions[hold.ID]
+	pointsMu.Unlock()
+	if loaded.Status != redemptionCaptured || loaded.Points != 20 || loaded.ReleasedPoints != 10 || loaded.Partner != "acme" {
+		t.Errorf("loaded redemption = %+v, want 20 points captured for acme with 10 released", loaded)
+	}
+}
@@ -0,0 +1,251 @@
+package receiptapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Receipt read from an archive, with the line it starts on
+type archivedReceipt struct {
+	Line    int
+	Receipt Receipt
+
+	// Set if the record couldn't be read as a receipt
+	Err error
+}
+
+// Replays an archive of receipts, as NDJSON like the data file and backups or as CSV
+// like exports, through the same validation and scoring as submitted receipts. Prints
+// what happened to each record.
+func RunReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	partnerName := flags.String("partner", "", "replay as this partner instead of the one stored with each receipt")
+	originalTime := flags.Bool("original-time", false, "check each receipt as of its purchase date instead of today")
+	dryRun := flags.Bool("dry-run", false, "report what would happen without storing anything")
+	mergeItems := flags.Bool("merge-items", false, "merge receipts with the same retailer, purchase date and time into one")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("replay takes the path of one archive")
+	}
+	path := flags.Arg(0)
+	err = Setup()
+	if err != nil {
+		return err
+	}
+	if *partnerName != "" {
+		if _, ok := FindPartner(*partnerName); !ok {
+			return fmt.Errorf("unknown partner %q", *partnerName)
+		}
+	}
+	archive, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	var records []archivedReceipt
+	format := "ndjson"
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = "csv"
+		records, err = ReadReceiptsCSV(archive)
+	} else {
+		records, err = ReadReceiptsNDJSON(archive)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", path, err)
+	}
+	if *mergeItems {
+		read := len(records)
+		records = MergePurchases(records)
+		fmt.Println("Merged", read, "records into", len(records), "receipts")
+	}
+
+	stored, err := openForCommand()
+	if err != nil {
+		return err
+	}
+	defer UnlockDataFile(config.DataFile)
+
+	s := New()
+	s.Store.Replace(stored)
+	accepted, duplicates, rejected := 0, 0, 0
+	for _, record := range records {
+		if record.Err != nil {
+			fmt.Printf("line %d: unreadable: %v\n", record.Line, record.Err)
+			rejected += 1
+			continue
+		}
+
+		receipt := record.Receipt
+		name := receipt.Partner
+		if *partnerName != "" {
+			name = *partnerName
+		}
+		partner, _ := FindPartner(name)
+
+		// Scored afresh, so nothing derived from the earlier submission is kept
+		receipt.ShortCode = ""
+		receipt.Review = nil
+		receipt.RejectionReason = ""
+		receipt.Provenance = &Provenance{Channel: channelImport, Format: format, ParserVersion: parserVersion}
+
+		s.Clock = SystemClock{}
+		if *originalTime {
+			s.Clock = purchaseClock(receipt)
+		}
+
+		before := s.Store.Len()
+		processed, _, rejection := s.ProcessReceipt(context.Background(), receipt, partner)
+		switch {
+		case rejection != nil:
+			fmt.Printf("line %d: rejected: %s: %s\n", record.Line, rejection.Code, rejection.Message)
+			rejected += 1
+		case s.Store.Len() == before:
+			fmt.Printf("line %d: duplicate of %s\n", record.Line, processed.ID)
+			duplicates += 1
+		default:
+			fmt.Printf("line %d: accepted %s as %s, %d points\n", record.Line, processed.ID, processed.Status, processed.Points)
+			accepted += 1
+		}
+	}
+
+	summary := fmt.Sprintf("%d accepted, %d duplicates and %d rejected of %d records", accepted, duplicates, rejected, len(records))
+	if *dryRun {
+		fmt.Println("Would have replayed", summary)
+		return nil
+	}
+	err = SaveReceipts(config.DataFile, s.Store.All())
+	if err != nil {
+		return err
+	}
+	fmt.Println("Replayed", summary)
+	return nil
+}
+
+// Returns a clock stopped at the start of a receipt's purchase date, so date rules judge
+// it as they would have when it was bought. Receipts without a readable date get the
+// system clock, and are rejected as usual.
+func purchaseClock(receipt Receipt) Clock {
+	// Reads the combined field on a copy; the pipeline checks it properly
+	ApplyPurchaseDateTime(&receipt)
+	purchased, err := ParseDate(SystemClock{}, receipt.PurchaseDate)
+	if err != nil {
+		return SystemClock{}
+	}
+	return FixedClock{purchased}
+}
+
+// Merges receipts with the same retailer, purchase date and time into the first of them,
+// appending their items in order, for archives that give each item of a purchase a
+// receipt of its own. The first receipt's ID and total are kept. Unreadable records are
+// left as they are.
+func MergePurchases(records []archivedReceipt) []archivedReceipt {
+	merged := []archivedReceipt{}
+	purchases := map[string]int{}
+	for _, record := range records {
+		if record.Err != nil {
+			merged = append(merged, record)
+			continue
+		}
+		receipt := record.Receipt
+		key := strings.ToLower(strings.TrimSpace(receipt.Retailer)) + "\x00" + strings.TrimSpace(receipt.PurchaseDate) + "\x00" + strings.TrimSpace(receipt.PurchaseTime)
+		i, seen := purchases[key]
+		if !seen {
+			purchases[key] = len(merged)
+			merged = append(merged, record)
+			continue
+		}
+		first := &merged[i].Receipt
+		// Replace the items rather than appending to them, since they may be shared
+		first.Items = append(slices.Clip(first.Items), receipt.Items...)
+	}
+	return merged
+}
+
+// Reads receipts stored one per line as JSON, as in the data file and backups. A
+// receipt changed after it was stored appears again; each line is replayed as it was.
+func ReadReceiptsNDJSON(r io.Reader) ([]archivedReceipt, error) {
+	var records []archivedReceipt
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		record := archivedReceipt{Line: line}
+		record.Err = json.Unmarshal(scanner.Bytes(), &record.Receipt)
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// Reads receipts from CSV in the export format, where each receipt spans consecutive
+// rows with the same ID, one row per item. The points column is ignored.
+func ReadReceiptsCSV(r io.Reader) ([]archivedReceipt, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range exportHeader {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	var records []archivedReceipt
+	line := 1
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line += 1
+		field := func(name string) string {
+			return row[columns[name]]
+		}
+		item := Item{ShortDescription: field("shortDescription"), Price: field("price")}
+
+		last := len(records) - 1
+		if last >= 0 && records[last].Receipt.ID == field("id") {
+			records[last].Receipt.Items = append(records[last].Receipt.Items, item)
+			continue
+		}
+		records = append(records, archivedReceipt{
+			Line: line,
+			Receipt: Receipt{
+				ID:           field("id"),
+				Retailer:     field("retailer"),
+				PurchaseDate: field("purchaseDate"),
+				PurchaseTime: field("purchaseTime"),
+				Total:        field("total"),
+				Items:        []Item{item},
+			},
+		})
+	}
+}
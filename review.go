@@ -0,0 +1,187 @@
+package receiptapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Decisions a reviewer can make about a flagged receipt
+const (
+	decisionApproved = "approved"
+	decisionRejected = "rejected"
+)
+
+// Record of a person reviewing a flagged receipt
+type Review struct {
+	Reviewer   string    `json:"reviewer"`
+	Decision   string    `json:"decision"`
+	Reason     string    `json:"reason,omitempty"`
+	ReviewedAt time.Time `json:"reviewedAt"`
+}
+
+// Key the authenticated reviewer is kept under in a context
+type reviewerKey struct{}
+
+// Request to reject a flagged receipt
+type RejectRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Returns the points a receipt has been awarded; receipts waiting for review or
+// rejected by a reviewer have none
+func AwardedPoints(receipt Receipt) int64 {
+	if receipt.Status == statusSubmitted || receipt.Status == statusRejected {
+		return 0
+	}
+	return receipt.Points
+}
+
+// Returns the reviewer a request is made by: the one whose token from REVIEWERS it has as
+// a bearer token or, with the admin token, the one its X-Reviewer header names. Returns
+// 401 for any other token and 403 if neither reviewers nor an admin token are configured.
+func reviewerFor(r *http.Request) (string, *Rejection) {
+	if len(config.Reviewers) == 0 && adminToken() == "" {
+		return "", &Rejection{http.StatusForbidden, codeUnauthorized, "Reviews need REVIEWERS or ADMIN_TOKEN to be set."}
+	}
+	given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if found {
+		for name, token := range config.Reviewers {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				return name, nil
+			}
+		}
+	}
+	if checkAdminToken(r) != nil {
+		return "", &Rejection{http.StatusUnauthorized, codeUnauthorized, "The Authorization header must hold a reviewer's token or the admin token as a bearer token."}
+	}
+	reviewer := strings.TrimSpace(r.Header.Get("X-Reviewer"))
+	if reviewer == "" {
+		return "", &Rejection{http.StatusBadRequest, codeInvalidReview, "The X-Reviewer header is required with the admin token."}
+	}
+	return reviewer, nil
+}
+
+// Answers 401 instead of calling next unless the request is made by a reviewer, and passes
+// the reviewer on in its context
+func RequireReviewer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reviewer, rejection := reviewerFor(r)
+		if rejection != nil {
+			w.Header().Set("Content-Type", "application/json")
+			if rejection.Status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			WriteRejection(w, rejection)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), reviewerKey{}, reviewer)))
+	}
+}
+
+// Requires a reviewer for every route of a router, as RequireReviewer does for one
+func ReviewersOnly(next http.Handler) http.Handler {
+	return RequireReviewer(next.ServeHTTP)
+}
+
+// Returns the reviewer RequireReviewer passed on in the context, empty if there is none
+func ReviewerFrom(ctx context.Context) string {
+	reviewer, _ := ctx.Value(reviewerKey{}).(string)
+	return reviewer
+}
+
+// Method to list flagged receipts waiting for review, oldest first, with only the
+// ?fields= given
+func (s *Server) ListReviewQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fields, rejection := ParseFields(r.URL.Query())
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	pending := []Receipt{}
+	for _, receipt := range s.Store.All() {
+		if receipt.Flagged && receipt.Status == statusSubmitted {
+			// Reviewers don't see where receipts came from
+			receipt.Provenance = nil
+			pending = append(pending, receipt)
+		}
+	}
+
+	WriteReceiptList(w, pending, fields)
+}
+
+// Method to approve a flagged receipt, awarding its points
+func (s *Server) ApproveReceipt(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	s.reviewReceipt(w, r, decisionApproved, "")
+}
+
+// Method to reject a flagged receipt with a reason
+func (s *Server) RejectReceipt(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request RejectRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Reason == "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidReview, "A reason is required to reject a receipt.")
+		return
+	}
+	s.reviewReceipt(w, r, decisionRejected, request.Reason)
+}
+
+// Records a reviewer's decision on a receipt waiting for review and writes the result
+func (s *Server) reviewReceipt(w http.ResponseWriter, r *http.Request, decision string, reason string) {
+	reviewer := ReviewerFrom(r.Context())
+	if reviewer == "" {
+		WriteError(w, http.StatusUnauthorized, codeUnauthorized, "Reviews must be made by an authenticated reviewer.")
+		return
+	}
+	id := mux.Vars(r)["id"]
+	rejection := CheckAnyIDPrefix(id)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+
+	pending := false
+	_, span := StartSpan(r.Context(), "storage.modify")
+	receipt, found := s.Store.Modify(id, func(receipt *Receipt) bool {
+		pending = receipt.Status == statusSubmitted
+		if !pending {
+			return false
+		}
+
+		receipt.Review = &Review{
+			Reviewer:   reviewer,
+			Decision:   decision,
+			Reason:     reason,
+			ReviewedAt: s.Clock.Now().UTC(),
+		}
+		if decision == decisionApproved {
+			receipt.Status = statusProcessed
+		} else {
+			receipt.Status = statusRejected
+			receipt.RejectionReason = reason
+		}
+		return true
+	})
+	span.End(logStorage, "receiptId", id)
+	if !found {
+		WriteError(w, http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage)
+		return
+	}
+	if !pending {
+		WriteError(w, http.StatusConflict, codeNotPendingReview, "The receipt is not waiting for review.")
+		return
+	}
+	if decision == decisionApproved && !receipt.Sandbox && receipt.ProcessedAt != nil {
+		AdjustPointsBudget(*receipt.ProcessedAt, AwardedPoints(receipt))
+	}
+	s.Announce(r.Context(), "receipt."+decision, receipt)
+	json.NewEncoder(w).Encode(receipt)
+}
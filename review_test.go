@@ -0,0 +1,158 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequireReviewer(t *testing.T) {
+	tests := []struct {
+		name          string
+		reviewers     map[string]string
+		adminToken    string
+		authorization string
+		xReviewer     string
+		status        int
+		reviewer      string
+	}{
+		{name: "nothing configured", authorization: "Bearer x", status: http.StatusForbidden},
+		{name: "reviewer's token", reviewers: map[string]string{"ana": "ana-token", "bo": "bo-token"}, authorization: "Bearer bo-token", status: http.StatusOK, reviewer: "bo"},
+		{name: "reviewer can't pick a name", reviewers: map[string]string{"ana": "ana-token"}, authorization: "Bearer ana-token", xReviewer: "bo", status: http.StatusOK, reviewer: "ana"},
+		{name: "admin token names the reviewer", adminToken: "admin", authorization: "Bearer admin", xReviewer: "carla", status: http.StatusOK, reviewer: "carla"},
+		{name: "admin token without a reviewer", adminToken: "admin", authorization: "Bearer admin", status: http.StatusBadRequest},
+		{name: "unknown token", reviewers: map[string]string{"ana": "ana-token"}, adminToken: "admin", authorization: "Bearer other", xReviewer: "ana", status: http.StatusUnauthorized},
+		{name: "no token", reviewers: map[string]string{"ana": "ana-token"}, xReviewer: "ana", status: http.StatusUnauthorized},
+		{name: "not a bearer token", reviewers: map[string]string{"ana": "ana-token"}, authorization: "ana-token", status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withConfig(t, func(config *Config) {
+				config.Reviewers = test.reviewers
+				config.AdminToken = test.adminToken
+			})
+			reviewer := ""
+			handler := RequireReviewer(func(w http.ResponseWriter, r *http.Request) {
+				reviewer = ReviewerFrom(r.Context())
+			})
+			r := httptest.NewRequest("GET", "/review/receipts", nil)
+			r.Header.Set("Authorization", test.authorization)
+			r.Header.Set("X-Reviewer", test.xReviewer)
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.status || reviewer != test.reviewer {
+				t.Errorf("status = %d, reviewer %q, want %d, %q", w.Code, reviewer, test.status, test.reviewer)
+			}
+		})
+	}
+}
+
+// Stores a flagged receipt waiting for review, and returns its ID
+func storeFlagged(t *testing.T, s *Server, id string) string {
+	t.Helper()
+	receipt := targetReceipt
+	receipt.ID, receipt.Status, receipt.Flagged = id, statusSubmitted, true
+	receipt.Points = GetReceiptPoints(receipt)
+	s.Store.Add(receipt)
+	return id
+}
+
+// Calls a review handler as the reviewer, with the receipt ID as the {id} route variable
+func callReview(handler http.HandlerFunc, reviewer string, id string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/review/receipts/"+id, strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"id": id})
+	r.Header.Set("Authorization", "Bearer "+reviewer+"-token")
+	w := httptest.NewRecorder()
+	RequireReviewer(handler)(w, r)
+	return w
+}
+
+func TestReviewReceipt(t *testing.T) {
+	s := New()
+	withConfig(t, func(config *Config) { config.Reviewers = map[string]string{"ana": "ana-token"} })
+	approved := storeFlagged(t, s, "approved")
+	rejected := storeFlagged(t, s, "rejected")
+	storeFlagged(t, s, "waiting")
+
+	if w := callReview(s.ApproveReceipt, "ana", approved, ""); w.Code != http.StatusOK {
+		t.Fatalf("ApproveReceipt() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if w := callReview(s.RejectReceipt, "ana", rejected, `{"reason": "Photo of a screen"}`); w.Code != http.StatusOK {
+		t.Fatalf("RejectReceipt() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	tests := []struct {
+		id       string
+		status   string
+		decision string
+		reason   string
+		points   int64
+	}{
+		{approved, statusProcessed, decisionApproved, "", 28},
+		{rejected, statusRejected, decisionRejected, "Photo of a screen", 0},
+		{"waiting", statusSubmitted, "", "", 0},
+	}
+	for _, test := range tests {
+		receipt, _ := s.Store.Find(test.id)
+		decision, reason := "", ""
+		if receipt.Review != nil {
+			decision, reason = receipt.Review.Decision, receipt.Review.Reason
+			if receipt.Review.Reviewer != "ana" {
+				t.Errorf("%s: reviewer = %q, want %q", test.id, receipt.Review.Reviewer, "ana")
+			}
+		}
+		if receipt.Status != test.status || decision != test.decision || reason != test.reason || AwardedPoints(receipt) != test.points {
+			t.Errorf("%s: status %q, decision %q, reason %q, points %d, want %q, %q, %q, %d", test.id,
+				receipt.Status, decision, reason, AwardedPoints(receipt), test.status, test.decision, test.reason, test.points)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	RequireReviewer(s.ListReviewQueue)(w, func() *http.Request {
+		r := httptest.NewRequest("GET", "/review/receipts", nil)
+		r.Header.Set("Authorization", "Bearer ana-token")
+		return r
+	}())
+	var queue ReceiptListResponse
+	json.NewDecoder(w.Body).Decode(&queue)
+	if len(queue.Receipts) != 1 || queue.Receipts[0].ID != "waiting" {
+		t.Errorf("ListReviewQueue() = %+v, want only the receipt still waiting", queue.Receipts)
+	}
+}
+
+func TestReviewReceiptErrors(t *testing.T) {
+	s := New()
+	withConfig(t, func(config *Config) { config.Reviewers = map[string]string{"ana": "ana-token"} })
+	storeFlagged(t, s, "flagged")
+	processed := targetReceipt
+	processed.ID, processed.Status = "processed", statusProcessed
+	s.Store.Add(processed)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		id      string
+		body    string
+		status  int
+		code    string
+	}{
+		{"unknown receipt", s.ApproveReceipt, "missing", "", http.StatusNotFound, codeReceiptNotFound},
+		{"not waiting for review", s.ApproveReceipt, "processed", "", http.StatusConflict, codeNotPendingReview},
+		{"rejection without a reason", s.RejectReceipt, "flagged", `{}`, http.StatusBadRequest, codeInvalidReview},
+		{"rejection that isn't JSON", s.RejectReceipt, "flagged", `reason`, http.StatusBadRequest, codeInvalidReview},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := callReview(test.handler, "ana", test.id, test.body)
+			var response ErrorResponse
+			json.NewDecoder(w.Body).Decode(&response)
+			if w.Code != test.status || response.Code != test.code {
+				t.Errorf("status = %d, code %q, want %d, %q", w.Code, response.Code, test.status, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package receiptapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keeps blobs as objects in an S3 compatible bucket, such as on AWS or MinIO. Requests
+// are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	// Base URL of the service, e.g. "https://s3.us-east-1.amazonaws.com" or "http://localhost:9000"
+	Endpoint string
+
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Address the bucket in the path rather than the host name, as MinIO expects
+	PathStyle bool
+
+	// Tells the time presigned URLs expire from; the system clock when nil
+	Clock Clock
+}
+
+// Uploads a blob, replacing any object with the same key
+func (b *S3BlobStore) Put(ctx context.Context, key string, data io.Reader) error {
+	// The payload is signed, so it has to be read up front
+	body, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	response, err := b.do(ctx, http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// Downloads a blob
+func (b *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	response, err := b.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// Deletes a blob; deleting one that doesn't exist is not an error
+func (b *S3BlobStore) Delete(ctx context.Context, key string) error {
+	response, err := b.do(ctx, http.MethodDelete, key, nil)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// Returns a presigned URL the blob can be downloaded from until it expires, at most
+// a week from now
+func (b *S3BlobStore) SignedURL(key string, expires time.Duration) (string, error) {
+	err := CheckBlobKey(key)
+	if err != nil {
+		return "", err
+	}
+	return b.presign(http.MethodGet, key, expires, clockOrSystem(b.Clock).Now().UTC())
+}
+
+// Sends a signed request for an object; responses other than success are returned as errors
+func (b *S3BlobStore) do(ctx context.Context, method string, key string, body []byte) (*http.Response, error) {
+	err := CheckBlobKey(key)
+	if err != nil {
+		return nil, err
+	}
+	target, err := b.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	b.signer().sign(request, body, time.Now().UTC())
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if response.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, key, response.Status, detail)
+	}
+	return response, nil
+}
+
+// Returns the URL of an object, addressing the bucket by path or by host name
+func (b *S3BlobStore) objectURL(key string) (*url.URL, error) {
+	endpoint := b.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + b.Region + ".amazonaws.com"
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	target := *base
+	if b.PathStyle {
+		target.Path = strings.TrimSuffix(base.Path, "/") + "/" + b.Bucket + "/" + key
+	} else {
+		target.Host = b.Bucket + "." + base.Host
+		target.Path = strings.TrimSuffix(base.Path, "/") + "/" + key
+	}
+	target.RawPath = awsEscape(target.Path, true)
+	return &target, nil
+}
+
+// Returns the signer for requests to the bucket
+func (b *S3BlobStore) signer() awsSigner {
+	return awsSigner{
+		Region:          b.Region,
+		Service:         "s3",
+		AccessKeyID:     b.AccessKeyID,
+		SecretAccessKey: b.SecretAccessKey,
+	}
+}
+
+// Returns a URL for a request authorized by its query string rather than its headers
+func (b *S3BlobStore) presign(method string, key string, expires time.Duration, now time.Time) (string, error) {
+	target, err := b.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+	seconds := int64(expires / time.Second)
+	if seconds < 1 || seconds > 7*24*60*60 {
+		return "", fmt.Errorf("signed URLs must expire within a week, not %s", expires)
+	}
+
+	signer := b.signer()
+	scope := signer.scope(now)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {b.AccessKeyID + "/" + scope},
+		"X-Amz-Date":          {now.Format(amzDateLayout)},
+		"X-Amz-Expires":       {strconv.FormatInt(seconds, 10)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	signedHeaders, canonicalHeaders := canonicalHeaders(map[string]string{"host": target.Host})
+	canonical := strings.Join([]string{
+		method,
+		target.EscapedPath(),
+		canonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	target.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signer.signature(now, scope, canonical)
+	return target.String(), nil
+}
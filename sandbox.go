@@ -0,0 +1,15 @@
+package receiptapi
+
+import "net/http"
+
+// Returns whether receipts a partner submits for a tenant go to the sandbox: they are
+// validated and scored as usual, but kept apart from production data
+func IsSandbox(partner Partner, tenant string) bool {
+	return partner.Sandbox || (config.SandboxTenant != "" && tenant == config.SandboxTenant)
+}
+
+// Returns whether a request comes from a sandbox partner or for the sandbox tenant
+func IsSandboxRequest(r *http.Request) bool {
+	partner, _ := GetPartner(r)
+	return IsSandbox(partner, r.Header.Get("X-Tenant-ID"))
+}
@@ -0,0 +1,313 @@
+package receiptapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source of secrets such as partner API keys, by name
+type SecretsProvider interface {
+	Fetch(ctx context.Context) (map[string]string, error)
+}
+
+// Secrets from the last successful fetch
+var secretValues = map[string]string{}
+
+// Guards secretValues, since they are refreshed while serving
+var secretsMu sync.RWMutex
+
+// Returns the secrets provider selected by the configuration
+func NewSecretsProvider(config Config) (SecretsProvider, error) {
+	switch config.SecretsProvider {
+	case "env":
+		return EnvSecrets{}, nil
+	case "vault":
+		if config.VaultToken == "" || config.VaultSecretPath == "" {
+			return nil, errors.New("SECRETS_PROVIDER vault needs VAULT_TOKEN and VAULT_SECRET_PATH")
+		}
+		return &VaultSecrets{Address: config.VaultAddress, Token: config.VaultToken, Path: config.VaultSecretPath}, nil
+	case "aws":
+		if config.AWSSecretID == "" {
+			return nil, errors.New("SECRETS_PROVIDER aws needs AWS_SECRET_ID")
+		}
+		return &AWSSecrets{
+			Endpoint:        config.AWSSecretsEndpoint,
+			Region:          config.AWSSecretsRegion,
+			SecretID:        config.AWSSecretID,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown SECRETS_PROVIDER %q", config.SecretsProvider)
+}
+
+// Loads the secrets from the configured provider; they come before the rest of setup,
+// since they fill in settings that are checked and used there
+func SetupSecrets() error {
+	provider, err := NewSecretsProvider(config)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	err = LoadSecrets(context.Background(), provider)
+	if err != nil {
+		return fmt.Errorf("could not load secrets: %w", err)
+	}
+	return nil
+}
+
+// Fetches the secrets and applies those read at startup to the configuration: the blob
+// and response signing keys, the SMTP password and S3 credentials. Partner credentials are applied as
+// partners load.
+func LoadSecrets(ctx context.Context, provider SecretsProvider) error {
+	values, err := provider.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+	secretsMu.Lock()
+	secretValues = values
+	secretsMu.Unlock()
+
+	if value, ok := values["BLOB_SIGNING_KEY"]; ok {
+		config.BlobSigningKey = value
+	}
+	if value, ok := values["RESPONSE_SIGNING_KEY"]; ok {
+		config.ResponseSigningKey = value
+	}
+	if value, ok := values["SMTP_PASSWORD"]; ok {
+		config.SMTPPassword = value
+	}
+	if value, ok := values["S3_ACCESS_KEY_ID"]; ok {
+		config.S3AccessKeyID = value
+	}
+	if value, ok := values["S3_SECRET_ACCESS_KEY"]; ok {
+		config.S3SecretAccessKey = value
+	}
+	return nil
+}
+
+// Fetches the secrets every interval until the context is done, updating partner
+// credentials so keys rotated in the provider take effect without a restart. A failed
+// fetch keeps the secrets already loaded.
+func RefreshSecrets(ctx context.Context, provider SecretsProvider, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		values, err := provider.Fetch(ctx)
+		if err != nil {
+			logApp.Error("Could not refresh secrets", "error", err)
+			continue
+		}
+		secretsMu.Lock()
+		secretValues = values
+		secretsMu.Unlock()
+		applyPartnerSecrets()
+	}
+}
+
+// Returns a secret, and whether the provider has it
+func Secret(name string) (string, bool) {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	value, ok := secretValues[name]
+	return value, ok
+}
+
+// Returns the name of a partner's secret, e.g. "PARTNER_KEY_ACME_CORP" for the key of
+// "Acme Corp"
+func partnerSecretName(kind string, partner string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(partner))
+	return "PARTNER_" + kind + "_" + name
+}
+
+// Replaces a partner's key and signing secret with those in the secrets, if there are any
+func withPartnerSecrets(partner Partner) Partner {
+	if value, ok := Secret(partnerSecretName("KEY", partner.Name)); ok {
+		partner.Key = value
+	}
+	if value, ok := Secret(partnerSecretName("SIGNING_SECRET", partner.Name)); ok {
+		partner.SigningSecret = value
+	}
+	return partner
+}
+
+// Checks whether a partner's credentials come from the secrets provider
+func hasPartnerSecrets(name string) bool {
+	_, ok := Secret(partnerSecretName("KEY", name))
+	return ok
+}
+
+// Updates every partner's credentials from the secrets. A key another partner already
+// uses is ignored, keeping the old one.
+func applyPartnerSecrets() {
+	partnersMu.Lock()
+	defer partnersMu.Unlock()
+	updated := make(map[string]Partner, len(partners))
+	for key, partner := range partners {
+		partner = withPartnerSecrets(partner)
+		if _, taken := updated[partner.Key]; taken || partner.Key == "" {
+			logApp.Warn("Ignoring unusable key in secrets", "partner", partner.Name)
+			partner.Key = key
+		}
+		updated[partner.Key] = partner
+	}
+	partners = updated
+}
+
+/*
+	Below are the secrets providers
+*/
+
+// Reads secrets from environment variables
+type EnvSecrets struct{}
+
+// Returns every environment variable
+func (EnvSecrets) Fetch(ctx context.Context) (map[string]string, error) {
+	values := map[string]string{}
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		values[name] = value
+	}
+	return values, nil
+}
+
+// Reads secrets from a key/value secret in HashiCorp Vault
+type VaultSecrets struct {
+	// Where Vault is reached, e.g. "https://vault.example.com:8200"
+	Address string
+	Token   string
+
+	// Path of the secret, e.g. "secret/data/receipt-api" for version 2 of the KV engine
+	Path string
+}
+
+// Reads every value of the secret; values that aren't strings are left out
+func (v *VaultSecrets) Fetch(ctx context.Context) (map[string]string, error) {
+	target := strings.TrimSuffix(v.Address, "/") + "/v1/" + strings.TrimPrefix(v.Path, "/")
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Vault-Token", v.Token)
+	body, err := fetchSecret(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Data map[string]any `json:"data"`
+	}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+	// Version 2 of the KV engine nests the values, next to their metadata
+	data := response.Data
+	if nested, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = nested
+	}
+	return stringValues(data), nil
+}
+
+// Reads secrets from a secret in AWS Secrets Manager holding a JSON object
+type AWSSecrets struct {
+	// Base URL of the service; when empty AWS is used
+	Endpoint string
+
+	Region          string
+	SecretID        string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// Reads every value of the secret; values that aren't strings are left out
+func (a *AWSSecrets) Fetch(ctx context.Context) (map[string]string, error) {
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + a.Region + ".amazonaws.com"
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": a.SecretID})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signer := awsSigner{
+		Region:          a.Region,
+		Service:         "secretsmanager",
+		AccessKeyID:     a.AccessKeyID,
+		SecretAccessKey: a.SecretAccessKey,
+	}
+	signer.sign(request, body, time.Now().UTC())
+	response, err := fetchSecret(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret struct {
+		SecretString string `json:"SecretString"`
+	}
+	err = json.Unmarshal(response, &secret)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]any
+	err = json.Unmarshal([]byte(secret.SecretString), &data)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object: %w", a.SecretID, err)
+	}
+	return stringValues(data), nil
+}
+
+// Sends a request for a secret and returns the response body; responses other than
+// success are returned as errors
+func fetchSecret(request *http.Request) ([]byte, error) {
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		// The body may echo secrets, so only the status is reported
+		return nil, fmt.Errorf("%s %s: %s", request.Method, request.URL.Redacted(), response.Status)
+	}
+	return body, nil
+}
+
+// Returns the string values of a JSON object
+func stringValues(data map[string]any) map[string]string {
+	values := make(map[string]string, len(data))
+	for name, value := range data {
+		if text, ok := value.(string); ok {
+			values[name] = text
+		}
+	}
+	return values
+}
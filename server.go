@@ -0,0 +1,126 @@
+// Package receiptapi is the receipt processor API: New builds a server, and its Handler
+// serves the API so it can be mounted in another program. The receipt-api command runs it.
+package receiptapi
+
+import "net/http"
+
+// Rules receipts are scored by
+type Rules interface {
+	// Returns the points a receipt earns
+	Points(receipt Receipt) int64
+
+	// Returns the points a receipt earns from each rule, always listing every rule in
+	// the same order
+	PointsByRule(receipt Receipt) []RulePoints
+}
+
+// The standard scoring rules, as the program currently sets them
+type StandardRules struct{}
+
+// Returns the points a receipt earns under the standard rules
+func (StandardRules) Points(receipt Receipt) int64 {
+	return GetReceiptPoints(receipt)
+}
+
+// Returns the points a receipt earns from each of the standard rules
+func (StandardRules) PointsByRule(receipt Receipt) []RulePoints {
+	return GetPointsByRule(receipt)
+}
+
+// Holds what the handlers depend on, so tests can fix the time and IDs and other
+// environments can wire in their own
+type Server struct {
+	// Where receipts are kept
+	Store *ReceiptStore
+
+	// Tells the time, for timestamps and date rules
+	Clock Clock
+
+	// Assigns IDs to new receipts
+	IDs IDGenerator
+
+	// Scores receipts
+	Rules Rules
+
+	// Where exports and backups are stored, if anywhere
+	Blobs BlobStore
+
+	// Nonces of signed submissions already received
+	Nonces *NonceStore
+
+	// Single use tokens issued for submissions
+	SubmissionTokens *SubmissionTokenStore
+
+	// Where receipt events are published, if anywhere
+	Events EventPublisher
+}
+
+// Changes how a server is set up, such as by replacing its store or rules
+type ServerOption func(s *Server)
+
+// Returns a server with an empty in-memory store, the system clock, IDs from the
+// configured scheme and the standard rules, changed by any options
+func New(options ...ServerOption) *Server {
+	s := &Server{
+		Store:  NewReceiptStore(),
+		Clock:  SystemClock{},
+		Rules:  StandardRules{},
+		Nonces: NewNonceStore(),
+
+		SubmissionTokens: NewSubmissionTokenStore(),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	if s.IDs == nil {
+		s.IDs = NewIDGenerator(config, s.Clock)
+	}
+	return s
+}
+
+// Keeps receipts in the given store instead of an empty in-memory one
+func WithStore(store *ReceiptStore) ServerOption {
+	return func(s *Server) { s.Store = store }
+}
+
+// Scores receipts with the given rules instead of the standard ones
+func WithRules(rules Rules) ServerOption {
+	return func(s *Server) { s.Rules = rules }
+}
+
+// Tells the time with the given clock instead of the system's
+func WithClock(clock Clock) ServerOption {
+	return func(s *Server) { s.Clock = clock }
+}
+
+// Assigns receipt IDs with the given generator instead of the configured scheme's; an
+// IDGeneratorFunc makes any function one
+func WithIDs(ids IDGenerator) ServerOption {
+	return func(s *Server) { s.IDs = ids }
+}
+
+// Stores exports and backups in the given blob store
+func WithBlobStore(blobs BlobStore) ServerOption {
+	return func(s *Server) { s.Blobs = blobs }
+}
+
+// Publishes receipt events with the given publisher
+func WithEvents(events EventPublisher) ServerOption {
+	return func(s *Server) { s.Events = events }
+}
+
+// Returns the API as a handler, so it can be mounted under another router and wrapped
+// in other middleware. Paths are the same as when serving, e.g. "/receipts/process"; mount
+// it under a prefix with http.StripPrefix.
+func (s *Server) Handler() http.Handler {
+	return NewRouter(s)
+}
+
+// Returns the rules a receipt is scored with: the server's, or the program's rules as
+// an admin overrode them for the request if they did
+func (s *Server) scoringRules(overriddenRules ProgramRules, overridden bool) Rules {
+	if overridden {
+		return overriddenRules
+	}
+	return s.Rules
+}
@@ -0,0 +1,268 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Rule values tried in shadow mode: every receipt processed while they are set is also
+// scored with them, and the result kept alongside its points for comparison, without
+// changing the points it is awarded
+type Candidate struct {
+	ID        string       `json:"id"`
+	Rules     ProgramRules `json:"rules"`
+	CreatedAt time.Time    `json:"createdAt"`
+	CreatedBy string       `json:"createdBy,omitempty"`
+	Reason    string       `json:"reason,omitempty"`
+}
+
+// Points a receipt would have earned with a candidate's rules, from each rule and in all
+type ShadowScore struct {
+	CandidateID string       `json:"candidateId"`
+	Points      int64        `json:"points"`
+	Rules       []RulePoints `json:"rules"`
+}
+
+// Request to try rule values as the candidate, replacing any candidate already set
+type CandidateRequest struct {
+	Rules     ProgramRules `json:"rules"`
+	CreatedBy string       `json:"createdBy"`
+	Reason    string       `json:"reason"`
+}
+
+// Request to make the candidate's rules the program's. Version must be the program's
+// version, as for a change to the program.
+type PromoteRequest struct {
+	Version   int    `json:"version"`
+	ChangedBy string `json:"changedBy"`
+	Reason    string `json:"reason"`
+}
+
+// How the receipts scored with a candidate compare: how many it would have given the
+// same, more or fewer points, and the points from each rule under both
+type ShadowComparison struct {
+	Receipts int `json:"receipts"`
+	Same     int `json:"same"`
+	Higher   int `json:"higher"`
+	Lower    int `json:"lower"`
+
+	ActivePoints    int64            `json:"activePoints"`
+	CandidatePoints int64            `json:"candidatePoints"`
+	Rules           []RuleComparison `json:"rules"`
+}
+
+// Points one rule awarded the receipts scored with a candidate, and would have with it
+type RuleComparison struct {
+	Rule            string `json:"rule"`
+	ActivePoints    int64  `json:"activePoints"`
+	CandidatePoints int64  `json:"candidatePoints"`
+}
+
+// Response with the candidate and how its scores compare so far
+type CandidateResponse struct {
+	Candidate
+	Comparison ShadowComparison `json:"comparison"`
+}
+
+// Candidate being tried, if any; guarded by programMu
+var candidate *Candidate
+
+// Returns the candidate being tried, or nil if there is none
+func CurrentCandidate() *Candidate {
+	programMu.RLock()
+	defer programMu.RUnlock()
+	if candidate == nil {
+		return nil
+	}
+	current := *candidate
+	return &current
+}
+
+// Scores a receipt with the candidate's rules, if one is being tried
+func ShadowScoreReceipt(receipt Receipt) *ShadowScore {
+	current := CurrentCandidate()
+	if current == nil {
+		return nil
+	}
+	return &ShadowScore{
+		CandidateID: current.ID,
+		Points:      current.Rules.Points(receipt),
+		Rules:       current.Rules.PointsByRule(receipt),
+	}
+}
+
+// Sets the rule values to try as the candidate, if they could be the program's. The
+// comparison starts over, since receipts scored with an earlier candidate don't count.
+func (s *Server) SetCandidate(request CandidateRequest) (Candidate, *Rejection) {
+	proposed := CurrentProgram()
+	proposed.Rules = request.Rules.withEmptyMaps()
+	err := ValidateProgram(proposed)
+	if err != nil {
+		return Candidate{}, &Rejection{http.StatusBadRequest, codeInvalidProgram, "The candidate rules are not valid: " + err.Error() + "."}
+	}
+
+	created := Candidate{
+		ID:        uuid.New().String(),
+		Rules:     proposed.Rules,
+		CreatedAt: s.Clock.Now().UTC(),
+		CreatedBy: request.CreatedBy,
+		Reason:    request.Reason,
+	}
+	programMu.Lock()
+	candidate = &created
+	programMu.Unlock()
+	logApp.Info("Candidate rules set", "candidateId", created.ID, "createdBy", created.CreatedBy)
+	return created, nil
+}
+
+// Returns a comparison of no receipts yet, listing every rule in the usual order, as for
+// the points by rule report
+func newShadowComparison() ShadowComparison {
+	comparison := ShadowComparison{Rules: []RuleComparison{}}
+	for _, rule := range GetPointsByRule(Receipt{}) {
+		comparison.Rules = append(comparison.Rules, RuleComparison{Rule: rule.Rule})
+	}
+	return comparison
+}
+
+// Counts a receipt scored with both the active and the other rules in a comparison
+func (comparison *ShadowComparison) add(active int64, activeRules []RulePoints, other int64, otherRules []RulePoints) {
+	comparison.Receipts += 1
+	comparison.ActivePoints += active
+	comparison.CandidatePoints += other
+	switch {
+	case other > active:
+		comparison.Higher += 1
+	case other < active:
+		comparison.Lower += 1
+	default:
+		comparison.Same += 1
+	}
+	for i := range comparison.Rules {
+		for _, points := range activeRules {
+			if points.Rule == comparison.Rules[i].Rule {
+				comparison.Rules[i].ActivePoints += points.Points
+			}
+		}
+		for _, points := range otherRules {
+			if points.Rule == comparison.Rules[i].Rule {
+				comparison.Rules[i].CandidatePoints += points.Points
+			}
+		}
+	}
+}
+
+// Returns how the receipts scored with a candidate compare with the points they were
+// awarded
+func (s *Server) CompareCandidate(id string) ShadowComparison {
+	comparison := newShadowComparison()
+	for _, receipt := range s.Store.All() {
+		if receipt.Shadow == nil || receipt.Shadow.CandidateID != id {
+			continue
+		}
+		var activeRules []RulePoints
+		if receipt.Scoring != nil {
+			activeRules = receipt.Scoring.Rules
+		}
+		comparison.add(receipt.Points, activeRules, receipt.Shadow.Points, receipt.Shadow.Rules)
+	}
+	return comparison
+}
+
+// Makes the candidate's rules the program's and stops trying it. Receipts already
+// scored keep their points until they are recalculated.
+func (s *Server) PromoteCandidate(request PromoteRequest) (ProgramState, *Rejection) {
+	promoted := CurrentCandidate()
+	if promoted == nil {
+		return ProgramState{}, &Rejection{http.StatusNotFound, codeCandidateNotFound, "No candidate rules are being tried."}
+	}
+	update := ProgramUpdate{
+		Version:   request.Version,
+		ChangedBy: request.ChangedBy,
+		Reason:    request.Reason,
+		Program:   CurrentProgram(),
+	}
+	update.Rules = promoted.Rules
+	if update.Reason == "" {
+		update.Reason = "Promoted candidate " + promoted.ID
+	}
+	state, rejection := s.UpdateProgram(update)
+	if rejection != nil {
+		return ProgramState{}, rejection
+	}
+
+	// Unless another candidate was set meanwhile
+	programMu.Lock()
+	if candidate != nil && candidate.ID == promoted.ID {
+		candidate = nil
+	}
+	programMu.Unlock()
+	return state, nil
+}
+
+/*
+	Below are the handlers for candidate rules
+*/
+
+// Method to get the candidate rules being tried and how their scores compare so far
+func (s *Server) GetCandidate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	current := CurrentCandidate()
+	if current == nil {
+		WriteError(w, http.StatusNotFound, codeCandidateNotFound, "No candidate rules are being tried.")
+		return
+	}
+	json.NewEncoder(w).Encode(CandidateResponse{Candidate: *current, Comparison: s.CompareCandidate(current.ID)})
+}
+
+// Method to start trying rule values as the candidate
+func (s *Server) PutCandidate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request CandidateRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidProgram, "The candidate is not valid JSON with only known fields.")
+		return
+	}
+	request.CreatedBy = strings.TrimSpace(request.CreatedBy)
+	request.Reason = strings.TrimSpace(request.Reason)
+	created, rejection := s.SetCandidate(request)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	json.NewEncoder(w).Encode(CandidateResponse{Candidate: created, Comparison: s.CompareCandidate(created.ID)})
+}
+
+// Method to stop trying the candidate rules; receipts keep the scores already recorded
+func DeleteCandidate(w http.ResponseWriter, r *http.Request) {
+	programMu.Lock()
+	candidate = nil
+	programMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Method to make the candidate rules the program's; responds with the program as it now is
+func (s *Server) PromoteCandidateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request PromoteRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidProgram, "The promotion is not valid JSON.")
+		return
+	}
+	request.ChangedBy = strings.TrimSpace(request.ChangedBy)
+	request.Reason = strings.TrimSpace(request.Reason)
+	state, rejection := s.PromoteCandidate(request)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	json.NewEncoder(w).Encode(state)
+}
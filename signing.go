@@ -0,0 +1,118 @@
+package receiptapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Longest nonce accepted on a signed submission
+const maxNonceLength = 128
+
+// Counts of signed submissions turned away, published at /admin/debug/vars
+var (
+	signaturesRejected = expvar.NewInt("signatures_rejected")
+	replaysRejected    = expvar.NewInt("replays_rejected")
+)
+
+// Remembers the nonces of signed submissions until their timestamps are too old to be
+// accepted anyway, so each one can only be used once
+type NonceStore struct {
+	mu sync.Mutex
+
+	// Expiry times keyed by partner and nonce
+	seen map[string]time.Time
+
+	// When expired nonces are next cleared out
+	nextSweep time.Time
+}
+
+// Returns an empty nonce store
+func NewNonceStore() *NonceStore {
+	return &NonceStore{seen: map[string]time.Time{}}
+}
+
+// Records a partner's nonce until it expires; returns false if it was already used
+func (n *NonceStore) Use(partner string, nonce string, now time.Time, expires time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if now.After(n.nextSweep) {
+		for key, expiry := range n.seen {
+			if now.After(expiry) {
+				delete(n.seen, key)
+			}
+		}
+		n.nextSweep = now.Add(time.Minute)
+	}
+
+	key := partner + "\x00" + nonce
+	if expiry, used := n.seen[key]; used && !now.After(expiry) {
+		return false
+	}
+	n.seen[key] = expires
+	return true
+}
+
+// Checks the signature of a submission, if it has one or the partner requires one. The
+// X-Signature header holds the hex HMAC-SHA256, keyed with the partner's signing
+// secret, of the X-Signature-Timestamp header (Unix seconds), a newline, the
+// X-Signature-Nonce header, a newline and the body. Returns why it was turned away, or
+// nil if it wasn't.
+func (s *Server) CheckSignature(r *http.Request, partner Partner, body []byte) *Rejection {
+	signature := r.Header.Get("X-Signature")
+	if signature == "" && !partner.RequireSignature {
+		return nil
+	}
+	rejection := s.checkSignature(r, partner, signature, body)
+	if rejection != nil {
+		if rejection.Code == codeReplayedRequest {
+			replaysRejected.Add(1)
+		} else {
+			signaturesRejected.Add(1)
+		}
+	}
+	return rejection
+}
+
+// Checks a signature is valid, fresh and not seen before
+func (s *Server) checkSignature(r *http.Request, partner Partner, signature string, body []byte) *Rejection {
+	if signature == "" {
+		return &Rejection{http.StatusUnauthorized, codeInvalidSignature, "Submissions from this partner must be signed."}
+	}
+	if partner.SigningSecret == "" {
+		return &Rejection{http.StatusUnauthorized, codeInvalidSignature, "The partner has no signing secret to check the signature with."}
+	}
+
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	nonce := r.Header.Get("X-Signature-Nonce")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" || len(nonce) > maxNonceLength {
+		return &Rejection{http.StatusUnauthorized, codeInvalidSignature, "Signed submissions need a Unix timestamp and a nonce."}
+	}
+
+	mac := hmac.New(sha256.New, []byte(partner.SigningSecret))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return &Rejection{http.StatusUnauthorized, codeInvalidSignature, "The signature does not match."}
+	}
+
+	// Timestamps are checked after the signature, so they can't be forged to probe the window
+	now := s.Clock.Now()
+	signedAt := time.Unix(seconds, 0)
+	tolerance := time.Duration(config.SignatureToleranceSeconds) * time.Second
+	if signedAt.Before(now.Add(-tolerance)) || signedAt.After(now.Add(tolerance)) {
+		return &Rejection{http.StatusUnauthorized, codeInvalidSignature, "The signature timestamp is too far from the current time."}
+	}
+
+	// Nonces only need remembering while their timestamp would still be accepted
+	if !s.Nonces.Use(partner.Name, nonce, now, signedAt.Add(tolerance)) {
+		return &Rejection{http.StatusConflict, codeReplayedRequest, "The submission was already received with this nonce."}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package receiptapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Returns the signature a partner would send for a body
+func signBody(secret string, timestamp string, nonce string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCheckSignature(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fresh := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-301*time.Second).Unix(), 10)
+	early := strconv.FormatInt(now.Add(301*time.Second).Unix(), 10)
+	body := `{"retailer":"Target"}`
+	tests := []struct {
+		name      string
+		partner   Partner
+		headers   map[string]string
+		wantCode  string
+		wantNoErr bool
+	}{
+		{
+			name:      "unsigned and not required",
+			partner:   Partner{Name: "acme", SigningSecret: "secret"},
+			wantNoErr: true,
+		},
+		{
+			name:     "unsigned but required",
+			partner:  Partner{Name: "acme", SigningSecret: "secret", RequireSignature: true},
+			wantCode: codeInvalidSignature,
+		},
+		{
+			name:      "signed",
+			partner:   Partner{Name: "acme", SigningSecret: "secret"},
+			headers:   map[string]string{"X-Signature": signBody("secret", fresh, "n1", body), "X-Signature-Timestamp": fresh, "X-Signature-Nonce": "n1"},
+			wantNoErr: true,
+		},
+		{
+			name:     "wrong secret",
+			partner:  Partner{Name: "acme", SigningSecret: "secret"},
+			headers:  map[string]string{"X-Signature": signBody("other", fresh, "n1", body), "X-Signature-Timestamp": fresh, "X-Signature-Nonce": "n1"},
+			wantCode: codeInvalidSignature,
+		},
+		{
+			name:     "no secret to check with",
+			partner:  Partner{Name: "acme"},
+			headers:  map[string]string{"X-Signature": signBody("", fresh, "n1", body), "X-Signature-Timestamp": fresh, "X-Signature-Nonce": "n1"},
+			wantCode: codeInvalidSignature,
+		},
+		{
+			name:     "no nonce",
+			partner:  Partner{Name: "acme", SigningSecret: "secret"},
+			headers:  map[string]string{"X-Signature": signBody("secret", fresh, "", body), "X-Signature-Timestamp": fresh},
+			wantCode: codeInvalidSignature,
+		},
+		{
+			name:     "timestamp too old",
+			partner:  Partner{Name: "acme", SigningSecret: "secret"},
+			headers:  map[string]string{"X-Signature": signBody("secret", stale, "n1", body), "X-Signature-Timestamp": stale, "X-Signature-Nonce": "n1"},
+			wantCode: codeInvalidSignature,
+		},
+		{
+			name:     "timestamp in the future",
+			partner:  Partner{Name: "acme", SigningSecret: "secret"},
+			headers:  map[string]string{"X-Signature": signBody("secret", early, "n1", body), "X-Signature-Timestamp": early, "X-Signature-Nonce": "n1"},
+			wantCode: codeInvalidSignature,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New()
+			s.Clock = FixedClock{now}
+			r := httptest.NewRequest(http.MethodPost, "/receipts/process", nil)
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+			rejection := s.CheckSignature(r, test.partner, []byte(body))
+			if test.wantNoErr {
+				if rejection != nil {
+					t.Errorf("CheckSignature() = %+v, want nil", rejection)
+				}
+				return
+			}
+			if rejection == nil || rejection.Code != test.wantCode {
+				t.Errorf("CheckSignature() = %+v, want %s", rejection, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestCheckSignatureReplay(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	body := `{"retailer":"Target"}`
+	s := New()
+	s.Clock = FixedClock{now}
+	request := func(partner string) *Rejection {
+		r := httptest.NewRequest(http.MethodPost, "/receipts/process", nil)
+		r.Header.Set("X-Signature", signBody("secret", timestamp, "n1", body))
+		r.Header.Set("X-Signature-Timestamp", timestamp)
+		r.Header.Set("X-Signature-Nonce", "n1")
+		return s.CheckSignature(r, Partner{Name: partner, SigningSecret: "secret"}, []byte(body))
+	}
+	if rejection := request("acme"); rejection != nil {
+		t.Fatalf("first CheckSignature() = %+v, want nil", rejection)
+	}
+	if rejection := request("acme"); rejection == nil || rejection.Status != http.StatusConflict || rejection.Code != codeReplayedRequest {
+		t.Errorf("replayed CheckSignature() = %+v, want 409 %s", rejection, codeReplayedRequest)
+	}
+
+	// Nonces are kept apart per partner
+	if rejection := request("globex"); rejection != nil {
+		t.Errorf("CheckSignature() for another partner = %+v, want nil", rejection)
+	}
+}
+
+func TestNonceStore(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	nonces := NewNonceStore()
+	steps := []struct {
+		partner string
+		nonce   string
+		at      time.Duration
+		want    bool
+	}{
+		{"acme", "n1", 0, true},
+		{"acme", "n1", time.Second, false},
+		{"acme", "n2", time.Second, true},
+		{"globex", "n1", time.Second, true},
+		{"acme", "n1", 5 * time.Minute, false},
+
+		// Every nonce expires 5 minutes in, and is forgotten after, whether or not it was
+		// swept yet
+		{"acme", "n1", 5*time.Minute + time.Second, true},
+		{"acme", "n2", 10 * time.Minute, true},
+	}
+	for _, step := range steps {
+		got := nonces.Use(step.partner, step.nonce, now.Add(step.at), now.Add(5*time.Minute))
+		if got != step.want {
+			t.Errorf("Use(%s, %s) at +%s = %v, want %v", step.partner, step.nonce, step.at, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package receiptapi
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// Receipts from the same retailer with the same total whose items are this alike, as
+// the share of distinct item descriptions they have in common, are clustered together
+const similarItemsThreshold = 0.8
+
+// Group of receipts so alike they may be one purchase submitted by several users
+type SimilarityCluster struct {
+	Retailer string `json:"retailer"`
+	Total    string `json:"total"`
+
+	// Item descriptions of the first receipt in the cluster, trimmed and lowercased
+	Items []string `json:"items"`
+
+	// Users who submitted the receipts, and the receipts, oldest first
+	Users    []string `json:"users"`
+	Receipts []string `json:"receipts"`
+}
+
+// Report of the similarity job: clusters of receipts submitted by more than one user,
+// those with the most users first
+type SimilarityReport struct {
+	Clustered int                 `json:"clustered"`
+	Clusters  []SimilarityCluster `json:"clusters"`
+
+	// Receipts added so far, keyed by normalized retailer and total in cents
+	buckets map[string][]similarReceipt
+}
+
+// Receipt as the similarity job compares it
+type similarReceipt struct {
+	ID     string
+	UserID string
+	Items  []string
+}
+
+// Returns an empty similarity report
+func NewSimilarityReport() JobReport {
+	return &SimilarityReport{Clusters: []SimilarityCluster{}, buckets: map[string][]similarReceipt{}}
+}
+
+// Returns the distinct item descriptions of a receipt, trimmed, lowercased and sorted
+func itemPattern(receipt Receipt) []string {
+	pattern := []string{}
+	for _, item := range receipt.Items {
+		pattern = append(pattern, strings.ToLower(strings.Join(strings.Fields(item.ShortDescription), " ")))
+	}
+	slices.Sort(pattern)
+	return slices.Compact(pattern)
+}
+
+// Returns the share of the distinct descriptions in either pattern that are in both
+func patternSimilarity(a []string, b []string) float64 {
+	common := 0
+	for _, description := range a {
+		if _, found := slices.BinarySearch(b, description); found {
+			common += 1
+		}
+	}
+	all := len(a) + len(b) - common
+	if all == 0 {
+		return 1
+	}
+	return float64(common) / float64(all)
+}
+
+// Adds a receipt to the report. Sandbox receipts, and those without a user or whose
+// items are gone, are left out.
+func (report *SimilarityReport) Add(receipt Receipt) {
+	if receipt.Sandbox || receipt.UserID == "" || receipt.Anonymized != nil || receipt.Compacted != nil {
+		return
+	}
+	cents, err := ParseCents(receipt.Total)
+	if err != nil {
+		return
+	}
+	key := NormalizeRetailer(receipt.Retailer) + "\n" + formatCents(cents)
+	report.buckets[key] = append(report.buckets[key], similarReceipt{receipt.ID, receipt.UserID, itemPattern(receipt)})
+}
+
+// Clusters the receipts in each bucket whose items are alike, directly or through other
+// receipts in the cluster, and keeps the clusters with more than one user
+func (report *SimilarityReport) Finish() {
+	for key, receipts := range report.buckets {
+		// Union-find over the receipts in the bucket
+		parent := make([]int, len(receipts))
+		for i := range parent {
+			parent[i] = i
+		}
+		var root func(i int) int
+		root = func(i int) int {
+			if parent[i] != i {
+				parent[i] = root(parent[i])
+			}
+			return parent[i]
+		}
+		for i := range receipts {
+			for j := i + 1; j < len(receipts); j++ {
+				if patternSimilarity(receipts[i].Items, receipts[j].Items) >= similarItemsThreshold {
+					parent[root(j)] = root(i)
+				}
+			}
+		}
+
+		retailer, total, _ := strings.Cut(key, "\n")
+		clusters := map[int]*SimilarityCluster{}
+		for i, receipt := range receipts {
+			cluster, ok := clusters[root(i)]
+			if !ok {
+				cluster = &SimilarityCluster{Retailer: retailer, Total: total, Items: receipt.Items}
+				clusters[root(i)] = cluster
+			}
+			cluster.Receipts = append(cluster.Receipts, receipt.ID)
+			if !slices.Contains(cluster.Users, receipt.UserID) {
+				cluster.Users = append(cluster.Users, receipt.UserID)
+			}
+		}
+		for _, cluster := range clusters {
+			if len(cluster.Users) > 1 {
+				report.Clusters = append(report.Clusters, *cluster)
+				report.Clustered += len(cluster.Receipts)
+			}
+		}
+	}
+	slices.SortFunc(report.Clusters, func(a, b SimilarityCluster) int {
+		return cmp.Or(
+			cmp.Compare(len(b.Users), len(a.Users)),
+			cmp.Compare(len(b.Receipts), len(a.Receipts)),
+			cmp.Compare(a.Retailer, b.Retailer),
+			cmp.Compare(a.Receipts[0], b.Receipts[0]),
+		)
+	})
+	report.buckets = nil
+}
@@ -0,0 +1,150 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Rule settings a receipt was scored with and what each rule awarded it, kept with the
+// receipt so its points can still be explained after the settings change
+type RuleSnapshot struct {
+	ScoredAt time.Time `json:"scoredAt"`
+
+	// Settings of the item description rule
+	ItemPriceMultiplier   string `json:"itemPriceMultiplier"`
+	ItemPriceRounding     string `json:"itemPriceRounding"`
+	DescriptionLengthMode string `json:"descriptionLengthMode"`
+
+	// Whether identical items were scored as one, for the item pair and description rules
+	CollapseDuplicateItems bool `json:"collapseDuplicateItems,omitempty"`
+
+	// Settings of the round dollar and multiple of 0.25 rules
+	TotalRulesBasis    string `json:"totalRulesBasis"`
+	ZeroTotalQualifies bool   `json:"zeroTotalQualifies"`
+
+	// Bonuses configured for the receipt's merchant category and payment method, and for
+	// each catalog product its items matched, keyed by SKU
+	MerchantCategoryBonus int64            `json:"merchantCategoryBonus"`
+	PaymentMethodBonus    int64            `json:"paymentMethodBonus"`
+	ProductBonuses        map[string]int64 `json:"productBonuses,omitempty"`
+
+	// Most points a receipt could earn, and each rule, when they were capped
+	MaxReceiptPoints int64            `json:"maxReceiptPoints,omitempty"`
+	RulePointCaps    map[string]int64 `json:"rulePointCaps,omitempty"`
+
+	// Percentage of its points the receipt earned when the daily points budget was
+	// nearly spent, if they were reduced
+	BudgetPercent int `json:"budgetPercent,omitempty"`
+
+	Rules []RulePoints `json:"rules,omitempty"`
+}
+
+// Response explaining where a receipt's points came from
+type BreakdownResponse struct {
+	ID string `json:"id"`
+
+	// Points awarded, which are none until a flagged receipt is approved
+	Points int64 `json:"points"`
+
+	// Points from each rule as the receipt was scored
+	Rules []RulePoints `json:"rules"`
+
+	// Settings the receipt was scored with; missing for receipts scored before they
+	// were kept, whose rules are worked out with the current settings
+	Scoring *RuleSnapshot `json:"scoring,omitempty"`
+}
+
+// Returns the current rule settings as they apply to a receipt, with what each of the
+// standard rules awards it
+func SnapshotRules(receipt Receipt, now time.Time) *RuleSnapshot {
+	return CurrentProgram().Rules.Snapshot(receipt, GetPointsByRule(receipt), now)
+}
+
+// Records these rule values as they applied to a receipt when it was scored, and what
+// each rule awarded it
+func (rules ProgramRules) Snapshot(receipt Receipt, scored []RulePoints, now time.Time) *RuleSnapshot {
+	snapshot := &RuleSnapshot{
+		ScoredAt:              now,
+		ItemPriceMultiplier:   rules.ItemPriceMultiplier,
+		ItemPriceRounding:     rules.ItemPriceRounding,
+		DescriptionLengthMode: rules.LengthMode(),
+		TotalRulesBasis:       rules.TotalRulesBasis,
+		ZeroTotalQualifies:    rules.ZeroTotalQualifies,
+		MerchantCategoryBonus: GetMCCPoints(receipt, rules),
+		PaymentMethodBonus:    rules.PaymentMethodBonuses[receipt.PaymentMethod],
+		Rules:                 scored,
+	}
+	snapshot.CollapseDuplicateItems = rules.CollapseDuplicateItems
+	if rules.MaxReceiptPoints > 0 {
+		snapshot.MaxReceiptPoints = rules.MaxReceiptPoints
+	}
+	if len(rules.RulePointCaps) > 0 {
+		snapshot.RulePointCaps = maps.Clone(rules.RulePointCaps)
+	}
+	for _, item := range receipt.Items {
+		product := GetProduct(item.SKU)
+		if item.SKU != "" && product != nil {
+			if snapshot.ProductBonuses == nil {
+				snapshot.ProductBonuses = map[string]int64{}
+			}
+			snapshot.ProductBonuses[item.SKU] = product.BonusPoints
+		}
+	}
+	return snapshot
+}
+
+// Returns the points a receipt earned from each of the rules when it was last scored, or
+// when it was compacted or anonymized. Receipts scored before snapshots were kept are
+// worked out with the rules as they are now.
+func PointsByRule(receipt Receipt, scoring Rules) []RulePoints {
+	rules := scoring.PointsByRule(receipt)
+	var kept []RulePoints
+	switch {
+	case receipt.Scoring != nil:
+		kept = receipt.Scoring.Rules
+	case receipt.Compacted != nil:
+		kept = receipt.Compacted.PointsByRule
+	case receipt.Anonymized != nil:
+		kept = receipt.Anonymized.PointsByRule
+	default:
+		return rules
+	}
+	for i := range rules {
+		rules[i].Points = 0
+		for _, rule := range kept {
+			if rule.Rule == rules[i].Rule {
+				rules[i].Points = rule.Points
+			}
+		}
+	}
+	return rules
+}
+
+// Method to explain a receipt's points rule by rule, with the settings it was scored with
+func (s *Server) GetReceiptBreakdown(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rejection := CheckIDPrefix(mux.Vars(r)["id"], IsSandboxRequest(r))
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	// A short code can be used in place of the ID
+	id := s.Store.ResolveShortCode(mux.Vars(r)["id"])
+	receipt, found := s.Store.Find(id)
+	if !found || receipt.Sandbox != IsSandboxRequest(r) {
+		WriteError(w, http.StatusNotFound, codeReceiptNotFound, receiptNotFoundMessage)
+		return
+	}
+	response := BreakdownResponse{ID: receipt.ID, Points: AwardedPoints(receipt), Rules: PointsByRule(receipt, s.Rules)}
+	if receipt.Scoring != nil {
+		// The rules are already listed once
+		scoring := *receipt.Scoring
+		scoring.Rules = nil
+		response.Scoring = &scoring
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,303 @@
+package receiptapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Status of a submission that was queued in the spool and hasn't been processed yet
+const spoolPending = "pending"
+
+// Count of submissions queued in the spool while changes couldn't be saved, published at
+// /admin/debug/vars
+var submissionsSpooled = expvar.NewInt("submissions_spooled")
+
+// Submission accepted while changes couldn't be saved to the data file, waiting to be
+// processed. Its receipt already has the ID the submitter was given.
+type SpooledSubmission struct {
+	Partner     string    `json:"partner,omitempty"`
+	ReceivedAt  time.Time `json:"receivedAt"`
+	TraceParent string    `json:"traceParent,omitempty"`
+	Receipt     Receipt   `json:"receipt"`
+}
+
+// Response for a submission that is queued in the spool
+type PendingResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// Submissions waiting in the spool, oldest first, and the file they are kept in
+var (
+	spooled   []SpooledSubmission
+	spoolFile *os.File
+)
+
+// Why spooled submissions were turned away once they were processed, keyed by receipt
+// ID, for as many as the spool holds; the oldest are forgotten first
+var (
+	spoolRejections     = map[string]*Rejection{}
+	spoolRejectionOrder []string
+)
+
+// Guards the spool, its file and the rejections
+var spoolMu sync.Mutex
+
+// Loads the submissions waiting in a spool file, then keeps it open to append to. Each
+// line holds a submission as JSON. Does nothing if no spool file is configured.
+func OpenSpool(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line += 1
+			var submission SpooledSubmission
+			err = json.Unmarshal(scanner.Bytes(), &submission)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			spooled = append(spooled, submission)
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+		if len(spooled) > 0 {
+			logStorage.Info("Loaded spooled submissions", "count", len(spooled), "path", path)
+		}
+	}
+
+	spoolFile, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	return err
+}
+
+// Closes the spool file
+func CloseSpool() {
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	if spoolFile != nil {
+		spoolFile.Close()
+		spoolFile = nil
+	}
+}
+
+// Returns how many submissions are waiting in the spool
+func SpooledCount() int {
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	return len(spooled)
+}
+
+// Returns whether submissions should be queued in the spool: there is one, and changes
+// can't be saved to the data file. While an admin has made the server read-only they
+// are turned away as usual.
+func (s *Server) Spooling() bool {
+	unsaved, _ := s.Store.Unsaved()
+	readOnlyMu.Lock()
+	manual := readOnlyManual
+	readOnlyMu.Unlock()
+	spoolMu.Lock()
+	open := spoolFile != nil
+	spoolMu.Unlock()
+	return open && unsaved > 0 && !manual && !s.Store.FailedOver()
+}
+
+// Queues a submission in the spool, returning the ID of the receipt it will be stored
+// under. A receipt already waiting, with the same ID or from the same partner with the
+// same external ID, is queued once, and its ID is returned. The submission is only
+// queued once it has been synced to disk.
+func (s *Server) SpoolReceipt(ctx context.Context, receipt Receipt, partner Partner) (string, *Rejection) {
+	receipt.Sandbox = IsSandbox(partner, receipt.Tenant)
+	receipt.Partner = partner.Name
+	if receipt.ID == "" {
+		receipt.ID = IDPrefix(receipt.Sandbox) + s.IDs.NewID(receipt)
+	}
+	submission := SpooledSubmission{Partner: partner.Name, ReceivedAt: s.Clock.Now().UTC(), Receipt: receipt}
+	if trace, ok := TraceFrom(ctx); ok {
+		submission.TraceParent = trace.Traceparent()
+	}
+
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	for _, waiting := range spooled {
+		sameExternal := receipt.ExternalID != "" && waiting.Partner == partner.Name &&
+			waiting.Receipt.ExternalID == receipt.ExternalID && waiting.Receipt.Sandbox == receipt.Sandbox
+		if waiting.Receipt.ID == receipt.ID || sameExternal {
+			return waiting.Receipt.ID, nil
+		}
+	}
+	full := &Rejection{http.StatusServiceUnavailable, codeReadOnly, "Receipts can't be changed right now: changes can't be saved to the data file, and the spool is full. Try again later."}
+	if len(spooled) >= config.SpoolMaxSubmissions {
+		return "", full
+	}
+	line, err := json.Marshal(submission)
+	if err == nil {
+		_, err = spoolFile.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = spoolFile.Sync()
+	}
+	if err != nil {
+		logStorage.Error("Could not spool submission", "id", receipt.ID, "error", err)
+		full.Message = "Receipts can't be changed right now: changes can't be saved to the data file or the spool. Try again later."
+		return "", full
+	}
+	spooled = append(spooled, submission)
+	submissionsSpooled.Add(1)
+	return receipt.ID, nil
+}
+
+// Returns whether a receipt is waiting in the spool, or why it was turned away once it
+// was processed
+func SpoolOutcome(id string) (bool, *Rejection) {
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	pending := slices.ContainsFunc(spooled, func(submission SpooledSubmission) bool {
+		return submission.Receipt.ID == id
+	})
+	return pending, spoolRejections[id]
+}
+
+// Remembers why a spooled submission was turned away; the caller must hold spoolMu
+func rememberSpoolRejection(id string, rejection *Rejection) {
+	spoolRejections[id] = rejection
+	spoolRejectionOrder = append(spoolRejectionOrder, id)
+	for len(spoolRejectionOrder) > config.SpoolMaxSubmissions {
+		delete(spoolRejections, spoolRejectionOrder[0])
+		spoolRejectionOrder = spoolRejectionOrder[1:]
+	}
+}
+
+// Processes a spooled submission as it would have been when it was received, announcing
+// the receipt or remembering why it was turned away
+func (s *Server) processSpooled(ctx context.Context, submission SpooledSubmission) {
+	if trace, ok := ParseTraceparent(submission.TraceParent); ok {
+		ctx = WithTrace(ctx, trace.Child())
+	}
+	now := s.Clock.Now().UTC()
+	partner, found := FindPartner(submission.Partner)
+	var receipt Receipt
+	var rejection *Rejection
+	if !found && submission.Partner != "" {
+		rejection = &Rejection{http.StatusUnauthorized, codeUnknownAPIKey, "The partner that submitted the receipt is no longer recognized."}
+	} else {
+		receipt, _, rejection = s.ProcessReceipt(ctx, submission.Receipt, partner)
+	}
+	if rejection != nil {
+		logStorage.Warn("Spooled submission was turned away", "id", submission.Receipt.ID, "code", rejection.Code)
+		RecordPartnerActivity(submission.Partner, PartnerActivity{Time: now, Event: "receipt_rejected", ReceiptID: submission.Receipt.ID, Detail: rejection.Code})
+		CountRejection(rejection.Code, now)
+		spoolMu.Lock()
+		rememberSpoolRejection(submission.Receipt.ID, rejection)
+		spoolMu.Unlock()
+		return
+	}
+	RecordPartnerActivity(submission.Partner, PartnerActivity{Time: now, Event: "receipt_accepted", ReceiptID: receipt.ID})
+	s.Announce(ctx, "receipt."+receipt.Status, receipt)
+}
+
+// Processes the submissions waiting in the spool, oldest first, while changes can be
+// saved, then rewrites the spool file with those still waiting. A submission processed
+// again after a crash finds its receipt already stored under its ID.
+func (s *Server) drainSpool(ctx context.Context) {
+	spoolMu.Lock()
+	waiting := slices.Clone(spooled)
+	spoolMu.Unlock()
+
+	drained := 0
+	for _, submission := range waiting {
+		if s.ReadOnlyStatus().ReadOnly {
+			break
+		}
+		s.processSpooled(ctx, submission)
+		drained += 1
+	}
+	if drained == 0 {
+		return
+	}
+
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	spooled = spooled[drained:]
+	if spoolFile == nil {
+		return
+	}
+	err := spoolFile.Truncate(0)
+	for i := 0; err == nil && i < len(spooled); i++ {
+		var line []byte
+		line, err = json.Marshal(spooled[i])
+		if err == nil {
+			_, err = spoolFile.Write(append(line, '\n'))
+		}
+	}
+	if err == nil {
+		err = spoolFile.Sync()
+	}
+	if err != nil {
+		logStorage.Error("Could not rewrite the spool file; its submissions will be processed again after a restart", "error", err)
+	}
+	logStorage.Info("Processed spooled submissions", "count", drained, "waiting", len(spooled))
+}
+
+// Processes the submissions waiting in the spool every interval until the context is
+// done, as soon as changes can be saved again
+func (s *Server) DrainSpool(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if SpooledCount() > 0 {
+			s.drainSpool(ctx)
+		}
+	}
+}
+
+/*
+	Below are helpers for answering submissions that are waiting in the spool
+*/
+
+// Answers 202 with the ID a spooled submission will be stored under and its pending
+// status
+func WritePending(w http.ResponseWriter, id string) {
+	w.Header().Set("Retry-After", strconv.Itoa(config.ReadOnlyRetryAfterSeconds))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(PendingResponse{ID: id, Status: spoolPending})
+}
+
+// Lets submissions through to be spooled while changes can't be saved but there is room
+// in the spool; otherwise acts as RejectWhenReadOnly
+func (s *Server) SpoolWhenUnsaved(next http.HandlerFunc) http.HandlerFunc {
+	reject := s.RejectWhenReadOnly(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Spooling() {
+			next(w, r)
+			return
+		}
+		reject(w, r)
+	}
+}
@@ -0,0 +1,123 @@
+package receiptapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Opens an empty spool in a temporary file for a test, and closes and forgets it when the
+// test ends. Returns the file's path.
+func withSpool(t *testing.T) string {
+	t.Helper()
+	reset := func() {
+		CloseSpool()
+		spoolMu.Lock()
+		spooled, spoolRejections, spoolRejectionOrder = nil, map[string]*Rejection{}, nil
+		spoolMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	err := OpenSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSpoolReceipt(t *testing.T) {
+	path := withSpool(t)
+	withConfig(t, func(config *Config) { config.SpoolMaxSubmissions = 2 })
+	s := New()
+	partner := Partner{Name: "acme"}
+
+	first := targetReceipt
+	first.ExternalID = "pos-1"
+	id, rejection := s.SpoolReceipt(context.Background(), first, partner)
+	if rejection != nil || id == "" {
+		t.Fatalf("SpoolReceipt() = %q, %+v", id, rejection)
+	}
+
+	// The same external ID is queued once
+	again, rejection := s.SpoolReceipt(context.Background(), first, partner)
+	if rejection != nil || again != id {
+		t.Errorf("SpoolReceipt() of the same external ID = %q, %+v, want %q", again, rejection, id)
+	}
+
+	tests := []struct {
+		name     string
+		receipt  Receipt
+		wantCode string
+	}{
+		{"another receipt", cornerMarketReceipt, ""},
+		{"spool full", targetReceipt, codeReadOnly},
+	}
+	for _, test := range tests {
+		_, rejection := s.SpoolReceipt(context.Background(), test.receipt, partner)
+		if test.wantCode == "" && rejection != nil || test.wantCode != "" && (rejection == nil || rejection.Code != test.wantCode) {
+			t.Errorf("%s: SpoolReceipt() = %+v, want %q", test.name, rejection, test.wantCode)
+		}
+	}
+
+	// What was queued survives a restart
+	CloseSpool()
+	spoolMu.Lock()
+	spooled = nil
+	spoolMu.Unlock()
+	err := OpenSpool(path)
+	if err != nil || SpooledCount() != 2 {
+		t.Errorf("OpenSpool() = %v with %d waiting, want 2", err, SpooledCount())
+	}
+	if pending, _ := SpoolOutcome(id); !pending {
+		t.Errorf("SpoolOutcome(%q) isn't pending", id)
+	}
+}
+
+func TestDrainSpool(t *testing.T) {
+	path := withSpool(t)
+	s := New()
+	accepted, _ := s.SpoolReceipt(context.Background(), targetReceipt, Partner{})
+	invalid := targetReceipt
+	invalid.Total = "thirty"
+	rejected, _ := s.SpoolReceipt(context.Background(), invalid, Partner{})
+
+	// Submissions are pending until processed
+	get := func(id string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/receipts/"+id, nil), map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		s.GetReceiptByID(w, r)
+		return w
+	}
+	w := get(accepted)
+	var pending PendingResponse
+	json.NewDecoder(w.Body).Decode(&pending)
+	if w.Code != http.StatusAccepted || pending.ID != accepted || pending.Status != spoolPending {
+		t.Errorf("GetReceiptByID() while spooled = %d, %+v, want 202 pending", w.Code, pending)
+	}
+
+	s.drainSpool(context.Background())
+	if SpooledCount() != 0 {
+		t.Errorf("drainSpool() left %d waiting", SpooledCount())
+	}
+	if _, ok := s.Store.Find(accepted); !ok {
+		t.Errorf("drainSpool() didn't store %s under the ID it was given", accepted)
+	}
+	w = get(rejected)
+	var response ErrorResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusBadRequest || response.Code != codeInvalidReceipt {
+		t.Errorf("GetReceiptByID() of a rejected submission = %d, %q, want 400 %s", w.Code, response.Code, codeInvalidReceipt)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.TrimSpace(string(data)) != "" {
+		t.Errorf("spool file = %q after draining, want it empty", data)
+	}
+}
@@ -0,0 +1,373 @@
+package receiptapi
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of statement line made by receipts and expired holds, besides ledger entries
+const (
+	entryEarned      = "earned"
+	entryHoldExpired = "hold_expired"
+)
+
+// Formats a statement can be generated in, and their content types
+var statementFormats = map[string]string{
+	"csv": "text/csv",
+	"pdf": "application/pdf",
+}
+
+// Event type a delivered statement is published under
+const statementEventType = "statement.ready"
+
+// Change to a user's points during a statement's month. Expired holds change nothing,
+// but are listed so the user can see why points held for them came back.
+type StatementLine struct {
+	Date   time.Time `json:"date"`
+	Kind   string    `json:"kind"`
+	Points int64     `json:"points"`
+
+	// Retailer, counterparty or what happened, and the receipt, transfer or redemption
+	Detail    string `json:"detail,omitempty"`
+	Reference string `json:"reference,omitempty"`
+
+	// Points an expired hold had held
+	expired int64
+}
+
+// Points a user had at the start and end of a month, and what changed them. Transfers
+// out include their fees. Points on hold are only taken off once the hold is captured.
+type StatementSummary struct {
+	UserID string `json:"userId"`
+	Month  string `json:"month"`
+
+	OpeningBalance int64 `json:"openingBalance"`
+	Earned         int64 `json:"earned"`
+	TransferredIn  int64 `json:"transferredIn"`
+	TransferredOut int64 `json:"transferredOut"`
+	Redeemed       int64 `json:"redeemed"`
+	ClosingBalance int64 `json:"closingBalance"`
+
+	// Points in holds that expired during the month
+	Expired int64 `json:"expired"`
+
+	GeneratedAt time.Time `json:"generatedAt"`
+}
+
+// Statement of a user's points for a month, with its lines oldest first
+type Statement struct {
+	StatementSummary
+	Lines []StatementLine `json:"lines"`
+}
+
+// Event published when a statement is delivered, with the document itself
+type StatementEvent struct {
+	ID          string           `json:"id"`
+	Type        string           `json:"type"`
+	CreatedAt   time.Time        `json:"createdAt"`
+	Filename    string           `json:"filename"`
+	ContentType string           `json:"contentType"`
+	Content     []byte           `json:"content"`
+	Summary     StatementSummary `json:"summary"`
+}
+
+// Returns every change to a user's points, oldest first; the caller must hold pointsMu
+// and have expired holds. Receipts stored before processing times were kept come first.
+func (s *Server) statementLines(userID string) []StatementLine {
+	lines := []StatementLine{}
+	for _, receipt := range s.Store.All() {
+		points := AwardedPoints(receipt)
+		if receipt.UserID != userID || receipt.Sandbox || points == 0 {
+			continue
+		}
+		date, _ := storedAt(receipt)
+		lines = append(lines, StatementLine{Date: date, Kind: entryEarned, Points: points, Detail: receipt.Retailer, Reference: receipt.ID})
+	}
+	for _, entry := range ledgerEntries(userID) {
+		line := StatementLine{Date: entry.CreatedAt, Kind: entry.Kind, Points: entry.Points, Detail: entry.CounterpartyID, Reference: entry.TransferID}
+		if entry.RedemptionID != "" {
+			line.Reference = entry.RedemptionID
+		}
+		lines = append(lines, line)
+	}
+	for _, redemption := range redemptions {
+		if redemption.UserID == userID && redemption.Status == redemptionExpired {
+			detail := fmt.Sprintf("hold of %d points expired", redemption.Points)
+			lines = append(lines, StatementLine{Date: *redemption.SettledAt, Kind: entryHoldExpired, Detail: detail, Reference: redemption.ID, expired: redemption.Points})
+		}
+	}
+	slices.SortStableFunc(lines, func(a, b StatementLine) int {
+		return cmp.Compare(a.Date.UnixNano(), b.Date.UnixNano())
+	})
+	return lines
+}
+
+// Builds a user's statement for the month starting at a time
+func (s *Server) BuildStatement(userID string, month time.Time) Statement {
+	now := s.Clock.Now().UTC()
+	end := month.AddDate(0, 1, 0)
+	pointsMu.Lock()
+	expireHolds(now)
+	lines := s.statementLines(userID)
+	pointsMu.Unlock()
+
+	statement := Statement{
+		StatementSummary: StatementSummary{UserID: userID, Month: month.Format("2006-01"), GeneratedAt: now},
+		Lines:            []StatementLine{},
+	}
+	for _, line := range lines {
+		if line.Date.Before(month) {
+			statement.OpeningBalance += line.Points
+			continue
+		}
+		if !line.Date.Before(end) {
+			break
+		}
+		statement.Lines = append(statement.Lines, line)
+		switch line.Kind {
+		case entryEarned:
+			statement.Earned += line.Points
+		case entryTransferIn:
+			statement.TransferredIn += line.Points
+		case entryTransferOut, entryTransferFee:
+			statement.TransferredOut -= line.Points
+		case entryRedemption:
+			statement.Redeemed -= line.Points
+		case entryHoldExpired:
+			statement.Expired += line.expired
+		}
+	}
+	statement.ClosingBalance = statement.OpeningBalance + statement.Earned + statement.TransferredIn - statement.TransferredOut - statement.Redeemed
+	return statement
+}
+
+// Writes a statement as CSV: a row per line, between rows for the opening and closing
+// balances
+func WriteStatementCSV(w io.Writer, statement Statement) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"date", "kind", "points", "detail", "reference"})
+	month, _ := time.Parse("2006-01", statement.Month)
+	writer.Write([]string{month.Format(time.DateOnly), "opening_balance", strconv.FormatInt(statement.OpeningBalance, 10), "", ""})
+	for _, line := range statement.Lines {
+		writer.Write([]string{line.Date.Format(time.DateOnly), line.Kind, strconv.FormatInt(line.Points, 10), line.Detail, line.Reference})
+	}
+	closing := month.AddDate(0, 1, -1).Format(time.DateOnly)
+	writer.Write([]string{closing, "closing_balance", strconv.FormatInt(statement.ClosingBalance, 10), "", ""})
+	writer.Flush()
+	return writer.Error()
+}
+
+// Writes a statement as a PDF of monospaced text: the summary, then a line per change
+func WriteStatementPDF(w io.Writer, statement Statement) error {
+	month, _ := time.Parse("2006-01", statement.Month)
+	text := []string{
+		"Points statement",
+		"",
+		"User:       " + statement.UserID,
+		"Period:     " + month.Format(time.DateOnly) + " to " + month.AddDate(0, 1, -1).Format(time.DateOnly),
+		"Generated:  " + statement.GeneratedAt.Format("2006-01-02 15:04 UTC"),
+		"",
+		fmt.Sprintf("%-24s %12d", "Opening balance", statement.OpeningBalance),
+		fmt.Sprintf("%-24s %+12d", "Earned", statement.Earned),
+		fmt.Sprintf("%-24s %+12d", "Transferred in", statement.TransferredIn),
+		fmt.Sprintf("%-24s %+12d", "Transferred out", -statement.TransferredOut),
+		fmt.Sprintf("%-24s %+12d", "Redeemed", -statement.Redeemed),
+		fmt.Sprintf("%-24s %12d", "Closing balance", statement.ClosingBalance),
+		fmt.Sprintf("%-24s %12d", "Expired holds", statement.Expired),
+		"",
+		fmt.Sprintf("%-10s  %-14s %8s  %s", "Date", "Kind", "Points", "Detail"),
+	}
+	for _, line := range statement.Lines {
+		text = append(text, fmt.Sprintf("%-10s  %-14s %+8d  %s", line.Date.Format(time.DateOnly), line.Kind, line.Points, line.Detail))
+	}
+	if len(statement.Lines) == 0 {
+		text = append(text, "No changes to your points this month.")
+	}
+	_, err := w.Write(textPDF(text))
+	return err
+}
+
+// Lines of text on each page of a PDF, and their size and spacing in points
+const (
+	pdfPageLines   = 50
+	pdfFontSize    = 10
+	pdfLineSpacing = 14
+)
+
+// Returns a PDF of US Letter pages showing lines of text in Courier. Text is spelled
+// in ASCII, since the standard fonts have no other encoding we can rely on.
+func textPDF(lines []string) []byte {
+	var pages [][]string
+	for start := 0; start < len(lines); start += pdfPageLines {
+		pages = append(pages, lines[start:min(start+pdfPageLines, len(lines))])
+	}
+
+	// Objects are the catalog, the page tree, the font, then each page and its contents
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+	}
+	kids := []string{}
+	for _, page := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL 50 742 Td\n", pdfFontSize, pdfLineSpacing)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", pdfEscape(line))
+		}
+		content.WriteString("ET")
+		pageID := len(objects) + 1
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pageID+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, object := range objects {
+		offsets = append(offsets, pdf.Len())
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return pdf.Bytes()
+}
+
+// Returns text as a PDF string's contents: in ASCII, with anything else as '?', and
+// backslashes and parentheses escaped
+func pdfEscape(text string) string {
+	var builder strings.Builder
+	for _, r := range transliterate(text) {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			builder.WriteRune('\\')
+			builder.WriteRune(r)
+		case r < ' ' || r > '~':
+			builder.WriteRune('?')
+		default:
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// Returns the month a statement request asks for with ?month=, the current one by
+// default, and the format it asks for with ?format=, CSV by default
+func statementRequest(r *http.Request, now time.Time) (time.Time, string, *Rejection) {
+	query := r.URL.Query()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if query.Get("month") != "" {
+		var err error
+		month, err = time.Parse("2006-01", query.Get("month"))
+		if err != nil {
+			return time.Time{}, "", &Rejection{http.StatusBadRequest, codeInvalidStatement, "month must be a month like 2024-01."}
+		}
+	}
+	format := cmp.Or(query.Get("format"), "csv")
+	if statementFormats[format] == "" {
+		return time.Time{}, "", &Rejection{http.StatusBadRequest, codeInvalidStatement, "format must be csv or pdf."}
+	}
+	return month, format, nil
+}
+
+// Returns a statement as a document in a format
+func statementDocument(statement Statement, format string) ([]byte, error) {
+	var document bytes.Buffer
+	var err error
+	switch format {
+	case "pdf":
+		err = WriteStatementPDF(&document, statement)
+	default:
+		err = WriteStatementCSV(&document, statement)
+	}
+	return document.Bytes(), err
+}
+
+/*
+	Below are the handlers for users' points statements
+*/
+
+// Method to download a user's points statement for a month as CSV or PDF
+func (s *Server) GetStatement(w http.ResponseWriter, r *http.Request) {
+	month, format, rejection := statementRequest(r, s.Clock.Now().UTC())
+	if rejection != nil {
+		w.Header().Set("Content-Type", "application/json")
+		WriteRejection(w, rejection)
+		return
+	}
+	statement := s.BuildStatement(mux.Vars(r)["id"], month)
+	document, err := statementDocument(statement, format)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		WriteError(w, http.StatusInternalServerError, codeInternal, "The statement could not be generated.")
+		return
+	}
+	w.Header().Set("Content-Type", statementFormats[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%s.%s"`, statement.Month, format))
+	w.Write(document)
+}
+
+// Method to generate a user's points statement for a month and publish it to the event
+// broker, for the notification service to send on to the user
+func (s *Server) DeliverStatement(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.Events == nil {
+		WriteError(w, http.StatusServiceUnavailable, codeNotificationsNotConfigured, "Statements can't be delivered without EVENT_PUBLISHER set.")
+		return
+	}
+	month, format, rejection := statementRequest(r, s.Clock.Now().UTC())
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	statement := s.BuildStatement(mux.Vars(r)["id"], month)
+	document, err := statementDocument(statement, format)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, codeInternal, "The statement could not be generated.")
+		return
+	}
+	event := StatementEvent{
+		ID:          GenerateID(),
+		Type:        statementEventType,
+		CreatedAt:   s.Clock.Now().UTC(),
+		Filename:    fmt.Sprintf("statement-%s.%s", statement.Month, format),
+		ContentType: statementFormats[format],
+		Content:     document,
+		Summary:     statement.StatementSummary,
+	}
+	body, _ := json.Marshal(event)
+
+	// Published before responding, so the caller knows whether it will be delivered
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	ctx, span := StartSpan(ctx, "events.publish")
+	err = s.Events.Publish(ctx, statementEventType, body)
+	span.End(logApp, "type", statementEventType)
+	if err != nil {
+		logApp.ErrorContext(ctx, "Could not publish statement", "error", err)
+		WriteError(w, http.StatusBadGateway, codeStatementNotDelivered, "The statement could not be published for delivery.")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(event.Summary)
+}
@@ -0,0 +1,324 @@
+package receiptapi
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most entries a leaderboard returns
+const maxLeaderboardLimit = 100
+
+// Entry on a leaderboard: a user or retailer and the points their receipts earned
+type LeaderboardEntry struct {
+	Rank     int    `json:"rank"`
+	Name     string `json:"name"`
+	Points   int64  `json:"points"`
+	Receipts int    `json:"receipts"`
+}
+
+// Response for a leaderboard
+type LeaderboardResponse struct {
+	By      string             `json:"by"`
+	From    string             `json:"from,omitempty"`
+	To      string             `json:"to,omitempty"`
+	Entries []LeaderboardEntry `json:"entries"`
+}
+
+// Method to rank users or retailers by the points their receipts earned, optionally only
+// counting receipts purchased between ?from= and ?to=. Ties go to the name that sorts first.
+func (s *Server) GetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+
+	by := query.Get("by")
+	if by == "" {
+		by = "user"
+	}
+	if by != "user" && by != "retailer" {
+		WriteError(w, http.StatusBadRequest, codeInvalidQuery, "The by parameter must be user or retailer.")
+		return
+	}
+
+	limit := 10
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxLeaderboardLimit {
+			message := "The limit parameter must be a whole number from 1 to " + strconv.Itoa(maxLeaderboardLimit) + "."
+			WriteError(w, http.StatusBadRequest, codeInvalidQuery, message)
+			return
+		}
+	}
+
+	period, rejection := parsePeriod(s.Clock, query)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+
+	// Total the points awarded, keyed by user ID or normalized retailer name
+	totals := map[string]*LeaderboardEntry{}
+	for _, receipt := range s.Store.All() {
+		if receipt.Sandbox {
+			continue
+		}
+		if !period.Contains(s.Clock, receipt) {
+			continue
+		}
+
+		key, name := receipt.UserID, receipt.UserID
+		if by == "retailer" {
+			key, name = NormalizeRetailer(receipt.Retailer), receipt.Retailer
+		}
+		if key == "" {
+			continue
+		}
+		entry, ok := totals[key]
+		if !ok {
+			// Retailers are shown as first written
+			entry = &LeaderboardEntry{Name: name}
+			totals[key] = entry
+		}
+		entry.Points += AwardedPoints(receipt)
+		entry.Receipts += 1
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(totals))
+	for _, entry := range totals {
+		entries = append(entries, *entry)
+	}
+	slices.SortFunc(entries, func(a, b LeaderboardEntry) int {
+		if a.Points != b.Points {
+			return cmp.Compare(b.Points, a.Points)
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+
+	json.NewEncoder(w).Encode(LeaderboardResponse{
+		By:      by,
+		From:    query.Get("from"),
+		To:      query.Get("to"),
+		Entries: entries,
+	})
+}
+
+// Totals of the points awarded by one scoring rule
+type RuleTotal struct {
+	Rule   string `json:"rule"`
+	Points int64  `json:"points"`
+
+	// Receipts the rule awarded any points to
+	Receipts int `json:"receipts"`
+}
+
+// Response for the points by rule report
+type PointsByRuleResponse struct {
+	From     string      `json:"from,omitempty"`
+	To       string      `json:"to,omitempty"`
+	Receipts int         `json:"receipts"`
+	Points   int64       `json:"points"`
+	Rules    []RuleTotal `json:"rules"`
+}
+
+// Method to total the points awarded by each scoring rule, optionally only counting
+// receipts purchased between ?from= and ?to=. Receipts are broken down with the current
+// rules, so totals match stored points as long as receipts were recalculated after the
+// rules last changed.
+func (s *Server) GetPointsByRuleReport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	period, rejection := parsePeriod(s.Clock, query)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+
+	response := PointsByRuleResponse{From: query.Get("from"), To: query.Get("to")}
+
+	// Every rule is listed, even those no receipt earned points from
+	for _, rule := range s.Rules.PointsByRule(Receipt{}) {
+		response.Rules = append(response.Rules, RuleTotal{Rule: rule.Rule})
+	}
+	for _, receipt := range s.Store.All() {
+		// Only receipts whose points were actually awarded count
+		if receipt.Sandbox || receipt.Status == statusSubmitted || receipt.Status == statusRejected {
+			continue
+		}
+		if !period.Contains(s.Clock, receipt) {
+			continue
+		}
+
+		for i, rule := range PointsByRule(receipt, s.Rules) {
+			response.Points += rule.Points
+			response.Rules[i].Points += rule.Points
+			if rule.Points != 0 {
+				response.Rules[i].Receipts += 1
+			}
+		}
+		response.Receipts += 1
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Receipts counted in part of the heatmap and the points awarded to them
+type HeatmapTotals struct {
+	Receipts int   `json:"receipts"`
+	Points   int64 `json:"points"`
+
+	// Points the afternoon rule awarded, to compare against the rest
+	AfternoonPoints int64 `json:"afternoonPoints"`
+}
+
+// Totals for one hour of one day of the week
+type HeatmapCell struct {
+	Day  string `json:"day"`
+	Hour int    `json:"hour"`
+	HeatmapTotals
+}
+
+// Totals for one hour of the day, across the days of the week
+type HeatmapHour struct {
+	Hour int `json:"hour"`
+	HeatmapTotals
+}
+
+// Totals for one day of the week, across its hours
+type HeatmapDay struct {
+	Day string `json:"day"`
+	HeatmapTotals
+}
+
+// Response for the heatmap: one cell for every hour of every day, Sunday first, and the
+// totals for each hour of the day and each day of the week across the others
+type HeatmapResponse struct {
+	By       string        `json:"by"`
+	From     string        `json:"from,omitempty"`
+	To       string        `json:"to,omitempty"`
+	Receipts int           `json:"receipts"`
+	Points   int64         `json:"points"`
+	Cells    []HeatmapCell `json:"cells"`
+	Hours    []HeatmapHour `json:"hours"`
+	Days     []HeatmapDay  `json:"days"`
+}
+
+// Returns when a receipt falls on the heatmap: when it was purchased, or when it was
+// submitted, in the clock's time zone
+func heatmapTime(clock Clock, receipt Receipt, by string) (time.Time, bool) {
+	if by == "submitted" {
+		if receipt.ProcessedAt == nil {
+			return time.Time{}, false
+		}
+		return receipt.ProcessedAt.In(clock.Location()), true
+	}
+	return purchaseInstant(clock, receipt)
+}
+
+// Method to count receipts and the points awarded to them by hour of the day and day of
+// the week they were purchased, or ?by=submitted, optionally only counting receipts
+// purchased between ?from= and ?to=. Shows whether the afternoon bonus moves purchases.
+func (s *Server) GetHeatmap(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	by := query.Get("by")
+	if by == "" {
+		by = "purchased"
+	}
+	if by != "purchased" && by != "submitted" {
+		WriteError(w, http.StatusBadRequest, codeInvalidQuery, "The by parameter must be purchased or submitted.")
+		return
+	}
+	period, rejection := parsePeriod(s.Clock, query)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+
+	response := HeatmapResponse{By: by, From: query.Get("from"), To: query.Get("to")}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		response.Days = append(response.Days, HeatmapDay{Day: name})
+		for hour := 0; hour < 24; hour++ {
+			response.Cells = append(response.Cells, HeatmapCell{Day: name, Hour: hour})
+		}
+	}
+	for hour := 0; hour < 24; hour++ {
+		response.Hours = append(response.Hours, HeatmapHour{Hour: hour})
+	}
+
+	for _, receipt := range s.Store.All() {
+		if receipt.Sandbox || !period.Contains(s.Clock, receipt) {
+			continue
+		}
+		at, ok := heatmapTime(s.Clock, receipt, by)
+		if !ok {
+			continue
+		}
+		points := AwardedPoints(receipt)
+		var afternoon int64
+		if points > 0 {
+			for _, rule := range PointsByRule(receipt, s.Rules) {
+				if rule.Rule == "afternoon" {
+					afternoon = rule.Points
+				}
+			}
+		}
+		day, hour := int(at.Weekday()), at.Hour()
+		for _, totals := range []*HeatmapTotals{&response.Cells[day*24+hour].HeatmapTotals, &response.Hours[hour].HeatmapTotals, &response.Days[day].HeatmapTotals} {
+			totals.Receipts += 1
+			totals.Points += points
+			totals.AfternoonPoints += afternoon
+		}
+		response.Receipts += 1
+		response.Points += points
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Range of purchase dates a report covers; zero bounds are open
+type period struct {
+	From time.Time
+	To   time.Time
+}
+
+// Reads the optional ?from= and ?to= dates of a report
+func parsePeriod(clock Clock, query url.Values) (period, *Rejection) {
+	from, ok := parseDateParam(clock, query.Get("from"))
+	if !ok {
+		return period{}, &Rejection{http.StatusBadRequest, codeInvalidQuery, "The from parameter must be a date like 2022-01-01."}
+	}
+	to, ok := parseDateParam(clock, query.Get("to"))
+	if !ok {
+		return period{}, &Rejection{http.StatusBadRequest, codeInvalidQuery, "The to parameter must be a date like 2022-01-01."}
+	}
+	return period{from, to}, nil
+}
+
+// Checks whether a receipt was purchased within the period, both ends included
+func (p period) Contains(clock Clock, receipt Receipt) bool {
+	purchaseDate, err := ParseDate(clock, receipt.PurchaseDate)
+	if err != nil {
+		return false
+	}
+	return (p.From.IsZero() || !purchaseDate.Before(p.From)) && (p.To.IsZero() || !purchaseDate.After(p.To))
+}
+
+// Parses an optional date query parameter; an empty value gives the zero time
+func parseDateParam(clock Clock, value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, true
+	}
+	date, err := ParseDate(clock, value)
+	return date, err == nil
+}
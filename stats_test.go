@@ -0,0 +1,58 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetPointsByRuleReport(t *testing.T) {
+	s := New()
+	for _, receipt := range []Receipt{targetReceipt, cornerMarketReceipt, targetReceipt, cornerMarketReceipt} {
+		receipt.ID, receipt.Status = GenerateID(), statusProcessed
+		s.Store.Add(receipt)
+	}
+	// Neither rejected nor sandbox receipts count
+	rejected, sandbox := targetReceipt, targetReceipt
+	rejected.ID, rejected.Status = GenerateID(), statusRejected
+	sandbox.ID, sandbox.Status, sandbox.Sandbox = GenerateID(), statusProcessed, true
+	s.Store.Add(rejected)
+	s.Store.Add(sandbox)
+
+	tests := []struct {
+		name      string
+		query     string
+		receipts  int
+		points    int64
+		afternoon RuleTotal
+	}{
+		{"all", "", 4, 2 * (28 + 109), RuleTotal{"afternoon", 20, 2}},
+		{"from", "?from=2022-02-01", 2, 2 * 109, RuleTotal{"afternoon", 20, 2}},
+		{"to", "?to=2022-01-01", 2, 2 * 28, RuleTotal{"afternoon", 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.GetPointsByRuleReport(w, httptest.NewRequest("GET", "/stats/points-by-rule"+test.query, nil))
+			var response PointsByRuleResponse
+			json.NewDecoder(w.Body).Decode(&response)
+			var afternoon RuleTotal
+			for _, rule := range response.Rules {
+				if rule.Rule == "afternoon" {
+					afternoon = rule
+				}
+			}
+			if response.Receipts != test.receipts || response.Points != test.points || afternoon != test.afternoon {
+				t.Errorf("GetPointsByRuleReport() = %d receipts, %d points, %+v, want %d, %d, %+v",
+					response.Receipts, response.Points, afternoon, test.receipts, test.points, test.afternoon)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	s.GetPointsByRuleReport(w, httptest.NewRequest("GET", "/stats/points-by-rule?from=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GetPointsByRuleReport() status = %d for an invalid date, want %d", w.Code, http.StatusBadRequest)
+	}
+}
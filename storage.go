@@ -0,0 +1,225 @@
+package receiptapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Loads receipts from a data file. Each line holds a receipt as JSON; a receipt changed
+// after it was stored appears again further down, and its last line wins. A missing file
+// holds no receipts.
+func LoadReceipts(path string) ([]Receipt, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var loaded []Receipt
+	positions := map[string]int{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var receipt Receipt
+		err = json.Unmarshal(scanner.Bytes(), &receipt)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		position, seen := positions[receipt.ID]
+		if seen {
+			loaded[position] = receipt
+		} else {
+			positions[receipt.ID] = len(loaded)
+			loaded = append(loaded, receipt)
+		}
+	}
+	return loaded, scanner.Err()
+}
+
+// Rewrites a data file with one line per receipt, dropping lines that were superseded.
+// The new file is written alongside and renamed over the old one, so a crash midway
+// leaves the old file intact.
+func SaveReceipts(path string, receipts []Receipt) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	writer := bufio.NewWriter(temp)
+	encoder := json.NewEncoder(writer)
+	for _, receipt := range receipts {
+		err = encoder.Encode(receipt)
+		if err != nil {
+			temp.Close()
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = temp.Sync()
+	}
+	closeErr := temp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// Loads the receipts stored in a data file and opens it so changes are appended to it.
+// Does nothing if no data file is configured.
+func (s *ReceiptStore) Open(path string) error {
+	if path == "" {
+		return nil
+	}
+	loaded, err := LoadReceipts(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	s.Replace(loaded)
+	s.mu.Lock()
+	s.file, s.path = file, path
+	s.mu.Unlock()
+	logStorage.Info("Loaded receipts", "count", len(loaded), "path", path)
+	return nil
+}
+
+// Closes the data file, waiting for any change being saved to finish
+func (s *ReceiptStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	if len(s.unsaved) > 0 && s.flush() != nil {
+		logStorage.Error("Could not save receipts before closing the data file", "bytes", len(s.unsaved))
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Appends a new or changed receipt to the data file, if one is open; the caller must
+// hold mu. If it can't be written, it waits with any earlier ones that couldn't, and the
+// server is read-only until they are. It is saved to the fallback too when it can't be
+// written, and every change is while failed over, in case the data file can't be
+// trusted. During a storage migration it is written to the target too.
+func (s *ReceiptStore) persist(receipt Receipt) {
+	s.writeMirror(receipt)
+	if s.file == nil {
+		return
+	}
+	line, err := json.Marshal(receipt)
+	if err != nil {
+		logStorage.Error("Could not save receipt", "id", receipt.ID, "error", err)
+		return
+	}
+	failing := len(s.unsaved) > 0
+	s.unsaved = append(s.unsaved, append(line, '\n')...)
+	err = s.flush()
+	if err != nil || s.health.FailedOver {
+		s.writeFallback(receipt)
+	}
+	if err != nil && !failing {
+		s.unsavedSince = time.Now()
+		logStorage.Error("Could not save receipt, so changes are refused until it can be", "id", receipt.ID, "error", err)
+	}
+}
+
+// Appends the lines waiting to be saved to the data file, keeping whatever wasn't
+// written; the caller must hold mu
+func (s *ReceiptStore) flush() error {
+	if s.file == nil {
+		return errors.New("the data file is not open")
+	}
+	written, err := s.file.Write(s.unsaved)
+	s.unsaved = s.unsaved[written:]
+	if len(s.unsaved) == 0 {
+		s.unsaved = nil
+	}
+	return err
+}
+
+// Returns how many bytes of changes are waiting to be saved, and since when
+func (s *ReceiptStore) Unsaved() (int, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.unsaved), s.unsavedSince
+}
+
+// Tries to save the changes waiting to be, every interval until the context is done
+func (s *ReceiptStore) RetryUnsaved(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if len(s.unsaved) > 0 {
+			err := s.flush()
+			if err != nil {
+				logStorage.Warn("Still could not save receipts", "error", err)
+			} else {
+				logStorage.Info("Saved the receipts that were waiting, so changes are accepted again")
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+/*
+	Below are helpers for the lock that keeps the server and admin commands from
+	changing the data file at the same time
+*/
+
+// Returns the path of the lock file for a data file
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// Takes the lock on a data file, failing if the server or another command holds it
+func LockDataFile(path string) error {
+	file, err := os.OpenFile(lockPath(path), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s is in use by the server or another command; if neither is running, remove %s",
+			path, lockPath(path))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(file, os.Getpid())
+	return file.Close()
+}
+
+// Releases the lock on a data file
+func UnlockDataFile(path string) {
+	os.Remove(lockPath(path))
+}
@@ -0,0 +1,348 @@
+package receiptapi
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Holds all receipts in memory, normally would be a database. Changes are appended to
+// a data file if one is open.
+type ReceiptStore struct {
+	// Guards every field, since exports read while new receipts are being added
+	mu sync.RWMutex
+
+	receipts []Receipt
+
+	// Receipt IDs keyed by short code
+	shortCodes map[string]string
+
+	// Receipt IDs keyed by partner and the partner's own ID for the receipt
+	externalIDs map[string]string
+
+	// How many receipts each user has, so users can be told from strangers without a scan
+	users map[string]int
+
+	// Data file new and changed receipts are appended to, if one is open, and its path
+	file *os.File
+	path string
+
+	// Lines that couldn't be appended to the data file, written ahead of any later change
+	// once it can be written again, and when the first of them failed
+	unsaved      []byte
+	unsavedSince time.Time
+
+	// Latest link in the hash chain over accepted production receipts and the changes to
+	// them; kept when that receipt is deleted, so the next one doesn't take its place
+	chainHead ChainLink
+
+	// Backend changes are also written to during a storage migration, and how many
+	// couldn't be
+	mirror         ReceiptBackend
+	mirrorFailures int
+
+	// Backend changes are saved to while the data file is failing, and its health
+	fallback ReceiptBackend
+	health   StorageHealth
+}
+
+// Returns an empty store that only keeps receipts in memory
+func NewReceiptStore() *ReceiptStore {
+	return &ReceiptStore{shortCodes: map[string]string{}, externalIDs: map[string]string{}, users: map[string]int{}}
+}
+
+// Returns the receipt with the given ID, and whether it was found
+func (s *ReceiptStore) Find(id string) (Receipt, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.index(id)
+	if i < 0 {
+		return Receipt{}, false
+	}
+	return s.receipts[i], true
+}
+
+// Returns the position of the receipt with the given ID, or -1; the caller must hold mu
+func (s *ReceiptStore) index(id string) int {
+	for i, receipt := range s.receipts {
+		if receipt.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the receipt a partner submitted with its own ID, and whether there is one.
+// Sandbox receipts have IDs of their own, apart from production ones.
+func (s *ReceiptStore) FindExternal(partner string, externalID string, sandbox bool) (Receipt, bool) {
+	if externalID == "" {
+		return Receipt{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.externalIDs[externalKey(partner, externalID, sandbox)]
+	if !ok {
+		return Receipt{}, false
+	}
+	return s.receipts[s.index(id)], true
+}
+
+// Returns the key of a partner's own ID in the index
+func externalKey(partner string, externalID string, sandbox bool) string {
+	if sandbox {
+		return partner + "\x00" + externalID + "\x00sandbox"
+	}
+	return partner + "\x00" + externalID
+}
+
+// Returns whether any stored receipt belongs to the user
+func (s *ReceiptStore) HasUser(userID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return userID != "" && s.users[userID] > 0
+}
+
+// Moves a receipt from one user to another in the index, when its user changes; the
+// caller must hold mu
+func (s *ReceiptStore) moveUser(before string, after string) {
+	if before == after {
+		return
+	}
+	if before != "" {
+		s.users[before] -= 1
+		if s.users[before] == 0 {
+			delete(s.users, before)
+		}
+	}
+	if after != "" {
+		s.users[after] += 1
+	}
+}
+
+// Returns how many receipts are stored
+func (s *ReceiptStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.receipts)
+}
+
+// Returns a copy of every stored receipt, in the order they were stored
+func (s *ReceiptStore) All() []Receipt {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.receipts)
+}
+
+// Stores a new receipt under a short code of its own and returns it as stored. If a
+// receipt with the same ID, or from the same partner with the same external ID, is
+// already stored, that one is returned instead.
+func (s *ReceiptStore) Add(receipt Receipt) Receipt {
+	stored, _ := s.Insert(receipt)
+	return stored
+}
+
+// Adds a receipt as Add does, and tells whether it was added rather than one already
+// stored being returned
+func (s *ReceiptStore) Insert(receipt Receipt) (Receipt, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(receipt.ID)
+	if i >= 0 {
+		return s.receipts[i], false
+	}
+	if receipt.ExternalID != "" {
+		id, ok := s.externalIDs[externalKey(receipt.Partner, receipt.ExternalID, receipt.Sandbox)]
+		if ok {
+			return s.receipts[s.index(id)], false
+		}
+		s.externalIDs[externalKey(receipt.Partner, receipt.ExternalID, receipt.Sandbox)] = receipt.ID
+	}
+	receipt.ShortCode = s.newShortCode()
+	receipt.UpdatedAt = updatedNow()
+	if !receipt.Sandbox {
+		s.chainHead = ChainLink{
+			Sequence:     s.chainHead.Sequence + 1,
+			PreviousHash: s.chainHead.Hash,
+			Hash:         chainHash(s.chainHead.Hash, receipt),
+		}
+		link := s.chainHead
+		receipt.Chain = &link
+	}
+	s.receipts = append(s.receipts, receipt)
+	s.shortCodes[receipt.ShortCode] = receipt.ID
+	s.moveUser("", receipt.UserID)
+	s.persist(receipt)
+	return receipt, true
+}
+
+// Changes the stored receipt with the given ID while holding the lock. modify returns
+// whether it changed anything, so unchanged receipts aren't saved again. Returns the
+// receipt as it is now, or false if there isn't one.
+func (s *ReceiptStore) Modify(id string, modify func(receipt *Receipt) bool) (Receipt, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return Receipt{}, false
+	}
+	user := s.receipts[i].UserID
+	if modify(&s.receipts[i]) {
+		s.receipts[i].UpdatedAt = updatedNow()
+		s.persist(s.receipts[i])
+	}
+	s.moveUser(user, s.receipts[i].UserID)
+	return s.receipts[i], true
+}
+
+// Changes the stored receipt with the given ID as Modify does, chaining the change as a
+// link of its own when the receipt is in the chain
+func (s *ReceiptStore) ModifyChained(id string, change string, modify func(receipt *Receipt) bool) (Receipt, bool) {
+	return s.Modify(id, func(receipt *Receipt) bool {
+		if !modify(receipt) {
+			return false
+		}
+		s.chainHead = chainChange(s.chainHead, receipt, change)
+		return true
+	})
+}
+
+// Applies modify to every stored receipt while holding the lock; returns how many it
+// changed
+func (s *ReceiptStore) ModifyAll(modify func(receipt *Receipt) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for i := range s.receipts {
+		user := s.receipts[i].UserID
+		if modify(&s.receipts[i]) {
+			s.receipts[i].UpdatedAt = updatedNow()
+			s.persist(s.receipts[i])
+			count += 1
+		}
+		s.moveUser(user, s.receipts[i].UserID)
+	}
+	return count
+}
+
+// Returns the current time to mark a receipt as changed. The system clock is used even
+// when the server has another, since changes are synced from it.
+func updatedNow() *time.Time {
+	now := time.Now().UTC()
+	return &now
+}
+
+// Returns the latest link in the hash chain, or false if no receipt was chained yet
+func (s *ReceiptStore) ChainHead() (ChainLink, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.chainHead, s.chainHead.Sequence > 0
+}
+
+// Returns the ID of the receipt with the given short code, or the argument unchanged if
+// it isn't a known short code
+func (s *ReceiptStore) ResolveShortCode(code string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.shortCodes[NormalizeShortCode(code)]
+	if ok {
+		return id
+	}
+	return code
+}
+
+// Makes sure a receipt has a short code of its own and the index points at it; returns
+// false if there is no receipt with the ID
+func (s *ReceiptStore) Reindex(id string) bool {
+	_, found := s.Modify(id, func(receipt *Receipt) bool {
+		owner, taken := s.shortCodes[receipt.ShortCode]
+		changed := false
+		if receipt.ShortCode == "" || (taken && owner != receipt.ID) {
+			receipt.ShortCode = s.newShortCode()
+			changed = true
+		}
+		s.shortCodes[receipt.ShortCode] = receipt.ID
+		return changed
+	})
+	return found
+}
+
+// Replaces every stored receipt and rebuilds the indexes
+func (s *ReceiptStore) Replace(receipts []Receipt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replace(receipts)
+}
+
+// Removes the receipts with the given IDs and returns how many were stored. An open data
+// file is rewritten without them, since appending can't remove a receipt.
+func (s *ReceiptStore) Delete(ids map[string]bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := make([]Receipt, 0, len(s.receipts))
+	for _, receipt := range s.receipts {
+		if !ids[receipt.ID] {
+			kept = append(kept, receipt)
+		}
+	}
+	deleted := len(s.receipts) - len(kept)
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	var err error
+	if s.file != nil {
+		err = SaveReceipts(s.path, kept)
+		if err != nil {
+			return 0, err
+		}
+		// The rewritten file holds every change, including any that were waiting
+		s.unsaved = nil
+		// The old file was replaced, so later changes must be appended to the new one
+		s.file.Close()
+		s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			s.file = nil
+			err = fmt.Errorf("could not reopen data file, so changes are no longer saved: %w", err)
+		}
+	}
+	s.replace(kept)
+	removed := []string{}
+	for id := range ids {
+		removed = append(removed, id)
+	}
+	s.deleteMirror(removed)
+	return deleted, err
+}
+
+// Replaces every stored receipt and rebuilds the indexes; the caller must hold mu
+func (s *ReceiptStore) replace(receipts []Receipt) {
+	s.receipts = receipts
+	s.shortCodes = map[string]string{}
+	s.externalIDs = map[string]string{}
+	s.users = map[string]int{}
+	for _, receipt := range receipts {
+		s.moveUser("", receipt.UserID)
+		if receipt.ShortCode != "" {
+			s.shortCodes[receipt.ShortCode] = receipt.ID
+		}
+		if receipt.ExternalID != "" {
+			s.externalIDs[externalKey(receipt.Partner, receipt.ExternalID, receipt.Sandbox)] = receipt.ID
+		}
+	}
+	if head := chainHeadOf(receipts); head.Sequence > s.chainHead.Sequence {
+		s.chainHead = head
+	}
+}
+
+// Returns a short code no stored receipt uses yet; the caller must hold mu
+func (s *ReceiptStore) newShortCode() string {
+	for {
+		code := GenerateShortCode()
+		_, taken := s.shortCodes[code]
+		if !taken {
+			return code
+		}
+	}
+}
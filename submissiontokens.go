@@ -0,0 +1,150 @@
+package receiptapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Response with a new submission token
+type SubmissionTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Single use tokens a frontend sends with a submission, so a second click on the same
+// form is turned away instead of submitting the receipt twice
+type SubmissionTokenStore struct {
+	mu sync.Mutex
+
+	// Tokens keyed by value; used ones are kept until they expire, to tell a repeated
+	// submission from an unknown token
+	tokens map[string]*submissionToken
+
+	// When expired tokens are next cleared out
+	nextSweep time.Time
+}
+
+// Partner a submission token was issued to, when it expires and whether it was used
+type submissionToken struct {
+	partner string
+	expires time.Time
+	used    bool
+}
+
+// Returns an empty submission token store
+func NewSubmissionTokenStore() *SubmissionTokenStore {
+	return &SubmissionTokenStore{tokens: map[string]*submissionToken{}}
+}
+
+// Issues a token for one submission by a partner, valid until it expires
+func (t *SubmissionTokenStore) Issue(partner string, now time.Time, expires time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+	token := randomHex(16)
+	t.tokens[token] = &submissionToken{partner: partner, expires: expires}
+	return token
+}
+
+// Uses up a partner's token, returning why it can't be used if it can't
+func (t *SubmissionTokenStore) Use(partner string, token string, now time.Time) *Rejection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+	issued, ok := t.tokens[token]
+	if !ok || issued.partner != partner || now.After(issued.expires) {
+		return &Rejection{http.StatusBadRequest, codeInvalidSubmissionToken, "The submission token is unknown or has expired; request a new one."}
+	}
+	if issued.used {
+		return &Rejection{http.StatusConflict, codeSubmissionTokenUsed, "A receipt was already submitted with this submission token."}
+	}
+	issued.used = true
+	return nil
+}
+
+// Makes a partner's used token usable again, when the submission it was used for was
+// turned away
+func (t *SubmissionTokenStore) Release(partner string, token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	issued, ok := t.tokens[token]
+	if ok && issued.partner == partner {
+		issued.used = false
+	}
+}
+
+// Clears out expired tokens at most once a minute; the caller must hold mu
+func (t *SubmissionTokenStore) sweep(now time.Time) {
+	if now.Before(t.nextSweep) {
+		return
+	}
+	for token, issued := range t.tokens {
+		if now.After(issued.expires) {
+			delete(t.tokens, token)
+		}
+	}
+	t.nextSweep = now.Add(time.Minute)
+}
+
+// Checks the X-Submission-Token header of a submission and uses the token up, returning
+// a function that releases it again for when the submission is then turned away, so a
+// token is only spent on a submission that passed. Submissions without an API key, and
+// from partners that require one, are turned away without a token; for others it is
+// checked if given.
+func (s *Server) CheckSubmissionToken(r *http.Request, partner Partner) (func(), *Rejection) {
+	keep := func() {}
+	token := r.Header.Get("X-Submission-Token")
+	if token == "" {
+		switch {
+		case partner.Name == "":
+			return keep, &Rejection{http.StatusBadRequest, codeInvalidSubmissionToken, "Submissions without an X-API-Key need an X-Submission-Token header from POST /receipts/submission-tokens."}
+		case partner.RequireSubmissionToken:
+			return keep, &Rejection{http.StatusBadRequest, codeInvalidSubmissionToken, "Submissions from this partner need an X-Submission-Token header from POST /receipts/submission-tokens."}
+		}
+		return keep, nil
+	}
+	rejection := s.SubmissionTokens.Use(partner.Name, token, s.Clock.Now())
+	if rejection != nil {
+		return keep, rejection
+	}
+	return func() { s.SubmissionTokens.Release(partner.Name, token) }, nil
+}
+
+// Gets a submission token from the server at the base URL, for the loadtest and
+// conformance commands to submit with when they have no API key
+func FetchSubmissionToken(ctx context.Context, client *http.Client, base string) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/receipts/submission-tokens", nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("submission token request returned status %d", response.StatusCode)
+	}
+	var created SubmissionTokenResponse
+	err = json.NewDecoder(response.Body).Decode(&created)
+	return created.Token, err
+}
+
+// Method to issue a single use token for the calling partner's next submission
+func (s *Server) CreateSubmissionToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	partner, ok := GetPartner(r)
+	if !ok {
+		WriteError(w, http.StatusUnauthorized, codeUnknownAPIKey, "The API key is not recognized.")
+		return
+	}
+	now := s.Clock.Now()
+	expires := now.Add(time.Duration(config.SubmissionTokenTTLSeconds) * time.Second)
+	token := s.SubmissionTokens.Issue(partner.Name, now, expires)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(SubmissionTokenResponse{Token: token, ExpiresAt: expires.UTC()})
+}
@@ -0,0 +1,41 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeylessSubmissionToken(t *testing.T) {
+	s := New()
+	valid, _ := json.Marshal(targetReceipt)
+	now := s.Clock.Now()
+	token := s.SubmissionTokens.Issue("", now, now.Add(time.Hour))
+
+	steps := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+		code   string
+	}{
+		{"without a token", "", string(valid), http.StatusBadRequest, codeInvalidSubmissionToken},
+		{"invalid receipt", token, `{"retailer": "Target"}`, http.StatusBadRequest, codeInvalidReceipt},
+		{"token kept after the invalid receipt", token, string(valid), http.StatusOK, ""},
+		{"token used again", token, string(valid), http.StatusConflict, codeSubmissionTokenUsed},
+	}
+	for _, step := range steps {
+		r := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(step.body))
+		r.Header.Set("X-Submission-Token", step.token)
+		w := httptest.NewRecorder()
+		s.CreateReceipt(w, r)
+		var response ErrorResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		if w.Code != step.status || response.Code != step.code {
+			t.Errorf("%s: CreateReceipt() = %d, %q, want %d, %q", step.name, w.Code, response.Code, step.status, step.code)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package receiptapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Types of receipt event a subscription can be for
+var subscriptionEventTypes = []string{
+	"receipt.processed",
+	"receipt.submitted",
+	"receipt.approved",
+	"receipt.rejected",
+	"receipt.corrected",
+	"receipt.recalculated",
+}
+
+// Registration of a URL to be sent the receipt events that match its filters, signed with
+// its own secret, whichever partner submitted the receipts
+type Subscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+
+	// Types of event sent, such as "receipt.processed"; every type when empty
+	EventTypes []string `json:"eventTypes"`
+
+	// Only events about receipts for this tenant, from this retailer, matched however
+	// it's spaced or cased, and awarded at least these points, when set
+	Tenant    string `json:"tenant,omitempty"`
+	Retailer  string `json:"retailer,omitempty"`
+	MinPoints int64  `json:"minPoints,omitempty"`
+
+	// Whether it is sent events about sandbox receipts instead of production ones
+	Sandbox bool `json:"sandbox"`
+
+	// Only returned when the subscription is created
+	SigningSecret string `json:"signingSecret,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// Set in the log when the subscription is deleted
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Body of a request to create a subscription or replace its URL and filters
+type SubscriptionRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventTypes"`
+	Tenant     string   `json:"tenant"`
+	Retailer   string   `json:"retailer"`
+	MinPoints  int64    `json:"minPoints"`
+	Sandbox    bool     `json:"sandbox"`
+}
+
+// Response listing subscriptions
+type SubscriptionListResponse struct {
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+// Subscriptions keyed by ID
+var subscriptions = map[string]*Subscription{}
+
+// Guards subscriptions and the log file
+var subscriptionsMu sync.Mutex
+
+// Log file every change to a subscription is appended to, if one is open
+var subscriptionLog *os.File
+
+// Loads subscriptions from a log file, then keeps it open to append to. Each line holds a
+// subscription as JSON; it appears again each time it changes, and its last line wins.
+func OpenSubscriptionLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		line := 0
+		for scanner.Scan() {
+			line += 1
+			var subscription Subscription
+			err = json.Unmarshal(scanner.Bytes(), &subscription)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			if subscription.Deleted {
+				delete(subscriptions, subscription.ID)
+				continue
+			}
+			subscriptions[subscription.ID] = &subscription
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+	}
+
+	subscriptionLog, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	return err
+}
+
+// Appends a subscription as it is now to the log file, if one is open; the caller must
+// hold subscriptionsMu
+func persistSubscription(subscription *Subscription) error {
+	if subscriptionLog == nil {
+		return nil
+	}
+	line, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+	_, err = subscriptionLog.Write(append(line, '\n'))
+	return err
+}
+
+// Returns a subscription as it is listed, without its signing secret
+func (subscription Subscription) listed() Subscription {
+	subscription.SigningSecret = ""
+	subscription.EventTypes = slices.Clone(subscription.EventTypes)
+	return subscription
+}
+
+// Returns whether a subscription is sent an event of the given type about a receipt
+func (subscription Subscription) matches(eventType string, receipt Receipt) bool {
+	switch {
+	case len(subscription.EventTypes) > 0 && !slices.Contains(subscription.EventTypes, eventType):
+		return false
+	case subscription.Sandbox != receipt.Sandbox:
+		return false
+	case subscription.Tenant != "" && subscription.Tenant != receipt.Tenant:
+		return false
+	case subscription.Retailer != "" && NormalizeRetailer(subscription.Retailer) != NormalizeRetailer(receipt.Retailer):
+		return false
+	}
+	return AwardedPoints(receipt) >= subscription.MinPoints
+}
+
+// Checks a subscription request, returning why it can't be used
+func checkSubscriptionRequest(request SubscriptionRequest) string {
+	if !CheckWebhookURL(request.URL) {
+		return "The URL must be an absolute http or https URL."
+	}
+	for _, eventType := range request.EventTypes {
+		if !slices.Contains(subscriptionEventTypes, eventType) {
+			return "Unknown event type " + eventType + "; types are " + strings.Join(subscriptionEventTypes, ", ") + "."
+		}
+	}
+	if request.MinPoints < 0 {
+		return "minPoints must not be negative."
+	}
+	return ""
+}
+
+// Sends an event about a receipt to every subscription it matches. Each delivery is a
+// webhook event of its own, retried and redelivered like those sent to partners.
+func (s *Server) NotifySubscribers(ctx context.Context, receiptEvent ReceiptEvent, receipt Receipt, body []byte) {
+	var matched []string
+	subscriptionsMu.Lock()
+	for _, subscription := range subscriptions {
+		if subscription.matches(receiptEvent.Type, receipt) {
+			matched = append(matched, subscription.ID)
+		}
+	}
+	subscriptionsMu.Unlock()
+
+	for _, id := range matched {
+		event := &WebhookEvent{
+			ID:           GenerateID(),
+			Type:         receiptEvent.Type,
+			Subscription: id,
+			ReceiptID:    receipt.ID,
+			CreatedAt:    receiptEvent.CreatedAt,
+			Status:       webhookPending,
+			Payload:      body,
+			Attempts:     []WebhookAttempt{},
+		}
+		if trace, ok := TraceFrom(ctx); ok {
+			event.TraceParent = trace.Traceparent()
+		}
+		s.sendWebhook(event)
+	}
+}
+
+// Returns the subscription with the given ID, if there is one
+func FindSubscription(id string) (Subscription, bool) {
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	subscription, ok := subscriptions[id]
+	if !ok {
+		return Subscription{}, false
+	}
+	return *subscription, true
+}
+
+/*
+	Below are the handlers for managing subscriptions
+*/
+
+// Decodes and checks the subscription request in a body, writing the error if it isn't
+// valid
+func decodeSubscriptionRequest(w http.ResponseWriter, r *http.Request) (SubscriptionRequest, bool) {
+	var request SubscriptionRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidSubscription, "The subscription is not valid JSON with only known fields.")
+		return request, false
+	}
+	request.Tenant = strings.TrimSpace(request.Tenant)
+	request.Retailer = strings.TrimSpace(request.Retailer)
+	message := checkSubscriptionRequest(request)
+	if message != "" {
+		WriteError(w, http.StatusBadRequest, codeInvalidSubscription, message)
+		return request, false
+	}
+	if request.EventTypes == nil {
+		request.EventTypes = []string{}
+	}
+	return request, true
+}
+
+// Method to create a subscription, returning it with a new signing secret, which is only
+// ever returned here
+func (s *Server) CreateSubscription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	request, ok := decodeSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+	now := s.Clock.Now().UTC()
+	subscription := &Subscription{
+		ID:            uuid.New().String(),
+		URL:           request.URL,
+		EventTypes:    request.EventTypes,
+		Tenant:        request.Tenant,
+		Retailer:      request.Retailer,
+		MinPoints:     request.MinPoints,
+		Sandbox:       request.Sandbox,
+		SigningSecret: generateSecret(),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	subscriptionsMu.Lock()
+	err := persistSubscription(subscription)
+	if err == nil {
+		subscriptions[subscription.ID] = subscription
+	}
+	subscriptionsMu.Unlock()
+	if err != nil {
+		logApp.Error("Could not write subscription log", "error", err)
+		WriteError(w, http.StatusInternalServerError, codeInternal, "The subscription could not be saved.")
+		return
+	}
+	logApp.Info("Subscription created", "subscriptionId", subscription.ID, "url", subscription.URL)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(subscription)
+}
+
+// Method to list subscriptions, oldest first
+func ListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	list := []Subscription{}
+	subscriptionsMu.Lock()
+	for _, subscription := range subscriptions {
+		list = append(list, subscription.listed())
+	}
+	subscriptionsMu.Unlock()
+	slices.SortFunc(list, func(a, b Subscription) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	json.NewEncoder(w).Encode(SubscriptionListResponse{Subscriptions: list})
+}
+
+// Method to get a subscription
+func GetSubscription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	subscription, ok := FindSubscription(mux.Vars(r)["id"])
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeSubscriptionNotFound, "No subscription found for that ID.")
+		return
+	}
+	json.NewEncoder(w).Encode(subscription.listed())
+}
+
+// Method to replace a subscription's URL and filters; it keeps its signing secret
+func (s *Server) UpdateSubscription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	request, ok := decodeSubscriptionRequest(w, r)
+	if !ok {
+		return
+	}
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	subscription, found := subscriptions[mux.Vars(r)["id"]]
+	if !found {
+		WriteError(w, http.StatusNotFound, codeSubscriptionNotFound, "No subscription found for that ID.")
+		return
+	}
+	changed := *subscription
+	changed.URL = request.URL
+	changed.EventTypes = request.EventTypes
+	changed.Tenant = request.Tenant
+	changed.Retailer = request.Retailer
+	changed.MinPoints = request.MinPoints
+	changed.Sandbox = request.Sandbox
+	changed.UpdatedAt = s.Clock.Now().UTC()
+	err := persistSubscription(&changed)
+	if err != nil {
+		logApp.Error("Could not write subscription log", "error", err)
+		WriteError(w, http.StatusInternalServerError, codeInternal, "The subscription could not be saved.")
+		return
+	}
+	*subscription = changed
+	json.NewEncoder(w).Encode(changed.listed())
+}
+
+// Method to delete a subscription; events already raised for it are no longer delivered
+func (s *Server) DeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	subscription, found := subscriptions[mux.Vars(r)["id"]]
+	if !found {
+		w.Header().Set("Content-Type", "application/json")
+		WriteError(w, http.StatusNotFound, codeSubscriptionNotFound, "No subscription found for that ID.")
+		return
+	}
+	deleted := Subscription{ID: subscription.ID, UpdatedAt: s.Clock.Now().UTC(), Deleted: true}
+	err := persistSubscription(&deleted)
+	if err != nil {
+		logApp.Error("Could not write subscription log", "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		WriteError(w, http.StatusInternalServerError, codeInternal, "The subscription could not be deleted.")
+		return
+	}
+	delete(subscriptions, subscription.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,210 @@
+package receiptapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Trace a piece of work belongs to and the span it is, as carried by W3C traceparent and
+// B3 headers, so a receipt can be followed through other systems without full OTel
+type TraceContext struct {
+	// 32 lowercase hex digits shared by every span of the trace
+	TraceID string
+
+	// 16 lowercase hex digits identifying this span, and the span that started it, if any
+	SpanID   string
+	ParentID string
+
+	Sampled bool
+}
+
+// Part of the program doing traced work, logged with how long it took when it ends
+type Span struct {
+	Name  string
+	Trace TraceContext
+
+	ctx   context.Context
+	start time.Time
+}
+
+// Key the trace is kept under in a context
+type traceKey struct{}
+
+// Returns a new trace with a root span
+func NewTrace() TraceContext {
+	return TraceContext{TraceID: randomHex(16), SpanID: randomHex(8), Sampled: true}
+}
+
+// Returns a span of the same trace started by this one
+func (t TraceContext) Child() TraceContext {
+	return TraceContext{TraceID: t.TraceID, SpanID: randomHex(8), ParentID: t.SpanID, Sampled: t.Sampled}
+}
+
+// Formats the span as a W3C traceparent header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+func (t TraceContext) Traceparent() string {
+	flags := "00"
+	if t.Sampled {
+		flags = "01"
+	}
+	return "00-" + t.TraceID + "-" + t.SpanID + "-" + flags
+}
+
+// Formats the span as a B3 single header, e.g.
+// "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1-05e3ac9a4f6e3b90"
+func (t TraceContext) B3() string {
+	sampled := "0"
+	if t.Sampled {
+		sampled = "1"
+	}
+	value := t.TraceID + "-" + t.SpanID + "-" + sampled
+	if t.ParentID != "" {
+		value += "-" + t.ParentID
+	}
+	return value
+}
+
+// Sets the traceparent and b3 headers to the span, for whoever receives them to continue
+// the trace
+func SetTraceHeaders(header http.Header, t TraceContext) {
+	header.Set("traceparent", t.Traceparent())
+	header.Set("b3", t.B3())
+}
+
+// Reads the span that sent a request from its traceparent header, or failing that its B3
+// headers, single or multiple. Returns false if none of them hold a valid one.
+func ParseTraceHeaders(header http.Header) (TraceContext, bool) {
+	trace, ok := ParseTraceparent(header.Get("traceparent"))
+	if ok {
+		return trace, true
+	}
+	trace, ok = parseB3(header.Get("b3"))
+	if ok {
+		return trace, true
+	}
+
+	trace = TraceContext{
+		TraceID:  padTraceID(strings.ToLower(header.Get("X-B3-TraceId"))),
+		SpanID:   strings.ToLower(header.Get("X-B3-SpanId")),
+		ParentID: strings.ToLower(header.Get("X-B3-ParentSpanId")),
+		Sampled:  header.Get("X-B3-Sampled") != "0" && header.Get("X-B3-Sampled") != "false",
+	}
+	if header.Get("X-B3-Flags") == "1" {
+		trace.Sampled = true
+	}
+	return trace, validTraceID(trace.TraceID) && validSpanID(trace.SpanID)
+}
+
+// Reads a W3C traceparent header; later versions may add fields after the flags
+func ParseTraceparent(value string) (TraceContext, bool) {
+	fields := strings.Split(strings.TrimSpace(value), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return TraceContext{}, false
+	}
+	flags, err := hex.DecodeString(fields[3])
+	if err != nil || len(flags) != 1 || !validTraceID(fields[1]) || !validSpanID(fields[2]) {
+		return TraceContext{}, false
+	}
+	return TraceContext{TraceID: fields[1], SpanID: fields[2], Sampled: flags[0]&1 == 1}, true
+}
+
+// Reads a B3 single header: trace ID, span ID, then optionally the sampling decision
+// and the parent span ID
+func parseB3(value string) (TraceContext, bool) {
+	fields := strings.Split(strings.ToLower(strings.TrimSpace(value)), "-")
+	if len(fields) < 2 || len(fields) > 4 {
+		return TraceContext{}, false
+	}
+	trace := TraceContext{TraceID: padTraceID(fields[0]), SpanID: fields[1], Sampled: true}
+	if len(fields) > 2 {
+		trace.Sampled = fields[2] != "0"
+	}
+	if len(fields) > 3 {
+		trace.ParentID = fields[3]
+		if !validSpanID(trace.ParentID) {
+			return TraceContext{}, false
+		}
+	}
+	return trace, validTraceID(trace.TraceID) && validSpanID(trace.SpanID)
+}
+
+// B3 allows 64 bit trace IDs, which W3C pads to 128 bits with leading zeros
+func padTraceID(id string) string {
+	if len(id) == 16 {
+		return strings.Repeat("0", 16) + id
+	}
+	return id
+}
+
+func validTraceID(id string) bool {
+	return len(id) == 32 && isLowerHex(id) && id != strings.Repeat("0", 32)
+}
+
+func validSpanID(id string) bool {
+	return len(id) == 16 && isLowerHex(id) && id != strings.Repeat("0", 16)
+}
+
+func isLowerHex(value string) bool {
+	for _, c := range value {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns n random bytes as hex
+func randomHex(n int) string {
+	buffer := make([]byte, n)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// Returns a copy of the context carrying the span
+func WithTrace(ctx context.Context, t TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// Returns the span the context carries, if any
+func TraceFrom(ctx context.Context) (TraceContext, bool) {
+	t, ok := ctx.Value(traceKey{}).(TraceContext)
+	return t, ok
+}
+
+// Starts a span of the context's trace, or of a new trace if it has none, and returns a
+// context carrying it
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	t, ok := TraceFrom(ctx)
+	if ok {
+		t = t.Child()
+	} else {
+		t = NewTrace()
+	}
+	ctx = WithTrace(ctx, t)
+	return ctx, &Span{Name: name, Trace: t, ctx: ctx, start: time.Now()}
+}
+
+// Logs the span at debug level to the given component, with any extra attributes
+func (span *Span) End(logger *slog.Logger, attrs ...any) {
+	attrs = append([]any{"span", span.Name, "parentSpanId", span.Trace.ParentID, "durationMs", time.Since(span.start).Milliseconds()}, attrs...)
+	logger.DebugContext(span.ctx, "Span", attrs...)
+}
+
+// Continues the trace of the span that sent each request, or starts a new one, so its
+// logs, storage spans, events and webhooks all share the trace ID
+func TraceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace, ok := ParseTraceHeaders(r.Header)
+		if ok {
+			trace = trace.Child()
+		} else {
+			trace = NewTrace()
+		}
+		next.ServeHTTP(w, r.WithContext(WithTrace(r.Context(), trace)))
+	})
+}
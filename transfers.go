@@ -0,0 +1,322 @@
+package receiptapi
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Kinds of ledger entry a transfer makes
+const (
+	entryTransferOut = "transfer_out"
+	entryTransferFee = "transfer_fee"
+	entryTransferIn  = "transfer_in"
+)
+
+// Kind of ledger entry a captured redemption makes
+const entryRedemption = "redemption"
+
+// Most TRANSFER_MAX_POINTS and TRANSFER_FEE_POINTS can be, so a transfer's points and fee
+// can be added and scaled by the fee rate without overflowing
+const maxTransferPoints = 1_000_000_000_000
+
+// Points one user sent another, with the ledger entries it made on both sides. A
+// transfer is stored whole, in one line of the log, so neither side can be saved
+// without the other.
+type Transfer struct {
+	ID         string `json:"id"`
+	FromUserID string `json:"fromUserId"`
+	ToUserID   string `json:"toUserId"`
+
+	// Points the recipient gets, and the fee the sender pays on top
+	Points int64 `json:"points"`
+	Fee    int64 `json:"fee"`
+
+	// Sender's own ID for the transfer; a sender's transfer with the same reference is
+	// only made once
+	Reference string `json:"reference,omitempty"`
+
+	CreatedAt time.Time     `json:"createdAt"`
+	Entries   []LedgerEntry `json:"entries"`
+}
+
+// Change to one user's points. Debits are negative.
+type LedgerEntry struct {
+	UserID string `json:"userId"`
+	Kind   string `json:"kind"`
+	Points int64  `json:"points"`
+
+	// Transfer that made the entry, and the user on its other side
+	TransferID     string    `json:"transferId,omitempty"`
+	CounterpartyID string    `json:"counterpartyId,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+
+	// Captured redemption that made the entry
+	RedemptionID string `json:"redemptionId,omitempty"`
+}
+
+// Request to send points to another user
+type TransferRequest struct {
+	ToUserID  string `json:"toUserId"`
+	Points    int64  `json:"points"`
+	Reference string `json:"reference"`
+}
+
+// Response listing a user's ledger entries, newest first
+type LedgerResponse struct {
+	UserID  string        `json:"userId"`
+	Entries []LedgerEntry `json:"entries"`
+}
+
+// Transfers in the order they were made
+var transfers []Transfer
+
+// Log file every transfer is appended to, if one is open
+var transferLog *os.File
+
+// Loads transfers from a log file, then keeps it open to append to. Each line holds one
+// transfer as JSON.
+func OpenTransferLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	pointsMu.Lock()
+	defer pointsMu.Unlock()
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line += 1
+			var transfer Transfer
+			err = json.Unmarshal(scanner.Bytes(), &transfer)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			transfers = append(transfers, transfer)
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+	}
+
+	transferLog, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	return err
+}
+
+// Appends a transfer to the log file, if one is open, syncing it to disk before the
+// transfer counts; the caller must hold pointsMu
+func persistTransfer(transfer Transfer) error {
+	if transferLog == nil {
+		return nil
+	}
+	line, err := json.Marshal(transfer)
+	if err != nil {
+		return err
+	}
+	_, err = transferLog.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return transferLog.Sync()
+}
+
+// Returns the fee for sending points: the flat fee plus the configured rate of the
+// points, rounded up
+func TransferFee(points int64) int64 {
+	numerator, denominator, err := ParseDecimal(config.TransferFeeRate)
+	if err != nil {
+		return config.TransferFeePoints
+	}
+	return config.TransferFeePoints - floorDiv(-points*numerator, denominator)
+}
+
+// Returns whether a user is known, through a linked loyalty number or a receipt
+func (s *Server) knownUser(userID string) bool {
+	loyaltyMu.RLock()
+	linked := loyaltyUsers[userID]
+	loyaltyMu.RUnlock()
+	return linked || s.Store.HasUser(userID)
+}
+
+// Sends points from one user to another, debiting the sender the points and the fee and
+// crediting the recipient the points, or returns the transfer already made with the same
+// reference. Returns whether a new transfer was made.
+func (s *Server) TransferPoints(fromUserID string, request TransferRequest) (Transfer, bool, *Rejection) {
+	switch {
+	case request.ToUserID == "" || request.ToUserID == fromUserID:
+		return Transfer{}, false, &Rejection{http.StatusBadRequest, codeInvalidTransfer, "A transfer needs a toUserId other than the sender."}
+	case request.Points < max(config.TransferMinPoints, 1):
+		message := fmt.Sprintf("A transfer must be of at least %d points.", max(config.TransferMinPoints, 1))
+		return Transfer{}, false, &Rejection{http.StatusBadRequest, codeInvalidTransfer, message}
+	case request.Points > config.TransferMaxPoints:
+		message := fmt.Sprintf("A transfer can be of at most %d points.", config.TransferMaxPoints)
+		return Transfer{}, false, &Rejection{http.StatusBadRequest, codeTransferLimitExceeded, message}
+	case !s.knownUser(fromUserID):
+		return Transfer{}, false, &Rejection{http.StatusNotFound, codeInvalidTransfer, "The sender isn't a known user."}
+	case !s.knownUser(request.ToUserID):
+		return Transfer{}, false, &Rejection{http.StatusBadRequest, codeInvalidTransfer, "The recipient isn't a known user."}
+	}
+
+	now := s.Clock.Now().UTC()
+	pointsMu.Lock()
+	defer pointsMu.Unlock()
+	expireHolds(now)
+	if request.Reference != "" {
+		for _, transfer := range transfers {
+			if transfer.FromUserID == fromUserID && transfer.Reference == request.Reference {
+				return transfer, false, nil
+			}
+		}
+	}
+
+	// The daily limit counts what the sender sent since midnight UTC, fees aside
+	if config.TransferDailyLimitPoints > 0 {
+		midnight := now.Truncate(24 * time.Hour)
+		sent := request.Points
+		for _, transfer := range transfers {
+			if transfer.FromUserID == fromUserID && !transfer.CreatedAt.Before(midnight) {
+				sent += transfer.Points
+			}
+		}
+		if sent > config.TransferDailyLimitPoints {
+			message := fmt.Sprintf("The sender can send at most %d points a day; this would make %d.", config.TransferDailyLimitPoints, sent)
+			return Transfer{}, false, &Rejection{http.StatusBadRequest, codeTransferLimitExceeded, message}
+		}
+	}
+
+	fee := TransferFee(request.Points)
+	balance := s.pointsBalance(fromUserID)
+	if request.Points > balance.Available-fee {
+		message := fmt.Sprintf("The sender has %d points available, fewer than the %d points and %d fee.", balance.Available, request.Points, fee)
+		return Transfer{}, false, &Rejection{http.StatusConflict, codeInsufficientPoints, message}
+	}
+
+	transfer := Transfer{
+		ID:         uuid.New().String(),
+		FromUserID: fromUserID,
+		ToUserID:   request.ToUserID,
+		Points:     request.Points,
+		Fee:        fee,
+		Reference:  request.Reference,
+		CreatedAt:  now,
+	}
+	transfer.Entries = []LedgerEntry{
+		{UserID: fromUserID, Kind: entryTransferOut, Points: -request.Points, CounterpartyID: request.ToUserID},
+		{UserID: request.ToUserID, Kind: entryTransferIn, Points: request.Points, CounterpartyID: fromUserID},
+	}
+	if fee > 0 {
+		transfer.Entries = append(transfer.Entries, LedgerEntry{UserID: fromUserID, Kind: entryTransferFee, Points: -fee})
+	}
+	for i := range transfer.Entries {
+		transfer.Entries[i].TransferID = transfer.ID
+		transfer.Entries[i].CreatedAt = now
+	}
+
+	err := persistTransfer(transfer)
+	if err != nil {
+		logApp.Error("Could not write transfer log", "error", err)
+		return Transfer{}, false, &Rejection{http.StatusInternalServerError, codeInternal, "The transfer could not be saved."}
+	}
+	transfers = append(transfers, transfer)
+	return transfer, true, nil
+}
+
+// Returns the sum of a user's ledger entries from transfers, in and out; the caller
+// must hold pointsMu
+func transferredPoints(userID string) (int64, int64) {
+	var in, out int64
+	for _, transfer := range transfers {
+		for _, entry := range transfer.Entries {
+			switch {
+			case entry.UserID != userID:
+			case entry.Points > 0:
+				in += entry.Points
+			default:
+				out -= entry.Points
+			}
+		}
+	}
+	return in, out
+}
+
+/*
+	Below are the handlers for transfers and ledgers
+*/
+
+// Method for a user to send points to another user
+func (s *Server) CreateTransfer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var request TransferRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, codeInvalidTransfer, "The transfer request is not valid JSON.")
+		return
+	}
+	request.ToUserID = strings.TrimSpace(request.ToUserID)
+	request.Reference = strings.TrimSpace(request.Reference)
+	transfer, created, rejection := s.TransferPoints(mux.Vars(r)["id"], request)
+	if rejection != nil {
+		WriteRejection(w, rejection)
+		return
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(transfer)
+}
+
+// Method to list a user's ledger entries from transfers and captured redemptions, newest
+// first
+func GetLedger(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := mux.Vars(r)["id"]
+	pointsMu.Lock()
+	response := LedgerResponse{UserID: userID, Entries: ledgerEntries(userID)}
+	pointsMu.Unlock()
+	slices.SortStableFunc(response.Entries, func(a, b LedgerEntry) int {
+		return cmp.Compare(b.CreatedAt.UnixNano(), a.CreatedAt.UnixNano())
+	})
+	json.NewEncoder(w).Encode(response)
+}
+
+// Returns a user's ledger entries from transfers and captured redemptions, in no
+// particular order; the caller must hold pointsMu
+func ledgerEntries(userID string) []LedgerEntry {
+	entries := []LedgerEntry{}
+	for _, transfer := range transfers {
+		for _, entry := range transfer.Entries {
+			if entry.UserID == userID {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	for _, redemption := range redemptions {
+		if redemption.UserID == userID && redemption.Status == redemptionCaptured {
+			entries = append(entries, LedgerEntry{
+				UserID:       userID,
+				Kind:         entryRedemption,
+				Points:       -redemption.Points,
+				CreatedAt:    *redemption.SettledAt,
+				RedemptionID: redemption.ID,
+			})
+		}
+	}
+	return entries
+}
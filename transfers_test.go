@@ -0,0 +1,292 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Returns a server whose users alice and bob have 100 points and none, with no transfers
+// or redemptions made yet
+func newLedgerServer(t *testing.T) *Server {
+	t.Helper()
+	resetLedger()
+	t.Cleanup(resetLedger)
+	s := New(WithClock(FixedClock{time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}))
+	s.Store.Add(Receipt{ID: "alice-receipt", UserID: "alice", Points: 100})
+	s.Store.Add(Receipt{ID: "bob-receipt", UserID: "bob"})
+	return s
+}
+
+// Forgets every transfer and redemption
+func resetLedger() {
+	pointsMu.Lock()
+	transfers, redemptions = nil, map[string]*Redemption{}
+	pointsMu.Unlock()
+}
+
+// Returns the ledger entries transfers made for a user; the caller must hold pointsMu
+func transferEntries(userID string) []LedgerEntry {
+	var entries []LedgerEntry
+	for _, transfer := range transfers {
+		for _, entry := range transfer.Entries {
+			if entry.UserID == userID {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+func TestTransferFee(t *testing.T) {
+	tests := []struct {
+		flat   int64
+		rate   string
+		points int64
+		want   int64
+	}{
+		{0, "0", 500, 0},
+		{5, "0", 500, 5},
+		{0, "0.02", 500, 10},
+		{0, "0.02", 10, 1},
+		{2, "0.1", 45, 7},
+		{0, "1", 40, 40},
+		{0, "0.000001", maxTransferPoints, 1_000_000},
+	}
+	for _, test := range tests {
+		withConfig(t, func(config *Config) {
+			config.TransferFeePoints, config.TransferFeeRate = test.flat, test.rate
+		})
+		got := TransferFee(test.points)
+		if got != test.want {
+			t.Errorf("TransferFee(%d) with %d + %s = %d, want %d", test.points, test.flat, test.rate, got, test.want)
+		}
+	}
+}
+
+func TestTransferPoints(t *testing.T) {
+	tests := []struct {
+		name       string
+		change     func(config *Config)
+		from       string
+		request    TransferRequest
+		wantStatus int
+		wantCode   string
+		wantFee    int64
+	}{
+		{name: "sent", from: "alice", request: TransferRequest{ToUserID: "bob", Points: 40}},
+		{
+			name:    "sent with a fee",
+			change:  func(config *Config) { config.TransferFeePoints, config.TransferFeeRate = 2, "0.1" },
+			from:    "alice",
+			request: TransferRequest{ToUserID: "bob", Points: 40},
+			wantFee: 6,
+		},
+		{
+			name:    "everything available",
+			change:  func(config *Config) { config.TransferFeePoints = 10 },
+			from:    "alice",
+			request: TransferRequest{ToUserID: "bob", Points: 90},
+			wantFee: 10,
+		},
+		{
+			name:       "fee passes the balance",
+			change:     func(config *Config) { config.TransferFeePoints = 11 },
+			from:       "alice",
+			request:    TransferRequest{ToUserID: "bob", Points: 90},
+			wantStatus: http.StatusConflict,
+			wantCode:   codeInsufficientPoints,
+		},
+		{
+			name:       "more than available",
+			from:       "bob",
+			request:    TransferRequest{ToUserID: "alice", Points: 1},
+			wantStatus: http.StatusConflict,
+			wantCode:   codeInsufficientPoints,
+		},
+		{
+			name:       "to the sender",
+			from:       "alice",
+			request:    TransferRequest{ToUserID: "alice", Points: 1},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeInvalidTransfer,
+		},
+		{
+			name:       "below the minimum",
+			change:     func(config *Config) { config.TransferMinPoints = 5 },
+			from:       "alice",
+			request:    TransferRequest{ToUserID: "bob", Points: 4},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeInvalidTransfer,
+		},
+		{
+			name:       "above the maximum",
+			change:     func(config *Config) { config.TransferMaxPoints = 50 },
+			from:       "alice",
+			request:    TransferRequest{ToUserID: "bob", Points: 51},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeTransferLimitExceeded,
+		},
+		{
+			name:       "above the daily limit",
+			change:     func(config *Config) { config.TransferDailyLimitPoints = 30 },
+			from:       "alice",
+			request:    TransferRequest{ToUserID: "bob", Points: 31},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeTransferLimitExceeded,
+		},
+		{
+			name:       "unknown sender",
+			from:       "carol",
+			request:    TransferRequest{ToUserID: "bob", Points: 1},
+			wantStatus: http.StatusNotFound,
+			wantCode:   codeInvalidTransfer,
+		},
+		{
+			name:       "unknown recipient",
+			from:       "alice",
+			request:    TransferRequest{ToUserID: "carol", Points: 1},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeInvalidTransfer,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.change != nil {
+				withConfig(t, test.change)
+			}
+			s := newLedgerServer(t)
+			transfer, created, rejection := s.TransferPoints(test.from, test.request)
+			if test.wantStatus != 0 {
+				if rejection == nil || rejection.Status != test.wantStatus || rejection.Code != test.wantCode {
+					t.Fatalf("TransferPoints() rejection = %+v, want %d %s", rejection, test.wantStatus, test.wantCode)
+				}
+				return
+			}
+			if rejection != nil {
+				t.Fatalf("TransferPoints() rejection = %+v", rejection)
+			}
+			if !created || transfer.Points != test.request.Points || transfer.Fee != test.wantFee {
+				t.Errorf("TransferPoints() = %+v, created %v; want %d points and a fee of %d", transfer, created, test.request.Points, test.wantFee)
+			}
+		})
+	}
+}
+
+func TestTransferLedger(t *testing.T) {
+	withConfig(t, func(config *Config) { config.TransferFeePoints = 3 })
+	s := newLedgerServer(t)
+	first, created, rejection := s.TransferPoints("alice", TransferRequest{ToUserID: "bob", Points: 40, Reference: "gift"})
+	if rejection != nil || !created {
+		t.Fatalf("TransferPoints() = %+v, %v, %+v", first, created, rejection)
+	}
+
+	// Sending again with the same reference returns the first transfer
+	again, created, rejection := s.TransferPoints("alice", TransferRequest{ToUserID: "bob", Points: 40, Reference: "gift"})
+	if rejection != nil || created || again.ID != first.ID {
+		t.Errorf("repeated TransferPoints() = %+v, %v, %+v; want transfer %s again", again, created, rejection, first.ID)
+	}
+
+	pointsMu.Lock()
+	alice, bob := s.pointsBalance("alice"), s.pointsBalance("bob")
+	aliceEntries, bobEntries := transferEntries("alice"), transferEntries("bob")
+	pointsMu.Unlock()
+	if alice.Available != 57 || alice.TransferredOut != 43 {
+		t.Errorf("alice's balance = %+v, want 57 available after 43 transferred out", alice)
+	}
+	if bob.Available != 40 || bob.TransferredIn != 40 {
+		t.Errorf("bob's balance = %+v, want 40 available after 40 transferred in", bob)
+	}
+
+	wantAlice := map[string]int64{entryTransferOut: -40, entryTransferFee: -3}
+	if len(aliceEntries) != len(wantAlice) {
+		t.Errorf("alice's ledger = %+v, want %v", aliceEntries, wantAlice)
+	}
+	for _, entry := range aliceEntries {
+		if wantAlice[entry.Kind] != entry.Points || entry.TransferID != first.ID {
+			t.Errorf("alice's ledger entry = %+v, want %v from transfer %s", entry, wantAlice, first.ID)
+		}
+	}
+	if len(bobEntries) != 1 || bobEntries[0].Kind != entryTransferIn || bobEntries[0].Points != 40 || bobEntries[0].CounterpartyID != "alice" {
+		t.Errorf("bob's ledger = %+v, want 40 points transferred in from alice", bobEntries)
+	}
+}
+
+func TestTransferDailyLimitCountsEarlierTransfers(t *testing.T) {
+	withConfig(t, func(config *Config) { config.TransferDailyLimitPoints = 50 })
+	s := newLedgerServer(t)
+	_, _, rejection := s.TransferPoints("alice", TransferRequest{ToUserID: "bob", Points: 30})
+	if rejection != nil {
+		t.Fatalf("first TransferPoints() rejection = %+v", rejection)
+	}
+	_, _, rejection = s.TransferPoints("alice", TransferRequest{ToUserID: "bob", Points: 21})
+	if rejection == nil || rejection.Code != codeTransferLimitExceeded {
+		t.Errorf("second TransferPoints() rejection = %+v, want %s", rejection, codeTransferLimitExceeded)
+	}
+	_, _, rejection = s.TransferPoints("alice", TransferRequest{ToUserID: "bob", Points: 20})
+	if rejection != nil {
+		t.Errorf("third TransferPoints() rejection = %+v, want none", rejection)
+	}
+}
+
+func TestKnownUser(t *testing.T) {
+	s := newLedgerServer(t)
+	s.Store.Modify("bob-receipt", func(receipt *Receipt) bool {
+		receipt.UserID = "carol"
+		return true
+	})
+	tests := []struct {
+		user string
+		want bool
+	}{
+		{"alice", true},
+		{"bob", false},
+		{"carol", true},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := s.knownUser(test.user); got != test.want {
+			t.Errorf("knownUser(%q) = %v, want %v", test.user, got, test.want)
+		}
+	}
+}
+
+func TestCreateTransferAsUser(t *testing.T) {
+	withoutPartners(t)
+	partners["acme-key"] = Partner{Name: "acme", Key: "acme-key"}
+	tests := []struct {
+		name   string
+		key    string
+		user   string
+		path   string
+		status int
+		code   string
+	}{
+		{name: "user sending their own points", key: "acme-key", user: "alice", path: "alice", status: http.StatusCreated},
+		{name: "user sending another's points", key: "acme-key", user: "bob", path: "alice", status: http.StatusForbidden, code: codeWrongUser},
+		{name: "no user", key: "acme-key", path: "alice", status: http.StatusUnauthorized, code: codeUnauthorized},
+		{name: "no API key", user: "alice", path: "alice", status: http.StatusUnauthorized, code: codeUnauthorized},
+		{name: "unknown API key", key: "other-key", user: "alice", path: "alice", status: http.StatusUnauthorized, code: codeUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newLedgerServer(t)
+			r := httptest.NewRequest("POST", "/users/"+test.path+"/transfers", strings.NewReader(`{"toUserId": "bob", "points": 10}`))
+			r = mux.SetURLVars(r, map[string]string{"id": test.path})
+			r.Header.Set("X-API-Key", test.key)
+			r.Header.Set("X-User-ID", test.user)
+			w := httptest.NewRecorder()
+			RequireUser(s.CreateTransfer)(w, r)
+			var response ErrorResponse
+			json.NewDecoder(w.Body).Decode(&response)
+			if w.Code != test.status || response.Code != test.code {
+				t.Errorf("status = %d, code %q, want %d, %q", w.Code, response.Code, test.status, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package receiptapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// What a loyalty app's profile screen shows about a user: points earned over their
+// lifetime and available now, how many receipts they submitted, where they shop most and
+// when they last submitted a receipt
+type UserSummary struct {
+	UserID         string `json:"userId"`
+	LifetimePoints int64  `json:"lifetimePoints"`
+	Balance        int64  `json:"balance"`
+	Receipts       int    `json:"receipts"`
+
+	// Retailer the user submitted the most receipts from, as first written, if any
+	FavoriteRetailer string `json:"favoriteRetailer,omitempty"`
+
+	LastSubmittedAt *time.Time `json:"lastSubmittedAt,omitempty"`
+}
+
+// Returns the user a request is made by: the one its X-User-ID header names, which a
+// partner's app asserts for the user signed in to it, with that partner's API key, or
+// the user support staff impersonate. Returns 401 for requests without a known partner's
+// key or without the header.
+func userFor(r *http.Request) (string, *Rejection) {
+	if user := ImpersonatedUser(r.Context()); user != "" {
+		return user, nil
+	}
+	partner, known := GetPartner(r)
+	if !known || partner.Name == "" {
+		return "", &Rejection{http.StatusUnauthorized, codeUnauthorized, "Requests for a user need a partner's X-API-Key."}
+	}
+	user := strings.TrimSpace(r.Header.Get("X-User-ID"))
+	if user == "" {
+		return "", &Rejection{http.StatusUnauthorized, codeUnauthorized, "Requests for a user need an X-User-ID header naming the user signed in."}
+	}
+	return user, nil
+}
+
+// Answers 401 instead of calling next unless the request is made by a user, and 403 if
+// that isn't the user whose {id} the route has
+func RequireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, rejection := userFor(r)
+		if rejection == nil && user != mux.Vars(r)["id"] {
+			rejection = &Rejection{http.StatusForbidden, codeWrongUser, "Users can only act for themselves."}
+		}
+		if rejection != nil {
+			w.Header().Set("Content-Type", "application/json")
+			WriteRejection(w, rejection)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Returns a user's summary; the caller must hold pointsMu and have expired holds
+func (s *Server) userSummary(userID string) UserSummary {
+	balance := s.pointsBalance(userID)
+	summary := UserSummary{UserID: userID, LifetimePoints: balance.Earned, Balance: balance.Available}
+
+	// Receipts from each retailer, keyed by normalized name; ties go to the retailer
+	// submitted from most recently
+	type retailerCount struct {
+		name     string
+		receipts int
+		last     time.Time
+	}
+	retailers := map[string]*retailerCount{}
+	var favorite *retailerCount
+	for _, receipt := range s.Store.All() {
+		if receipt.UserID != userID || receipt.Sandbox {
+			continue
+		}
+		summary.Receipts += 1
+		if receipt.ProcessedAt != nil && (summary.LastSubmittedAt == nil || receipt.ProcessedAt.After(*summary.LastSubmittedAt)) {
+			summary.LastSubmittedAt = receipt.ProcessedAt
+		}
+
+		// Anonymized receipts have no retailer left to count
+		key := NormalizeRetailer(receipt.Retailer)
+		if key == "" {
+			continue
+		}
+		count, ok := retailers[key]
+		if !ok {
+			count = &retailerCount{name: receipt.Retailer}
+			retailers[key] = count
+		}
+		count.receipts += 1
+		if receipt.ProcessedAt != nil && receipt.ProcessedAt.After(count.last) {
+			count.last = *receipt.ProcessedAt
+		}
+		if favorite == nil || count.receipts > favorite.receipts || (count.receipts == favorite.receipts && count.last.After(favorite.last)) {
+			favorite = count
+		}
+	}
+	if favorite != nil {
+		summary.FavoriteRetailer = favorite.name
+	}
+	return summary
+}
+
+// Method to get a user's summary for their profile
+func (s *Server) GetUserSummary(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	pointsMu.Lock()
+	expireHolds(s.Clock.Now().UTC())
+	summary := s.userSummary(mux.Vars(r)["id"])
+	pointsMu.Unlock()
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,273 @@
+package receiptapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Most rows sent to the warehouse in one request
+const warehouseBatchRows = 500
+
+// Table in a data warehouse receipts are copied to, so analysts can query them without
+// going through the API
+type Warehouse interface {
+	// Appends rows to the table; a row sent again with the same insert ID may be dropped
+	Insert(ctx context.Context, rows []WarehouseRow) error
+}
+
+// Row for a receipt in the warehouse table. The table keeps every version of a receipt
+// that was synced; the one with the latest updated_at is current.
+type WarehouseRow struct {
+	InsertID string
+	Columns  map[string]any
+}
+
+// Receipt field copied to a column of the warehouse table
+type WarehouseColumn struct {
+	Field  string
+	Column string
+}
+
+// Returns the warehouse selected by the configuration, or nil if none is
+func NewWarehouse(config Config) (Warehouse, error) {
+	switch config.Warehouse {
+	case "":
+		return nil, nil
+	case "bigquery":
+		credentials, err := ReadServiceAccount(config.BigQueryCredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read BIGQUERY_CREDENTIALS_FILE: %w", err)
+		}
+		return &BigQueryWarehouse{
+			Endpoint:    config.BigQueryEndpoint,
+			Project:     config.BigQueryProject,
+			Dataset:     config.BigQueryDataset,
+			Table:       config.BigQueryTable,
+			Credentials: credentials,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown WAREHOUSE %q", config.Warehouse)
+}
+
+// Returns the columns receipts are copied to: the fields in the mapping, each as
+// "field" or "field:column", or every receipt field if the mapping is empty. Columns
+// not named are the field's name in snake case, e.g. purchase_date.
+func WarehouseColumns(mapping []string) ([]WarehouseColumn, error) {
+	if len(mapping) == 0 {
+		mapping = receiptFieldNames
+	}
+	columns := []WarehouseColumn{}
+	for _, entry := range mapping {
+		field, column, renamed := strings.Cut(entry, ":")
+		field, column = strings.TrimSpace(field), strings.TrimSpace(column)
+		if !slices.Contains(receiptFieldNames, field) {
+			return nil, fmt.Errorf("unknown receipt field %q in WAREHOUSE_COLUMNS", field)
+		}
+		if !renamed {
+			column = snakeCase(field)
+		}
+		if column == "" {
+			return nil, fmt.Errorf("no column given for %s in WAREHOUSE_COLUMNS", field)
+		}
+		columns = append(columns, WarehouseColumn{Field: field, Column: column})
+	}
+	return columns, nil
+}
+
+// Returns a camel case name in snake case, e.g. "purchase_date" for "purchaseDate"
+func snakeCase(name string) string {
+	var snake strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 {
+			snake.WriteByte('_')
+		}
+		snake.WriteRune(unicode.ToLower(r))
+	}
+	return snake.String()
+}
+
+// Maps a receipt to its row in the warehouse table. Fields the receipt leaves out are
+// null, and lists and objects such as the items are JSON text.
+func WarehouseRowFor(receipt Receipt, columns []WarehouseColumn) (WarehouseRow, error) {
+	encoded, err := json.Marshal(receipt)
+	if err != nil {
+		return WarehouseRow{}, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(encoded, &fields)
+	if err != nil {
+		return WarehouseRow{}, err
+	}
+
+	row := WarehouseRow{
+		InsertID: receipt.ID + "-" + changedAt(receipt).Format(time.RFC3339Nano),
+		Columns:  map[string]any{},
+	}
+	for _, column := range columns {
+		raw, ok := fields[column.Field]
+		if !ok {
+			row.Columns[column.Column] = nil
+			continue
+		}
+		var value any
+		json.Unmarshal(raw, &value)
+		switch value.(type) {
+		case map[string]any, []any:
+			row.Columns[column.Column] = string(raw)
+		default:
+			row.Columns[column.Column] = value
+		}
+	}
+	return row, nil
+}
+
+// Returns when a receipt last changed, or for receipts stored before that was kept,
+// when it was stored
+func changedAt(receipt Receipt) time.Time {
+	if receipt.UpdatedAt != nil {
+		return *receipt.UpdatedAt
+	}
+	at, _ := storedAt(receipt)
+	return at
+}
+
+// Copies the production receipts that changed after one time, or since ever if it is
+// zero, and no later than another to the warehouse, in batches. Returns how many were
+// copied.
+func SyncWarehouse(ctx context.Context, warehouse Warehouse, receipts []Receipt, since time.Time, until time.Time) (int, error) {
+	columns, err := WarehouseColumns(config.WarehouseColumns)
+	if err != nil {
+		return 0, err
+	}
+	rows := []WarehouseRow{}
+	for _, receipt := range receipts {
+		changed := changedAt(receipt)
+		// Sandbox receipts are test data
+		if receipt.Sandbox || (!since.IsZero() && !changed.After(since)) || changed.After(until) {
+			continue
+		}
+		row, err := WarehouseRowFor(receipt, columns)
+		if err != nil {
+			return 0, err
+		}
+		rows = append(rows, row)
+	}
+
+	copied := 0
+	for batch := range slices.Chunk(rows, warehouseBatchRows) {
+		err = warehouse.Insert(ctx, batch)
+		if err != nil {
+			return copied, err
+		}
+		copied += len(batch)
+	}
+	return copied, nil
+}
+
+// Reads the time the warehouse was last synced up to from the state file, or the zero
+// time if it was never synced
+func ReadWarehouseWatermark(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+}
+
+// Records the time the warehouse was synced up to in the state file, replacing it
+// whole so a crash can't leave it half written
+func WriteWarehouseWatermark(path string, watermark time.Time) error {
+	temporary := path + ".tmp"
+	err := os.WriteFile(temporary, []byte(watermark.UTC().Format(time.RFC3339Nano)+"\n"), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
+
+// Copies the receipts that changed since the last sync to the warehouse and moves the
+// watermark up to when this one started; a failed sync is retried in full next time
+func (s *Server) SyncWarehouseOnce(ctx context.Context, warehouse Warehouse) (int, error) {
+	since, err := ReadWarehouseWatermark(config.WarehouseStateFile)
+	if err != nil {
+		return 0, fmt.Errorf("could not read WAREHOUSE_STATE_FILE: %w", err)
+	}
+
+	// Receipts changed after the copy is taken are marked later than this, so the next
+	// sync picks them up
+	until := time.Now().UTC()
+	copied, err := SyncWarehouse(ctx, warehouse, s.Store.All(), since, until)
+	if err != nil {
+		return copied, err
+	}
+	return copied, WriteWarehouseWatermark(config.WarehouseStateFile, until)
+}
+
+// Syncs the warehouse at the configured interval until the context is done
+func (s *Server) RunWarehouseSync(ctx context.Context, warehouse Warehouse) {
+	interval := time.Duration(config.WarehouseSyncMinutes) * time.Minute
+	for {
+		logJobs.Info("Started", "job", "warehouse-sync")
+		copied, err := s.SyncWarehouseOnce(ctx, warehouse)
+		if err != nil {
+			logJobs.Error("Could not sync warehouse", "error", err, "receipts", copied)
+		} else {
+			logJobs.Info("Finished", "job", "warehouse-sync", "receipts", copied)
+		}
+		sleepContext(ctx, interval)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Copies every stored receipt, or those changed since a date, to the warehouse, as when
+// it is first set up or a table is rebuilt. Only reads the data file, so it can run
+// alongside the server, and leaves the watermark of the scheduled sync alone.
+func RunWarehouseBackfill(args []string) error {
+	flags := flag.NewFlagSet("warehouse-backfill", flag.ContinueOnError)
+	since := flags.String("since", "", "only copy receipts changed on or after this date, YYYY-MM-DD")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	err = Setup()
+	if err != nil {
+		return err
+	}
+	if config.Warehouse == "" {
+		return errors.New("WAREHOUSE must be set")
+	}
+	var from time.Time
+	if *since != "" {
+		from, err = time.Parse(dateLayout, *since)
+		if err != nil {
+			return fmt.Errorf("-since must be a date in YYYY-MM-DD form: %w", err)
+		}
+		// The start of the range is exclusive
+		from = from.Add(-time.Nanosecond)
+	}
+	warehouse, err := NewWarehouse(config)
+	if err != nil {
+		return err
+	}
+	stored, err := LoadReceipts(config.DataFile)
+	if err != nil {
+		return fmt.Errorf("could not read data file: %w", err)
+	}
+
+	copied, err := SyncWarehouse(context.Background(), warehouse, stored, from, time.Now().UTC())
+	fmt.Println("Copied", copied, "receipts to the warehouse")
+	return err
+}
@@ -0,0 +1,111 @@
+package receiptapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Warehouse that records the batches inserted into it, failing from a given batch on
+type recordingWarehouse struct {
+	batches [][]WarehouseRow
+	failAt  int
+}
+
+func (w *recordingWarehouse) Insert(ctx context.Context, rows []WarehouseRow) error {
+	if w.failAt > 0 && len(w.batches)+1 >= w.failAt {
+		return errors.New("insert failed")
+	}
+	w.batches = append(w.batches, rows)
+	return nil
+}
+
+func TestWarehouseColumns(t *testing.T) {
+	tests := []struct {
+		mapping []string
+		want    []WarehouseColumn
+		wantErr bool
+	}{
+		{
+			mapping: []string{"id:receipt_id", "purchaseDate", " points "},
+			want:    []WarehouseColumn{{"id", "receipt_id"}, {"purchaseDate", "purchase_date"}, {"points", "points"}},
+		},
+		{mapping: []string{"nope"}, wantErr: true},
+		{mapping: []string{"id:"}, wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := WarehouseColumns(test.mapping)
+		if (err != nil) != test.wantErr || fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("WarehouseColumns(%q) = %v, %v; want %v", test.mapping, got, err, test.want)
+		}
+	}
+
+	every, err := WarehouseColumns(nil)
+	if err != nil || len(every) != len(receiptFieldNames) {
+		t.Errorf("WarehouseColumns(nil) = %d columns, %v; want one for each of the %d receipt fields", len(every), err, len(receiptFieldNames))
+	}
+}
+
+func TestWarehouseRowFor(t *testing.T) {
+	updatedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	receipt := targetReceipt
+	receipt.ID, receipt.Points, receipt.UpdatedAt = "r1", 28, &updatedAt
+	columns := []WarehouseColumn{{"id", "receipt_id"}, {"points", "points"}, {"items", "items"}, {"paymentMethod", "payment_method"}}
+	row, err := WarehouseRowFor(receipt, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.InsertID != "r1-2024-05-01T12:00:00Z" {
+		t.Errorf("InsertID = %q, want the ID and change time", row.InsertID)
+	}
+	items, _ := row.Columns["items"].(string)
+	if row.Columns["receipt_id"] != "r1" || row.Columns["points"] != float64(28) || row.Columns["payment_method"] != nil ||
+		len(items) == 0 || items[0] != '[' {
+		t.Errorf("Columns = %v, want the ID, points, items as JSON text and no payment method", row.Columns)
+	}
+}
+
+func TestSyncWarehouse(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	receipts := []Receipt{}
+	for i := range warehouseBatchRows + 2 {
+		changed := start.Add(time.Duration(i+1) * time.Second)
+		receipts = append(receipts, Receipt{ID: fmt.Sprint("r", i), UpdatedAt: &changed})
+	}
+	changed := start.Add(time.Second)
+	receipts = append(receipts, Receipt{ID: "sandbox", Sandbox: true, UpdatedAt: &changed})
+	until := start.Add(time.Duration(warehouseBatchRows+2) * time.Second)
+
+	tests := []struct {
+		name        string
+		since       time.Time
+		until       time.Time
+		failAt      int
+		wantCopied  int
+		wantBatches int
+		wantErr     bool
+	}{
+		{name: "everything", until: until, wantCopied: warehouseBatchRows + 2, wantBatches: 2},
+		{name: "changed since", since: start.Add(3 * time.Second), until: until, wantCopied: warehouseBatchRows - 1, wantBatches: 1},
+		{name: "changed until", until: start.Add(2 * time.Second), wantCopied: 2, wantBatches: 1},
+		{name: "failed batch", until: until, failAt: 2, wantCopied: warehouseBatchRows, wantBatches: 1, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			warehouse := &recordingWarehouse{failAt: test.failAt}
+			copied, err := SyncWarehouse(context.Background(), warehouse, receipts, test.since, test.until)
+			if copied != test.wantCopied || len(warehouse.batches) != test.wantBatches || (err != nil) != test.wantErr {
+				t.Errorf("SyncWarehouse() copied %d in %d batches, %v; want %d in %d", copied, len(warehouse.batches), err, test.wantCopied, test.wantBatches)
+			}
+			for _, batch := range warehouse.batches {
+				for _, row := range batch {
+					if row.Columns["sandbox"] == true {
+						t.Errorf("SyncWarehouse() copied sandbox receipt %v", row.Columns["id"])
+					}
+				}
+			}
+		})
+	}
+}
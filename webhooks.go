@@ -0,0 +1,342 @@
+package receiptapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// States of a webhook event
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+// Most of a response body kept with a delivery attempt
+const webhookSnippetBytes = 512
+
+// Client webhooks are delivered with, so a slow receiver can't hold a delivery forever
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Event sent to a partner's webhook, about a receipt it submitted or its own usage, with
+// every attempt to deliver it
+type WebhookEvent struct {
+	ID        string           `json:"id"`
+	Type      string           `json:"type"`
+	Partner   string           `json:"partner,omitempty"`
+	ReceiptID string           `json:"receiptId,omitempty"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Status    string           `json:"status"`
+	Payload   json.RawMessage  `json:"payload"`
+	Attempts  []WebhookAttempt `json:"attempts"`
+
+	// Subscription the event is sent to, instead of a partner's webhook
+	Subscription string `json:"subscription,omitempty"`
+
+	// Span that raised the event, as a W3C traceparent; each attempt is sent as a new
+	// span of its trace
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// One attempt to deliver a webhook event
+type WebhookAttempt struct {
+	Time       time.Time `json:"time"`
+	URL        string    `json:"url"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	LatencyMs  int64     `json:"latencyMs"`
+
+	// Start of the receiver's response body
+	Response string `json:"response,omitempty"`
+
+	// Set for redeliveries requested through the API
+	Manual bool `json:"manual,omitempty"`
+}
+
+// Response listing webhook events
+type WebhookEventListResponse struct {
+	Events []WebhookEvent `json:"events"`
+}
+
+// Webhook events keyed by ID, and their IDs in the order they were created
+var (
+	webhookEvents     = map[string]*WebhookEvent{}
+	webhookEventOrder []string
+)
+
+// Guards webhookEvents, webhookEventOrder, every event and the log file
+var webhooksMu sync.Mutex
+
+// Log file every change to an event is appended to, if one is open
+var webhookLog *os.File
+
+// Loads webhook events from a log file, then keeps it open to append to. Each line holds
+// an event as JSON; an event appears again each time it changes, and its last line wins.
+func OpenWebhookLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line += 1
+			var event WebhookEvent
+			err = json.Unmarshal(scanner.Bytes(), &event)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			if _, seen := webhookEvents[event.ID]; !seen {
+				webhookEventOrder = append(webhookEventOrder, event.ID)
+			}
+			webhookEvents[event.ID] = &event
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+	}
+
+	webhookLog, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	return err
+}
+
+// Appends an event as it is now to the log file, if one is open; the caller must hold
+// webhooksMu
+func persistWebhookEvent(event *WebhookEvent) {
+	if webhookLog == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err == nil {
+		_, err = webhookLog.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logApp.Error("Could not write webhook log", "error", err)
+	}
+}
+
+// Sends an event about a receipt to the webhook of the partner that submitted it, if it
+// has one
+func (s *Server) NotifyPartner(ctx context.Context, receiptEvent ReceiptEvent, body []byte) {
+	partner, ok := FindPartner(receiptEvent.Partner)
+	if !ok || partner.WebhookURL == "" {
+		return
+	}
+
+	event := &WebhookEvent{
+		ID:        receiptEvent.ID,
+		Type:      receiptEvent.Type,
+		Partner:   partner.Name,
+		ReceiptID: receiptEvent.Receipt.ID,
+		CreatedAt: receiptEvent.CreatedAt,
+		Status:    webhookPending,
+		Payload:   body,
+		Attempts:  []WebhookAttempt{},
+	}
+	if trace, ok := TraceFrom(ctx); ok {
+		event.TraceParent = trace.Traceparent()
+	}
+	s.sendWebhook(event)
+}
+
+// Records a new webhook event and delivers it in the background, retrying failures with
+// growing delays up to the configured number of attempts
+func (s *Server) sendWebhook(event *WebhookEvent) {
+	webhooksMu.Lock()
+	webhookEvents[event.ID] = event
+	webhookEventOrder = append(webhookEventOrder, event.ID)
+	persistWebhookEvent(event)
+	webhooksMu.Unlock()
+
+	go func() {
+		delay := time.Second
+		for attempt := 1; attempt <= config.WebhookMaxAttempts; attempt++ {
+			if s.deliverWebhook(event.ID, false) {
+				return
+			}
+			if attempt < config.WebhookMaxAttempts {
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+	}()
+}
+
+// Makes one attempt to deliver an event to its partner's current webhook URL, or its
+// subscription's current URL, signed with their current signing secret, and records it. Returns whether it was
+// delivered.
+func (s *Server) deliverWebhook(id string, manual bool) bool {
+	webhooksMu.Lock()
+	event, ok := webhookEvents[id]
+	var payload []byte
+	var name, subscriptionID, traceparent string
+	if ok {
+		payload, name, subscriptionID, traceparent = event.Payload, event.Partner, event.Subscription, event.TraceParent
+	}
+	webhooksMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	attempt := WebhookAttempt{Time: s.Clock.Now().UTC(), Manual: manual}
+	if subscriptionID != "" {
+		subscription, found := FindSubscription(subscriptionID)
+		if !found {
+			attempt.Error = "the subscription no longer exists"
+		} else {
+			attempt.URL = subscription.URL
+			postWebhook(&attempt, subscription.URL, subscription.SigningSecret, id, payload, traceparent)
+		}
+	} else {
+		partner, found := FindPartner(name)
+		if !found || partner.WebhookURL == "" {
+			attempt.Error = "the partner has no webhook URL"
+		} else {
+			attempt.URL = partner.WebhookURL
+			postWebhook(&attempt, partner.WebhookURL, partner.SigningSecret, id, payload, traceparent)
+		}
+	}
+	delivered := attempt.Error == "" && attempt.StatusCode >= 200 && attempt.StatusCode < 300
+
+	webhooksMu.Lock()
+	event.Attempts = append(event.Attempts, attempt)
+	switch {
+	case delivered:
+		event.Status = webhookDelivered
+	case event.Status == webhookDelivered:
+		// A failed redelivery doesn't undo an earlier delivery
+	case manual || len(event.Attempts) >= config.WebhookMaxAttempts:
+		event.Status = webhookFailed
+	}
+	persistWebhookEvent(event)
+	webhooksMu.Unlock()
+	return delivered
+}
+
+// Posts a webhook and fills in the outcome of the attempt. The X-Signature header holds
+// the hex HMAC-SHA256, keyed with the signing secret, of the
+// X-Signature-Timestamp header, a newline, the X-Webhook-ID header, a newline and the body.
+// The traceparent and b3 headers carry a new span of the event's trace, if it has one.
+func postWebhook(attempt *WebhookAttempt, url string, secret string, id string, payload []byte, traceparent string) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-ID", id)
+	request.Header.Set("X-Signature-Timestamp", timestamp)
+	if trace, ok := ParseTraceparent(traceparent); ok {
+		SetTraceHeaders(request.Header, trace.Child())
+	}
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "\n" + id + "\n"))
+		mac.Write(payload)
+		request.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	start := time.Now()
+	response, err := webhookClient.Do(request)
+	attempt.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return
+	}
+	defer response.Body.Close()
+	attempt.StatusCode = response.StatusCode
+	snippet, _ := io.ReadAll(io.LimitReader(response.Body, webhookSnippetBytes))
+	attempt.Response = string(snippet)
+}
+
+/*
+	Below are the handlers for inspecting and redelivering webhook events
+*/
+
+// Method to list webhook events, newest first, optionally only those with the given
+// ?status= or for the given ?partner= or ?subscription=
+func ListWebhookEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status != "" && status != webhookPending && status != webhookDelivered && status != webhookFailed {
+		WriteError(w, http.StatusBadRequest, codeInvalidQuery, "The status parameter must be pending, delivered or failed.")
+		return
+	}
+	partner := query.Get("partner")
+	subscription := query.Get("subscription")
+
+	events := []WebhookEvent{}
+	webhooksMu.Lock()
+	for _, id := range slices.Backward(webhookEventOrder) {
+		event := webhookEvents[id]
+		if (status == "" || event.Status == status) && (partner == "" || event.Partner == partner) &&
+			(subscription == "" || event.Subscription == subscription) {
+			copied := *event
+			copied.Attempts = slices.Clone(event.Attempts)
+			events = append(events, copied)
+		}
+	}
+	webhooksMu.Unlock()
+	json.NewEncoder(w).Encode(WebhookEventListResponse{Events: events})
+}
+
+// Method to get a webhook event with every delivery attempt
+func GetWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	webhooksMu.Lock()
+	event, ok := webhookEvents[mux.Vars(r)["id"]]
+	var copied WebhookEvent
+	if ok {
+		copied = *event
+		copied.Attempts = slices.Clone(event.Attempts)
+	}
+	webhooksMu.Unlock()
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeWebhookEventNotFound, "No webhook event found for that ID.")
+		return
+	}
+	json.NewEncoder(w).Encode(copied)
+}
+
+// Method to deliver a webhook event again straight away, returning it with the outcome
+func (s *Server) RedeliverWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := mux.Vars(r)["id"]
+	webhooksMu.Lock()
+	_, ok := webhookEvents[id]
+	webhooksMu.Unlock()
+	if !ok {
+		WriteError(w, http.StatusNotFound, codeWebhookEventNotFound, "No webhook event found for that ID.")
+		return
+	}
+
+	s.deliverWebhook(id, true)
+	GetWebhookEvent(w, r)
+}